@@ -23,3 +23,29 @@ func TestBasicBitfield(t *testing.T) {
 		t.Errorf("Bitfield not setting the number of one bits correctly: Have %d , expected 1", b.OneBits)
 	}
 }
+
+func TestSharedBitfield(t *testing.T) {
+	shared := NewShared(16)
+	done := make(chan bool)
+
+	// Adjacent bits share a byte , so they are set concurrently without losing any.
+	for pos := 0; pos < 16; pos++ {
+		go func(pos int) {
+			shared.Set(pos, true)
+			done <- true
+		}(pos)
+	}
+	for pos := 0; pos < 16; pos++ {
+		<-done
+	}
+	snapshot := shared.Snapshot()
+	if snapshot.OneBits != 16 || !shared.At(15) {
+		t.Errorf("Expected all the bits to be set , got %s", snapshot.Dump())
+	}
+
+	// The snapshot doesn't change with the bitfield.
+	shared.Set(3, false)
+	if !snapshot.At(3) || shared.At(3) {
+		t.Errorf("Expected the snapshot to keep bit 3")
+	}
+}
@@ -0,0 +1,46 @@
+package bitfield
+
+import (
+	"sync"
+)
+
+// Shared is a bitfield used by several goroutines , like the pieces we have , which are set
+// while the peers read them. All its methods hold its lock.
+type Shared struct {
+	bitfield Bitfield
+	locker   sync.Mutex
+}
+
+func NewShared(length int) *Shared {
+	return &Shared{bitfield: New(length)}
+}
+
+// Return true if the position `pos` is ON and false otherwise
+func (shared *Shared) At(pos int) bool {
+	shared.locker.Lock()
+	defer shared.locker.Unlock()
+	return shared.bitfield.At(pos)
+}
+
+// Sets a position ON or OFF
+func (shared *Shared) Set(pos int, val bool) {
+	shared.locker.Lock()
+	defer shared.locker.Unlock()
+	shared.bitfield.Set(pos, val)
+}
+
+// Snapshot returns a copy of the bitfield , which doesn't change with it.
+func (shared *Shared) Snapshot() Bitfield {
+	shared.locker.Lock()
+	defer shared.locker.Unlock()
+	snapshot := shared.bitfield
+	snapshot.bytes = append([]uint8{}, shared.bitfield.bytes...)
+	return snapshot
+}
+
+// Encode returns the bytes of the bitfield , like Bitfield.Encode.
+func (shared *Shared) Encode() []byte {
+	shared.locker.Lock()
+	defer shared.locker.Unlock()
+	return shared.bitfield.Encode()
+}
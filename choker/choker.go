@@ -0,0 +1,200 @@
+// Package choker decides which of the interested peers we upload to.
+// Every RECHOKE_DURATION the interested peers are ranked by a Policy and the best
+// UploadSlots peers are unchoked. One more peer is unchoked optimistically , and it
+// is rotated every OPTIMISTIC_ROUNDS rechokes , so new peers get a chance to show their rate.
+package choker
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/bbpcr/Yomato/peer"
+)
+
+const (
+	RECHOKE_DURATION     = 10 * time.Second
+	OPTIMISTIC_ROUNDS    = 3
+	DEFAULT_UPLOAD_SLOTS = 4
+)
+
+// Candidate is an interested peer , with the rates measured at the last rechoke.
+type Candidate struct {
+	Peer         *peer.Peer
+	DownloadRate float64 // bytes per second received from the peer
+	UploadRate   float64 // bytes per second sent to the peer
+	LastUnchoked time.Time
+}
+
+// Policy orders the candidates , so that the first ones are unchoked.
+type Policy interface {
+	Sort(candidates []Candidate, seeding bool)
+}
+
+// TitForTat unchokes the peers which give us the best download rate.
+// When seeding nobody gives us anything , so the peers we upload fastest to are preferred.
+type TitForTat struct{}
+
+func (policy TitForTat) Sort(candidates []Candidate, seeding bool) {
+	if seeding {
+		FastestUpload{}.Sort(candidates, seeding)
+		return
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].DownloadRate > candidates[j].DownloadRate
+	})
+}
+
+// FastestUpload unchokes the peers we upload fastest to.
+type FastestUpload struct{}
+
+func (policy FastestUpload) Sort(candidates []Candidate, seeding bool) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].UploadRate > candidates[j].UploadRate
+	})
+}
+
+// RoundRobin gives the upload slots in turns while seeding , to the peers which waited the longest.
+// While downloading it behaves like TitForTat.
+type RoundRobin struct{}
+
+func (policy RoundRobin) Sort(candidates []Candidate, seeding bool) {
+	if !seeding {
+		TitForTat{}.Sort(candidates, seeding)
+		return
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastUnchoked.Before(candidates[j].LastUnchoked)
+	})
+}
+
+// PolicyByName returns the policy with the given name , as used in the command line.
+func PolicyByName(name string) (Policy, error) {
+	switch name {
+	case "tit-for-tat":
+		return TitForTat{}, nil
+	case "fastest-upload":
+		return FastestUpload{}, nil
+	case "round-robin":
+		return RoundRobin{}, nil
+	}
+	return nil, errors.New("Unknown choking policy " + name)
+}
+
+type peerStats struct {
+	downloaded   int64
+	uploaded     int64
+	lastUnchoked time.Time
+}
+
+type Choker struct {
+	Policy      Policy
+	UploadSlots int
+
+	round      int
+	optimistic *peer.Peer
+	stats      map[*peer.Peer]*peerStats
+}
+
+// updateRates computes the rates of the peers since the last rechoke,
+// and stores them on the peers , so other components can use them.
+func (choker *Choker) updateRates(peers []*peer.Peer, elapsed time.Duration) {
+
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = RECHOKE_DURATION.Seconds()
+	}
+
+	current := make(map[*peer.Peer]*peerStats)
+	for _, connectedPeer := range peers {
+		stats, exists := choker.stats[connectedPeer]
+		if !exists {
+			stats = &peerStats{downloaded: connectedPeer.GetDownloaded(), uploaded: connectedPeer.GetUploaded()}
+		}
+		downloaded, uploaded := connectedPeer.GetDownloaded(), connectedPeer.GetUploaded()
+		connectedPeer.SetRates(float64(downloaded-stats.downloaded)/seconds, float64(uploaded-stats.uploaded)/seconds)
+		stats.downloaded = downloaded
+		stats.uploaded = uploaded
+		current[connectedPeer] = stats
+	}
+	choker.stats = current
+}
+
+// Rechoke decides which peers are unchoked and sends them CHOKE or UNCHOKE if their state changed.
+// It should be called every RECHOKE_DURATION , elapsed being the time since the last call.
+func (choker *Choker) Rechoke(peers []*peer.Peer, seeding bool, elapsed time.Duration) {
+
+	choker.updateRates(peers, elapsed)
+
+	candidates := []Candidate{}
+	for _, connectedPeer := range peers {
+		if connectedPeer.GetStatus() == peer.CONNECTED && connectedPeer.IsPeerInterested() {
+			candidates = append(candidates, Candidate{
+				Peer:         connectedPeer,
+				DownloadRate: connectedPeer.GetDownloadRate(),
+				UploadRate:   connectedPeer.GetUploadRate(),
+				LastUnchoked: choker.stats[connectedPeer].lastUnchoked,
+			})
+		}
+	}
+	choker.Policy.Sort(candidates, seeding)
+
+	unchoked := make(map[*peer.Peer]bool)
+	for index := 0; index < len(candidates) && index < choker.UploadSlots; index++ {
+		unchoked[candidates[index].Peer] = true
+	}
+
+	// The optimistic unchoke is rotated every OPTIMISTIC_ROUNDS rechokes,
+	// or sooner if the peer is gone or became one of the regular unchoked peers.
+	optimisticValid := false
+	for _, candidate := range candidates {
+		if candidate.Peer == choker.optimistic && !unchoked[candidate.Peer] {
+			optimisticValid = true
+		}
+	}
+	if choker.round%OPTIMISTIC_ROUNDS == 0 || !optimisticValid {
+		choker.optimistic = nil
+		choked := []*peer.Peer{}
+		for _, candidate := range candidates {
+			if !unchoked[candidate.Peer] {
+				choked = append(choked, candidate.Peer)
+			}
+		}
+		if len(choked) > 0 {
+			choker.optimistic = choked[rand.Intn(len(choked))]
+		}
+	}
+	if choker.optimistic != nil {
+		unchoked[choker.optimistic] = true
+	}
+	choker.round++
+
+	for _, connectedPeer := range peers {
+		if connectedPeer.GetStatus() != peer.CONNECTED {
+			continue
+		}
+		if unchoked[connectedPeer] {
+			choker.stats[connectedPeer].lastUnchoked = time.Now()
+			if connectedPeer.IsClientChoking() {
+				connectedPeer.SendUnchoke()
+			}
+		} else if !connectedPeer.IsClientChoking() {
+			connectedPeer.SendChoke()
+		}
+	}
+}
+
+// Optimistic returns the peer which is currently optimistically unchoked , or nil.
+func (choker *Choker) Optimistic() *peer.Peer {
+	return choker.optimistic
+}
+
+// New returns a Choker using the given policy , which unchokes uploadSlots peers plus the optimistic one.
+func New(policy Policy, uploadSlots int) *Choker {
+	return &Choker{
+		Policy:      policy,
+		UploadSlots: uploadSlots,
+		stats:       make(map[*peer.Peer]*peerStats),
+	}
+}
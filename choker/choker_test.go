@@ -0,0 +1,124 @@
+package choker
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestTitForTat(t *testing.T) {
+	candidates := []Candidate{
+		{DownloadRate: 10, UploadRate: 300},
+		{DownloadRate: 30, UploadRate: 100},
+		{DownloadRate: 20, UploadRate: 200},
+	}
+
+	TitForTat{}.Sort(candidates, false)
+	if candidates[0].DownloadRate != 30 || candidates[1].DownloadRate != 20 || candidates[2].DownloadRate != 10 {
+		t.Errorf("TitForTat not sorting by download rate: %v", candidates)
+	}
+
+	TitForTat{}.Sort(candidates, true)
+	if candidates[0].UploadRate != 300 || candidates[1].UploadRate != 200 || candidates[2].UploadRate != 100 {
+		t.Errorf("TitForTat not sorting by upload rate when seeding: %v", candidates)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	now := time.Now()
+	candidates := []Candidate{
+		{DownloadRate: 1, LastUnchoked: now},
+		{DownloadRate: 2, LastUnchoked: now.Add(-time.Minute)},
+		{DownloadRate: 3},
+	}
+
+	RoundRobin{}.Sort(candidates, true)
+	if candidates[0].DownloadRate != 3 || candidates[1].DownloadRate != 2 || candidates[2].DownloadRate != 1 {
+		t.Errorf("RoundRobin not preferring the peers which waited the longest: %v", candidates)
+	}
+}
+
+func TestPolicyByName(t *testing.T) {
+	for _, name := range []string{"tit-for-tat", "fastest-upload", "round-robin"} {
+		if _, err := PolicyByName(name); err != nil {
+			t.Errorf("Policy %s not found: %s", name, err)
+		}
+	}
+	if _, err := PolicyByName("nothing"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+// newInterestedPeer returns a connected peer which told us it is interested. What we send it is dropped.
+func newInterestedPeer(t *testing.T, torrentInfo *torrent_info.TorrentInfo, port int) *peer.Peer {
+	local, remote := net.Pipe()
+	connectedPeer := peer.New(torrentInfo, "-YM00000000000000000", "127.0.0.1", port)
+	connectedPeer.Connection = local
+	connectedPeer.SetStatus(peer.CONNECTED)
+	go remote.Write([]byte{0, 0, 0, 1, peer.INTERESTED})
+	if err := connectedPeer.ReadMessage(time.Second); err != nil || !connectedPeer.IsPeerInterested() {
+		t.Fatalf("Expected the peer to be interested , got %v", err)
+	}
+	go io.Copy(ioutil.Discard, remote)
+	return &connectedPeer
+}
+
+func TestRechoke(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x04}, 20)}
+	peers := []*peer.Peer{}
+	for index := 0; index < 5; index++ {
+		connectedPeer := newInterestedPeer(t, torrentInfo, 6881+index)
+		defer connectedPeer.Connection.Close()
+		peers = append(peers, connectedPeer)
+	}
+	choker := New(TitForTat{}, 2)
+	choker.Rechoke(peers, false, RECHOKE_DURATION)
+
+	// The two peers which sent us the most in the last 10 seconds get the regular slots.
+	downloadFor := func(seconds time.Duration) {
+		for index, connectedPeer := range peers {
+			connectedPeer.Downloaded += int64(100*(index+1)) * int64(seconds/time.Second)
+		}
+	}
+	downloadFor(RECHOKE_DURATION)
+	choker.Rechoke(peers, false, RECHOKE_DURATION)
+	if rate := peers[4].GetDownloadRate(); rate != 500 {
+		t.Errorf("Expected a rate of 500 , got %f", rate)
+	}
+	for index, connectedPeer := range peers {
+		regular := index >= 3
+		if regular && connectedPeer.IsClientChoking() {
+			t.Errorf("Expected peer %d to be unchoked", index)
+		}
+		if !regular && connectedPeer.IsClientChoking() != (connectedPeer != choker.Optimistic()) {
+			t.Errorf("Expected only the optimistic peer to be unchoked among the slow ones , peer %d isn't", index)
+		}
+	}
+	if optimistic := choker.Optimistic(); optimistic == nil || optimistic == peers[3] || optimistic == peers[4] {
+		t.Fatalf("Expected one of the slow peers to be unchoked optimistically")
+	}
+
+	// The optimistic unchoke is kept for OPTIMISTIC_ROUNDS rechokes , then it is drawn again.
+	optimistics := make(map[*peer.Peer]bool)
+	for round := 2; round < 32; round++ {
+		previous := choker.Optimistic()
+		downloadFor(RECHOKE_DURATION)
+		choker.Rechoke(peers, false, RECHOKE_DURATION)
+		if round%OPTIMISTIC_ROUNDS != 0 && choker.Optimistic() != previous {
+			t.Errorf("The optimistic unchoke changed at round %d", round)
+		}
+		if choker.Optimistic().IsClientChoking() {
+			t.Errorf("The optimistic peer is choked at round %d", round)
+		}
+		optimistics[choker.Optimistic()] = true
+	}
+	if len(optimistics) < 2 {
+		t.Errorf("Expected the optimistic unchoke to rotate , got %d peers", len(optimistics))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 type StringList []string
@@ -16,10 +17,80 @@ func (sl *StringList) Set(value string) error {
 	return nil
 }
 
-func Parse() (string, []string) {
+// Options holds everything given in the command line.
+type Options struct {
+	Command    string // "scrape" , or empty to download.
+	Path       string
+	Excludes   []string
+	Priorities []string
+
+	Seed      bool
+	SeedOnly  bool
+	SeedRatio float64
+	SeedTime  time.Duration
+	SeedIdle  time.Duration
+
+	ChokingPolicy string
+	UploadSlots   int
+
+	Sequential bool
+	StreamFile int
+
+	SaveTorrent string
+
+	NoDHT        bool
+	DHTBootstrap []string
+	NoLSD        bool
+
+	Encryption string
+
+	TrackerProxy   string
+	TrackerCARoots string
+	UserAgent      string
+	TrackerTimeout time.Duration
+}
+
+// SeedingEnabled tells if we should keep seeding after the download.
+func (options Options) SeedingEnabled() bool {
+	return options.Seed || options.SeedOnly || options.SeedRatio > 0 || options.SeedTime > 0 || options.SeedIdle > 0
+}
+
+func Parse() Options {
+	var options Options
 	var excludes StringList
+	var priorities StringList
+	var dhtBootstrap StringList
 	flag.Var(&excludes, "exclude", "exclude files from the download")
-	flag.Parse()
-	path := os.Args[len(os.Args)-1]
-	return path, ([]string)(excludes)
+	flag.Var(&priorities, "priority", "set the priority of files , as pattern=skip|low|normal|high")
+	flag.BoolVar(&options.Seed, "seed", false, "keep seeding after the download is completed")
+	flag.BoolVar(&options.SeedOnly, "seed-only", false, "only seed the files which were already downloaded")
+	flag.Float64Var(&options.SeedRatio, "seed-ratio", 0, "stop seeding when this share ratio is reached")
+	flag.DurationVar(&options.SeedTime, "seed-time", 0, "stop seeding after this duration")
+	flag.DurationVar(&options.SeedIdle, "seed-idle", 0, "stop seeding when nothing was uploaded for this duration")
+	flag.StringVar(&options.ChokingPolicy, "choker", "tit-for-tat", "choking policy: tit-for-tat, fastest-upload or round-robin")
+	flag.IntVar(&options.UploadSlots, "upload-slots", 4, "how many peers are unchoked , besides the optimistic unchoke")
+	flag.BoolVar(&options.Sequential, "sequential", false, "download the pieces in order")
+	flag.IntVar(&options.StreamFile, "stream", -1, "download the file with this index first , in order , so it can be played while downloading")
+	flag.StringVar(&options.SaveTorrent, "save-torrent", "", "when downloading from a magnet link , save the torrent file here")
+	flag.BoolVar(&options.NoDHT, "no-dht", false, "don't look for peers in the DHT")
+	flag.Var(&dhtBootstrap, "dht-bootstrap", "start the DHT from this node , as host:port")
+	flag.BoolVar(&options.NoLSD, "no-lsd", false, "don't look for peers on the local network")
+	flag.StringVar(&options.Encryption, "encryption", "prefer", "encryption of the peer connections: disabled, prefer or require")
+	flag.StringVar(&options.TrackerProxy, "tracker-proxy", "", "send the announces to the HTTP trackers through this proxy , as http://host:port or socks5://host:port")
+	flag.StringVar(&options.TrackerCARoots, "tracker-ca", "", "check the HTTPS trackers against the certificates of this PEM file")
+	flag.StringVar(&options.UserAgent, "user-agent", "Yomato", "the user agent sent to the HTTP trackers")
+	flag.DurationVar(&options.TrackerTimeout, "tracker-timeout", 30*time.Second, "how long to wait for an HTTP tracker")
+
+	// The command comes before the options.
+	arguments := os.Args[1:]
+	if len(arguments) > 0 && arguments[0] == "scrape" {
+		options.Command = arguments[0]
+		arguments = arguments[1:]
+	}
+	flag.CommandLine.Parse(arguments)
+	options.Path = os.Args[len(os.Args)-1]
+	options.Excludes = ([]string)(excludes)
+	options.Priorities = ([]string)(priorities)
+	options.DHTBootstrap = ([]string)(dhtBootstrap)
+	return options
 }
@@ -0,0 +1,536 @@
+// Package dht implements a node of the mainline DHT , described here : http://www.bittorrent.org/beps/bep_0005.html
+// It is used to find peers for torrents without working trackers , and to announce that we download them.
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+const (
+	QUERY_TIMEOUT = 2 * time.Second
+	ALPHA         = 3
+)
+
+const (
+	SECRET_ROTATION_DURATION = 5 * time.Minute
+	PEER_EXPIRATION_DURATION = 30 * time.Minute
+	MAX_RETURNED_PEERS       = 50
+)
+
+const MAX_PACKET_SIZE = 65536
+
+var DEFAULT_BOOTSTRAP_NODES = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// DHT is our node of the DHT.
+type DHT struct {
+	Id             string
+	Port           int
+	BootstrapNodes []string
+	Table          *RoutingTable
+
+	connection *net.UDPConn
+
+	transactions    map[string]chan *message
+	nextTransaction uint16
+	tLocker         sync.Mutex
+
+	secret         []byte
+	previousSecret []byte
+	lastRotation   time.Time
+	sLocker        sync.Mutex
+
+	peers   map[string]map[string]time.Time // info hash -> peer address -> time of the announce
+	pLocker sync.Mutex
+}
+
+// lookupResult holds what an iterative lookup found : the closest nodes which answered,
+// the tokens they gave us and the peers they know.
+type lookupResult struct {
+	Nodes  []*Node
+	Tokens map[string]string
+	Peers  []string
+}
+
+// randomBytes returns count random bytes.
+func randomBytes(count int) []byte {
+	result := make([]byte, count)
+	rand.Read(result)
+	return result
+}
+
+// New returns a node which uses the given UDP connection. If id is empty , a random one is generated.
+// The packets must be passed to HandlePacket , either by Serve or by whoever reads the connection.
+func New(connection *net.UDPConn, id string) *DHT {
+	if len(id) != ID_LENGTH {
+		id = string(randomBytes(ID_LENGTH))
+	}
+	dht := &DHT{
+		Id:             id,
+		BootstrapNodes: DEFAULT_BOOTSTRAP_NODES,
+		Table:          NewRoutingTable(id),
+		connection:     connection,
+		transactions:   make(map[string]chan *message),
+		secret:         randomBytes(ID_LENGTH),
+		lastRotation:   time.Now(),
+		peers:          make(map[string]map[string]time.Time),
+	}
+	if connection != nil {
+		dht.Port = connection.LocalAddr().(*net.UDPAddr).Port
+	}
+	dht.previousSecret = dht.secret
+	return dht
+}
+
+// Listen returns a node listening on the given UDP port.
+func Listen(port int) (*DHT, error) {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return New(connection, ""), nil
+}
+
+// Serve reads the packets from the connection , until it is closed.
+func (dht *DHT) Serve() {
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		length, address, err := dht.connection.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		copy(packet, buffer[:length])
+		dht.HandlePacket(packet, address)
+	}
+}
+
+// Close closes the connection of the node.
+func (dht *DHT) Close() error {
+	return dht.connection.Close()
+}
+
+// HandlePacket handles a KRPC message received from address.
+// The data may be changed while parsing.
+func (dht *DHT) HandlePacket(data []byte, address *net.UDPAddr) {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return
+	}
+	switch msg.Type {
+	case QUERY:
+		go dht.handleQuery(msg, address)
+	case RESPONSE, ERROR:
+		dht.tLocker.Lock()
+		answer, isWaiting := dht.transactions[msg.TransactionId]
+		delete(dht.transactions, msg.TransactionId)
+		dht.tLocker.Unlock()
+		if isWaiting {
+			answer <- msg
+		}
+	}
+}
+
+// send sends the message to address.
+func (dht *DHT) send(msg *message, address *net.UDPAddr) error {
+	_, err := dht.connection.WriteToUDP(msg.encode(), address)
+	return err
+}
+
+// addNode adds a node which talked to us to the routing table.
+// The questionable nodes of a full bucket are pinged , so they are replaced if they are gone.
+func (dht *DHT) addNode(id string, address *net.UDPAddr) {
+	questionable := dht.Table.Insert(&Node{Id: id, Address: address, LastSeen: time.Now()})
+	for _, node := range questionable {
+		go dht.Ping(node.Address)
+	}
+}
+
+// query sends a query to address and waits for the response.
+func (dht *DHT) query(address *net.UDPAddr, queryType string, arguments *bencode.Dictionary) (*bencode.Dictionary, error) {
+
+	setString(arguments, "id", dht.Id)
+
+	answer := make(chan *message, 1)
+	dht.tLocker.Lock()
+	dht.nextTransaction++
+	transactionId := make([]byte, 2)
+	binary.BigEndian.PutUint16(transactionId, dht.nextTransaction)
+	dht.transactions[string(transactionId)] = answer
+	dht.tLocker.Unlock()
+
+	forget := func() {
+		dht.tLocker.Lock()
+		delete(dht.transactions, string(transactionId))
+		dht.tLocker.Unlock()
+	}
+
+	msg := &message{TransactionId: string(transactionId), Type: QUERY, Query: queryType, Arguments: arguments}
+	if err := dht.send(msg, address); err != nil {
+		forget()
+		return nil, err
+	}
+
+	select {
+	case response := <-answer:
+		if response.Type == ERROR {
+			return nil, errors.New("Error " + strconv.FormatInt(response.ErrorCode, 10) + " : " + response.ErrorMessage)
+		}
+		if id, hasId := getString(response.Response, "id"); hasId && len(id) == ID_LENGTH {
+			dht.addNode(id, address)
+		}
+		return response.Response, nil
+	case <-time.After(QUERY_TIMEOUT):
+		forget()
+		dht.Table.Failed(address)
+		return nil, errors.New("Timeout while waiting for " + address.String())
+	}
+}
+
+// Ping checks that the node at address is alive.
+func (dht *DHT) Ping(address *net.UDPAddr) error {
+	_, err := dht.query(address, PING, newDictionary())
+	return err
+}
+
+// FindNode asks the node at address for the nodes closest to target.
+func (dht *DHT) FindNode(address *net.UDPAddr, target string) ([]*Node, error) {
+	arguments := newDictionary()
+	setString(arguments, "target", target)
+	response, err := dht.query(address, FIND_NODE, arguments)
+	if err != nil {
+		return nil, err
+	}
+	compactNodes, _ := getString(response, "nodes")
+	return decodeNodes(compactNodes), nil
+}
+
+// GetPeers asks the node at address for the peers of the torrent.
+// It returns the peers it knows , the nodes closest to the info hash , and the token needed to announce.
+func (dht *DHT) GetPeers(address *net.UDPAddr, infoHash string) ([]string, []*Node, string, error) {
+	arguments := newDictionary()
+	setString(arguments, "info_hash", infoHash)
+	response, err := dht.query(address, GET_PEERS, arguments)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	peers := []string{}
+	if values, isList := response.Values[bencode.String{Value: "values"}].(*bencode.List); isList {
+		for _, value := range values.Values {
+			if compactPeer, isString := value.(*bencode.String); isString {
+				if peerAddress := decodePeer(compactPeer.Value); peerAddress != nil && peerAddress.Port > 0 {
+					peers = append(peers, peerAddress.String())
+				}
+			}
+		}
+	}
+	compactNodes, _ := getString(response, "nodes")
+	token, _ := getString(response, "token")
+	return peers, decodeNodes(compactNodes), token, nil
+}
+
+// AnnouncePeer tells the node at address that we download the torrent , and listen on port.
+func (dht *DHT) AnnouncePeer(address *net.UDPAddr, infoHash string, port int, token string) error {
+	arguments := newDictionary()
+	setString(arguments, "info_hash", infoHash)
+	setNumber(arguments, "port", int64(port))
+	setString(arguments, "token", token)
+	_, err := dht.query(address, ANNOUNCE_PEER, arguments)
+	return err
+}
+
+// rotateSecret changes the secret used for the tokens , if it is old enough.
+// The tokens made with the previous secret are still accepted.
+func (dht *DHT) rotateSecret() {
+	if time.Since(dht.lastRotation) > SECRET_ROTATION_DURATION {
+		dht.previousSecret = dht.secret
+		dht.secret = randomBytes(ID_LENGTH)
+		dht.lastRotation = time.Now()
+	}
+}
+
+// makeToken returns the token given to the node at address , made from the secret and its IP.
+func makeToken(secret []byte, address *net.UDPAddr) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), address.IP...))
+	return string(hash[:])
+}
+
+// getToken returns the token the node at address must send back when it announces.
+func (dht *DHT) getToken(address *net.UDPAddr) string {
+	dht.sLocker.Lock()
+	defer dht.sLocker.Unlock()
+	dht.rotateSecret()
+	return makeToken(dht.secret, address)
+}
+
+// checkToken tells if the token is one we gave recently to the node at address.
+func (dht *DHT) checkToken(token string, address *net.UDPAddr) bool {
+	dht.sLocker.Lock()
+	defer dht.sLocker.Unlock()
+	dht.rotateSecret()
+	return token == makeToken(dht.secret, address) || token == makeToken(dht.previousSecret, address)
+}
+
+// storePeer remembers that the peer at address downloads the torrent.
+func (dht *DHT) storePeer(infoHash string, address *net.UDPAddr) {
+	dht.pLocker.Lock()
+	defer dht.pLocker.Unlock()
+	if dht.peers[infoHash] == nil {
+		dht.peers[infoHash] = make(map[string]time.Time)
+	}
+	dht.peers[infoHash][encodePeer(address)] = time.Now()
+}
+
+// getStoredPeers returns the compact addresses of the peers which announced the torrent recently.
+func (dht *DHT) getStoredPeers(infoHash string) []bencode.Bencoder {
+	dht.pLocker.Lock()
+	defer dht.pLocker.Unlock()
+	values := []bencode.Bencoder{}
+	for compactPeer, announced := range dht.peers[infoHash] {
+		if time.Since(announced) > PEER_EXPIRATION_DURATION {
+			delete(dht.peers[infoHash], compactPeer)
+			continue
+		}
+		if len(values) < MAX_RETURNED_PEERS {
+			values = append(values, &bencode.String{Value: compactPeer})
+		}
+	}
+	return values
+}
+
+// handleQuery answers a query received from address.
+func (dht *DHT) handleQuery(msg *message, address *net.UDPAddr) {
+
+	id, hasId := getString(msg.Arguments, "id")
+	if !hasId || len(id) != ID_LENGTH {
+		dht.send(&message{TransactionId: msg.TransactionId, Type: ERROR, ErrorCode: PROTOCOL_ERROR, ErrorMessage: "Invalid id"}, address)
+		return
+	}
+
+	response := newDictionary()
+	setString(response, "id", dht.Id)
+
+	switch msg.Query {
+	case PING:
+	case FIND_NODE:
+		target, _ := getString(msg.Arguments, "target")
+		setString(response, "nodes", encodeNodes(dht.Table.Closest(target, BUCKET_SIZE)))
+	case GET_PEERS:
+		infoHash, _ := getString(msg.Arguments, "info_hash")
+		if len(infoHash) != ID_LENGTH {
+			dht.send(&message{TransactionId: msg.TransactionId, Type: ERROR, ErrorCode: PROTOCOL_ERROR, ErrorMessage: "Invalid info_hash"}, address)
+			return
+		}
+		setString(response, "token", dht.getToken(address))
+		if values := dht.getStoredPeers(infoHash); len(values) > 0 {
+			response.Values[bencode.String{Value: "values"}] = &bencode.List{Values: values}
+		} else {
+			setString(response, "nodes", encodeNodes(dht.Table.Closest(infoHash, BUCKET_SIZE)))
+		}
+	case ANNOUNCE_PEER:
+		infoHash, _ := getString(msg.Arguments, "info_hash")
+		token, _ := getString(msg.Arguments, "token")
+		port, _ := getNumber(msg.Arguments, "port")
+		if impliedPort, _ := getNumber(msg.Arguments, "implied_port"); impliedPort != 0 {
+			port = int64(address.Port)
+		}
+		if len(infoHash) != ID_LENGTH || port <= 0 || port >= 65536 || !dht.checkToken(token, address) {
+			dht.send(&message{TransactionId: msg.TransactionId, Type: ERROR, ErrorCode: PROTOCOL_ERROR, ErrorMessage: "Bad token or port"}, address)
+			return
+		}
+		dht.storePeer(infoHash, &net.UDPAddr{IP: address.IP, Port: int(port)})
+	default:
+		dht.send(&message{TransactionId: msg.TransactionId, Type: ERROR, ErrorCode: METHOD_UNKNOWN, ErrorMessage: "Method Unknown"}, address)
+		return
+	}
+
+	dht.addNode(id, address)
+	dht.send(&message{TransactionId: msg.TransactionId, Type: RESPONSE, Response: response}, address)
+}
+
+// lookup iteratively asks the nodes closest to target for closer nodes , ALPHA at a time,
+// until the BUCKET_SIZE closest nodes we know have all been asked.
+// If getPeers is set , get_peers queries are sent , and the peers and tokens are gathered.
+func (dht *DHT) lookup(target string, getPeers bool) *lookupResult {
+
+	result := &lookupResult{Tokens: make(map[string]string)}
+	candidates := dht.Table.Closest(target, BUCKET_SIZE)
+	known := make(map[string]bool)
+	for _, node := range candidates {
+		known[node.Id] = true
+	}
+	queried := make(map[string]bool)
+	knownPeers := make(map[string]bool)
+
+	type answer struct {
+		node  *Node
+		nodes []*Node
+		peers []string
+		token string
+		err   error
+	}
+
+	for {
+		sortByDistance(candidates, target)
+		closest := candidates
+		if len(closest) > BUCKET_SIZE {
+			closest = closest[:BUCKET_SIZE]
+		}
+
+		toQuery := []*Node{}
+		for _, node := range closest {
+			if !queried[node.Id] && len(toQuery) < ALPHA {
+				toQuery = append(toQuery, node)
+			}
+		}
+		if len(toQuery) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(toQuery))
+		for _, node := range toQuery {
+			queried[node.Id] = true
+			go func(node *Node) {
+				if getPeers {
+					peers, nodes, token, err := dht.GetPeers(node.Address, target)
+					answers <- answer{node, nodes, peers, token, err}
+				} else {
+					nodes, err := dht.FindNode(node.Address, target)
+					answers <- answer{node, nodes, nil, "", err}
+				}
+			}(node)
+		}
+
+		for range toQuery {
+			nodeAnswer := <-answers
+			if nodeAnswer.err != nil {
+				continue
+			}
+			result.Nodes = append(result.Nodes, nodeAnswer.node)
+			if nodeAnswer.token != "" {
+				result.Tokens[nodeAnswer.node.Id] = nodeAnswer.token
+			}
+			for _, peerAddress := range nodeAnswer.peers {
+				if !knownPeers[peerAddress] {
+					knownPeers[peerAddress] = true
+					result.Peers = append(result.Peers, peerAddress)
+				}
+			}
+			for _, node := range nodeAnswer.nodes {
+				if !known[node.Id] && node.Id != dht.Id {
+					known[node.Id] = true
+					candidates = append(candidates, node)
+				}
+			}
+		}
+	}
+
+	sortByDistance(result.Nodes, target)
+	if len(result.Nodes) > BUCKET_SIZE {
+		result.Nodes = result.Nodes[:BUCKET_SIZE]
+	}
+	return result
+}
+
+// Bootstrap fills the routing table , starting from the bootstrap nodes , and then looking up our own id.
+func (dht *DHT) Bootstrap() error {
+
+	var wait sync.WaitGroup
+	for _, bootstrapNode := range dht.BootstrapNodes {
+		address, err := net.ResolveUDPAddr("udp", bootstrapNode)
+		if err != nil {
+			continue
+		}
+		wait.Add(1)
+		go func(address *net.UDPAddr) {
+			defer wait.Done()
+			nodes, err := dht.FindNode(address, dht.Id)
+			if err != nil {
+				return
+			}
+			// These nodes didn't talk to us yet , they are checked during the lookup.
+			for _, node := range nodes {
+				dht.Table.Insert(&Node{Id: node.Id, Address: node.Address})
+			}
+		}(address)
+	}
+	wait.Wait()
+
+	dht.lookup(dht.Id, false)
+	if dht.Table.Length() == 0 {
+		return errors.New("No DHT node answered")
+	}
+	return nil
+}
+
+// FindPeers returns the addresses of the peers of the torrent.
+// If announcePort is positive , we announce to the closest nodes that we listen on it.
+func (dht *DHT) FindPeers(infoHash []byte, announcePort int) []string {
+	result := dht.lookup(string(infoHash), true)
+	if announcePort > 0 {
+		var wait sync.WaitGroup
+		for _, node := range result.Nodes {
+			if token, hasToken := result.Tokens[node.Id]; hasToken {
+				wait.Add(1)
+				go func(node *Node, token string) {
+					defer wait.Done()
+					dht.AnnouncePeer(node.Address, string(infoHash), announcePort, token)
+				}(node, token)
+			}
+		}
+		wait.Wait()
+	}
+	return result.Peers
+}
+
+// SaveState writes our id and the nodes of the routing table to path , so the next run doesn't need to bootstrap.
+func (dht *DHT) SaveState(path string) error {
+	state := newDictionary()
+	setString(state, "id", dht.Id)
+	setString(state, "nodes", encodeNodes(dht.Table.Nodes()))
+
+	temporaryPath := path + ".tmp"
+	if err := ioutil.WriteFile(temporaryPath, state.Encode(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+// LoadState reads the state written by SaveState : our id is restored , and the nodes are added to the routing table.
+// It must be called before the node starts talking to others.
+func (dht *DHT) LoadState(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	state, _, err := bencode.ParseDictionary(data)
+	if err != nil {
+		return err
+	}
+
+	if id, hasId := getString(state, "id"); hasId && len(id) == ID_LENGTH && id != dht.Id {
+		dht.Id = id
+		dht.Table = NewRoutingTable(id)
+	}
+	compactNodes, _ := getString(state, "nodes")
+	for _, node := range decodeNodes(compactNodes) {
+		dht.Table.Insert(node)
+	}
+	return nil
+}
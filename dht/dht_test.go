@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_NODES = 8
+
+// makeId returns an id starting with the given byte.
+func makeId(first byte) string {
+	return string([]byte{first}) + strings.Repeat("\x00", ID_LENGTH-1)
+}
+
+// startNodes starts count nodes on loopback , all bootstrapping from the first one.
+func startNodes(t *testing.T, count int) []*DHT {
+	nodes := []*DHT{}
+	for index := 0; index < count; index++ {
+		connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		node := New(connection, "")
+		go node.Serve()
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		node.BootstrapNodes = []string{nodes[0].connection.LocalAddr().String()}
+	}
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap(); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+	}
+	return nodes
+}
+
+func closeNodes(nodes []*DHT) {
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	arguments := newDictionary()
+	setString(arguments, "id", makeId(1))
+	setNumber(arguments, "port", 6881)
+	sent := &message{TransactionId: "aa", Type: QUERY, Query: ANNOUNCE_PEER, Arguments: arguments}
+
+	received, err := parseMessage(sent.encode())
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if received.TransactionId != "aa" || received.Type != QUERY || received.Query != ANNOUNCE_PEER {
+		t.Errorf("Wrong message %v", received)
+	}
+	if port, _ := getNumber(received.Arguments, "port"); port != 6881 {
+		t.Errorf("Wrong port %d", port)
+	}
+
+	sent = &message{TransactionId: "bb", Type: ERROR, ErrorCode: METHOD_UNKNOWN, ErrorMessage: "Method Unknown"}
+	received, err = parseMessage(sent.encode())
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if received.ErrorCode != METHOD_UNKNOWN || received.ErrorMessage != "Method Unknown" {
+		t.Errorf("Wrong error %d %s", received.ErrorCode, received.ErrorMessage)
+	}
+
+	for _, invalid := range []string{"", "le", "d1:t2:aae", "d1:t2:aa1:y1:qe", "d1:t2:aa1:y1:xe"} {
+		if _, err := parseMessage([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []*Node{
+		{Id: makeId(1), Address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+		{Id: makeId(2), Address: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 51413}},
+	}
+	decoded := decodeNodes(encodeNodes(nodes))
+	if len(decoded) != 2 {
+		t.Fatalf("Expected 2 nodes , got %d", len(decoded))
+	}
+	for index, node := range decoded {
+		if node.Id != nodes[index].Id || node.Address.String() != nodes[index].Address.String() {
+			t.Errorf("Wrong node %x %s", node.Id, node.Address)
+		}
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	table := NewRoutingTable(makeId(0))
+	address := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+	if table.Insert(&Node{Id: makeId(0), Address: address}) != nil || table.Length() != 0 {
+		t.Errorf("Our own id must not be inserted")
+	}
+
+	// All these ids have the first bit set , so they go to the same bucket.
+	for index := 0; index < BUCKET_SIZE; index++ {
+		table.Insert(&Node{Id: makeId(byte(0x80 + index)), Address: address, LastSeen: time.Now()})
+	}
+	if table.Length() != BUCKET_SIZE {
+		t.Errorf("Expected %d nodes , got %d", BUCKET_SIZE, table.Length())
+	}
+
+	// The bucket is full of good nodes , so the new one is dropped.
+	table.Insert(&Node{Id: makeId(0xf0), Address: address, LastSeen: time.Now()})
+	if table.Length() != BUCKET_SIZE {
+		t.Errorf("Expected %d nodes , got %d", BUCKET_SIZE, table.Length())
+	}
+
+	// A node in another bucket is accepted.
+	table.Insert(&Node{Id: makeId(0x01), Address: address, LastSeen: time.Now()})
+	closest := table.Closest(makeId(0x03), 2)
+	if len(closest) != 2 || closest[0].Id != makeId(0x01) || closest[1].Id != makeId(0x83) {
+		t.Errorf("Wrong closest nodes")
+	}
+
+	// Once the nodes of the full bucket fail , they are replaced.
+	for failure := 0; failure < MAX_NODE_FAILURES; failure++ {
+		table.Failed(address)
+	}
+	table.Insert(&Node{Id: makeId(0xf0), Address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}, LastSeen: time.Now()})
+	if closest := table.Closest(makeId(0xf0), 1); len(closest) != 1 || closest[0].Id != makeId(0xf0) {
+		t.Errorf("The bad node was not replaced")
+	}
+}
+
+func TestFindPeers(t *testing.T) {
+	nodes := startNodes(t, TEST_NODES)
+	defer closeNodes(nodes)
+
+	for index, node := range nodes {
+		if node.Table.Length() == 0 {
+			t.Errorf("Node %d has an empty routing table", index)
+		}
+	}
+
+	infoHash := []byte(makeId(0x42))
+	if peers := nodes[3].FindPeers(infoHash, 6881); len(peers) != 0 {
+		t.Errorf("Expected no peers , got %v", peers)
+	}
+
+	peers := nodes[TEST_NODES-1].FindPeers(infoHash, 0)
+	if len(peers) != 1 || peers[0] != "127.0.0.1:6881" {
+		t.Errorf("Expected the announced peer , got %v", peers)
+	}
+}
+
+func TestAnnounceWithBadToken(t *testing.T) {
+	nodes := startNodes(t, 2)
+	defer closeNodes(nodes)
+
+	address := nodes[0].connection.LocalAddr().(*net.UDPAddr)
+	if err := nodes[1].AnnouncePeer(address, makeId(0x42), 6881, "bad token"); err == nil {
+		t.Errorf("Expected an error for a bad token")
+	}
+
+	_, _, token, err := nodes[1].GetPeers(address, makeId(0x42))
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if err := nodes[1].AnnouncePeer(address, makeId(0x42), 6881, token); err != nil {
+		t.Errorf("Got error: %s", err)
+	}
+}
+
+func TestState(t *testing.T) {
+	nodes := startNodes(t, 3)
+	defer closeNodes(nodes)
+
+	path := filepath.Join(os.TempDir(), "yomato_dht_test_state")
+	defer os.Remove(path)
+	if err := nodes[1].SaveState(path); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+
+	restored := New(nil, "")
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if restored.Id != nodes[1].Id {
+		t.Errorf("The id was not restored")
+	}
+	if restored.Table.Length() != nodes[1].Table.Length() {
+		t.Errorf("Expected %d nodes , got %d", nodes[1].Table.Length(), restored.Table.Length())
+	}
+}
@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// The KRPC protocol is described here : http://www.bittorrent.org/beps/bep_0005.html#krpc-protocol
+const (
+	QUERY    = "q"
+	RESPONSE = "r"
+	ERROR    = "e"
+)
+
+const (
+	PING          = "ping"
+	FIND_NODE     = "find_node"
+	GET_PEERS     = "get_peers"
+	ANNOUNCE_PEER = "announce_peer"
+)
+
+const (
+	GENERIC_ERROR  = 201
+	SERVER_ERROR   = 202
+	PROTOCOL_ERROR = 203
+	METHOD_UNKNOWN = 204
+)
+
+const (
+	COMPACT_NODE_LENGTH = 26
+	COMPACT_PEER_LENGTH = 6
+)
+
+// message is a KRPC message : a query , a response or an error.
+type message struct {
+	TransactionId string
+	Type          string
+	Query         string
+	Arguments     *bencode.Dictionary
+	Response      *bencode.Dictionary
+	ErrorCode     int64
+	ErrorMessage  string
+}
+
+func newDictionary() *bencode.Dictionary {
+	return &bencode.Dictionary{Values: make(map[bencode.String]bencode.Bencoder)}
+}
+
+func setString(dictionary *bencode.Dictionary, key string, value string) {
+	dictionary.Values[bencode.String{Value: key}] = &bencode.String{Value: value}
+}
+
+func setNumber(dictionary *bencode.Dictionary, key string, value int64) {
+	dictionary.Values[bencode.String{Value: key}] = &bencode.Number{Value: value}
+}
+
+func getString(dictionary *bencode.Dictionary, key string) (string, bool) {
+	value, isString := dictionary.Values[bencode.String{Value: key}].(*bencode.String)
+	if !isString {
+		return "", false
+	}
+	return value.Value, true
+}
+
+func getNumber(dictionary *bencode.Dictionary, key string) (int64, bool) {
+	value, isNumber := dictionary.Values[bencode.String{Value: key}].(*bencode.Number)
+	if !isNumber {
+		return 0, false
+	}
+	return value.Value, true
+}
+
+// encode returns the bencoded message.
+func (msg *message) encode() []byte {
+	dictionary := newDictionary()
+	setString(dictionary, "t", msg.TransactionId)
+	setString(dictionary, "y", msg.Type)
+	switch msg.Type {
+	case QUERY:
+		setString(dictionary, "q", msg.Query)
+		dictionary.Values[bencode.String{Value: "a"}] = msg.Arguments
+	case RESPONSE:
+		dictionary.Values[bencode.String{Value: "r"}] = msg.Response
+	case ERROR:
+		dictionary.Values[bencode.String{Value: "e"}] = &bencode.List{Values: []bencode.Bencoder{
+			&bencode.Number{Value: msg.ErrorCode},
+			&bencode.String{Value: msg.ErrorMessage},
+		}}
+	}
+	return dictionary.Encode()
+}
+
+// parseMessage parses a bencoded KRPC message.
+func parseMessage(data []byte) (*message, error) {
+
+	decoded, _, err := bencode.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, isDictionary := decoded.(*bencode.Dictionary)
+	if !isDictionary {
+		return nil, errors.New("Message is not a dictionary")
+	}
+
+	msg := &message{}
+	var hasTransaction, hasType bool
+	msg.TransactionId, hasTransaction = getString(dictionary, "t")
+	msg.Type, hasType = getString(dictionary, "y")
+	if !hasTransaction || !hasType {
+		return nil, errors.New("Message without transaction id or type")
+	}
+
+	switch msg.Type {
+	case QUERY:
+		var hasQuery, hasArguments bool
+		msg.Query, hasQuery = getString(dictionary, "q")
+		msg.Arguments, hasArguments = dictionary.Values[bencode.String{Value: "a"}].(*bencode.Dictionary)
+		if !hasQuery || !hasArguments {
+			return nil, errors.New("Malformed query")
+		}
+	case RESPONSE:
+		var hasResponse bool
+		msg.Response, hasResponse = dictionary.Values[bencode.String{Value: "r"}].(*bencode.Dictionary)
+		if !hasResponse {
+			return nil, errors.New("Malformed response")
+		}
+	case ERROR:
+		if list, isList := dictionary.Values[bencode.String{Value: "e"}].(*bencode.List); isList && len(list.Values) == 2 {
+			if code, isNumber := list.Values[0].(*bencode.Number); isNumber {
+				msg.ErrorCode = code.Value
+			}
+			if text, isString := list.Values[1].(*bencode.String); isString {
+				msg.ErrorMessage = text.Value
+			}
+		}
+	default:
+		return nil, errors.New("Unknown message type " + msg.Type)
+	}
+	return msg, nil
+}
+
+// encodePeer returns the compact form of an IPv4 address : 4 bytes of IP and 2 bytes of port.
+func encodePeer(address *net.UDPAddr) string {
+	ip := address.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	compact := make([]byte, COMPACT_PEER_LENGTH)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[4:], uint16(address.Port))
+	return string(compact)
+}
+
+// decodePeer parses an address in compact form.
+func decodePeer(compact string) *net.UDPAddr {
+	if len(compact) != COMPACT_PEER_LENGTH {
+		return nil
+	}
+	ip := net.IPv4(compact[0], compact[1], compact[2], compact[3])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16([]byte(compact[4:])))}
+}
+
+// encodeNodes returns the compact node info of the nodes : the id followed by the compact address.
+func encodeNodes(nodes []*Node) string {
+	compact := make([]byte, 0, len(nodes)*COMPACT_NODE_LENGTH)
+	for _, node := range nodes {
+		address := encodePeer(node.Address)
+		if address != "" {
+			compact = append(compact, node.Id...)
+			compact = append(compact, address...)
+		}
+	}
+	return string(compact)
+}
+
+// decodeNodes parses compact node info.
+func decodeNodes(compact string) []*Node {
+	nodes := []*Node{}
+	for start := 0; start+COMPACT_NODE_LENGTH <= len(compact); start += COMPACT_NODE_LENGTH {
+		address := decodePeer(compact[start+20 : start+COMPACT_NODE_LENGTH])
+		if address.Port > 0 {
+			nodes = append(nodes, &Node{Id: compact[start : start+20], Address: address})
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,186 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ID_LENGTH   = 20
+	BUCKET_SIZE = 8
+	BUCKETS     = ID_LENGTH * 8
+)
+
+// A node which failed to answer this many queries in a row is bad , and can be replaced.
+const MAX_NODE_FAILURES = 3
+
+// A node which didn't answer for this long is questionable , and is pinged before being evicted.
+const NODE_QUESTIONABLE_DURATION = 15 * time.Minute
+
+// Node is a DHT node , known by its id and its UDP address.
+type Node struct {
+	Id       string
+	Address  *net.UDPAddr
+	LastSeen time.Time
+	Failures int
+}
+
+// isBad tells if the node can be replaced by a new one.
+func (node *Node) isBad() bool {
+	return node.Failures >= MAX_NODE_FAILURES
+}
+
+// distance returns the XOR distance between two ids.
+func distance(first, second string) []byte {
+	result := make([]byte, ID_LENGTH)
+	for index := 0; index < ID_LENGTH && index < len(first) && index < len(second); index++ {
+		result[index] = first[index] ^ second[index]
+	}
+	return result
+}
+
+// isCloser tells if first is closer than second to target.
+func isCloser(target, first, second string) bool {
+	firstDistance := distance(target, first)
+	secondDistance := distance(target, second)
+	for index := range firstDistance {
+		if firstDistance[index] != secondDistance[index] {
+			return firstDistance[index] < secondDistance[index]
+		}
+	}
+	return false
+}
+
+// commonPrefixLength returns the number of leading bits the two ids have in common.
+func commonPrefixLength(first, second string) int {
+	for index, value := range distance(first, second) {
+		if value != 0 {
+			for bit := 0; bit < 8; bit++ {
+				if value&(0x80>>uint(bit)) != 0 {
+					return index*8 + bit
+				}
+			}
+		}
+	}
+	return BUCKETS
+}
+
+// sortByDistance sorts the nodes from the closest to target to the farthest.
+func sortByDistance(nodes []*Node, target string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return isCloser(target, nodes[i].Id, nodes[j].Id)
+	})
+}
+
+// RoutingTable holds the known nodes in k-buckets.
+// The bucket of a node is given by the number of leading bits its id has in common with ours.
+type RoutingTable struct {
+	Id      string
+	buckets [BUCKETS][]*Node
+	locker  sync.Mutex
+}
+
+// NewRoutingTable returns an empty routing table for the node with the given id.
+func NewRoutingTable(id string) *RoutingTable {
+	return &RoutingTable{Id: id}
+}
+
+// bucketIndex returns the index of the bucket where the node with the given id belongs.
+func (table *RoutingTable) bucketIndex(id string) int {
+	index := commonPrefixLength(table.Id, id)
+	if index >= BUCKETS {
+		index = BUCKETS - 1
+	}
+	return index
+}
+
+// Insert adds the node to its bucket , or refreshes it if it is already there.
+// If the bucket is full , a bad node is replaced. Otherwise , the questionable nodes are returned,
+// so they can be pinged , and the new node is dropped.
+func (table *RoutingTable) Insert(node *Node) []*Node {
+	if len(node.Id) != ID_LENGTH || node.Id == table.Id {
+		return nil
+	}
+
+	table.locker.Lock()
+	defer table.locker.Unlock()
+
+	bucketIndex := table.bucketIndex(node.Id)
+	bucket := table.buckets[bucketIndex]
+	for _, known := range bucket {
+		if known.Id == node.Id {
+			known.Address = node.Address
+			known.LastSeen = node.LastSeen
+			known.Failures = 0
+			return nil
+		}
+	}
+
+	if len(bucket) < BUCKET_SIZE {
+		table.buckets[bucketIndex] = append(bucket, node)
+		return nil
+	}
+
+	questionable := []*Node{}
+	for index, known := range bucket {
+		if known.isBad() {
+			bucket[index] = node
+			return nil
+		}
+		if time.Since(known.LastSeen) > NODE_QUESTIONABLE_DURATION {
+			questionable = append(questionable, known)
+		}
+	}
+	return questionable
+}
+
+// Failed marks that the node at address didn't answer a query.
+func (table *RoutingTable) Failed(address *net.UDPAddr) {
+	table.locker.Lock()
+	defer table.locker.Unlock()
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			if node.Address.String() == address.String() {
+				node.Failures++
+			}
+		}
+	}
+}
+
+// Closest returns at most count good nodes , the closest to target.
+func (table *RoutingTable) Closest(target string, count int) []*Node {
+	table.locker.Lock()
+	nodes := []*Node{}
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			if !node.isBad() {
+				nodes = append(nodes, &Node{Id: node.Id, Address: node.Address, LastSeen: node.LastSeen})
+			}
+		}
+	}
+	table.locker.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Nodes returns all the good nodes of the table.
+func (table *RoutingTable) Nodes() []*Node {
+	return table.Closest(table.Id, BUCKETS*BUCKET_SIZE)
+}
+
+// Length returns the number of nodes in the table.
+func (table *RoutingTable) Length() int {
+	table.locker.Lock()
+	defer table.locker.Unlock()
+	length := 0
+	for _, bucket := range table.buckets {
+		length += len(bucket)
+	}
+	return length
+}
@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/bbpcr/Yomato/dht"
+	"github.com/bbpcr/Yomato/local_server"
+)
+
+const DHT_SEARCH_DURATION = 5 * time.Minute
+
+const DHT_STATE_FILE = ".dht"
+
+// DHTSettings tells if we look for peers in the DHT , and which nodes we start from.
+// When BootstrapNodes is empty , the default ones are used.
+type DHTSettings struct {
+	Enabled        bool
+	BootstrapNodes []string
+}
+
+// dhtStatePath returns the path of the file where the routing table is kept between runs.
+func (downloader *Downloader) dhtStatePath() string {
+	return filepath.Join(downloader.fileWriter.Root, DHT_STATE_FILE)
+}
+
+// listenDHT starts a DHT node on the UDP port with the number of the listening port of the local server.
+// When the local server accepts uTP connections on that port , the node shares its socket ,
+// which gives it the packets that aren't uTP packets. It returns the node , and if it shares the socket.
+func listenDHT(localServer *local_server.LocalServer, settings DHTSettings) (*dht.DHT, bool, error) {
+
+	node, err := shareUTPSocket(localServer)
+	shared := err == nil
+	if !shared {
+		if node, err = dht.Listen(localServer.Port); err != nil {
+			node, err = dht.Listen(0)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		go node.Serve()
+	}
+	if len(settings.BootstrapNodes) > 0 {
+		node.BootstrapNodes = settings.BootstrapNodes
+	}
+	return node, shared, nil
+}
+
+// closeDHT stops the node. A node which shares the uTP socket gives it back to the local server.
+func closeDHT(node *dht.DHT, shared bool, localServer *local_server.LocalServer) {
+	if shared {
+		localServer.UTP.SetFallback(nil)
+		return
+	}
+	node.Close()
+}
+
+// startDHT starts our DHT node , unless a magnet link already started it to find the metadata.
+// The peers of private torrents must only come from their trackers , so the DHT isn't used for them.
+func (downloader *Downloader) startDHT() {
+
+	if !downloader.DHT.Enabled || downloader.TorrentInfo.FileInformations.Private == 1 {
+		// We only know that a magnet link is private once we have its metadata.
+		if downloader.dhtNode != nil {
+			closeDHT(downloader.dhtNode, downloader.dhtShared, downloader.LocalServer)
+			downloader.dhtNode = nil
+		}
+		return
+	}
+
+	if downloader.dhtNode == nil {
+		node, shared, err := listenDHT(downloader.LocalServer, downloader.DHT)
+		if err != nil {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't start the DHT:", err)
+			return
+		}
+		if err := node.LoadState(downloader.dhtStatePath()); err == nil {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Loaded %d DHT nodes", node.Table.Length()))
+		}
+		downloader.dhtNode = node
+		downloader.dhtShared = shared
+	}
+
+	node := downloader.dhtNode
+	go func() {
+		if err := node.Bootstrap(); err != nil {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't bootstrap the DHT:", err)
+		}
+		downloader.searchDHT()
+	}()
+}
+
+// shareUTPSocket returns a node using the uTP socket of the local server.
+// Only one node can share it , the others get their own socket.
+func shareUTPSocket(localServer *local_server.LocalServer) (*dht.DHT, error) {
+	socket := localServer.UTP
+	if socket == nil {
+		return nil, errors.New("No uTP socket")
+	}
+	node := dht.New(socket.Connection(), "")
+	if err := socket.SetFallback(node.HandlePacket); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// searchDHT asks the DHT for the peers of the torrent , and announces that we listen on our port.
+func (downloader *Downloader) searchDHT() {
+	if downloader.dhtNode == nil {
+		return
+	}
+	numPeers := 0
+	for _, address := range downloader.dhtNode.FindPeers(downloader.TorrentInfo.InfoHash, downloader.LocalServer.Port) {
+		if downloader.addPeerAddress(address) {
+			numPeers++
+		}
+	}
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("DHT with %d nodes gave us new %d peers.", downloader.dhtNode.Table.Length(), numPeers))
+}
+
+// stopDHT saves the routing table , so the next run doesn't need to bootstrap , and stops our node.
+func (downloader *Downloader) stopDHT() {
+	if downloader.dhtNode == nil {
+		return
+	}
+	if err := downloader.dhtNode.SaveState(downloader.dhtStatePath()); err != nil {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't save the DHT nodes:", err)
+	}
+	closeDHT(downloader.dhtNode, downloader.dhtShared, downloader.LocalServer)
+}
@@ -5,16 +5,26 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bbpcr/Yomato/bencode"
 	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/choker"
+	"github.com/bbpcr/Yomato/dht"
 	"github.com/bbpcr/Yomato/file_writer"
 	"github.com/bbpcr/Yomato/local_server"
+	"github.com/bbpcr/Yomato/lsd"
+	"github.com/bbpcr/Yomato/magnet"
 	"github.com/bbpcr/Yomato/peer"
 	"github.com/bbpcr/Yomato/peer_manager"
+	"github.com/bbpcr/Yomato/pex"
 	"github.com/bbpcr/Yomato/piece_manager"
 	"github.com/bbpcr/Yomato/torrent_info"
 	"github.com/bbpcr/Yomato/tracker"
@@ -23,6 +33,7 @@ import (
 const (
 	NOT_COMPLETED = iota
 	DOWNLOADING
+	SEEDING
 	COMPLETED
 )
 
@@ -34,49 +45,157 @@ const (
 )
 
 const (
-	UNCHOKE_DURATION    = 30 * time.Second
 	RECONNECT_DURATION  = 15 * time.Second
 	KEEP_ALIVE_DURATION = 60 * time.Second
+	SEED_CHECK_DURATION = 5 * time.Second
 )
 
+// The trackers are checked every ANNOUNCE_CHECK_DURATION , and the ones whose interval ended are announced to.
+// Their status is printed every TRACKER_STATUS_DURATION.
+const (
+	ANNOUNCE_CHECK_DURATION = 5 * time.Second
+	TRACKER_STATUS_DURATION = 5 * time.Minute
+)
+
+const METADATA_TIMEOUT = 5 * time.Minute
+
+// The requests of a peer are checked for timeouts every REQUEST_CHECK_DURATION.
+const REQUEST_CHECK_DURATION = 1 * time.Second
+
+const (
+	STREAMING_WINDOW         = 8
+	STREAMING_PIECE_DURATION = 2 * time.Second
+)
+
+// SeedSettings tells if we keep seeding after the download is completed , and until when.
+// Seeding stops when any of the goals is reached. A zero goal means there is no limit for it.
+type SeedSettings struct {
+	Enabled  bool
+	Ratio    float64
+	Duration time.Duration
+	IdleTime time.Duration
+}
+
 type Downloader struct {
-	Trackers      []tracker.Tracker
-	TorrentInfo   torrent_info.TorrentInfo
-	LocalServer   *local_server.LocalServer
-	PeerId        string
-	Bitfield      *bitfield.Bitfield
-	Status        int
-	Downloaded    int64
-	Speed         float64
-	PiecesManager *piece_manager.PieceManager
-	PeersManager  *peer_manager.PeerManager
-	fileWriter    *file_writer.Writer
+	Trackers    *tracker.Tiers
+	TorrentInfo torrent_info.TorrentInfo
+	LocalServer *local_server.LocalServer
+	PeerId      string
+	Bitfield    *bitfield.Shared
+	Status      int32 // One of NOT_COMPLETED , DOWNLOADING , SEEDING or COMPLETED , read and written atomically.
+	Downloaded  int64
+	Uploaded    int64
+	Speed       float64
+
+	// The bytes transferred in the previous runs , restored from the resume data.
+	PreviousUploaded   int64
+	PreviousDownloaded int64
+
+	Seeding        SeedSettings
+	DHT            DHTSettings
+	LocalDiscovery bool
+	Encryption     int
+	FilePriorities []int
+	Choker         *choker.Choker
+	Extensions     *peer.ExtensionRegistry
+	PiecesManager  *piece_manager.PieceManager
+	PeersManager   *peer_manager.PeerManager
+	fileWriter     *file_writer.Writer
+
+	// The piece at the playback cursor , whose deadlines are set once we know which pieces we have.
+	streaming   bool
+	cursorPiece int
+
+	seedingStarted  time.Time
+	seedingUploaded int64
+	lastUploadTime  time.Time
+	knownPeers      []string
+	dhtNode         *dht.DHT
+	dhtShared       bool
+	lsdService      *lsd.Service
+	pexStates       map[*peer.Peer]*pex.State
+	swarm           tracker.ScrapeResult
+	swarmLocker     sync.Mutex
 
 	connectionChan chan peer.ConnectionCommunication
 }
 
-func (downloader *Downloader) requestPeers(event int) {
+// addPeer starts connecting to a peer we didn't know about.
+// It returns false if the peer is already known.
+func (downloader *Downloader) addPeer(newPeer *peer.Peer) bool {
+	if downloader.PeersManager.Exists(newPeer) {
+		return false
+	}
+	newPeer.Availability = downloader.PiecesManager
+	newPeer.Extensions = downloader.Extensions
+	newPeer.Encryption = downloader.Encryption
+	newPeer.UTPSocket = downloader.LocalServer.UTP
+	downloader.PeersManager.SetPeerAsDisconnected(newPeer)
+	go newPeer.EstablishFullConnection(downloader.connectionChan, downloader.Bitfield)
+	return true
+}
 
-	// Request the peers , from the tracker
-	// The first paramater is how many bytes uploaded , the second downloaded , and the third remaining size.
-	// The fourth param is the event.
+// newPeerFromAddress returns the peer at address , given as host:port , or nil if the address is invalid.
+func (downloader *Downloader) newPeerFromAddress(address string) *peer.Peer {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil
+	}
+	newPeer := peer.New(&downloader.TorrentInfo, downloader.PeerId, host, port)
+	return &newPeer
+}
+
+// addPeerAddress starts connecting to the peer at address , given as host:port.
+// It returns false if the address is invalid or the peer is already known.
+func (downloader *Downloader) addPeerAddress(address string) bool {
+	newPeer := downloader.newPeerFromAddress(address)
+	return newPeer != nil && downloader.addPeer(newPeer)
+}
+
+// announce announces the event to the trackers , and connects to the peers they give us.
+// The regular announces only go to the trackers whose interval ended , unless force is set.
+func (downloader *Downloader) announce(event int, force bool) {
+
+	// The trackers are told how many bytes we uploaded , downloaded , and how many are left.
 	numPeers := 0
+	numTrackers := 0
 	bytesDownloaded := downloader.PiecesManager.CalculateDownloaded()
 	bytesLeft := downloader.TorrentInfo.FileInformations.TotalLength - bytesDownloaded
-	bytesUploaded := int64(0)
-	for trackerIndex := 0; trackerIndex < len(downloader.Trackers); trackerIndex++ {
-
-		trackerResponse := downloader.Trackers[trackerIndex].RequestPeers(bytesUploaded, bytesDownloaded, bytesLeft, event)
-
+	bytesUploaded := atomic.LoadInt64(&downloader.Uploaded)
+	for trackerResponse := range downloader.Trackers.Announce(event, bytesUploaded, bytesDownloaded, bytesLeft, force) {
+		numTrackers++
 		for peerIndex := 0; peerIndex < len(trackerResponse.Peers); peerIndex++ {
-			if !downloader.PeersManager.Exists(&trackerResponse.Peers[peerIndex]) {
-				downloader.PeersManager.SetPeerAsDisconnected(&trackerResponse.Peers[peerIndex])
-				go trackerResponse.Peers[peerIndex].EstablishFullConnection(downloader.connectionChan, downloader.Bitfield)
+			if downloader.addPeer(&trackerResponse.Peers[peerIndex]) {
 				numPeers++
 			}
 		}
 	}
-	fmt.Printf("%s %d trackers gave us new %d peers.\n", time.Now().Format("[2006.01.02 15:04:05]"), len(downloader.Trackers), numPeers)
+	if numTrackers > 0 {
+		fmt.Printf("%s %d trackers gave us new %d peers.\n", time.Now().Format("[2006.01.02 15:04:05]"), numTrackers, numPeers)
+	}
+	if event != tracker.NONE {
+		downloader.printTrackerStatus()
+	}
+}
+
+// GetStatus returns the status of the download , one of NOT_COMPLETED , DOWNLOADING , SEEDING or COMPLETED.
+func (downloader *Downloader) GetStatus() int {
+	return int(atomic.LoadInt32(&downloader.Status))
+}
+
+// setStatus changes the status of the download , which the goroutines of the peers read.
+func (downloader *Downloader) setStatus(status int) {
+	atomic.StoreInt32(&downloader.Status, int32(status))
+}
+
+// printTrackerStatus prints what happened when we announced to each tracker.
+func (downloader *Downloader) printTrackerStatus() {
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Trackers :")
+	fmt.Print(tracker.StatusTable(downloader.Trackers.Status()))
 }
 
 func (downloader *Downloader) checkExistingFiles() {
@@ -96,164 +215,345 @@ func (downloader *Downloader) checkExistingFiles() {
 
 }
 
-func (downloader *Downloader) ScanForUnchoke(seeder *peer.Peer) {
+// uploadToPeer sends the peer the blocks it requested from us.
+func (downloader *Downloader) uploadToPeer(leecher *peer.Peer) {
 
-	if seeder.Active || seeder.Downloading {
-		return
+	uploaded, err := leecher.ServeRequests(downloader.fileWriter)
+	atomic.AddInt64(&downloader.Uploaded, uploaded)
+	if err != nil {
+		leecher.Disconnect()
+		downloader.PeersManager.SetPeerAsDisconnected(leecher)
 	}
+}
 
-	seeder.Active = true
+// updateInterest tells the peer if we are interested in its pieces , when it changed.
+func (downloader *Downloader) updateInterest(connectedPeer *peer.Peer) {
+	interested := downloader.GetStatus() == DOWNLOADING && downloader.PiecesManager.IsInterestedIn(connectedPeer)
+	if interested && !connectedPeer.IsClientInterested() {
+		connectedPeer.SendInterested()
+	} else if !interested && connectedPeer.IsClientInterested() {
+		connectedPeer.SendUninterested()
+	}
+}
 
-	time.Sleep(1 * time.Second)
-	startTime := time.Now()
-	for time.Since(startTime) < UNCHOKE_DURATION && seeder.PeerChoking && seeder.Status == peer.CONNECTED {
-		err := seeder.SendInterested()
-		if err != nil {
-			seeder.Disconnect()
-			downloader.PeersManager.SetPeerAsDisconnected(seeder)
-			return
-		}
-		seeder.ReadMessages(1, 5*time.Second)
+// startDownloading starts downloading from the peer , if it has blocks for us,
+// and we don't download from MAX_ACTIVE_REQUESTS peers already.
+func (downloader *Downloader) startDownloading(seeder *peer.Peer) {
+	if downloader.GetStatus() != DOWNLOADING || seeder.IsDownloading() {
+		return
+	}
+	if downloader.PeersManager.CountDownloadingPeers() < MAX_ACTIVE_REQUESTS && downloader.PiecesManager.HasBlocksFor(seeder) {
+		seeder.SetDownloading(true)
 	}
-	if !seeder.PeerChoking {
-		numRequesting := downloader.PeersManager.CountDownloadingPeers()
-		if numRequesting < MAX_ACTIVE_REQUESTS {
-			go downloader.DownloadFromPeer(seeder)
+}
+
+// requestBlocks requests new blocks from the peer we download from , until PipelineDepth requests are outstanding.
+// When nothing is left to request from it and to wait for , we stop downloading from it.
+func (downloader *Downloader) requestBlocks(seeder *peer.Peer) error {
+	if !seeder.IsDownloading() {
+		return nil
+	}
+	missing := seeder.PipelineDepth() - seeder.CountPendingRequests()
+	if missing <= 0 {
+		return nil
+	}
+	blocks := downloader.PiecesManager.GetNextBlocksToDownload(seeder, missing)
+	if len(blocks) == 0 {
+		if seeder.CountPendingRequests() == 0 {
+			seeder.SetDownloading(false)
 		}
+		return nil
 	}
-	seeder.Active = false
+	requests := []peer.BlockRequest{}
+	for _, block := range blocks {
+		downloader.PiecesManager.RequestBlock(block, seeder)
+		index, offset, length := downloader.PiecesManager.MakeRequest(block)
+		requests = append(requests, peer.BlockRequest{PieceNumber: index, Offset: offset, Length: length})
+	}
+	return seeder.SendRequests(requests)
 }
 
-// This function , start downloading from a peer.
-func (downloader *Downloader) DownloadFromPeer(seeder *peer.Peer) {
+// releaseBlocks gives back to the pieces manager the blocks the peer won't send , so they are requested again.
+func (downloader *Downloader) releaseBlocks(seeder *peer.Peer, requests []peer.BlockRequest) {
+	for _, request := range requests {
+		downloader.PiecesManager.ReleaseBlock(downloader.PiecesManager.GetBlockIndex(request.PieceNumber, request.Offset), seeder)
+	}
+}
 
-	if seeder.Downloading || seeder.Active {
+// receiveBlock writes a block received from the peer , and checks its piece once it is completed.
+func (downloader *Downloader) receiveBlock(seeder *peer.Peer, pieceData file_writer.PieceData) {
+
+	// The peer only delivers the blocks we requested , but a block outside of the torrent is never written.
+	if downloader.PiecesManager.GetBlockIndex(pieceData.PieceNumber, pieceData.Offset) < 0 {
 		return
 	}
-	seeder.Downloading = true
+	err := downloader.PiecesManager.UpdatePiece(pieceData)
+	atomic.AddInt64(&downloader.Downloaded, int64(len(pieceData.Piece)))
+	if err == nil {
+		downloader.fileWriter.WritePiece(pieceData)
+	}
+
+	// In the endgame , the other peers we requested the block from don't need to send it anymore.
+	for _, otherPeer := range downloader.PiecesManager.FinishBlock(pieceData, seeder) {
+		otherPeer.SendCancel(pieceData.PieceNumber, pieceData.Offset, len(pieceData.Piece))
+	}
 
-	for seeder.Status == peer.CONNECTED {
+	if downloader.PiecesManager.IsPieceCompleted(pieceData.PieceNumber, &downloader.TorrentInfo) {
+		if !downloader.Bitfield.At(pieceData.PieceNumber) {
+			if downloader.fileWriter.CheckSha1Sum(int64(pieceData.PieceNumber)) {
+				downloader.Bitfield.Set(pieceData.PieceNumber, true)
 
-		blocks := downloader.PiecesManager.GetNextBlocksToDownload(seeder, 10)
-		if blocks == nil {
-			break
+				// The connected peers learn that they can request the piece from us.
+				for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
+					connectedPeer.SendHave(pieceData.PieceNumber)
+				}
+			} else {
+				fmt.Println("Dropped piece ", pieceData.PieceNumber)
+				downloader.PiecesManager.AddPieceToDownload(pieceData.PieceNumber, &downloader.TorrentInfo)
+			}
 		}
-		smallParams := []int{}
-		for block := 0; block < len(blocks); block++ {
-			downloader.PiecesManager.SetBlockDownloading(blocks[block], true)
-			index, offset, length := downloader.PiecesManager.MakeRequest(blocks[block])
-			smallParams = append(smallParams, index, offset, length)
+	}
+}
+
+// handlePeer reacts to the messages of a connected peer , until its connection breaks.
+// We download from it while it unchokes us , keeping PipelineDepth requests outstanding,
+// and we upload the blocks it requested. The requests it rejects , discards or doesn't answer
+// in REQUEST_TIMEOUT are given back , so they are requested again.
+func (downloader *Downloader) handlePeer(connectedPeer *peer.Peer) {
+
+	messages := connectedPeer.Messages()
+	if messages == nil {
+		return
+	}
+	checkTicker := time.NewTicker(REQUEST_CHECK_DURATION)
+	defer checkTicker.Stop()
+
+	// Our interest and the download are checked again when they may have changed : at the start , after the
+	// messages which change the pieces or the choke of the peer , and every REQUEST_CHECK_DURATION.
+	check := true
+handling:
+	for {
+		downloader.releaseBlocks(connectedPeer, connectedPeer.DroppedRequests(peer.REQUEST_TIMEOUT))
+		if check {
+			downloader.updateInterest(connectedPeer)
+			downloader.startDownloading(connectedPeer)
+			check = false
 		}
-		err := seeder.WriteRequest(smallParams)
-		if err != nil {
+		if err := downloader.requestBlocks(connectedPeer); err != nil {
 			break
 		}
 
-		pieces := seeder.ReadMessages(len(blocks), 3*time.Second)
-
-		if len(pieces) > 0 {
-			for _, pieceData := range pieces {
-				err := downloader.PiecesManager.UpdatePiece(pieceData)
-				downloader.Downloaded += int64(len(pieceData.Piece))
-				if err == nil {
-					downloader.fileWriter.WritePiece(pieceData)
-				}
-				if downloader.PiecesManager.IsPieceCompleted(pieceData.PieceNumber, &downloader.TorrentInfo) {
-					if !downloader.Bitfield.At(pieceData.PieceNumber) {
-						if downloader.fileWriter.CheckSha1Sum(int64(pieceData.PieceNumber)) {
-							downloader.Bitfield.Set(pieceData.PieceNumber, true)
-						} else {
-							fmt.Println("Dropped piece ", pieceData.PieceNumber)
-							downloader.PiecesManager.AddPieceToDownload(pieceData.PieceNumber, &downloader.TorrentInfo)
-						}
-					}
-				}
-				downloader.PiecesManager.SetPieceDownloading(pieceData, false)
-			}
-			for block := 0; block < len(blocks); block++ {
-				downloader.PiecesManager.SetBlockDownloading(blocks[block], false)
+		select {
+		case message, open := <-messages:
+			if !open {
+				break handling
 			}
-		} else {
-			for block := 0; block < len(blocks); block++ {
-				downloader.PiecesManager.SetBlockDownloading(blocks[block], false)
+			switch message.Id {
+			case peer.PIECE:
+				if message.Block != nil {
+					downloader.receiveBlock(connectedPeer, *message.Block)
+				}
+			case peer.REQUEST:
+				downloader.uploadToPeer(connectedPeer)
+			case peer.CHOKE, peer.UNCHOKE, peer.HAVE, peer.BITFIELD, peer.HAVE_ALL, peer.ALLOWED_FAST, peer.REJECT_REQUEST:
+				check = true
 			}
-			break
-		}
-		if seeder.PeerChoking {
-			break
+		case <-checkTicker.C:
+			check = true
 		}
 	}
 
-	// If the peer gets choked , we try to
-	// wait and see if it gets unchoked.
-	// If another error occurs we disconnect the peer.
-	if seeder.PeerChoking {
-		err := seeder.SendUninterested()
+	downloader.releaseBlocks(connectedPeer, connectedPeer.ClearPendingRequests())
+	connectedPeer.SetDownloading(false)
+
+	// The peer may already be connected again , with another handler.
+	if connectedPeer.Messages() == messages {
+		connectedPeer.Disconnect()
+		downloader.PeersManager.SetPeerAsDisconnected(connectedPeer)
+	}
+}
+
+// SetFilePriority sets the priority of the files whose path or name match the pattern.
+// It returns how many files matched. The priorities must be set before the download starts.
+func (downloader *Downloader) SetFilePriority(pattern string, priority int) (int, error) {
+
+	matched := 0
+	for fileIndex, fileData := range downloader.TorrentInfo.FileInformations.Files {
+		name := strings.TrimPrefix(fileData.Name, "/")
+		matchesPath, err := filepath.Match(pattern, name)
 		if err != nil {
-			seeder.Disconnect()
-			downloader.PeersManager.SetPeerAsDisconnected(seeder)
-		} else {
-			go downloader.ScanForUnchoke(seeder)
+			return 0, err
+		}
+		matchesName, _ := filepath.Match(pattern, filepath.Base(name))
+		if matchesPath || matchesName {
+			downloader.FilePriorities[fileIndex] = priority
+			matched++
 		}
-	} else {
-		seeder.Disconnect()
-		downloader.PeersManager.SetPeerAsDisconnected(seeder)
 	}
+	downloader.PiecesManager.SetFilePriorities(downloader.FilePriorities, &downloader.TorrentInfo)
+	return matched, nil
+}
 
-	// Whatever happens , we need to keep requesting,
-	// so we replace the current seed with another seed, if we can
-	var bestUnchoked *peer.Peer = nil
-	var bestChoked *peer.Peer = nil
-	// We need to find the best peer who isn't unchoked and currently downloading
-	// and we need to find the best peer who is choked so we can try to make more usable peers
-	for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
+// SetStreamingCursor moves the playback cursor at offset in the file fileIndex , and switches to sequential download.
+// The STREAMING_WINDOW pieces after the cursor get deadlines , STREAMING_PIECE_DURATION apart,
+// so that they are downloaded in time for the playback.
+// It should be called again whenever the playback moves.
+// Before the download starts , the deadlines are only set once the files are prepared,
+// so they don't run out while the pieces are checked , and the pieces we have get none.
+func (downloader *Downloader) SetStreamingCursor(fileIndex int, offset int64) error {
 
-		if seeder.IP != connectedPeer.IP && !connectedPeer.Downloading && !connectedPeer.Active && !connectedPeer.PeerChoking {
-			if bestUnchoked == nil {
-				bestUnchoked = connectedPeer
-			} else if bestUnchoked.ConnectTime > connectedPeer.ConnectTime {
-				bestUnchoked = connectedPeer
-			}
-		}
+	cursorPiece, err := file_writer.GetPieceAt(downloader.TorrentInfo, fileIndex, offset)
+	if err != nil {
+		return err
+	}
 
-		if seeder.IP != connectedPeer.IP && !connectedPeer.Downloading && connectedPeer.PeerChoking && !connectedPeer.Active {
-			if bestChoked == nil {
-				bestChoked = connectedPeer
-			} else if bestChoked.ConnectTime > connectedPeer.ConnectTime {
-				bestChoked = connectedPeer
-			}
-		}
+	downloader.PiecesManager.SetMode(piece_manager.SEQUENTIAL)
+	downloader.PiecesManager.SetCursor(cursorPiece)
+	downloader.streaming = true
+	downloader.cursorPiece = cursorPiece
+	if downloader.fileWriter != nil {
+		downloader.setStreamingDeadlines()
 	}
+	return nil
+}
 
-	if bestUnchoked != nil {
-		if downloader.PeersManager.CountConnectedPeers() < MAX_ACTIVE_REQUESTS {
-			go downloader.DownloadFromPeer(bestUnchoked)
+// setStreamingDeadlines gives deadlines to the missing pieces of the window after the playback cursor.
+func (downloader *Downloader) setStreamingDeadlines() {
+
+	cursorPiece := downloader.cursorPiece
+	downloader.PiecesManager.ClearDeadlines()
+	for position := 0; position < STREAMING_WINDOW; position++ {
+		pieceIndex := cursorPiece + position
+		if pieceIndex >= int(downloader.TorrentInfo.FileInformations.PieceCount) {
+			break
+		}
+		if !downloader.Bitfield.At(pieceIndex) {
+			downloader.PiecesManager.SetPieceDeadline(pieceIndex, time.Duration(position+1)*STREAMING_PIECE_DURATION)
 		}
 	}
+}
+
+// prepareFiles opens the files of the torrent and finds which pieces we already have.
+// The resume data is used when possible , otherwise all the pieces are checked.
+func (downloader *Downloader) prepareFiles() {
 
-	if bestChoked != nil {
-		go downloader.ScanForUnchoke(bestChoked)
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	downloader.fileWriter = file_writer.New(filepath.Join(cwd, "TorrentDownloads"), downloader.TorrentInfo, downloader.FilePriorities)
+	if !downloader.loadResumeData() {
+		downloader.checkExistingFiles()
+	}
+	if downloader.streaming {
+		downloader.setStreamingDeadlines()
 	}
-	seeder.Downloading = false
 }
 
 // StartDownloading downloads the motherfucker
+// If seeding is enabled , it keeps seeding after the download is completed,
+// until one of the seeding goals is reached.
 func (downloader *Downloader) StartDownloading() {
 
 	downloader.Downloaded = 0
-	if downloader.Status == DOWNLOADING {
+	if status := downloader.GetStatus(); status == DOWNLOADING || status == SEEDING {
 		return
 	}
 
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
+	downloader.prepareFiles()
+	defer downloader.fileWriter.CloseFiles()
+
+	downloader.setStatus(DOWNLOADING)
+	downloader.run()
+}
+
+// StartSeeding only seeds the files we already have , without downloading anything.
+// It returns without seeding if some pieces are missing.
+func (downloader *Downloader) StartSeeding() {
+
+	if status := downloader.GetStatus(); status == DOWNLOADING || status == SEEDING {
+		return
 	}
-	downloader.fileWriter = file_writer.New(filepath.Join(cwd, "TorrentDownloads"), downloader.TorrentInfo)
+
+	downloader.prepareFiles()
 	defer downloader.fileWriter.CloseFiles()
-	downloader.checkExistingFiles()
 
-	downloader.requestPeers(tracker.DOWNLOAD_STARTED)
+	if wanted, completed := downloader.PiecesManager.CountWantedPieces(downloader.Bitfield); completed < wanted {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Can't seed,", wanted-completed, "pieces are missing")
+		return
+	}
+
+	downloader.Seeding.Enabled = true
+	downloader.startSeeding()
+	downloader.run()
+}
+
+// startSeeding switches the downloader into seeding mode.
+func (downloader *Downloader) startSeeding() {
+	downloader.setStatus(SEEDING)
+	downloader.seedingStarted = time.Now()
+	downloader.lastUploadTime = time.Now()
+	downloader.seedingUploaded = atomic.LoadInt64(&downloader.Uploaded)
+}
+
+// seedingGoalReached tells if we seeded enough, according to the seeding settings.
+// The share ratio is computed from the bytes uploaded in all the runs and the total size of the torrent.
+func (downloader *Downloader) seedingGoalReached() bool {
+
+	settings := downloader.Seeding
+	if settings.Ratio > 0 {
+		ratio := float64(downloader.PreviousUploaded+atomic.LoadInt64(&downloader.Uploaded)) / float64(downloader.TorrentInfo.FileInformations.TotalLength)
+		if ratio >= settings.Ratio {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Reached share ratio %.2f", ratio))
+			return true
+		}
+	}
+	if settings.Duration > 0 && time.Since(downloader.seedingStarted) >= settings.Duration {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Seeded for", settings.Duration)
+		return true
+	}
+
+	uploaded := atomic.LoadInt64(&downloader.Uploaded)
+	if uploaded != downloader.seedingUploaded {
+		downloader.seedingUploaded = uploaded
+		downloader.lastUploadTime = time.Now()
+	}
+	if settings.IdleTime > 0 && time.Since(downloader.lastUploadTime) >= settings.IdleTime {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Nothing uploaded for", settings.IdleTime)
+		return true
+	}
+	return false
+}
+
+// finishDownload is called when all the pieces were downloaded.
+// We tell the trackers , and then we either start seeding or we stop.
+func (downloader *Downloader) finishDownload(startedTime time.Time) {
+
+	// The completed event is announced before run returns , so it can't come after the stopped event.
+	downloader.announce(tracker.DOWNLOAD_COMPLETED, false)
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Download completeted in %.2f seconds, with average speed %.2f KB/s\n", time.Since(startedTime).Seconds(), float64(atomic.LoadInt64(&downloader.Downloaded))/time.Since(startedTime).Seconds()/1024.0))
+
+	if !downloader.Seeding.Enabled {
+		downloader.setStatus(COMPLETED)
+		return
+	}
+
+	downloader.startSeeding()
+	for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
+		connectedPeer.SendUninterested()
+	}
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Started seeding")
+}
+
+// run does the work for downloading and seeding , until the downloader gets COMPLETED.
+func (downloader *Downloader) run() {
+
+	defer downloader.LocalServer.RemoveTorrent(downloader.TorrentInfo.InfoHash)
+
+	downloader.connectKnownPeers()
+	go downloader.announce(tracker.DOWNLOAD_STARTED, false)
+	downloader.startDHT()
+	downloader.startLSD()
 
 	ticker := time.NewTicker(time.Second * 2)
 	defer ticker.Stop()
@@ -261,74 +561,153 @@ func (downloader *Downloader) StartDownloading() {
 	defer reconnectTicker.Stop()
 	keepAliveTicker := time.NewTicker(KEEP_ALIVE_DURATION)
 	defer keepAliveTicker.Stop()
-
-	defer downloader.requestPeers(tracker.DOWNLOAD_STOPPED)
+	seedTicker := time.NewTicker(SEED_CHECK_DURATION)
+	defer seedTicker.Stop()
+	chokeTicker := time.NewTicker(choker.RECHOKE_DURATION)
+	defer chokeTicker.Stop()
+	resumeTicker := time.NewTicker(RESUME_SAVE_DURATION)
+	defer resumeTicker.Stop()
+	dhtTicker := time.NewTicker(DHT_SEARCH_DURATION)
+	defer dhtTicker.Stop()
+	pexTicker := time.NewTicker(pex.PEX_DURATION)
+	defer pexTicker.Stop()
+	lsdTicker := time.NewTicker(lsd.ANNOUNCE_DURATION)
+	defer lsdTicker.Stop()
+	announceTicker := time.NewTicker(ANNOUNCE_CHECK_DURATION)
+	defer announceTicker.Stop()
+	trackerStatusTicker := time.NewTicker(TRACKER_STATUS_DURATION)
+	defer trackerStatusTicker.Stop()
+	scrapeTicker := time.NewTicker(SCRAPE_DURATION)
+	defer scrapeTicker.Stop()
+	go downloader.scrapeTrackers()
+	lastRechoke := time.Now()
+
+	defer downloader.announce(tracker.DOWNLOAD_STOPPED, false)
 
 	startedTime := time.Now()
 	go func() {
-		var seconds int = 0
 		var lastDownloaded int64 = 0
 		for _ = range ticker.C {
-			seconds += 2
-			downloader.Speed = float64(downloader.Downloaded-lastDownloaded) / 1024.0
+			downloaded := atomic.LoadInt64(&downloader.Downloaded)
+			downloader.Speed = float64(downloaded-lastDownloaded) / 1024.0
 			downloader.Speed /= 2
-			lastDownloaded = downloader.Downloaded
+			lastDownloaded = downloaded
 			numRequesting := downloader.PeersManager.CountDownloadingPeers()
-			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Peers : %d / %d [Total %d / %d] Downloaded Pieces : %d / %d (%.2f%%) Speed : %.2f KB/s Elapsed : %.2f seconds ", numRequesting, downloader.PeersManager.CountConnectedPeers(), downloader.PeersManager.CountAlivePeers(), downloader.PeersManager.CountAllPeers(), downloader.Bitfield.OneBits, downloader.Bitfield.Length, float64(downloader.Bitfield.OneBits)*100.0/float64(downloader.Bitfield.Length), downloader.Speed, time.Since(startedTime).Seconds()))
-			if seconds == 200 {
-				downloader.requestPeers(tracker.NONE)
-				seconds = 0
-			}
+			wantedPieces, completedPieces := downloader.PiecesManager.CountWantedPieces(downloader.Bitfield)
+			swarm := downloader.getSwarm()
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Peers : %d / %d [Total %d / %d] Swarm : %d seeders %d leechers Downloaded Pieces : %d / %d (%.2f%%) Speed : %.2f KB/s Uploaded : %.2f MB Wasted : %.2f MB Copies : %.2f Elapsed : %.2f seconds ", numRequesting, downloader.PeersManager.CountConnectedPeers(), downloader.PeersManager.CountAlivePeers(), downloader.PeersManager.CountAllPeers(), swarm.Complete, swarm.Incomplete, completedPieces, wantedPieces, float64(completedPieces)*100.0/float64(wantedPieces), downloader.Speed, float64(atomic.LoadInt64(&downloader.Uploaded))/1024.0/1024.0, float64(downloader.PiecesManager.WastedBytes())/1024.0/1024.0, downloader.PiecesManager.DistributedCopies(), time.Since(startedTime).Seconds()))
 		}
 	}()
 
-	for downloader.Bitfield.OneBits < downloader.Bitfield.Length {
+	for downloader.GetStatus() != COMPLETED {
+
+		if downloader.GetStatus() == DOWNLOADING && downloader.PiecesManager.AllWantedCompleted(downloader.Bitfield) {
+			downloader.finishDownload(startedTime)
+			if downloader.GetStatus() == COMPLETED {
+				break
+			}
+		}
+
 		select {
 
+		case _ = <-resumeTicker.C:
+
+			// This ticker is called every RESUME_SAVE_DURATION seconds
+			// We save the state of the download , so it can be resumed quickly.
+			if err := downloader.saveResumeData(); err != nil {
+				fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't save the resume data:", err)
+			}
+
+		case _ = <-dhtTicker.C:
+
+			// This ticker is called every DHT_SEARCH_DURATION seconds
+			// We ask the DHT for new peers , which also announces us again.
+			go downloader.searchDHT()
+
+		case _ = <-pexTicker.C:
+
+			// This ticker is called every PEX_DURATION seconds
+			// We tell the connected peers which peers we connected to and dropped.
+			downloader.exchangePeers()
+
+		case _ = <-lsdTicker.C:
+
+			// This ticker is called every ANNOUNCE_DURATION seconds
+			// We announce the torrent again on the local network.
+			downloader.announceLocally()
+
+		case _ = <-announceTicker.C:
+
+			// This ticker is called every ANNOUNCE_CHECK_DURATION seconds
+			// We announce to the trackers whose interval ended.
+			go downloader.announce(tracker.NONE, false)
+
+		case _ = <-trackerStatusTicker.C:
+
+			// This ticker is called every TRACKER_STATUS_DURATION seconds
+			// We show how the trackers are doing.
+			downloader.printTrackerStatus()
+
+		case _ = <-scrapeTicker.C:
+
+			// This ticker is called every SCRAPE_DURATION seconds
+			// We ask the trackers how big the swarm is , for the status.
+			go downloader.scrapeTrackers()
+
+		case _ = <-seedTicker.C:
+
+			// This ticker is called every SEED_CHECK_DURATION seconds
+			// While seeding , we check if any of the seeding goals was reached.
+			if downloader.GetStatus() == SEEDING && downloader.seedingGoalReached() {
+				downloader.setStatus(COMPLETED)
+			}
+
 		case _ = <-keepAliveTicker.C:
 
 			// This ticker is called every KEEP_ALIVE_DURATION seconds
-			// We send a keep alive message , and we try to unchoke the peers that are choked
+			// We send a keep alive message to the connected peers , so they don't drop us.
 			numKeptAlive := 0
 			for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
-				if !connectedPeer.Downloading && !connectedPeer.Active {
-					if err := connectedPeer.SendKeepAlive(); err != nil {
-						connectedPeer.Disconnect()
-						downloader.PeersManager.SetPeerAsConnected(connectedPeer)
-					}
+				if err := connectedPeer.SendKeepAlive(); err != nil {
+					connectedPeer.Disconnect()
+					downloader.PeersManager.SetPeerAsDisconnected(connectedPeer)
+				} else {
 					numKeptAlive++
 				}
 			}
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Sent keep alive to %d connected peers", numKeptAlive))
 
-			numUnchoking := 0
-			for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
-				if !connectedPeer.Active && !connectedPeer.Downloading && connectedPeer.PeerChoking {
-					go downloader.ScanForUnchoke(connectedPeer)
-					numUnchoking++
-				}
-			}
-			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Sent keep alive to %d connected peers and unchoking %d connected peers", numKeptAlive, numUnchoking))
+		case _ = <-chokeTicker.C:
+
+			// This ticker is called every RECHOKE_DURATION seconds
+			// The choker decides which peers we upload to.
+			downloader.Choker.Rechoke(downloader.PeersManager.GetConnectedPeers(), downloader.GetStatus() == SEEDING, time.Since(lastRechoke))
+			lastRechoke = time.Now()
 
 		case _ = <-reconnectTicker.C:
 			// This ticker is called every RECONNECT_DURATION seconds
 			// If we have less than MIN_ACTIVE_CONNECTIONS peers connected , we reconnect all of them.
-			// If that doesnt happen then we choose 3 disconnected peers , and we try to connect them.
-			// Also we try to make more requests.
+			// If that doesnt happen then we choose MAX_NEW_CONNECTIONS disconnected peers , and we try to connect them.
+			// The peers which connected to us are only reconnected if they told us the port they listen on.
 			connectedPeersCount := downloader.PeersManager.CountConnectedPeers()
 			if connectedPeersCount < MIN_ACTIVE_CONNECTIONS {
 
 				for _, alivePeer := range downloader.PeersManager.GetAlivePeers() {
-					if alivePeer.Status == peer.DISCONNECTED {
+					if alivePeer.GetStatus() == peer.DISCONNECTED && alivePeer.DialPort() > 0 {
 						go alivePeer.EstablishFullConnection(downloader.connectionChan, downloader.Bitfield)
 					}
 				}
 				fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Reconnecting all alive peers, because of low connections")
 
+				// We also ask the trackers for more peers , if their min interval allows it.
+				go downloader.announce(tracker.NONE, true)
+
 			} else if connectedPeersCount < MAX_ACTIVE_CONNECTIONS {
 
+				// The peers of the local network are tried first.
 				newConnections := 0
-				for _, alivePeer := range downloader.PeersManager.GetAlivePeers() {
-					if alivePeer.Status == peer.DISCONNECTED {
+				for _, alivePeer := range downloader.PeersManager.PreferLocal(downloader.PeersManager.GetAlivePeers()) {
+					if alivePeer.GetStatus() == peer.DISCONNECTED && alivePeer.DialPort() > 0 {
 						go alivePeer.EstablishFullConnection(downloader.connectionChan, downloader.Bitfield)
 						newConnections++
 						if newConnections == MAX_NEW_CONNECTIONS {
@@ -339,18 +718,17 @@ func (downloader *Downloader) StartDownloading() {
 				fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Trying %d new connections", newConnections))
 			}
 
-			numDownloading := downloader.PeersManager.CountDownloadingPeers()
-			for _, connectedPeer := range downloader.PeersManager.GetAlivePeers() {
-				if numDownloading < MAX_ACTIVE_REQUESTS && !connectedPeer.PeerChoking && !connectedPeer.Downloading && !connectedPeer.Active {
-					numDownloading++
-					go downloader.DownloadFromPeer(connectedPeer)
-				}
-			}
-
 		case connectionMessage, _ := <-downloader.connectionChan:
 
 			if connectionMessage.StatusMessage == "OK" {
 
+				// A peer which connected to us may already be connected through an outgoing connection.
+				existingPeer := downloader.PeersManager.GetConnectedPeer(connectionMessage.Peer.IP)
+				if existingPeer != nil && existingPeer != connectionMessage.Peer && existingPeer.GetStatus() == peer.CONNECTED {
+					connectionMessage.Peer.Disconnect()
+					break
+				}
+
 				if downloader.PeersManager.CountConnectedPeers() < MAX_ACTIVE_CONNECTIONS {
 					downloader.PeersManager.SetPeerAsConnected(connectionMessage.Peer)
 				} else {
@@ -358,15 +736,16 @@ func (downloader *Downloader) StartDownloading() {
 					var worstPeer *peer.Peer = nil
 					for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
 						if worstPeer != nil {
-							if worstPeer.ConnectTime < connectedPeer.ConnectTime && connectedPeer.PeerChoking {
+							if worstPeer.ConnectTime < connectedPeer.ConnectTime && connectedPeer.IsPeerChoking() {
 								worstPeer = connectedPeer
 							}
-						} else if connectedPeer.PeerChoking {
+						} else if connectedPeer.IsPeerChoking() {
 							worstPeer = connectedPeer
 						}
 					}
 
-					if worstPeer != nil && worstPeer.ConnectTime > connectionMessage.Peer.ConnectTime {
+					// A peer of the local network always replaces the worst one.
+					if worstPeer != nil && (worstPeer.ConnectTime > connectionMessage.Peer.ConnectTime || downloader.PeersManager.IsLocal(connectionMessage.Peer)) {
 						worstPeer.Disconnect()
 						downloader.PeersManager.SetPeerAsDisconnected(worstPeer)
 						downloader.PeersManager.SetPeerAsConnected(connectionMessage.Peer)
@@ -375,37 +754,47 @@ func (downloader *Downloader) StartDownloading() {
 					}
 				}
 
-				if connectionMessage.Peer.Status != peer.DISCONNECTED {
-
-					numDownloading := downloader.PeersManager.CountDownloadingPeers()
+				// While seeding , other seeders are of no use to us.
+				if downloader.GetStatus() == SEEDING && connectionMessage.Peer.IsSeed() {
+					connectionMessage.Peer.Disconnect()
+					downloader.PeersManager.SetPeerAsDisconnected(connectionMessage.Peer)
+				}
 
-					if connectionMessage.Peer.PeerChoking {
-						go downloader.ScanForUnchoke(connectionMessage.Peer)
-					} else {
-						if numDownloading < MAX_ACTIVE_REQUESTS {
-							go downloader.DownloadFromPeer(connectionMessage.Peer)
-						} else {
-							//connectionMessage.Peer.SendUninterested()
-						}
-					}
+				// From now on , the peer is handled by its own goroutine.
+				if connectionMessage.Peer.GetStatus() == peer.CONNECTED {
+					go downloader.handlePeer(connectionMessage.Peer)
 				}
 				downloader.PeersManager.SetPeerAsAlive(connectionMessage.Peer)
 			}
 		}
 	}
 
-	downloader.requestPeers(tracker.DOWNLOAD_COMPLETED)
-
-	downloader.Status = COMPLETED
 	ticker.Stop()
 	reconnectTicker.Stop()
 	keepAliveTicker.Stop()
-	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Download completeted in %.2f seconds, with average speed %.2f KB/s\n", time.Since(startedTime).Seconds(), float64(downloader.Downloaded)/time.Since(startedTime).Seconds()/1024.0))
+	seedTicker.Stop()
+	chokeTicker.Stop()
+	resumeTicker.Stop()
+	dhtTicker.Stop()
+	pexTicker.Stop()
+	lsdTicker.Stop()
+
+	for _, connectedPeer := range downloader.PeersManager.GetConnectedPeers() {
+		connectedPeer.Disconnect()
+		downloader.PeersManager.SetPeerAsDisconnected(connectedPeer)
+	}
+	if err := downloader.saveResumeData(); err != nil {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't save the resume data:", err)
+	}
+	downloader.stopDHT()
+	downloader.stopLSD()
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Stopped after %.2f seconds, uploaded %.2f MB", time.Since(startedTime).Seconds(), float64(atomic.LoadInt64(&downloader.Uploaded))/1024.0/1024.0))
 	return
 }
 
 // New returns a Downloader from a torrent file.
-func New(torrent_path string) *Downloader {
+// The encryption policy , one of the mse constants , applies to all the connections , from the start.
+func New(torrent_path string, encryption int) *Downloader {
 	data, err := ioutil.ReadFile(torrent_path)
 	if err != nil {
 		panic(err)
@@ -420,31 +809,115 @@ func New(torrent_path string) *Downloader {
 		panic(err)
 	}
 
-	file_bitfield := bitfield.New(int(torrentInfo.FileInformations.PieceCount))
 	peerId := createPeerId()
+	return newDownloader(torrentInfo, peerId, local_server.New(peerId, encryption))
+}
+
+// NewFromMagnet returns a Downloader from a magnet link.
+// The info dictionary is fetched from the peers first. If torrentPath is not empty,
+// the torrent file rebuilt from it is saved there.
+// Unless the DHT is disabled , the peers are also looked up in the DHT , which finds them for the links without trackers.
+// The encryption policy applies to the connections which fetch the metadata too.
+func NewFromMagnet(uri string, torrentPath string, dhtSettings DHTSettings, encryption int) (*Downloader, error) {
+
+	link, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	peerId := createPeerId()
+	localServer := local_server.New(peerId, encryption)
+	var node *dht.DHT
+	shared := false
+	if dhtSettings.Enabled {
+		if node, shared, err = listenDHT(localServer, dhtSettings); err != nil {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't start the DHT:", err)
+		} else if err := node.Bootstrap(); err != nil {
+			fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't bootstrap the DHT:", err)
+		}
+	}
+	fail := func(err error) (*Downloader, error) {
+		if node != nil {
+			closeDHT(node, shared, localServer)
+		}
+		localServer.Close()
+		return nil, err
+	}
+
+	info, address, err := link.FetchMetadata(peerId, localServer.Port, METADATA_TIMEOUT, node, encryption)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Got metadata from", address)
+
+	torrent, err := link.BuildTorrent(info)
+	if err != nil {
+		return fail(err)
+	}
+	if torrentPath != "" {
+		if err := ioutil.WriteFile(torrentPath, torrent.Encode(), 0666); err != nil {
+			return fail(err)
+		}
+	}
+
+	torrentInfo, err := torrent_info.GetInfoFromBencoder(torrent)
+	if err != nil {
+		return fail(err)
+	}
+
+	downloader := newDownloader(torrentInfo, peerId, localServer)
+	downloader.knownPeers = append(downloader.knownPeers, address)
+	downloader.knownPeers = append(downloader.knownPeers, link.Peers...)
+
+	// The node keeps running for the download.
+	downloader.DHT = dhtSettings
+	downloader.dhtNode = node
+	downloader.dhtShared = shared
+	return downloader, nil
+}
+
+// newDownloader returns a Downloader for the torrent , which accepts peers on the local server.
+func newDownloader(torrentInfo *torrent_info.TorrentInfo, peerId string, localServer *local_server.LocalServer) *Downloader {
+
+	filePriorities := make([]int, len(torrentInfo.FileInformations.Files))
+	for fileIndex := range filePriorities {
+		filePriorities[fileIndex] = file_writer.PRIORITY_NORMAL
+	}
 	downloader := &Downloader{
 		TorrentInfo: *torrentInfo,
 		PeerId:      peerId,
-		Bitfield:    &file_bitfield,
+		Bitfield:    bitfield.NewShared(int(torrentInfo.FileInformations.PieceCount)),
 
-		PiecesManager: piece_manager.New(torrentInfo),
-		PeersManager:  peer_manager.New(),
+		PiecesManager:  piece_manager.New(torrentInfo),
+		PeersManager:   peer_manager.New(),
+		Choker:         choker.New(choker.TitForTat{}, choker.DEFAULT_UPLOAD_SLOTS),
+		DHT:            DHTSettings{Enabled: true},
+		LocalDiscovery: true,
+		Encryption:     localServer.Encryption,
+		FilePriorities: filePriorities,
 
 		connectionChan: make(chan peer.ConnectionCommunication),
-		Status:         NOT_COMPLETED,
 	}
-	downloader.LocalServer = local_server.New(peerId)
-	downloader.Trackers = make([]tracker.Tracker, 1)
-
-	mainTracker := tracker.New(torrentInfo.AnnounceUrl, torrentInfo, downloader.LocalServer.Port, peerId)
-	downloader.Trackers[0] = mainTracker
-
-	for _, announcerUrl := range torrentInfo.AnnounceList {
-		tracker := tracker.New(announcerUrl, torrentInfo, downloader.LocalServer.Port, peerId)
-		if tracker.AnnounceUrl != mainTracker.AnnounceUrl {
-			downloader.Trackers = append(downloader.Trackers, tracker)
-		}
+	downloader.LocalServer = localServer
+
+	// We send the info dictionary to the peers which started from a magnet link.
+	downloader.Extensions = peer.NewExtensionRegistry(localServer.Port)
+	downloader.Extensions.Register(magnet.UT_METADATA, magnet.ServeMetadata(torrentInfo.InfoBytes))
+	downloader.Extensions.SetMetadataSize(len(torrentInfo.InfoBytes))
+	if torrentInfo.FileInformations.Private != 1 {
+		handler, forget := pex.Handler(downloader.addPexPeer)
+		downloader.Extensions.Register(pex.UT_PEX, handler)
+		downloader.Extensions.OnDisconnect(forget)
 	}
+
+	downloader.LocalServer.AddTorrent(&local_server.Torrent{
+		TorrentInfo:    torrentInfo,
+		Bitfield:       downloader.Bitfield,
+		ConnectionChan: downloader.connectionChan,
+		Availability:   downloader.PiecesManager,
+		Extensions:     downloader.Extensions,
+	})
+	downloader.Trackers = tracker.NewTiers(torrentInfo, downloader.LocalServer.Port, peerId)
 	return downloader
 }
 
@@ -0,0 +1,40 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedingGoalReached(t *testing.T) {
+	tests := []struct {
+		name             string
+		settings         SeedSettings
+		previousUploaded int64
+		uploaded         int64
+		seedingUploaded  int64
+		seededFor        time.Duration
+		idleFor          time.Duration
+		expected         bool
+	}{
+		{"no goal", SeedSettings{Enabled: true}, 0, 5000, 0, time.Hour, time.Hour, false},
+		{"ratio not reached", SeedSettings{Ratio: 2}, 0, 1999, 1999, 0, 0, false},
+		{"ratio reached", SeedSettings{Ratio: 2}, 0, 2000, 2000, 0, 0, true},
+		{"ratio reached with the previous runs", SeedSettings{Ratio: 2}, 1500, 500, 500, 0, 0, true},
+		{"duration not reached", SeedSettings{Duration: time.Hour}, 0, 0, 0, 59 * time.Minute, 0, false},
+		{"duration reached", SeedSettings{Duration: time.Hour}, 0, 0, 0, time.Hour, 0, true},
+		{"idle not reached", SeedSettings{IdleTime: 10 * time.Minute}, 0, 100, 100, time.Hour, 9 * time.Minute, false},
+		{"idle reached", SeedSettings{IdleTime: 10 * time.Minute}, 0, 100, 100, time.Hour, 10 * time.Minute, true},
+		{"upload since the last check resets the idle time", SeedSettings{IdleTime: 10 * time.Minute}, 0, 200, 100, time.Hour, time.Hour, false},
+		{"any goal is enough", SeedSettings{Ratio: 10, Duration: time.Hour, IdleTime: 10 * time.Minute}, 0, 100, 100, time.Minute, 10 * time.Minute, true},
+	}
+	for _, test := range tests {
+		downloader := &Downloader{Seeding: test.settings, PreviousUploaded: test.previousUploaded, Uploaded: test.uploaded}
+		downloader.TorrentInfo.FileInformations.TotalLength = 1000
+		downloader.seedingUploaded = test.seedingUploaded
+		downloader.seedingStarted = time.Now().Add(-test.seededFor)
+		downloader.lastUploadTime = time.Now().Add(-test.idleFor)
+		if reached := downloader.seedingGoalReached(); reached != test.expected {
+			t.Errorf("%s : expected %t , got %t", test.name, test.expected, reached)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package downloader
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bbpcr/Yomato/lsd"
+)
+
+// startLSD starts announcing the torrent on the local network , and listening for the peers which do the same.
+// The peers of private torrents must only come from their trackers , so the local discovery isn't used for them.
+func (downloader *Downloader) startLSD() {
+
+	if !downloader.LocalDiscovery || downloader.TorrentInfo.FileInformations.Private == 1 {
+		return
+	}
+
+	service := lsd.New(downloader.LocalServer.Port)
+	service.AddTorrent(downloader.TorrentInfo.InfoHash, downloader.addLocalPeer)
+	if err := service.Start(); err != nil {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Couldn't start the local discovery:", err)
+		return
+	}
+	downloader.lsdService = service
+	downloader.announceLocally()
+}
+
+// addLocalPeer adds a peer found on the local network. It is preferred to the others,
+// even if we already knew it from somewhere else.
+func (downloader *Downloader) addLocalPeer(address string) {
+	localPeer := downloader.newPeerFromAddress(address)
+	if localPeer == nil {
+		return
+	}
+	downloader.PeersManager.SetPeerAsLocal(localPeer)
+	if downloader.addPeer(localPeer) {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Found local peer", address)
+	}
+}
+
+// announceLocally announces the torrent on the local network.
+func (downloader *Downloader) announceLocally() {
+	if downloader.lsdService == nil {
+		return
+	}
+	if err := downloader.lsdService.Announce(); err != nil {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), err)
+	}
+}
+
+// stopLSD stops announcing the torrent on the local network.
+func (downloader *Downloader) stopLSD() {
+	if downloader.lsdService == nil {
+		return
+	}
+	downloader.lsdService.Close()
+}
@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/pex"
+)
+
+// getPexContact returns how a connected peer is sent to the others in ut_pex messages.
+// The peers which connected to us are reachable on the port they told us in the extended handshake,
+// the ones which didn't tell us aren't sent.
+func getPexContact(connectedPeer *peer.Peer) (pex.Contact, bool) {
+	port := connectedPeer.DialPort()
+	if port == 0 {
+		return pex.Contact{}, false
+	}
+	contact := pex.Contact{Address: net.JoinHostPort(connectedPeer.IP, strconv.Itoa(port))}
+	if connectedPeer.IsSeed() {
+		contact.Flags |= pex.FLAG_SEED
+	}
+	if connectedPeer.IsEncrypted() {
+		contact.Flags |= pex.FLAG_ENCRYPTION
+	}
+	if connectedPeer.IsUTPSupported() {
+		contact.Flags |= pex.FLAG_UTP
+	}
+	return contact, true
+}
+
+// addPexPeer adds a peer sent by one of the connected peers , like the ones from the trackers.
+// The peers flagged as supporting uTP are connected over uTP first.
+func (downloader *Downloader) addPexPeer(contact pex.Contact) {
+	newPeer := downloader.newPeerFromAddress(contact.Address)
+	if newPeer == nil {
+		return
+	}
+	newPeer.SupportsUTP = contact.Flags&pex.FLAG_UTP != 0
+	downloader.addPeer(newPeer)
+}
+
+// exchangePeers sends to the connected peers which support ut_pex the peers we connected to
+// and the ones we dropped , since the previous message.
+// The peers of private torrents must only come from their trackers , so they are never exchanged.
+func (downloader *Downloader) exchangePeers() {
+
+	if downloader.TorrentInfo.FileInformations.Private == 1 {
+		return
+	}
+
+	connectedPeers := downloader.PeersManager.GetConnectedPeers()
+	contacts := make([]pex.Contact, 0, len(connectedPeers))
+	for _, connectedPeer := range connectedPeers {
+		if contact, reachable := getPexContact(connectedPeer); reachable {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	states := make(map[*peer.Peer]*pex.State)
+	for index, connectedPeer := range connectedPeers {
+		if connectedPeer.GetStatus() != peer.CONNECTED || !connectedPeer.SupportsExtension(pex.UT_PEX) {
+			continue
+		}
+		state, hasState := downloader.pexStates[connectedPeer]
+		if !hasState {
+			state = pex.NewState()
+		}
+		states[connectedPeer] = state
+
+		// A peer isn't told about itself.
+		others := make([]pex.Contact, 0, len(contacts)-1)
+		others = append(others, contacts[:index]...)
+		others = append(others, contacts[index+1:]...)
+		if message := state.Update(others); message != nil {
+			connectedPeer.SendExtended(pex.UT_PEX, message.Encode())
+		}
+	}
+
+	// The peers which disconnected start over , if they connect again.
+	downloader.pexStates = states
+}
@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/resume_data"
+)
+
+const RESUME_SAVE_DURATION = 60 * time.Second
+
+// resumePath returns the path of the resume file , which is kept next to the download.
+func (downloader *Downloader) resumePath() string {
+	return filepath.Join(downloader.fileWriter.Root, "."+downloader.TorrentInfo.FileInformations.RootPath+".resume")
+}
+
+// getFileState returns the state of the file where the bytes of the file fileIndex are stored.
+// A file which doesn't exist has an empty state.
+func (downloader *Downloader) getFileState(fileIndex int) resume_data.FileState {
+	state, err := resume_data.GetFileState(downloader.fileWriter.GetFilePath(fileIndex))
+	if err != nil {
+		return resume_data.FileState{}
+	}
+	return state
+}
+
+// saveResumeData writes the state of the download in the resume file.
+// The pieces are saved before the files are stat-ed , so if a file is written in the meantime
+// its modification time won't match and its pieces are checked again when resuming.
+func (downloader *Downloader) saveResumeData() error {
+
+	data := &resume_data.ResumeData{
+		InfoHash:   downloader.TorrentInfo.InfoHash,
+		Bitfield:   downloader.Bitfield.Encode(),
+		Uploaded:   downloader.PreviousUploaded + atomic.LoadInt64(&downloader.Uploaded),
+		Downloaded: downloader.PreviousDownloaded + atomic.LoadInt64(&downloader.Downloaded),
+	}
+
+	for pieceIndex, downloaded := range downloader.PiecesManager.GetPartialPieces() {
+		blocks := bitfield.New(len(downloaded))
+		for block, isDownloaded := range downloaded {
+			blocks.Set(block, isDownloaded)
+		}
+		data.PartialPieces = append(data.PartialPieces, resume_data.PartialPiece{PieceIndex: pieceIndex, Blocks: blocks.Encode()})
+	}
+
+	// The peers which connected to us and didn't tell us their port can't be connected to later.
+	for _, alivePeer := range downloader.PeersManager.GetAlivePeers() {
+		if port := alivePeer.DialPort(); port > 0 {
+			data.Peers = append(data.Peers, net.JoinHostPort(alivePeer.IP, strconv.Itoa(port)))
+		}
+	}
+
+	for fileIndex := range downloader.TorrentInfo.FileInformations.Files {
+		data.Files = append(data.Files, downloader.getFileState(fileIndex))
+	}
+
+	return data.Save(downloader.resumePath())
+}
+
+// loadResumeData restores the state of the download from the resume file.
+// The saved pieces are trusted for the files whose size and modification time didn't change,
+// the pieces of the other files are checked again.
+// It returns false if there is no usable resume data , and all the pieces must be checked.
+func (downloader *Downloader) loadResumeData() bool {
+
+	data, err := resume_data.Load(downloader.resumePath())
+	if err != nil {
+		return false
+	}
+
+	files := downloader.TorrentInfo.FileInformations.Files
+	pieceCount := int(downloader.TorrentInfo.FileInformations.PieceCount)
+	savedBitfield := bitfield.New(pieceCount)
+	if !data.Matches(downloader.TorrentInfo.InfoHash) || len(data.Files) != len(files) || len(data.Bitfield) != len(savedBitfield.Encode()) {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Resume data doesn't match the torrent")
+		return false
+	}
+	savedBitfield.Put(data.Bitfield, len(data.Bitfield))
+
+	changedFiles := make([]bool, len(files))
+	numChanged := 0
+	for fileIndex := range files {
+		if downloader.getFileState(fileIndex) != data.Files[fileIndex] {
+			changedFiles[fileIndex] = true
+			numChanged++
+		}
+	}
+	if numChanged == len(files) {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "All the files changed since the resume data was saved")
+		return false
+	}
+
+	pieceChanged := func(pieceIndex int) bool {
+		for _, fileIndex := range downloader.fileWriter.GetPieceFiles(pieceIndex) {
+			if changedFiles[fileIndex] {
+				return true
+			}
+		}
+		return false
+	}
+
+	startTime := time.Now()
+	missing, rechecked := 0, 0
+	for pieceIndex := 0; pieceIndex < pieceCount; pieceIndex++ {
+		havePiece := savedBitfield.At(pieceIndex)
+		if pieceChanged(pieceIndex) {
+			havePiece = downloader.fileWriter.CheckSha1Sum(int64(pieceIndex))
+			rechecked++
+		}
+		if havePiece {
+			downloader.PiecesManager.RemovePieceFromDownload(pieceIndex, &downloader.TorrentInfo)
+			downloader.Bitfield.Set(pieceIndex, true)
+		} else {
+			missing++
+		}
+	}
+
+	for _, partialPiece := range data.PartialPieces {
+		if partialPiece.PieceIndex < 0 || partialPiece.PieceIndex >= pieceCount || downloader.Bitfield.At(partialPiece.PieceIndex) || pieceChanged(partialPiece.PieceIndex) {
+			continue
+		}
+		blocks := bitfield.New(len(partialPiece.Blocks) * 8)
+		blocks.Put(partialPiece.Blocks, len(partialPiece.Blocks))
+		downloaded := make([]bool, blocks.Length)
+		for block := range downloaded {
+			downloaded[block] = blocks.At(block)
+		}
+		downloader.PiecesManager.SetDownloadedBlocks(partialPiece.PieceIndex, downloaded)
+	}
+
+	downloader.PreviousUploaded = data.Uploaded
+	downloader.PreviousDownloaded = data.Downloaded
+	downloader.knownPeers = append(downloader.knownPeers, data.Peers...)
+
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Resumed download,", numChanged, "files changed ,", rechecked, "pieces checked in", fmt.Sprintf("%.2fs", time.Since(startTime).Seconds()))
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), "Have", missing, "missing pieces")
+	return true
+}
+
+// connectKnownPeers connects to the peers we knew before asking the trackers,
+// from the previous run or from the magnet link.
+func (downloader *Downloader) connectKnownPeers() {
+	numPeers := 0
+	for _, address := range downloader.knownPeers {
+		if downloader.addPeerAddress(address) {
+			numPeers++
+		}
+	}
+	downloader.knownPeers = nil
+	if numPeers > 0 {
+		fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Connecting to %d known peers", numPeers))
+	}
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/file_writer"
+	"github.com/bbpcr/Yomato/peer_manager"
+	"github.com/bbpcr/Yomato/piece_manager"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+// newTestDownloader returns a downloader whose files are in root , without any connection.
+// The torrent has 3 files : a of 10 bytes , b of 20 bytes and c of 10 bytes , in pieces of 16 bytes,
+// so the piece 0 has the bytes of a and b , the piece 1 of b and c , and the piece 2 of c.
+// None of the pieces matches its hash.
+func newTestDownloader(root string) *Downloader {
+	var torrentInfo torrent_info.TorrentInfo
+	torrentInfo.InfoHash = bytes.Repeat([]byte{0x08}, 20)
+	torrentInfo.FileInformations.MultipleFiles = true
+	torrentInfo.FileInformations.RootPath = "root"
+	torrentInfo.FileInformations.PieceLength = 16
+	torrentInfo.FileInformations.PieceCount = 3
+	torrentInfo.FileInformations.TotalLength = 40
+	torrentInfo.FileInformations.Pieces = bytes.Repeat([]byte{0xab}, 3*20)
+	torrentInfo.FileInformations.Files = []torrent_info.SingleFileInfo{
+		{Name: "a", Length: 10},
+		{Name: "b", Length: 20},
+		{Name: "c", Length: 10},
+	}
+	return &Downloader{
+		TorrentInfo:   torrentInfo,
+		Bitfield:      bitfield.NewShared(3),
+		PiecesManager: piece_manager.New(&torrentInfo),
+		PeersManager:  peer_manager.New(),
+		fileWriter:    file_writer.New(root, torrentInfo, nil),
+	}
+}
+
+func TestLoadResumeData(t *testing.T) {
+	tests := []struct {
+		changedFiles []string
+		expected     []bool
+	}{
+		{nil, []bool{true, true, true}},
+		{[]string{"a"}, []bool{false, true, true}},
+		{[]string{"b"}, []bool{false, false, true}},
+		{[]string{"c"}, []bool{true, false, false}},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+
+		// The resume data says we have all the pieces , though their hashes don't match.
+		saved := newTestDownloader(root)
+		for pieceIndex := 0; pieceIndex < 3; pieceIndex++ {
+			saved.Bitfield.Set(pieceIndex, true)
+		}
+		if err := saved.saveResumeData(); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		saved.fileWriter.CloseFiles()
+
+		// Only the pieces of the changed files are checked , and found missing.
+		for _, name := range test.changedFiles {
+			modTime := time.Now().Add(time.Hour)
+			if err := os.Chtimes(filepath.Join(root, "root", name), modTime, modTime); err != nil {
+				t.Fatalf("Got error: %s", err)
+			}
+		}
+		resumed := newTestDownloader(root)
+		if !resumed.loadResumeData() {
+			t.Fatalf("%v : the resume data wasn't used", test.changedFiles)
+		}
+		resumed.fileWriter.CloseFiles()
+		for pieceIndex, expected := range test.expected {
+			if resumed.Bitfield.At(pieceIndex) != expected {
+				t.Errorf("%v : expected to have the piece %d : %t", test.changedFiles, pieceIndex, expected)
+			}
+		}
+	}
+
+	// When all the files changed , the resume data is useless.
+	root := t.TempDir()
+	saved := newTestDownloader(root)
+	if err := saved.saveResumeData(); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	saved.fileWriter.CloseFiles()
+	for _, name := range []string{"a", "b", "c"} {
+		modTime := time.Now().Add(time.Hour)
+		os.Chtimes(filepath.Join(root, "root", name), modTime, modTime)
+	}
+	resumed := newTestDownloader(root)
+	defer resumed.fileWriter.CloseFiles()
+	if resumed.loadResumeData() {
+		t.Errorf("Expected the resume data not to be used when all the files changed")
+	}
+}
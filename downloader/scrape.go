@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+	"github.com/bbpcr/Yomato/magnet"
+	"github.com/bbpcr/Yomato/torrent_info"
+	"github.com/bbpcr/Yomato/tracker"
+)
+
+// The trackers are asked about the swarm every SCRAPE_DURATION.
+const SCRAPE_DURATION = 5 * time.Minute
+
+// scrapeTrackers asks the trackers about the swarm of the torrent , and keeps the biggest swarm they know.
+func (downloader *Downloader) scrapeTrackers() {
+	var swarm tracker.ScrapeResult
+	for _, torrentTracker := range downloader.Trackers.Trackers() {
+		results, err := torrentTracker.Scrape()
+		if err != nil || len(results) == 0 {
+			continue
+		}
+		if results[0].Complete+results[0].Incomplete > swarm.Complete+swarm.Incomplete {
+			swarm = results[0]
+		}
+	}
+	downloader.swarmLocker.Lock()
+	downloader.swarm = swarm
+	downloader.swarmLocker.Unlock()
+}
+
+// getSwarm returns what the trackers know about the swarm of the torrent.
+func (downloader *Downloader) getSwarm() tracker.ScrapeResult {
+	downloader.swarmLocker.Lock()
+	defer downloader.swarmLocker.Unlock()
+	return downloader.swarm
+}
+
+// Scrape asks the trackers of the torrent file or magnet link at path about its swarm , without announcing us.
+// The answer of each tracker is printed.
+func Scrape(path string) error {
+
+	var infoHash []byte
+	var announceUrls []string
+	if strings.HasPrefix(path, "magnet:") {
+		link, err := magnet.Parse(path)
+		if err != nil {
+			return err
+		}
+		infoHash = link.InfoHash
+		announceUrls = link.Trackers
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		decoded, _, err := bencode.Parse(data)
+		if err != nil {
+			return err
+		}
+		torrentInfo, err := torrent_info.GetInfoFromBencoder(decoded)
+		if err != nil {
+			return err
+		}
+		infoHash = torrentInfo.InfoHash
+		announceUrls = []string{torrentInfo.AnnounceUrl}
+		for _, tier := range torrentInfo.AnnounceList {
+			announceUrls = append(announceUrls, tier...)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, announceUrl := range announceUrls {
+		if announceUrl == "" || known[announceUrl] {
+			continue
+		}
+		known[announceUrl] = true
+		results, err := tracker.New(announceUrl, &torrent_info.TorrentInfo{InfoHash: infoHash}, 0, createPeerId()).Scrape()
+		if err == nil && len(results) == 0 {
+			err = errors.New("Torrent not known by the tracker")
+		}
+		if err != nil {
+			fmt.Println(announceUrl, ":", err)
+			continue
+		}
+		fmt.Println(announceUrl, ":", results[0].GetInfo())
+	}
+	if len(known) == 0 {
+		return errors.New("The torrent has no trackers")
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package file_writer
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"github.com/bbpcr/Yomato/torrent_info"
 	"os"
 	"path/filepath"
@@ -15,15 +16,72 @@ type PieceData struct {
 	Piece       []byte
 }
 
+const (
+	PRIORITY_SKIP = iota
+	PRIORITY_LOW
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+// PriorityByName returns the priority with the given name : skip , low , normal or high.
+func PriorityByName(name string) (int, error) {
+	switch name {
+	case "skip":
+		return PRIORITY_SKIP, nil
+	case "low":
+		return PRIORITY_LOW, nil
+	case "normal":
+		return PRIORITY_NORMAL, nil
+	case "high":
+		return PRIORITY_HIGH, nil
+	}
+	return 0, errors.New("Unknown priority " + name)
+}
+
 // Writes torrent pieces to a file, as needed.
 type Writer struct {
 	Root        string
 	TorrentInfo torrent_info.TorrentInfo
+	Priorities  []int
 	filesArray  []*os.File
+	fileOffsets []int64
+	partFile    *os.File
 	fLocker     sync.Mutex
 }
 
-func New(root string, torrent torrent_info.TorrentInfo) *Writer {
+// GetTorrentOffset returns the offset in the whole torrent of the byte found at fileOffset in the file fileIndex.
+// The files are laid one after another , in the order from the torrent.
+func GetTorrentOffset(torrent torrent_info.TorrentInfo, fileIndex int, fileOffset int64) (int64, error) {
+
+	if fileIndex < 0 || fileIndex >= len(torrent.FileInformations.Files) {
+		return 0, errors.New("Invalid file index")
+	}
+	if fileOffset < 0 || fileOffset >= torrent.FileInformations.Files[fileIndex].Length {
+		return 0, errors.New("Invalid file offset")
+	}
+
+	offset := fileOffset
+	for index := 0; index < fileIndex; index++ {
+		offset += torrent.FileInformations.Files[index].Length
+	}
+	return offset, nil
+}
+
+// GetPieceAt returns the index of the piece containing the byte found at fileOffset in the file fileIndex.
+func GetPieceAt(torrent torrent_info.TorrentInfo, fileIndex int, fileOffset int64) (int, error) {
+
+	offset, err := GetTorrentOffset(torrent, fileIndex, fileOffset)
+	if err != nil {
+		return 0, err
+	}
+	return int(offset / torrent.FileInformations.PieceLength), nil
+}
+
+// New opens (and creates if needed) the files of the torrent in root.
+// priorities has the priority of every file. Files with PRIORITY_SKIP are never created,
+// the bytes of their pieces which we still need are stored in the part file.
+// If priorities is nil , all the files are created.
+func New(root string, torrent torrent_info.TorrentInfo, priorities []int) *Writer {
 	err := os.MkdirAll(root, 0777)
 	if err != nil {
 		panic(err)
@@ -32,6 +90,7 @@ func New(root string, torrent torrent_info.TorrentInfo) *Writer {
 	writer := &Writer{
 		Root:        root,
 		TorrentInfo: torrent,
+		Priorities:  priorities,
 	}
 	var folderPath string = ""
 
@@ -43,76 +102,124 @@ func New(root string, torrent torrent_info.TorrentInfo) *Writer {
 		}
 	}
 
-	for _, fileData := range writer.TorrentInfo.FileInformations.Files {
+	fileOffset := int64(0)
+	for index, fileData := range writer.TorrentInfo.FileInformations.Files {
+		writer.fileOffsets = append(writer.fileOffsets, fileOffset)
+		fileOffset += fileData.Length
+
+		if writer.IsSkipped(index) {
+			writer.filesArray = append(writer.filesArray, nil)
+			continue
+		}
 		fullFilepath := filepath.Join(writer.Root, folderPath, fileData.Name)
 		err := os.MkdirAll(filepath.Dir(fullFilepath), 0777)
 		if err != nil {
 			panic(err)
 		}
 		file, err := os.OpenFile(fullFilepath, os.O_RDWR|os.O_CREATE, 0666)
-		file.Truncate(fileData.Length)
 		if err != nil {
 			panic(err)
 		}
+		// Truncating changes the modification time even if the size stays the same,
+		// and that would make the resume data useless.
+		if info, err := file.Stat(); err != nil || info.Size() != fileData.Length {
+			file.Truncate(fileData.Length)
+		}
 		writer.filesArray = append(writer.filesArray, file)
 	}
 	return writer
 }
 
-func (writer *Writer) CheckSha1Sum(pieceIndex int64) bool {
+// IsSkipped tells if the file with the given index is not downloaded.
+func (writer *Writer) IsSkipped(fileIndex int) bool {
+	return writer.Priorities != nil && writer.Priorities[fileIndex] == PRIORITY_SKIP
+}
 
-	pieceLength := writer.TorrentInfo.FileInformations.PieceLength
-	if pieceIndex == writer.TorrentInfo.FileInformations.PieceCount-1 {
-		pieceLength = writer.TorrentInfo.FileInformations.TotalLength % writer.TorrentInfo.FileInformations.PieceLength
-		if pieceLength == 0 {
-			pieceLength = writer.TorrentInfo.FileInformations.PieceLength
-		}
+// GetPartFilePath returns the path of the file which stores the bytes of the skipped files.
+func (writer *Writer) GetPartFilePath() string {
+	return filepath.Join(writer.Root, "."+writer.TorrentInfo.FileInformations.RootPath+".parts")
+}
+
+// GetFilePath returns the path where the bytes of the file fileIndex are stored.
+// For the skipped files , that is the part file.
+func (writer *Writer) GetFilePath(fileIndex int) string {
+	if writer.IsSkipped(fileIndex) {
+		return writer.GetPartFilePath()
 	}
+	folderPath := ""
+	if writer.TorrentInfo.FileInformations.MultipleFiles {
+		folderPath = writer.TorrentInfo.FileInformations.RootPath
+	}
+	return filepath.Join(writer.Root, folderPath, writer.TorrentInfo.FileInformations.Files[fileIndex].Name)
+}
 
-	offset := pieceIndex * writer.TorrentInfo.FileInformations.PieceLength
-	// search the right file and offset
-	var currentFileIndex int = 0
-	for index, _ := range writer.filesArray {
-		if writer.TorrentInfo.FileInformations.Files[index].Length > offset {
-			currentFileIndex = index
-			break
-		} else {
-			offset -= writer.TorrentInfo.FileInformations.Files[index].Length
+// GetPieceFiles returns the indexes of the files which have bytes in the piece pieceIndex.
+func (writer *Writer) GetPieceFiles(pieceIndex int) []int {
+	pieceStart := int64(pieceIndex) * writer.TorrentInfo.FileInformations.PieceLength
+	pieceEnd := pieceStart + writer.TorrentInfo.FileInformations.PieceLength
+	var files []int
+	for index, fileData := range writer.TorrentInfo.FileInformations.Files {
+		fileStart := writer.fileOffsets[index]
+		if fileStart < pieceEnd && fileStart+fileData.Length > pieceStart {
+			files = append(files, index)
 		}
 	}
-	bytesToRead := pieceLength
+	return files
+}
 
-	buffer := make([]byte, 32*1024)
-	computedHash := sha1.New()
+// getFile returns the file where the bytes of the file fileIndex are stored , and the offset of fileOffset in it.
+// The bytes of the skipped files are stored in the part file , at their offset in the torrent.
+// The part file is created only when something needs to be written in it , and the one left by
+// a previous run is opened when it is first needed.
+// This must be called with fLocker locked.
+func (writer *Writer) getFile(fileIndex int, fileOffset int64, create bool) (*os.File, int64, error) {
 
-	writer.filesArray[currentFileIndex].Seek(offset, 0)
+	if !writer.IsSkipped(fileIndex) {
+		return writer.filesArray[fileIndex], fileOffset, nil
+	}
 
-	for bytesToRead > 0 {
-		writer.fLocker.Lock()
-		var n int
-		if bytesToRead < 32*1024 {
-			n, _ = writer.filesArray[currentFileIndex].Read(buffer[:bytesToRead])
-		} else {
-			n, _ = writer.filesArray[currentFileIndex].Read(buffer)
+	if writer.partFile == nil {
+		flags := os.O_RDWR
+		if create {
+			flags |= os.O_CREATE
 		}
-		writer.fLocker.Unlock()
-		readed := int64(n)
-		if readed != 0 {
-			bytesToRead -= readed
-			offset += readed
-		} else {
-			break
+		file, err := os.OpenFile(writer.GetPartFilePath(), flags, 0666)
+		if err != nil {
+			return nil, 0, err
 		}
-		computedHash.Write(buffer[:readed])
-		if offset >= writer.TorrentInfo.FileInformations.Files[currentFileIndex].Length {
-			currentFileIndex++
-			offset = 0
-			if currentFileIndex < len(writer.filesArray) {
-				writer.filesArray[currentFileIndex].Seek(offset, 0)
-			}
+		writer.partFile = file
+	}
+	return writer.partFile, writer.fileOffsets[fileIndex] + fileOffset, nil
+}
+
+// findFile returns the index of the file where the torrent offset is found , and the offset in that file.
+func (writer *Writer) findFile(offset int64) (int, int64) {
+	for index, fileData := range writer.TorrentInfo.FileInformations.Files {
+		if fileData.Length > offset {
+			return index, offset
 		}
+		offset -= fileData.Length
 	}
+	return len(writer.TorrentInfo.FileInformations.Files), offset
+}
 
+func (writer *Writer) CheckSha1Sum(pieceIndex int64) bool {
+
+	pieceLength := writer.TorrentInfo.FileInformations.PieceLength
+	if pieceIndex == writer.TorrentInfo.FileInformations.PieceCount-1 {
+		pieceLength = writer.TorrentInfo.FileInformations.TotalLength % writer.TorrentInfo.FileInformations.PieceLength
+		if pieceLength == 0 {
+			pieceLength = writer.TorrentInfo.FileInformations.PieceLength
+		}
+	}
+
+	data, err := writer.ReadBlock(int(pieceIndex), 0, int(pieceLength))
+	if err != nil {
+		return false
+	}
+
+	computedHash := sha1.New()
+	computedHash.Write(data)
 	hash := writer.TorrentInfo.FileInformations.Pieces[pieceIndex*20 : (pieceIndex+1)*20]
 	return bytes.Equal(hash, computedHash.Sum(nil))
 }
@@ -121,7 +228,12 @@ func (writer *Writer) CloseFiles() {
 	writer.fLocker.Lock()
 	defer writer.fLocker.Unlock()
 	for _, file := range writer.filesArray {
-		file.Close()
+		if file != nil {
+			file.Close()
+		}
+	}
+	if writer.partFile != nil {
+		writer.partFile.Close()
 	}
 }
 
@@ -129,36 +241,68 @@ func (writer *Writer) WritePiece(data PieceData) {
 	offset := int64(data.PieceNumber)*writer.TorrentInfo.FileInformations.PieceLength + int64(data.Offset)
 
 	// search the right file and offset
-	var currentFileIndex int = 0
+	currentFileIndex, offset := writer.findFile(offset)
+
+	bytesToWrite := int64(len(data.Piece))
 
-	for index, _ := range writer.filesArray {
-		if writer.TorrentInfo.FileInformations.Files[index].Length > offset {
-			currentFileIndex = index
-			break
-		} else {
-			offset -= writer.TorrentInfo.FileInformations.Files[index].Length
+	for ; bytesToWrite > 0 && currentFileIndex < len(writer.filesArray); currentFileIndex++ {
+
+		bucketSize := writer.TorrentInfo.FileInformations.Files[currentFileIndex].Length - offset
+		if bytesToWrite < bucketSize {
+			bucketSize = bytesToWrite
+		}
+
+		writer.fLocker.Lock()
+		file, fileOffset, err := writer.getFile(currentFileIndex, offset, true)
+		if err == nil {
+			file.WriteAt(data.Piece[:bucketSize], fileOffset)
 		}
+		writer.fLocker.Unlock()
+		bytesToWrite -= bucketSize
+		data.Piece = data.Piece[bucketSize:]
+		offset = 0
 	}
+}
 
-	bytesToWrite := int64(len(data.Piece))
+// ReadBlock reads length bytes of the piece pieceIndex , starting at offset in the piece.
+// The block can span multiple files , just like in WritePiece.
+func (writer *Writer) ReadBlock(pieceIndex int, offset int, length int) ([]byte, error) {
+	torrentOffset := int64(pieceIndex)*writer.TorrentInfo.FileInformations.PieceLength + int64(offset)
 
-	for ; bytesToWrite > 0; currentFileIndex++ {
+	if length <= 0 || torrentOffset+int64(length) > writer.TorrentInfo.FileInformations.TotalLength {
+		return nil, errors.New("Invalid block")
+	}
 
-		bucketSize := writer.TorrentInfo.FileInformations.Files[currentFileIndex].Length - offset
-		if bytesToWrite > bucketSize {
+	// search the right file and offset
+	currentFileIndex, fileOffset := writer.findFile(torrentOffset)
+
+	block := make([]byte, length)
+	bytesRead := int64(0)
 
-			writer.fLocker.Lock()
-			writer.filesArray[currentFileIndex].WriteAt(data.Piece[:bucketSize], offset)
-			writer.fLocker.Unlock()
-			bytesToWrite -= bucketSize
-			data.Piece = data.Piece[bucketSize:]
-			offset = 0
+	for bytesRead < int64(length) && currentFileIndex < len(writer.filesArray) {
 
-		} else {
-			writer.fLocker.Lock()
-			writer.filesArray[currentFileIndex].WriteAt(data.Piece, offset)
-			writer.fLocker.Unlock()
-			bytesToWrite = 0
+		bucketSize := writer.TorrentInfo.FileInformations.Files[currentFileIndex].Length - fileOffset
+		bytesToRead := int64(length) - bytesRead
+		if bytesToRead > bucketSize {
+			bytesToRead = bucketSize
+		}
+
+		writer.fLocker.Lock()
+		file, realOffset, err := writer.getFile(currentFileIndex, fileOffset, false)
+		if err == nil {
+			_, err = file.ReadAt(block[bytesRead:bytesRead+bytesToRead], realOffset)
 		}
+		writer.fLocker.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		bytesRead += bytesToRead
+		fileOffset = 0
+		currentFileIndex++
+	}
+
+	if bytesRead < int64(length) {
+		return nil, errors.New("Invalid block")
 	}
+	return block, nil
 }
@@ -0,0 +1,86 @@
+package file_writer
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+// testTorrent returns a torrent of 3 files in the folder root , with pieces of 16 bytes.
+// The piece 0 has the bytes of a and b , the piece 1 of b and c , and the piece 2 of c.
+func testTorrent() torrent_info.TorrentInfo {
+	var torrent torrent_info.TorrentInfo
+	torrent.FileInformations.MultipleFiles = true
+	torrent.FileInformations.RootPath = "root"
+	torrent.FileInformations.PieceLength = 16
+	torrent.FileInformations.PieceCount = 3
+	torrent.FileInformations.TotalLength = 40
+	torrent.FileInformations.Files = []torrent_info.SingleFileInfo{
+		{Name: "a", Length: 10},
+		{Name: "b", Length: 20},
+		{Name: "c", Length: 10},
+	}
+	return torrent
+}
+
+func TestSkippedFiles(t *testing.T) {
+	tests := []struct {
+		priorities []int
+		created    []bool
+	}{
+		{nil, []bool{true, true, true}},
+		{[]int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_NORMAL}, []bool{true, false, true}},
+		{[]int{PRIORITY_SKIP, PRIORITY_HIGH, PRIORITY_SKIP}, []bool{false, true, false}},
+		{[]int{PRIORITY_SKIP, PRIORITY_SKIP, PRIORITY_LOW}, []bool{false, false, true}},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		torrent := testTorrent()
+		content := make([]byte, torrent.FileInformations.TotalLength)
+		rand.New(rand.NewSource(1)).Read(content)
+
+		// Every piece is written , like the boundary pieces of the wanted files are.
+		writer := New(root, torrent, test.priorities)
+		for pieceIndex := 0; pieceIndex < 3; pieceIndex++ {
+			pieceEnd := (pieceIndex + 1) * 16
+			if pieceEnd > len(content) {
+				pieceEnd = len(content)
+			}
+			writer.WritePiece(PieceData{PieceNumber: pieceIndex, Piece: append([]byte{}, content[pieceIndex*16:pieceEnd]...)})
+		}
+		writer.CloseFiles()
+
+		for fileIndex, created := range test.created {
+			path := filepath.Join(root, "root", torrent.FileInformations.Files[fileIndex].Name)
+			if _, err := os.Stat(path); (err == nil) != created {
+				t.Errorf("%v : expected the file %d to be created : %t", test.priorities, fileIndex, created)
+			}
+		}
+		_, err := os.Stat(filepath.Join(root, ".root.parts"))
+		if skipsFiles := test.priorities != nil; (err == nil) != skipsFiles {
+			t.Errorf("%v : expected the part file : %t", test.priorities, skipsFiles)
+		}
+
+		// The bytes are read back after a restart , from the files and from the part file.
+		writer = New(root, torrent, test.priorities)
+		for pieceIndex := 0; pieceIndex < 3; pieceIndex++ {
+			for _, block := range [][2]int{{0, 16}, {4, 8}, {8, 8}} {
+				start, length := pieceIndex*16+block[0], block[1]
+				if start+length > len(content) {
+					continue
+				}
+				data, err := writer.ReadBlock(pieceIndex, block[0], length)
+				if err != nil {
+					t.Errorf("%v : got error %s for piece %d at %d", test.priorities, err, pieceIndex, block[0])
+				} else if !bytes.Equal(data, content[start:start+length]) {
+					t.Errorf("%v : wrong bytes for piece %d at %d", test.priorities, pieceIndex, block[0])
+				}
+			}
+		}
+		writer.CloseFiles()
+	}
+}
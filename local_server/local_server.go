@@ -1,52 +1,176 @@
-// Package local_server implements a http Server for handling each peer communication
+// Package local_server implements the listener which accepts incoming peer connections
 package local_server
 
 import (
-	"fmt"
 	"net"
-	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/mse"
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+	"github.com/bbpcr/Yomato/utp"
 )
 
+// Torrent describes a torrent served by the local server.
+// Peers which connect for it are sent on ConnectionChan, exactly like the outgoing ones.
+type Torrent struct {
+	TorrentInfo    *torrent_info.TorrentInfo
+	Bitfield       *bitfield.Shared
+	ConnectionChan chan peer.ConnectionCommunication
+	Availability   peer.AvailabilityCounter
+	Extensions     *peer.ExtensionRegistry
+}
+
 type LocalServer struct {
-	PeerId     string
-	Port       int
-	HttpServer *http.Server
+	PeerId   string
+	Port     int
+	Listener *net.TCPListener
+
+	// The uTP connections are accepted on the UDP port with the same number , which is shared with the DHT.
+	UTP *utp.Socket
+
+	// The encryption policy of the incoming connections , one of the mse constants.
+	Encryption int
+
+	torrents map[string]*Torrent
+	tLocker  sync.Mutex
 }
 
-type requestHandler struct{}
+// AddTorrent makes the server accept peers which want the given torrent.
+func (server *LocalServer) AddTorrent(torrent *Torrent) {
+	server.tLocker.Lock()
+	defer server.tLocker.Unlock()
+	server.torrents[string(torrent.TorrentInfo.InfoHash)] = torrent
+}
 
-func (req requestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Received Request")
-	fmt.Fprintf(w, "hi!!")
+// RemoveTorrent stops accepting peers for the torrent with the given info hash.
+func (server *LocalServer) RemoveTorrent(infoHash []byte) {
+	server.tLocker.Lock()
+	defer server.tLocker.Unlock()
+	delete(server.torrents, string(infoHash))
 }
 
-// New returns a http local server for peerId
-func New(peerId string) *LocalServer {
-	tryPorts := []int{6881, 6882, 6883, 6884, 6885, 6886, 6887, 6888, 6889}
-	serverChan := make(chan *http.Server)
-	go (func(serverChan chan *http.Server) {
-		var server *http.Server
-		for _, port := range tryPorts {
-			server = &http.Server{
-				Addr:    fmt.Sprintf(":%d", port),
-				Handler: requestHandler{},
-			}
-			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-			if err != nil {
+// infoHashes returns the info hashes of the torrents we serve.
+func (server *LocalServer) infoHashes() [][]byte {
+	server.tLocker.Lock()
+	defer server.tLocker.Unlock()
+	infoHashes := make([][]byte, 0, len(server.torrents))
+	for infoHash := range server.torrents {
+		infoHashes = append(infoHashes, []byte(infoHash))
+	}
+	return infoHashes
+}
+
+func (server *LocalServer) getTorrent(infoHash []byte) *Torrent {
+	server.tLocker.Lock()
+	defer server.tLocker.Unlock()
+	return server.torrents[string(infoHash)]
+}
+
+// acceptConnections accepts connections until the listener is closed.
+func (server *LocalServer) acceptConnections() {
+	for {
+		connection, err := server.Listener.AcceptTCP()
+		if err != nil {
+			if netError, isNetError := err.(net.Error); isNetError && netError.Temporary() {
 				continue
-			} else {
-				serverChan <- server
-				server.Serve(listener)
 			}
+			return
+		}
+		connection.SetKeepAlive(true)
+		connection.SetReadBuffer(64 * 1024)
+		connection.SetLinger(0)
+		go server.handleConnection(connection, false)
+	}
+}
+
+// acceptUTPConnections accepts uTP connections until the socket is closed.
+func (server *LocalServer) acceptUTPConnections() {
+	for {
+		connection, err := server.UTP.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConnection(connection, true)
+	}
+}
+
+// handleConnection reads the handshake of a peer which connected to us.
+// The message stream encryption handshake is done first , if the peer starts with it.
+// If we serve the torrent it asks for , the peer is handed to the torrent's ConnectionChan,
+// otherwise the connection is closed.
+func (server *LocalServer) handleConnection(rawConnection net.Conn, overUTP bool) {
+
+	connection, err := mse.Accept(rawConnection, server.infoHashes, server.Encryption)
+	if err != nil {
+		rawConnection.Close()
+		return
+	}
+
+	connection.SetDeadline(time.Now().Add(5 * time.Second))
+	handshake, err := peer.ReadHandshake(connection)
+	if err != nil {
+		connection.Close()
+		return
+	}
+
+	torrent := server.getTorrent(handshake.InfoHash)
+	if torrent == nil || handshake.PeerId == server.PeerId {
+		connection.Close()
+		return
+	}
+
+	host, portString, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		connection.Close()
+		return
+	}
+	port, _ := strconv.Atoi(portString)
+
+	newPeer := peer.New(torrent.TorrentInfo, server.PeerId, host, port)
+	newPeer.Availability = torrent.Availability
+	newPeer.Extensions = torrent.Extensions
+	newPeer.Encryption = server.Encryption
+	newPeer.UTPSocket = server.UTP
+	newPeer.SupportsUTP = overUTP
+	newPeer.UsesUTP = overUTP
+	newPeer.EstablishIncomingConnection(connection, handshake, torrent.ConnectionChan, torrent.Bitfield)
+}
+
+// Close stops accepting new connections.
+func (server *LocalServer) Close() error {
+	if server.UTP != nil {
+		server.UTP.Close()
+	}
+	return server.Listener.Close()
+}
+
+// New returns a local server for peerId , listening on the first available port.
+// The listeners have no address , so they are dual-stack : they accept both IPv4 and IPv6 peers.
+// Where IPv6 isn't available , they fall back to IPv4 only.
+func New(peerId string, encryption int) *LocalServer {
+	tryPorts := []int{6881, 6882, 6883, 6884, 6885, 6886, 6887, 6888, 6889}
+	for _, port := range tryPorts {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			continue
+		}
+		server := &LocalServer{
+			PeerId:     peerId,
+			Port:       port,
+			Listener:   listener,
+			Encryption: encryption,
+			torrents:   make(map[string]*Torrent),
+		}
+		go server.acceptConnections()
+		if socket, err := utp.Listen(port); err == nil {
+			server.UTP = socket
+			go server.acceptUTPConnections()
 		}
-		panic("No port available")
-	})(serverChan)
-	server := <-serverChan
-	var port int
-	fmt.Sscanf(server.Addr, ":%d", &port)
-	return &LocalServer{
-		PeerId:     peerId,
-		Port:       port,
-		HttpServer: server,
+		return server
 	}
+	panic("No port available")
 }
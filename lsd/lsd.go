@@ -0,0 +1,243 @@
+// Package lsd implements the local service discovery , described here : http://www.bittorrent.org/beps/bep_0014.html
+// The peers of a LAN announce the torrents they download on a multicast group , so they find each other.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LSD_IPV4_ADDRESS = "239.192.152.143:6771"
+	LSD_IPV6_ADDRESS = "[ff15::efc0:988f]:6771"
+)
+
+// A torrent must not be announced more than once per minute.
+const (
+	ANNOUNCE_DURATION     = 5 * time.Minute
+	MIN_ANNOUNCE_DURATION = time.Minute
+)
+
+const (
+	SEARCH_LINE     = "BT-SEARCH * HTTP/1.1"
+	MAX_PACKET_SIZE = 1400
+)
+
+// Announcement is a BT-SEARCH message : the port a peer listens on , and the torrents it downloads.
+// The cookie lets a peer recognize its own announcements.
+type Announcement struct {
+	Port       int
+	InfoHashes [][]byte
+	Cookie     string
+}
+
+// Encode returns the message , sent to the multicast group host.
+func (announcement *Announcement) Encode(host string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(SEARCH_LINE + "\r\n")
+	buffer.WriteString("Host: " + host + "\r\n")
+	buffer.WriteString("Port: " + strconv.Itoa(announcement.Port) + "\r\n")
+	for _, infoHash := range announcement.InfoHashes {
+		buffer.WriteString("Infohash: " + hex.EncodeToString(infoHash) + "\r\n")
+	}
+	if announcement.Cookie != "" {
+		buffer.WriteString("cookie: " + announcement.Cookie + "\r\n")
+	}
+	buffer.WriteString("\r\n\r\n")
+	return buffer.Bytes()
+}
+
+// ParseAnnouncement parses a BT-SEARCH message. The info hashes which aren't valid are skipped.
+func ParseAnnouncement(data []byte) (*Announcement, error) {
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if line != SEARCH_LINE {
+		return nil, errors.New("Not a BT-SEARCH message")
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(header.Get("Port"))
+	if err != nil || port <= 0 || port >= 65536 {
+		return nil, errors.New("Invalid port")
+	}
+	announcement := &Announcement{Port: port, Cookie: header.Get("Cookie")}
+	for _, value := range header["Infohash"] {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err == nil && len(infoHash) == 20 {
+			announcement.InfoHashes = append(announcement.InfoHashes, infoHash)
+		}
+	}
+	if len(announcement.InfoHashes) == 0 {
+		return nil, errors.New("No info hash")
+	}
+	return announcement, nil
+}
+
+// PeerFound is called with the address of a peer which announced a torrent we download.
+type PeerFound func(address string)
+
+// Service announces our torrents on the multicast groups , and listens for the announcements of the others.
+type Service struct {
+	Port   int
+	Cookie string
+
+	groups       []*net.UDPAddr
+	listeners    []*net.UDPConn
+	sender       *net.UDPConn
+	torrents     map[string]PeerFound
+	lastAnnounce time.Time
+	locker       sync.Mutex
+}
+
+// New returns a service which announces that we listen on port.
+func New(port int) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		Port:     port,
+		Cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[string]PeerFound),
+	}
+}
+
+// Start joins the multicast groups. It fails only if none of them could be joined.
+func (service *Service) Start() error {
+
+	sender, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	service.sender = sender
+
+	var lastErr error
+	for _, group := range []string{LSD_IPV4_ADDRESS, LSD_IPV6_ADDRESS} {
+		address, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		network := "udp4"
+		if address.IP.To4() == nil {
+			network = "udp6"
+		}
+		listener, err := net.ListenMulticastUDP(network, nil, address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		service.groups = append(service.groups, address)
+		service.listeners = append(service.listeners, listener)
+		go service.serve(listener)
+	}
+
+	if len(service.listeners) == 0 {
+		sender.Close()
+		return lastErr
+	}
+	return nil
+}
+
+// serve reads the announcements from listener , until it is closed.
+func (service *Service) serve(listener *net.UDPConn) {
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		length, address, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		service.HandlePacket(buffer[:length], address)
+	}
+}
+
+// HandlePacket handles an announcement received from address.
+// Our own announcements , and the ones of torrents we don't download , are ignored.
+func (service *Service) HandlePacket(data []byte, address *net.UDPAddr) {
+	announcement, err := ParseAnnouncement(data)
+	if err != nil || announcement.Cookie == service.Cookie {
+		return
+	}
+	peerAddress := net.JoinHostPort(address.IP.String(), strconv.Itoa(announcement.Port))
+	for _, infoHash := range announcement.InfoHashes {
+		service.locker.Lock()
+		found := service.torrents[string(infoHash)]
+		service.locker.Unlock()
+		if found != nil {
+			found(peerAddress)
+		}
+	}
+}
+
+// AddTorrent starts looking for the peers of the torrent , which are given to found.
+func (service *Service) AddTorrent(infoHash []byte, found PeerFound) {
+	service.locker.Lock()
+	defer service.locker.Unlock()
+	service.torrents[string(infoHash)] = found
+}
+
+// RemoveTorrent stops announcing the torrent.
+func (service *Service) RemoveTorrent(infoHash []byte) {
+	service.locker.Lock()
+	defer service.locker.Unlock()
+	delete(service.torrents, string(infoHash))
+}
+
+// Announce sends our torrents to the multicast groups we joined.
+// Nothing is sent if the previous announce was less than MIN_ANNOUNCE_DURATION ago.
+func (service *Service) Announce() error {
+
+	service.locker.Lock()
+	if time.Since(service.lastAnnounce) < MIN_ANNOUNCE_DURATION {
+		service.locker.Unlock()
+		return nil
+	}
+	service.lastAnnounce = time.Now()
+	announcement := &Announcement{Port: service.Port, Cookie: service.Cookie}
+	for infoHash := range service.torrents {
+		announcement.InfoHashes = append(announcement.InfoHashes, []byte(infoHash))
+	}
+	service.locker.Unlock()
+
+	if service.sender == nil {
+		return errors.New("Service not started")
+	}
+	sent := 0
+	var lastErr error
+	for _, group := range service.groups {
+		if _, err := service.sender.WriteToUDP(announcement.Encode(group.String()), group); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && lastErr != nil {
+		return fmt.Errorf("Couldn't announce on the local network: %s", lastErr)
+	}
+	return nil
+}
+
+// Close leaves the multicast groups.
+func (service *Service) Close() {
+	for _, listener := range service.listeners {
+		listener.Close()
+	}
+	if service.sender != nil {
+		service.sender.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package lsd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+var testInfoHash = bytes.Repeat([]byte{0xab}, 20)
+
+func TestEncodeParse(t *testing.T) {
+	sent := &Announcement{Port: 6881, InfoHashes: [][]byte{testInfoHash, bytes.Repeat([]byte{0x01}, 20)}, Cookie: "abcd"}
+	data := sent.Encode(LSD_IPV4_ADDRESS)
+	if !bytes.HasPrefix(data, []byte("BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: abab")) {
+		t.Errorf("Wrong message %q", data)
+	}
+
+	received, err := ParseAnnouncement(data)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if received.Port != 6881 || received.Cookie != "abcd" || len(received.InfoHashes) != 2 {
+		t.Fatalf("Wrong announcement %v", received)
+	}
+	for index, infoHash := range received.InfoHashes {
+		if !bytes.Equal(infoHash, sent.InfoHashes[index]) {
+			t.Errorf("Wrong info hash %x", infoHash)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abababababababababababababababababababab\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: abababababababababababababababababababab\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: abababababababababababababababababababab\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abab\r\n\r\n\r\n",
+	}
+	for _, data := range invalid {
+		if _, err := ParseAnnouncement([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestHandlePacket(t *testing.T) {
+	service := New(6881)
+	found := []string{}
+	service.AddTorrent(testInfoHash, func(address string) {
+		found = append(found, address)
+	})
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 6771}
+
+	// Our own announcement.
+	service.HandlePacket((&Announcement{Port: 6881, InfoHashes: [][]byte{testInfoHash}, Cookie: service.Cookie}).Encode(LSD_IPV4_ADDRESS), from)
+	// A torrent we don't download.
+	service.HandlePacket((&Announcement{Port: 6882, InfoHashes: [][]byte{bytes.Repeat([]byte{0x01}, 20)}}).Encode(LSD_IPV4_ADDRESS), from)
+	if len(found) != 0 {
+		t.Errorf("Expected no peers , got %v", found)
+	}
+
+	service.HandlePacket((&Announcement{Port: 6883, InfoHashes: [][]byte{testInfoHash}}).Encode(LSD_IPV4_ADDRESS), from)
+	if len(found) != 1 || found[0] != "192.168.1.10:6883" {
+		t.Errorf("Wrong peers %v", found)
+	}
+
+	service.RemoveTorrent(testInfoHash)
+	service.HandlePacket((&Announcement{Port: 6884, InfoHashes: [][]byte{testInfoHash}}).Encode(LSD_IPV4_ADDRESS), from)
+	if len(found) != 1 {
+		t.Errorf("Expected no more peers , got %v", found)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	first := New(6881)
+	if err := first.Start(); err != nil {
+		t.Skip("Multicast is not available:", err)
+	}
+	defer first.Close()
+
+	second := New(6882)
+	found := make(chan string, 1)
+	second.AddTorrent(testInfoHash, func(address string) {
+		select {
+		case found <- address:
+		default:
+		}
+	})
+	if err := second.Start(); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer second.Close()
+
+	first.AddTorrent(testInfoHash, func(address string) {})
+	if err := first.Announce(); err != nil {
+		t.Skip("Multicast is not available:", err)
+	}
+	select {
+	case address := <-found:
+		if _, port, _ := net.SplitHostPort(address); port != "6881" {
+			t.Errorf("Wrong peer %s", address)
+		}
+	case <-time.After(2 * time.Second):
+		t.Skip("No multicast route")
+	}
+
+	// The second announce comes too early , so nothing is sent.
+	if err := first.Announce(); err != nil {
+		t.Errorf("Got error: %s", err)
+	}
+}
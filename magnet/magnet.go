@@ -0,0 +1,101 @@
+// Package magnet parses magnet links and fetches the info dictionary of their torrent
+// from other peers , as described here : http://www.bittorrent.org/beps/bep_0009.html
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+const INFO_HASH_PREFIX = "urn:btih:"
+
+type Magnet struct {
+	InfoHash    []byte
+	DisplayName string
+	Trackers    []string
+	Peers       []string // host:port of the peers given with x.pe
+}
+
+// parseInfoHash decodes the info hash from the xt parameter.
+// It can be hex encoded (40 characters) or base32 encoded (32 characters).
+func parseInfoHash(exactTopic string) ([]byte, error) {
+
+	if !strings.HasPrefix(strings.ToLower(exactTopic), INFO_HASH_PREFIX) {
+		return nil, errors.New("Not a BitTorrent info hash : " + exactTopic)
+	}
+	encoded := exactTopic[len(INFO_HASH_PREFIX):]
+
+	switch len(encoded) {
+	case 40:
+		return hex.DecodeString(encoded)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	}
+	return nil, errors.New("Invalid info hash length")
+}
+
+// Parse parses a magnet link like:
+// magnet:?xt=urn:btih:<info-hash>&dn=<name>&tr=<tracker-url>&x.pe=<peer-address>
+func Parse(uri string) (*Magnet, error) {
+
+	parsedUrl, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if parsedUrl.Scheme != "magnet" {
+		return nil, errors.New("Not a magnet link")
+	}
+
+	query, err := url.ParseQuery(parsedUrl.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	magnet := &Magnet{}
+	for _, exactTopic := range query["xt"] {
+		if infoHash, err := parseInfoHash(exactTopic); err == nil {
+			magnet.InfoHash = infoHash
+			break
+		}
+	}
+	if magnet.InfoHash == nil {
+		return nil, errors.New("Magnet link without BitTorrent info hash")
+	}
+
+	magnet.DisplayName = query.Get("dn")
+	magnet.Trackers = query["tr"]
+	magnet.Peers = query["x.pe"]
+	return magnet, nil
+}
+
+// BuildTorrent returns the dictionary of a torrent file , made from the info dictionary
+// fetched from the peers and the trackers of the magnet link.
+func (magnet *Magnet) BuildTorrent(info []byte) (*bencode.Dictionary, error) {
+
+	// Parsing changes the source , so we keep the original bytes untouched.
+	source := make([]byte, len(info))
+	copy(source, info)
+	infoDictionary, _, err := bencode.ParseDictionary(source)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "info"}: infoDictionary,
+	}}
+	if len(magnet.Trackers) > 0 {
+		torrent.Values[bencode.String{Value: "announce"}] = &bencode.String{Value: magnet.Trackers[0]}
+		announceList := &bencode.List{}
+		for _, trackerUrl := range magnet.Trackers {
+			tier := &bencode.List{Values: []bencode.Bencoder{&bencode.String{Value: trackerUrl}}}
+			announceList.Values = append(announceList.Values, tier)
+		}
+		torrent.Values[bencode.String{Value: "announce-list"}] = announceList
+	}
+	return torrent, nil
+}
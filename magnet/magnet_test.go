@@ -0,0 +1,222 @@
+package magnet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/bbpcr/Yomato/bencode"
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/dht"
+	"github.com/bbpcr/Yomato/mse"
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestParseHex(t *testing.T) {
+	link, err := Parse("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=Some+Name&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Fother.example.com%2Fannounce&x.pe=10.0.0.1%3A6881")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if hex.EncodeToString(link.InfoHash) != "c12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+		t.Errorf("Wrong info hash %x", link.InfoHash)
+	}
+	if link.DisplayName != "Some Name" {
+		t.Errorf("Wrong display name %s", link.DisplayName)
+	}
+	if len(link.Trackers) != 2 || link.Trackers[0] != "udp://tracker.example.com:80" || link.Trackers[1] != "http://other.example.com/announce" {
+		t.Errorf("Wrong trackers %v", link.Trackers)
+	}
+	if len(link.Peers) != 1 || link.Peers[0] != "10.0.0.1:6881" {
+		t.Errorf("Wrong peers %v", link.Peers)
+	}
+}
+
+func TestParseBase32(t *testing.T) {
+	link, err := Parse("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if hex.EncodeToString(link.InfoHash) != "c12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+		t.Errorf("Wrong info hash %x", link.InfoHash)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	invalid := []string{
+		"http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=name",
+		"magnet:?xt=urn:sha1:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xt=urn:btih:c12fe1",
+	}
+	for _, uri := range invalid {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("Expected an error for %s", uri)
+		}
+	}
+}
+
+// servePeer answers one connection like a peer which has the metadata , following the encryption policy.
+// A connection which breaks the policy is closed.
+func servePeer(t *testing.T, listener net.Listener, info []byte, encryption int) {
+	rawConnection, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	knownInfoHashes := func() [][]byte {
+		infoHash := sha1.Sum(info)
+		return [][]byte{infoHash[:]}
+	}
+	connection, err := mse.Accept(rawConnection, knownInfoHashes, encryption)
+	if err != nil {
+		rawConnection.Close()
+		return
+	}
+
+	handshake, err := peer.ReadHandshake(connection)
+	if err != nil {
+		t.Errorf("Got error: %s", err)
+		return
+	}
+
+	seeder := peer.New(&torrent_info.TorrentInfo{InfoHash: handshake.InfoHash}, "-XX0000-000000000000", "127.0.0.1", 0)
+	seeder.Extensions = peer.NewExtensionRegistry(0)
+	seeder.Extensions.Register("other_extension", nil)
+	seeder.Extensions.Register(UT_METADATA, ServeMetadata(info))
+	seeder.Extensions.SetMetadataSize(len(info))
+
+	noPieces := bitfield.NewShared(0)
+	comm := make(chan peer.ConnectionCommunication, 1)
+	seeder.EstablishIncomingConnection(connection, handshake, comm, noPieces)
+	if result := <-comm; result.StatusMessage != "OK" {
+		t.Errorf("Got error: %s", result.StatusMessage)
+		return
+	}
+	defer seeder.Disconnect()
+	for seeder.ReadMessage(METADATA_PEER_TIMEOUT) == nil {
+	}
+}
+
+// testInfo returns an info dictionary of 1000 pieces , so its metadata has two pieces.
+func testInfo() []byte {
+	pieces := bytes.Repeat([]byte{0xab}, 20*1000)
+	infoDictionary := &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "name"}:         &bencode.String{Value: "file.bin"},
+		bencode.String{Value: "length"}:       &bencode.Number{Value: 1000 * 16384},
+		bencode.String{Value: "piece length"}: &bencode.Number{Value: 16384},
+		bencode.String{Value: "pieces"}:       &bencode.String{Value: string(pieces)},
+	}}
+	return infoDictionary.Encode()
+}
+
+func TestFetchMetadata(t *testing.T) {
+
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+	go servePeer(t, listener, info, mse.ENCRYPTION_PREFERRED)
+
+	link := &Magnet{InfoHash: infoHash[:], Peers: []string{listener.Addr().String()}}
+	fetched, address, err := link.FetchMetadata("-YM00000000000000000", 6881, METADATA_PEER_TIMEOUT, nil, mse.ENCRYPTION_PREFERRED)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if address != listener.Addr().String() || !bytes.Equal(fetched, info) {
+		t.Errorf("Wrong metadata from %s", address)
+	}
+
+	torrent, err := link.BuildTorrent(fetched)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if _, isDictionary := torrent.Values[bencode.String{Value: "info"}].(*bencode.Dictionary); !isDictionary {
+		t.Errorf("The torrent has no info dictionary")
+	}
+}
+
+func TestFetchMetadataEncrypted(t *testing.T) {
+
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+	link := &Magnet{InfoHash: infoHash[:], Peers: []string{listener.Addr().String()}}
+
+	// The seeder only talks encrypted , so a plaintext fetch gets nothing.
+	go servePeer(t, listener, info, mse.ENCRYPTION_REQUIRED)
+	if _, _, err := link.FetchMetadata("-YM00000000000000000", 6881, METADATA_PEER_TIMEOUT, nil, mse.ENCRYPTION_DISABLED); err == nil {
+		t.Fatalf("Expected no metadata over plaintext")
+	}
+
+	go servePeer(t, listener, info, mse.ENCRYPTION_REQUIRED)
+	fetched, _, err := link.FetchMetadata("-YM00000000000000000", 6881, METADATA_PEER_TIMEOUT, nil, mse.ENCRYPTION_REQUIRED)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !bytes.Equal(fetched, info) {
+		t.Errorf("Wrong metadata")
+	}
+}
+
+// startNode starts a DHT node on loopback , which bootstraps from the given nodes.
+func startNode(t *testing.T, bootstrapNodes ...string) (*dht.DHT, string) {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	node := dht.New(connection, "")
+	go node.Serve()
+	if len(bootstrapNodes) > 0 {
+		node.BootstrapNodes = bootstrapNodes
+		if err := node.Bootstrap(); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+	}
+	return node, connection.LocalAddr().String()
+}
+
+func TestFetchMetadataFromDHT(t *testing.T) {
+
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+	go servePeer(t, listener, info, mse.ENCRYPTION_PREFERRED)
+
+	// The seeder announced itself in the DHT.
+	bootstrapNode, bootstrapAddress := startNode(t)
+	defer bootstrapNode.Close()
+	seederNode, _ := startNode(t, bootstrapAddress)
+	defer seederNode.Close()
+	seederNode.FindPeers(infoHash[:], listener.Addr().(*net.TCPAddr).Port)
+
+	// The link has neither trackers nor peers.
+	node, _ := startNode(t, bootstrapAddress)
+	defer node.Close()
+	link := &Magnet{InfoHash: infoHash[:]}
+	if _, _, err := link.FetchMetadata("-YM00000000000000000", 6881, METADATA_PEER_TIMEOUT, nil, mse.ENCRYPTION_PREFERRED); err == nil {
+		t.Fatalf("Expected no peers without the DHT")
+	}
+	fetched, address, err := link.FetchMetadata("-YM00000000000000000", 6881, METADATA_PEER_TIMEOUT, node, mse.ENCRYPTION_PREFERRED)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if address != listener.Addr().String() || !bytes.Equal(fetched, info) {
+		t.Errorf("Wrong metadata from %s", address)
+	}
+}
@@ -0,0 +1,308 @@
+package magnet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/dht"
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+	"github.com/bbpcr/Yomato/tracker"
+)
+
+const UT_METADATA = "ut_metadata"
+
+const (
+	METADATA_PIECE_LENGTH    = 16 * 1024
+	MAX_METADATA_SIZE        = 16 * 1024 * 1024
+	MAX_METADATA_CONNECTIONS = 10
+)
+
+// The ut_metadata message types.
+const (
+	METADATA_REQUEST = iota
+	METADATA_DATA
+	METADATA_REJECT
+)
+
+const METADATA_PEER_TIMEOUT = 30 * time.Second
+
+type metadataResult struct {
+	Address string
+	Info    []byte
+	Err     error
+}
+
+// getNumber returns the number found at key in the dictionary.
+func getNumber(dictionary *bencode.Dictionary, key string) (int64, bool) {
+	number, isNumber := dictionary.Values[bencode.String{Value: key}].(*bencode.Number)
+	if !isNumber {
+		return 0, false
+	}
+	return number.Value, true
+}
+
+// buildMessage returns a ut_metadata message , followed by the data of the piece , if any.
+func buildMessage(messageType int, pieceIndex int, totalSize int, data []byte) []byte {
+	dictionary := &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "msg_type"}: &bencode.Number{Value: int64(messageType)},
+		bencode.String{Value: "piece"}:    &bencode.Number{Value: int64(pieceIndex)},
+	}}
+	if messageType == METADATA_DATA {
+		dictionary.Values[bencode.String{Value: "total_size"}] = &bencode.Number{Value: int64(totalSize)}
+	}
+	return append(dictionary.Encode(), data...)
+}
+
+// ServeMetadata returns the ut_metadata handler which sends the info dictionary to the peers which request it.
+func ServeMetadata(info []byte) peer.ExtensionHandler {
+	return func(remotePeer *peer.Peer, payload []byte) {
+		request, _, err := bencode.ParseDictionary(payload)
+		if err != nil {
+			return
+		}
+		messageType, _ := getNumber(request, "msg_type")
+		pieceIndex, _ := getNumber(request, "piece")
+		if messageType != METADATA_REQUEST {
+			return
+		}
+		start := int(pieceIndex) * METADATA_PIECE_LENGTH
+		if pieceIndex < 0 || start >= len(info) {
+			remotePeer.SendExtended(UT_METADATA, buildMessage(METADATA_REJECT, int(pieceIndex), 0, nil))
+			return
+		}
+		end := start + METADATA_PIECE_LENGTH
+		if end > len(info) {
+			end = len(info)
+		}
+		remotePeer.SendExtended(UT_METADATA, buildMessage(METADATA_DATA, int(pieceIndex), len(info), info[start:end]))
+	}
+}
+
+// metadataFetcher downloads the info dictionary from one peer.
+type metadataFetcher struct {
+	infoHash     []byte
+	metadataSize int
+	pieces       [][]byte
+	received     int
+	info         []byte
+	err          error
+
+	// The pieces arrive in the reader of the connection , while fetchFromPeer waits for them.
+	locker sync.Mutex
+}
+
+// requestPieces requests all the pieces of the info dictionary , once the peer told us its size.
+func (fetcher *metadataFetcher) requestPieces(remotePeer *peer.Peer) error {
+	if remotePeer.MetadataSize > MAX_METADATA_SIZE {
+		return errors.New("Invalid metadata size")
+	}
+	pieces := make([][]byte, (remotePeer.MetadataSize+METADATA_PIECE_LENGTH-1)/METADATA_PIECE_LENGTH)
+	fetcher.locker.Lock()
+	fetcher.metadataSize = remotePeer.MetadataSize
+	fetcher.pieces = pieces
+	fetcher.locker.Unlock()
+	for pieceIndex := range pieces {
+		if err := remotePeer.SendExtended(UT_METADATA, buildMessage(METADATA_REQUEST, pieceIndex, 0, nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMessage is the ut_metadata handler , which stores the pieces sent by the peer.
+// When all the pieces are received , they are verified against the info hash.
+func (fetcher *metadataFetcher) handleMessage(remotePeer *peer.Peer, payload []byte) {
+	fetcher.locker.Lock()
+	defer fetcher.locker.Unlock()
+
+	// Parsing changes the source , but the data after the dictionary stays the same.
+	message, data, err := bencode.ParseDictionary(payload)
+	if err != nil || fetcher.pieces == nil {
+		return
+	}
+
+	messageType, _ := getNumber(message, "msg_type")
+	pieceIndex, _ := getNumber(message, "piece")
+	if messageType == METADATA_REJECT {
+		fetcher.err = errors.New("Peer rejected the metadata request")
+		return
+	}
+	if messageType != METADATA_DATA || pieceIndex < 0 || int(pieceIndex) >= len(fetcher.pieces) {
+		return
+	}
+
+	expectedLength := METADATA_PIECE_LENGTH
+	if int(pieceIndex) == len(fetcher.pieces)-1 {
+		expectedLength = fetcher.metadataSize - METADATA_PIECE_LENGTH*(len(fetcher.pieces)-1)
+	}
+	if len(data) != expectedLength {
+		fetcher.err = errors.New("Invalid metadata piece length")
+		return
+	}
+	if fetcher.pieces[pieceIndex] == nil {
+		fetcher.pieces[pieceIndex] = data
+		fetcher.received++
+	}
+
+	if fetcher.received == len(fetcher.pieces) {
+		info := bytes.Join(fetcher.pieces, nil)
+		hash := sha1.Sum(info)
+		if !bytes.Equal(hash[:], fetcher.infoHash) {
+			fetcher.err = errors.New("Metadata doesn't match the info hash")
+			return
+		}
+		fetcher.info = info
+	}
+}
+
+// result returns the verified info dictionary or the error of the fetch , and if the pieces were requested.
+func (fetcher *metadataFetcher) result() ([]byte, error, bool) {
+	fetcher.locker.Lock()
+	defer fetcher.locker.Unlock()
+	return fetcher.info, fetcher.err, fetcher.pieces != nil
+}
+
+// fetchFromPeer downloads the info dictionary from the peer at address.
+// The pieces are requested with ut_metadata , once the peer sent its extended handshake.
+func fetchFromPeer(address string, infoHash []byte, peerId string, encryption int) ([]byte, error) {
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &metadataFetcher{infoHash: infoHash}
+	remotePeer := peer.New(&torrent_info.TorrentInfo{InfoHash: infoHash}, peerId, host, port)
+	remotePeer.Extensions = peer.NewExtensionRegistry(0)
+	remotePeer.Encryption = encryption
+	remotePeer.Extensions.Register(UT_METADATA, fetcher.handleMessage)
+
+	// We have no pieces , since we don't even know how many there are.
+	noPieces := bitfield.NewShared(0)
+	comm := make(chan peer.ConnectionCommunication, 1)
+	remotePeer.EstablishFullConnection(comm, noPieces)
+	if result := <-comm; result.StatusMessage != "OK" {
+		return nil, errors.New(result.StatusMessage)
+	}
+	defer remotePeer.Disconnect()
+
+	if !remotePeer.SupportsExtensions() {
+		return nil, errors.New("Peer doesn't support the extension protocol")
+	}
+
+	deadline := time.Now().Add(METADATA_PEER_TIMEOUT)
+	for {
+		info, err, requested := fetcher.result()
+		if info != nil || err != nil {
+			return info, err
+		}
+		if !requested && remotePeer.MetadataSize > 0 && remotePeer.SupportsExtension(UT_METADATA) {
+			if err := fetcher.requestPieces(&remotePeer); err != nil {
+				return nil, err
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timeout while fetching the metadata")
+		}
+		if err := remotePeer.ReadMessage(time.Until(deadline)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// findPeers returns the addresses of the peers given in the magnet link , by its trackers and by the DHT node , if any.
+func (magnet *Magnet) findPeers(peerId string, port int, node *dht.DHT) []string {
+
+	addresses := []string{}
+	known := make(map[string]bool)
+	addAddress := func(address string) {
+		if !known[address] {
+			known[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	for _, address := range magnet.Peers {
+		addAddress(address)
+	}
+
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: magnet.InfoHash}
+	for _, trackerUrl := range magnet.Trackers {
+		// We don't know the size yet , but we must not look like a seeder.
+		trackerResponse, err := tracker.New(trackerUrl, torrentInfo, port, peerId).RequestPeers(0, 0, 1, tracker.NONE)
+		if err != nil {
+			continue
+		}
+		for _, trackerPeer := range trackerResponse.Peers {
+			addAddress(net.JoinHostPort(trackerPeer.IP, fmt.Sprintf("%d", trackerPeer.Port)))
+		}
+	}
+
+	// The links without trackers only find their peers in the DHT. We announce that we listen on our port.
+	if node != nil {
+		for _, address := range node.FindPeers(magnet.InfoHash, port) {
+			addAddress(address)
+		}
+	}
+	return addresses
+}
+
+// FetchMetadata downloads the info dictionary of the torrent from the peers.
+// The peers are given by the magnet link , its trackers and the DHT node , which can be nil.
+// They are asked MAX_METADATA_CONNECTIONS at a time.
+// The connections follow the encryption policy , one of the mse constants.
+// It returns the verified info dictionary and the address of the peer which sent it.
+func (magnet *Magnet) FetchMetadata(peerId string, port int, timeout time.Duration, node *dht.DHT, encryption int) ([]byte, string, error) {
+
+	addresses := magnet.findPeers(peerId, port, node)
+	if len(addresses) == 0 {
+		return nil, "", errors.New("No peers found for the magnet link")
+	}
+	fmt.Println(time.Now().Format("[2006.01.02 15:04:05]"), fmt.Sprintf("Fetching metadata from %d peers", len(addresses)))
+
+	results := make(chan metadataResult, len(addresses))
+	slots := make(chan bool, MAX_METADATA_CONNECTIONS)
+	stop := make(chan bool)
+	defer close(stop)
+
+	go func() {
+		for _, address := range addresses {
+			select {
+			case slots <- true:
+			case <-stop:
+				return
+			}
+			go func(address string) {
+				info, err := fetchFromPeer(address, magnet.InfoHash, peerId, encryption)
+				<-slots
+				results <- metadataResult{address, info, err}
+			}(address)
+		}
+	}()
+
+	deadline := time.After(timeout)
+	for finished := 0; finished < len(addresses); finished++ {
+		select {
+		case result := <-results:
+			if result.Err == nil {
+				return result.Info, result.Address, nil
+			}
+		case <-deadline:
+			return nil, "", errors.New("Timeout while fetching the metadata")
+		}
+	}
+	return nil, "", errors.New("No peer sent the metadata")
+}
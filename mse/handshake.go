@@ -0,0 +1,251 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The handshake must be done in this time , otherwise the connection is dropped.
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// The plaintext handshake starts with this , so an incoming connection which starts with it isn't encrypted.
+const PLAINTEXT_HEADER = "\x13BitTorrent protocol"
+
+// cryptoProvide returns the crypto methods we support with the policy.
+func cryptoProvide(policy int) uint32 {
+	switch policy {
+	case ENCRYPTION_REQUIRED:
+		return CRYPTO_RC4
+	case ENCRYPTION_PREFERRED:
+		return CRYPTO_RC4 | CRYPTO_PLAINTEXT
+	}
+	return CRYPTO_PLAINTEXT
+}
+
+// cryptoSelect returns the method we choose among the ones the other peer provides , RC4 if possible.
+func cryptoSelect(provided uint32, policy int) (uint32, error) {
+	supported := provided & cryptoProvide(policy)
+	if supported&CRYPTO_RC4 != 0 {
+		return CRYPTO_RC4, nil
+	}
+	if supported&CRYPTO_PLAINTEXT != 0 {
+		return CRYPTO_PLAINTEXT, nil
+	}
+	return 0, errors.New("No common crypto method")
+}
+
+// synchronize reads from the connection until it reads the marker , at most maxLength bytes.
+// The bytes before the marker are the padding of the other peer , and are dropped.
+func synchronize(connection net.Conn, marker []byte, maxLength int) error {
+	window := make([]byte, 0, maxLength)
+	buffer := make([]byte, 1)
+	for len(window) < maxLength {
+		if _, err := io.ReadFull(connection, buffer); err != nil {
+			return err
+		}
+		window = append(window, buffer[0])
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("Couldn't synchronize with the encrypted stream")
+}
+
+// readEncrypted reads length bytes from the connection , and decrypts them.
+func readEncrypted(conn *Conn, length int) ([]byte, error) {
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(conn.Conn, buffer); err != nil {
+		return nil, err
+	}
+	conn.reader.XORKeyStream(buffer, buffer)
+	return buffer, nil
+}
+
+// readPadding reads the length of a padding , then the padding , which is dropped.
+func readPadding(conn *Conn) error {
+	lengthBytes, err := readEncrypted(conn, 2)
+	if err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(lengthBytes))
+	if length > MAX_PADDING {
+		return errors.New("Padding too long")
+	}
+	_, err = readEncrypted(conn, length)
+	return err
+}
+
+// Initiate does the handshake for a connection we made , for the torrent with the given info hash.
+// The returned connection encrypts the stream if RC4 was selected by the other peer.
+// With ENCRYPTION_DISABLED , the connection is returned unchanged.
+func Initiate(connection net.Conn, infoHash []byte, policy int) (net.Conn, error) {
+
+	if policy == ENCRYPTION_DISABLED {
+		return connection, nil
+	}
+	connection.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer connection.SetDeadline(time.Time{})
+
+	privateKey, publicKey := newKeyPair()
+	if _, err := connection.Write(append(publicKey, randomPadding()...)); err != nil {
+		return nil, err
+	}
+	remotePublicKey := make([]byte, KEY_LENGTH)
+	if _, err := io.ReadFull(connection, remotePublicKey); err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(privateKey, remotePublicKey)
+
+	conn := &Conn{
+		Conn:   connection,
+		reader: newCipher("keyB", secret, infoHash),
+		writer: newCipher("keyA", secret, infoHash),
+	}
+
+	// The crypto methods we provide , followed by an empty initial payload.
+	padding := randomPadding()
+	payload := make([]byte, 16+len(padding))
+	copy(payload, verificationConstant)
+	binary.BigEndian.PutUint32(payload[8:], cryptoProvide(policy))
+	binary.BigEndian.PutUint16(payload[12:], uint16(len(padding)))
+	copy(payload[14:], padding)
+	binary.BigEndian.PutUint16(payload[14+len(padding):], 0)
+	conn.writer.XORKeyStream(payload, payload)
+
+	message := hash([]byte("req1"), secret)
+	message = append(message, xorBytes(hash([]byte("req2"), infoHash), hash([]byte("req3"), secret))...)
+	message = append(message, payload...)
+	if _, err := connection.Write(message); err != nil {
+		return nil, err
+	}
+
+	// The other peer answers with the encrypted verification constant , after its padding.
+	marker := make([]byte, len(verificationConstant))
+	conn.reader.XORKeyStream(marker, verificationConstant)
+	if err := synchronize(connection, marker, MAX_PADDING+len(marker)); err != nil {
+		return nil, err
+	}
+	selectedBytes, err := readEncrypted(conn, 4)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(selectedBytes)
+	if selected != CRYPTO_RC4 && selected != CRYPTO_PLAINTEXT || selected&cryptoProvide(policy) == 0 {
+		return nil, errors.New("Invalid crypto method selected")
+	}
+	if err := readPadding(conn); err != nil {
+		return nil, err
+	}
+
+	conn.Method = int(selected)
+	if selected == CRYPTO_PLAINTEXT {
+		conn.reader = nil
+		conn.writer = nil
+	}
+	return conn, nil
+}
+
+// Accept does the handshake for a connection the other peer made.
+// infoHashes returns the info hashes of the torrents we serve , one of which must be asked by the peer.
+// Plaintext connections are accepted unless the policy is ENCRYPTION_REQUIRED ,
+// and the bytes read to recognize them are given back by the returned connection.
+func Accept(connection net.Conn, infoHashes func() [][]byte, policy int) (net.Conn, error) {
+
+	if policy == ENCRYPTION_DISABLED {
+		return connection, nil
+	}
+	connection.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer connection.SetDeadline(time.Time{})
+
+	remotePublicKey := make([]byte, KEY_LENGTH)
+	if _, err := io.ReadFull(connection, remotePublicKey[:len(PLAINTEXT_HEADER)]); err != nil {
+		return nil, err
+	}
+	if string(remotePublicKey[:len(PLAINTEXT_HEADER)]) == PLAINTEXT_HEADER {
+		if policy == ENCRYPTION_REQUIRED {
+			return nil, errors.New("Plaintext connection refused")
+		}
+		return &Conn{Conn: connection, Method: CRYPTO_PLAINTEXT, received: remotePublicKey[:len(PLAINTEXT_HEADER)]}, nil
+	}
+	if _, err := io.ReadFull(connection, remotePublicKey[len(PLAINTEXT_HEADER):]); err != nil {
+		return nil, err
+	}
+
+	privateKey, publicKey := newKeyPair()
+	if _, err := connection.Write(append(publicKey, randomPadding()...)); err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(privateKey, remotePublicKey)
+
+	// The other peer sends req1 after its padding , then the info hash it wants hidden by req2 and req3.
+	if err := synchronize(connection, hash([]byte("req1"), secret), MAX_PADDING+sha1.Size); err != nil {
+		return nil, err
+	}
+	obfuscatedHash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(connection, obfuscatedHash); err != nil {
+		return nil, err
+	}
+	wantedHash := xorBytes(obfuscatedHash, hash([]byte("req3"), secret))
+	var infoHash []byte
+	for _, candidate := range infoHashes() {
+		if bytes.Equal(hash([]byte("req2"), candidate), wantedHash) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, errors.New("Unknown info hash")
+	}
+
+	conn := &Conn{
+		Conn:   connection,
+		reader: newCipher("keyA", secret, infoHash),
+		writer: newCipher("keyB", secret, infoHash),
+	}
+	header, err := readEncrypted(conn, len(verificationConstant)+4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(verificationConstant)], verificationConstant) {
+		return nil, errors.New("Invalid verification constant")
+	}
+	selected, err := cryptoSelect(binary.BigEndian.Uint32(header[len(verificationConstant):]), policy)
+	if err != nil {
+		return nil, err
+	}
+	if err := readPadding(conn); err != nil {
+		return nil, err
+	}
+	initialLength, err := readEncrypted(conn, 2)
+	if err != nil {
+		return nil, err
+	}
+	initialPayload, err := readEncrypted(conn, int(binary.BigEndian.Uint16(initialLength)))
+	if err != nil {
+		return nil, err
+	}
+
+	padding := randomPadding()
+	answer := make([]byte, 14+len(padding))
+	copy(answer, verificationConstant)
+	binary.BigEndian.PutUint32(answer[8:], selected)
+	binary.BigEndian.PutUint16(answer[12:], uint16(len(padding)))
+	copy(answer[14:], padding)
+	conn.writer.XORKeyStream(answer, answer)
+	if _, err := connection.Write(answer); err != nil {
+		return nil, err
+	}
+
+	conn.Method = int(selected)
+	conn.decrypted = initialPayload
+	if selected == CRYPTO_PLAINTEXT {
+		conn.reader = nil
+		conn.writer = nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,164 @@
+// Package mse implements the message stream encryption , also known as protocol encryption.
+// It is described here : http://wiki.vuze.com/w/Message_Stream_Encryption
+// A Diffie-Hellman key exchange gives both peers a secret , from which the RC4 keys are made.
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"errors"
+	"math/big"
+	"net"
+)
+
+// The encryption policies.
+// With ENCRYPTION_PREFERRED , the connections are encrypted when possible , and plaintext otherwise.
+const (
+	ENCRYPTION_DISABLED = iota
+	ENCRYPTION_PREFERRED
+	ENCRYPTION_REQUIRED
+)
+
+// The crypto methods , negotiated during the handshake.
+const (
+	CRYPTO_PLAINTEXT = 0x01
+	CRYPTO_RC4       = 0x02
+)
+
+const (
+	KEY_LENGTH         = 96
+	PRIVATE_KEY_LENGTH = 20
+	MAX_PADDING        = 512
+	RC4_DISCARD        = 1024
+)
+
+// The prime and the generator of the key exchange.
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+// The verification constant , sent encrypted so the other peer can find where the encrypted stream starts.
+var verificationConstant = make([]byte, 8)
+
+// PolicyByName returns the policy with the given name : disabled , prefer or require.
+func PolicyByName(name string) (int, error) {
+	switch name {
+	case "disabled":
+		return ENCRYPTION_DISABLED, nil
+	case "prefer":
+		return ENCRYPTION_PREFERRED, nil
+	case "require":
+		return ENCRYPTION_REQUIRED, nil
+	}
+	return 0, errors.New("Unknown encryption policy " + name)
+}
+
+// hash returns the SHA-1 of the parts put together.
+func hash(parts ...[]byte) []byte {
+	sum := sha1.New()
+	for _, part := range parts {
+		sum.Write(part)
+	}
+	return sum.Sum(nil)
+}
+
+// xorBytes returns first xor second , which have the same length.
+func xorBytes(first, second []byte) []byte {
+	result := make([]byte, len(first))
+	for index := range first {
+		result[index] = first[index] ^ second[index]
+	}
+	return result
+}
+
+// padKey returns the key as a big endian number of exactly KEY_LENGTH bytes.
+func padKey(key *big.Int) []byte {
+	bytes := key.Bytes()
+	padded := make([]byte, KEY_LENGTH)
+	copy(padded[KEY_LENGTH-len(bytes):], bytes)
+	return padded
+}
+
+// newKeyPair returns a random private key , and the public key sent to the other peer.
+func newKeyPair() (*big.Int, []byte) {
+	privateBytes := make([]byte, PRIVATE_KEY_LENGTH)
+	rand.Read(privateBytes)
+	privateKey := new(big.Int).SetBytes(privateBytes)
+	return privateKey, padKey(new(big.Int).Exp(generator, privateKey, prime))
+}
+
+// sharedSecret returns the secret computed from our private key and the public key of the other peer.
+func sharedSecret(privateKey *big.Int, remotePublicKey []byte) []byte {
+	return padKey(new(big.Int).Exp(new(big.Int).SetBytes(remotePublicKey), privateKey, prime))
+}
+
+// randomPadding returns between 0 and MAX_PADDING random bytes.
+func randomPadding() []byte {
+	length := make([]byte, 2)
+	rand.Read(length)
+	padding := make([]byte, (int(length[0])<<8|int(length[1]))%(MAX_PADDING+1))
+	rand.Read(padding)
+	return padding
+}
+
+// newCipher returns the RC4 cipher for the key name ("keyA" or "keyB") , which discards the first RC4_DISCARD bytes.
+func newCipher(name string, secret []byte, infoHash []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), secret, infoHash))
+	discard := make([]byte, RC4_DISCARD)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+// Conn is a connection whose stream is encrypted with RC4 , or a plaintext connection
+// which gives back the bytes read during the handshake first.
+type Conn struct {
+	net.Conn
+	Method int
+
+	decrypted []byte // already decrypted bytes , read before the encrypted stream
+	received  []byte // bytes read during the handshake , which are not decrypted yet
+	reader    *rc4.Cipher
+	writer    *rc4.Cipher
+}
+
+// Read reads from the connection , and decrypts what it read.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	if len(conn.decrypted) > 0 {
+		length := copy(buffer, conn.decrypted)
+		conn.decrypted = conn.decrypted[length:]
+		return length, nil
+	}
+
+	var length int
+	if len(conn.received) > 0 {
+		length = copy(buffer, conn.received)
+		conn.received = conn.received[length:]
+	} else {
+		var err error
+		if length, err = conn.Conn.Read(buffer); err != nil {
+			return length, err
+		}
+	}
+	if conn.reader != nil {
+		conn.reader.XORKeyStream(buffer[:length], buffer[:length])
+	}
+	return length, nil
+}
+
+// Write encrypts the data , and writes it to the connection.
+func (conn *Conn) Write(data []byte) (int, error) {
+	if conn.writer == nil {
+		return conn.Conn.Write(data)
+	}
+	encrypted := make([]byte, len(data))
+	conn.writer.XORKeyStream(encrypted, data)
+	return conn.Conn.Write(encrypted)
+}
+
+// IsEncrypted tells if the connection was made with the message stream encryption , and its stream is encrypted.
+func IsEncrypted(connection net.Conn) bool {
+	conn, isConn := connection.(*Conn)
+	return isConn && conn.Method == CRYPTO_RC4
+}
@@ -0,0 +1,140 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+var testInfoHash = bytes.Repeat([]byte{0xab}, 20)
+
+func knownInfoHashes() [][]byte {
+	return [][]byte{bytes.Repeat([]byte{0x01}, 20), testInfoHash}
+}
+
+type handshakeResult struct {
+	connection net.Conn
+	err        error
+}
+
+// connect makes a loopback connection , and does the handshake on both ends with the given policies.
+func connect(t *testing.T, initiatePolicy int, acceptPolicy int, infoHash []byte) (handshakeResult, handshakeResult) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			accepted <- handshakeResult{nil, err}
+			return
+		}
+		encrypted, err := Accept(connection, knownInfoHashes, acceptPolicy)
+		if err != nil {
+			connection.Close()
+		}
+		accepted <- handshakeResult{encrypted, err}
+	}()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if initiatePolicy == ENCRYPTION_DISABLED {
+		// A plaintext peer starts with its handshake.
+		connection.Write([]byte(PLAINTEXT_HEADER))
+	}
+	initiated, err := Initiate(connection, infoHash, initiatePolicy)
+	if err != nil {
+		connection.Close()
+	}
+	return handshakeResult{initiated, err}, <-accepted
+}
+
+// exchange checks that the data written on one end is read on the other , in both directions.
+func exchange(t *testing.T, first net.Conn, second net.Conn) {
+	for _, ends := range [][]net.Conn{{first, second}, {second, first}} {
+		data := []byte("hello , this is a message of the stream")
+		go ends[0].Write(data)
+		received := make([]byte, len(data))
+		if _, err := io.ReadFull(ends[1], received); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatalf("Expected %q , got %q", data, received)
+		}
+	}
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	for _, policies := range [][]int{
+		{ENCRYPTION_PREFERRED, ENCRYPTION_PREFERRED},
+		{ENCRYPTION_PREFERRED, ENCRYPTION_REQUIRED},
+		{ENCRYPTION_REQUIRED, ENCRYPTION_PREFERRED},
+		{ENCRYPTION_REQUIRED, ENCRYPTION_REQUIRED},
+	} {
+		initiated, accepted := connect(t, policies[0], policies[1], testInfoHash)
+		if initiated.err != nil || accepted.err != nil {
+			t.Fatalf("Policies %v : got errors %v and %v", policies, initiated.err, accepted.err)
+		}
+		if !IsEncrypted(initiated.connection) || !IsEncrypted(accepted.connection) {
+			t.Errorf("Policies %v : expected an encrypted connection", policies)
+		}
+		exchange(t, initiated.connection, accepted.connection)
+		initiated.connection.Close()
+		accepted.connection.Close()
+	}
+}
+
+func TestPlaintextConnection(t *testing.T) {
+	initiated, accepted := connect(t, ENCRYPTION_DISABLED, ENCRYPTION_PREFERRED, testInfoHash)
+	if initiated.err != nil || accepted.err != nil {
+		t.Fatalf("Got errors %v and %v", initiated.err, accepted.err)
+	}
+	defer initiated.connection.Close()
+	defer accepted.connection.Close()
+	if IsEncrypted(accepted.connection) {
+		t.Errorf("Expected a plaintext connection")
+	}
+
+	// The header read to recognize the plaintext handshake is given back.
+	header := make([]byte, len(PLAINTEXT_HEADER))
+	if _, err := io.ReadFull(accepted.connection, header); err != nil || string(header) != PLAINTEXT_HEADER {
+		t.Fatalf("Expected the plaintext header , got %q %v", header, err)
+	}
+	exchange(t, initiated.connection, accepted.connection)
+
+	initiated, accepted = connect(t, ENCRYPTION_DISABLED, ENCRYPTION_REQUIRED, testInfoHash)
+	if accepted.err == nil {
+		t.Errorf("Expected the plaintext connection to be refused")
+		accepted.connection.Close()
+	}
+	initiated.connection.Close()
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	initiated, accepted := connect(t, ENCRYPTION_PREFERRED, ENCRYPTION_PREFERRED, bytes.Repeat([]byte{0x02}, 20))
+	if accepted.err == nil {
+		t.Errorf("Expected an error for an unknown info hash")
+		accepted.connection.Close()
+	}
+	if initiated.err == nil {
+		t.Errorf("Expected the initiator to fail")
+		initiated.connection.Close()
+	}
+}
+
+func TestPolicyByName(t *testing.T) {
+	for name, expected := range map[string]int{"disabled": ENCRYPTION_DISABLED, "prefer": ENCRYPTION_PREFERRED, "require": ENCRYPTION_REQUIRED} {
+		if policy, err := PolicyByName(name); err != nil || policy != expected {
+			t.Errorf("Expected %d for %s , got %d %v", expected, name, policy, err)
+		}
+	}
+	if _, err := PolicyByName("always"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
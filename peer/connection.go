@@ -0,0 +1,312 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbpcr/Yomato/file_writer"
+)
+
+const (
+	MESSAGE_QUEUE_LENGTH  = 64
+	OUTBOUND_QUEUE_LENGTH = 256
+)
+
+// A peer which sends nothing , not even a keep alive , in this time is disconnected.
+const IDLE_TIMEOUT = 3 * time.Minute
+
+// Once a message started , the rest of it must arrive in this time.
+const MESSAGE_TIMEOUT = 20 * time.Second
+
+// A message which can't be written in this time breaks the connection.
+const WRITE_TIMEOUT = 30 * time.Second
+
+var errConnectionClosed = errors.New("Connection closed")
+
+// timeoutError is returned when no message arrived in time. It is a net.Error , like the timeouts of the connections.
+type timeoutError struct{}
+
+func (err timeoutError) Error() string   { return "Timeout while waiting for a message" }
+func (err timeoutError) Timeout() bool   { return true }
+func (err timeoutError) Temporary() bool { return true }
+
+// Message is a message received from the peer. When it is delivered , the peer already handled it:
+// its state , its bitfield and the blocks it requested from us are up to date.
+type Message struct {
+	Id    int                    // One of the message ids , or KEEP_ALIVE.
+	Block *file_writer.PieceData // The block of a PIECE message.
+}
+
+// messageQueues are the queues of a connection. The reader delivers the messages of the peer on messages,
+// and the writer sends the messages put on outbound. Both stop when closed is closed , and done is closed
+// once the reader exited.
+type messageQueues struct {
+	connection net.Conn
+	messages   chan Message
+	outbound   chan []byte
+	closed     chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// close stops the reader and the writer of the connection.
+func (queues *messageQueues) close() {
+	queues.closeOnce.Do(func() {
+		close(queues.closed)
+	})
+}
+
+// startMessageLoops starts the reader and the writer of the connection.
+// From now on , the messages are sent through the writer , and read from Messages.
+func (peer *Peer) startMessageLoops() {
+	queues := &messageQueues{
+		connection: peer.Connection,
+		messages:   make(chan Message, MESSAGE_QUEUE_LENGTH),
+		outbound:   make(chan []byte, OUTBOUND_QUEUE_LENGTH),
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	peer.sLocker.Lock()
+	peer.queues = queues
+	peer.sLocker.Unlock()
+	go peer.readLoop(peer.Connection, queues)
+	go peer.writeLoop(peer.Connection, queues)
+}
+
+// getQueues returns the queues of the connection , or nil if the message loops aren't running.
+func (peer *Peer) getQueues() *messageQueues {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.queues
+}
+
+// stopMessageLoops stops the reader and the writer of the connection , if they are running.
+// The connection is closed , so the reader isn't stuck in a read , and we wait for the reader to exit.
+// It must not be called by the reader itself.
+func (peer *Peer) stopMessageLoops() {
+	peer.sLocker.Lock()
+	queues := peer.queues
+	peer.queues = nil
+	peer.sLocker.Unlock()
+	if queues != nil {
+		queues.close()
+		queues.connection.Close()
+		<-queues.done
+	}
+}
+
+// readLoop reads and handles the messages of the peer , and delivers them on the messages queue.
+// When the connection breaks , the queue is closed.
+func (peer *Peer) readLoop(connection net.Conn, queues *messageQueues) {
+	defer close(queues.done)
+	defer close(queues.messages)
+	for {
+		id, data, err := readMessage(connection, IDLE_TIMEOUT, 17*1024)
+		if err != nil {
+			queues.close()
+			connection.Close()
+			return
+		}
+		select {
+		case <-queues.closed:
+			return
+		default:
+		}
+
+		message := Message{Id: id}
+		pieces, err := peer.handleMessage(id, data, nil)
+		if err != nil {
+			queues.close()
+			connection.Close()
+			return
+		}
+		if len(pieces) > 0 {
+			message.Block = &pieces[0]
+		}
+		select {
+		case queues.messages <- message:
+		case <-queues.closed:
+			return
+		}
+	}
+}
+
+// writeLoop writes the messages of the outbound queue on the connection , in order.
+func (peer *Peer) writeLoop(connection net.Conn, queues *messageQueues) {
+	for {
+		select {
+		case message := <-queues.outbound:
+			if err := writeExactly(connection, message, len(message)); err != nil {
+				queues.close()
+				connection.Close()
+				return
+			}
+		case <-queues.closed:
+			return
+		}
+	}
+}
+
+// send puts a message on the outbound queue. Before the message loops start , it is written directly.
+func (peer *Peer) send(message []byte) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	queues := peer.getQueues()
+	if queues == nil {
+		return writeExactly(peer.Connection, message, len(message))
+	}
+	select {
+	case <-queues.closed:
+		return errConnectionClosed
+	default:
+	}
+	select {
+	case queues.outbound <- message:
+		return nil
+	case <-queues.closed:
+		return errConnectionClosed
+	}
+}
+
+// Messages returns the queue of the messages received from the peer , which is closed when the connection breaks.
+// The peer must be consumed by only one reader. It is nil if the peer isn't connected.
+func (peer *Peer) Messages() <-chan Message {
+	queues := peer.getQueues()
+	if queues == nil {
+		return nil
+	}
+	return queues.messages
+}
+
+// nextMessage returns the next message of the peer , waiting at most timeout for it.
+// Before the message loops start , the message is read directly from the connection.
+func (peer *Peer) nextMessage(timeout time.Duration) (Message, error) {
+	queues := peer.getQueues()
+	if queues == nil {
+		id, data, err := peer.tryReadMessage(timeout, 17*1024)
+		if err != nil {
+			return Message{}, err
+		}
+		message := Message{Id: id}
+		pieces, err := peer.handleMessage(id, data, nil)
+		if err != nil {
+			peer.Connection.Close()
+			return Message{}, err
+		}
+		if len(pieces) > 0 {
+			message.Block = &pieces[0]
+		}
+		return message, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message, open := <-queues.messages:
+		if !open {
+			return Message{}, errConnectionClosed
+		}
+		return message, nil
+	case <-timer.C:
+		return Message{}, timeoutError{}
+	}
+}
+
+// IsPeerChoking tells if the peer chokes us.
+func (peer *Peer) IsPeerChoking() bool {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.peerChoking
+}
+
+// IsPeerInterested tells if the peer is interested in our pieces.
+func (peer *Peer) IsPeerInterested() bool {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.peerInterested
+}
+
+// IsClientChoking tells if we choke the peer.
+func (peer *Peer) IsClientChoking() bool {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.clientChoking
+}
+
+// IsClientInterested tells if we told the peer that we are interested in its pieces.
+func (peer *Peer) IsClientInterested() bool {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.clientInterested
+}
+
+// IsDownloading tells if we download from the peer.
+func (peer *Peer) IsDownloading() bool {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.downloading
+}
+
+// SetDownloading marks if we download from the peer.
+func (peer *Peer) SetDownloading(downloading bool) {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	peer.downloading = downloading
+}
+
+// setState sets one of the choke and interest flags of the peer.
+func (peer *Peer) setState(flag *bool, value bool) {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	*flag = value
+}
+
+// GetStatus tells if the peer is connected.
+func (peer *Peer) GetStatus() PeerStatus {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.status
+}
+
+// SetStatus marks the peer as connected or disconnected.
+func (peer *Peer) SetStatus(status PeerStatus) {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	peer.status = status
+}
+
+// GetDownloadRate returns how fast the peer sent us blocks , in bytes per second , at the last rechoke.
+func (peer *Peer) GetDownloadRate() float64 {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.downloadRate
+}
+
+// GetUploadRate returns how fast we sent blocks to the peer , in bytes per second , at the last rechoke.
+func (peer *Peer) GetUploadRate() float64 {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	return peer.uploadRate
+}
+
+// SetRates stores the rates of the peer measured by the choker.
+func (peer *Peer) SetRates(downloadRate float64, uploadRate float64) {
+	peer.sLocker.Lock()
+	defer peer.sLocker.Unlock()
+	peer.downloadRate = downloadRate
+	peer.uploadRate = uploadRate
+}
+
+// GetDownloaded returns how many bytes of blocks the peer sent us.
+func (peer *Peer) GetDownloaded() int64 {
+	return atomic.LoadInt64(&peer.Downloaded)
+}
+
+// GetUploaded returns how many bytes of blocks we sent the peer.
+func (peer *Peer) GetUploaded() int64 {
+	return atomic.LoadInt64(&peer.Uploaded)
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestMessageLoops(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x05}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+	leecher.Connection = local
+	leecher.SetStatus(CONNECTED)
+	leecher.startMessageLoops()
+	defer leecher.stopMessageLoops()
+
+	// The messages are handled by the reader , before they are delivered.
+	go func() {
+		remote.Write(append([]byte{0, 0, 0, 5, HAVE}, convertIntsToByteArray(2)...))
+		remote.Write([]byte{0, 0, 0, 1, UNCHOKE})
+	}()
+	messages := leecher.Messages()
+	if message := <-messages; message.Id != HAVE || !leecher.HasPiece(2) {
+		t.Fatalf("Expected a HAVE for piece 2 , got %v", message)
+	}
+	if message := <-messages; message.Id != UNCHOKE || leecher.IsPeerChoking() {
+		t.Fatalf("Expected the peer to unchoke us , got %v", message)
+	}
+
+	// The messages are written in order by the writer.
+	if err := leecher.SendInterested(); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if err := leecher.SendKeepAlive(); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	data := make([]byte, 9)
+	if _, err := io.ReadFull(remote, data); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !bytes.Equal(data, []byte{0, 0, 0, 1, INTERESTED, 0, 0, 0, 0}) {
+		t.Errorf("Wrong messages %x", data)
+	}
+	if !leecher.IsClientInterested() {
+		t.Errorf("Expected the client to be interested")
+	}
+
+	// When the connection breaks , the queue of the messages is closed.
+	remote.Close()
+	select {
+	case message, open := <-messages:
+		if open {
+			t.Errorf("Expected the queue to be closed , got %v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The queue wasn't closed")
+	}
+	if err := leecher.SendKeepAlive(); err == nil {
+		t.Errorf("Expected an error after the connection broke")
+	}
+}
+
+// blockingAvailability counts the pieces announced by the peers , minus the pieces they lost.
+// A piece is only counted once it is released , so the reader can be caught while it handles a message.
+type blockingAvailability struct {
+	count   int
+	entered chan bool
+	release chan bool
+	locker  sync.Mutex
+}
+
+func (availability *blockingAvailability) IncreaseAvailability(pieceIndex int) {
+	availability.entered <- true
+	<-availability.release
+	availability.locker.Lock()
+	defer availability.locker.Unlock()
+	availability.count++
+}
+
+func (availability *blockingAvailability) DecreaseAvailability(pieceIndex int) {
+	availability.locker.Lock()
+	defer availability.locker.Unlock()
+	availability.count--
+}
+
+func TestDisconnectWaitsForReader(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0e}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	availability := &blockingAvailability{entered: make(chan bool, 1), release: make(chan bool)}
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+	leecher.Connection = local
+	leecher.Availability = availability
+	leecher.SetStatus(CONNECTED)
+	leecher.startMessageLoops()
+
+	go remote.Write(append([]byte{0, 0, 0, 5, HAVE}, convertIntsToByteArray(1)...))
+	<-availability.entered
+	if !leecher.HasPiece(1) || leecher.IsSeed() {
+		t.Errorf("Expected the peer to have only piece 1")
+	}
+
+	// The reader is still handling the HAVE , so the state isn't reset before it exits.
+	disconnected := make(chan bool)
+	go func() {
+		leecher.Disconnect()
+		disconnected <- true
+	}()
+	select {
+	case <-disconnected:
+		t.Fatalf("Disconnect didn't wait for the reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(availability.release)
+	<-disconnected
+
+	if leecher.GetStatus() != DISCONNECTED || leecher.CountPieces() != 0 {
+		t.Errorf("Expected a disconnected peer without pieces , got %d pieces", leecher.CountPieces())
+	}
+	availability.locker.Lock()
+	defer availability.locker.Unlock()
+	if availability.count != 0 {
+		t.Errorf("Expected the lost pieces to be given back , got an availability of %d", availability.count)
+	}
+}
@@ -0,0 +1,244 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// The extension protocol is described here : http://www.bittorrent.org/beps/bep_0010.html
+const (
+	EXTENDED           = 20
+	EXTENDED_HANDSHAKE = 0
+)
+
+// The bit of the reserved bytes which tells that the extension protocol is supported.
+const (
+	EXTENSION_BYTE = 5
+	EXTENSION_BIT  = 0x10
+)
+
+const CLIENT_VERSION = "Yomato 0.1"
+
+// The holepunch extension only works over uTP , so the peers which support it also accept uTP connections.
+// It is described here : http://www.bittorrent.org/beps/bep_0055.html
+const UT_HOLEPUNCH = "ut_holepunch"
+
+// ExtensionHandler handles the extended messages of an extension , received from the peer.
+// The payload doesn't contain the extended message id.
+type ExtensionHandler func(peer *Peer, payload []byte)
+
+// DisconnectHandler is told that a peer disconnected , so the extensions can forget about it.
+type DisconnectHandler func(peer *Peer)
+
+// ExtensionRegistry holds the extensions we support for a torrent , with the ids we gave them,
+// and the values we send in the extended handshake.
+type ExtensionRegistry struct {
+	ListenPort   int
+	MetadataSize int
+
+	names              []string
+	handlers           []ExtensionHandler
+	disconnectHandlers []DisconnectHandler
+	locker             sync.Mutex
+}
+
+// NewExtensionRegistry returns a registry without extensions.
+func NewExtensionRegistry(listenPort int) *ExtensionRegistry {
+	return &ExtensionRegistry{ListenPort: listenPort}
+}
+
+// Register adds an extension , and returns the id of its messages sent to us.
+// Registering the same name again replaces its handler.
+func (registry *ExtensionRegistry) Register(name string, handler ExtensionHandler) int {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+	for index, registeredName := range registry.names {
+		if registeredName == name {
+			registry.handlers[index] = handler
+			return index + 1
+		}
+	}
+	registry.names = append(registry.names, name)
+	registry.handlers = append(registry.handlers, handler)
+	return len(registry.names)
+}
+
+// OnDisconnect adds a handler , which is called whenever a peer using the registry disconnects.
+func (registry *ExtensionRegistry) OnDisconnect(handler DisconnectHandler) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+	registry.disconnectHandlers = append(registry.disconnectHandlers, handler)
+}
+
+// peerDisconnected tells the disconnect handlers that the peer disconnected.
+func (registry *ExtensionRegistry) peerDisconnected(peer *Peer) {
+	registry.locker.Lock()
+	handlers := append([]DisconnectHandler{}, registry.disconnectHandlers...)
+	registry.locker.Unlock()
+	for _, handler := range handlers {
+		handler(peer)
+	}
+}
+
+// SetMetadataSize sets the size of the info dictionary , sent in the extended handshake.
+func (registry *ExtensionRegistry) SetMetadataSize(size int) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+	registry.MetadataSize = size
+}
+
+// getHandler returns the name and the handler of the extension with the given id.
+func (registry *ExtensionRegistry) getHandler(extendedId int) (string, ExtensionHandler) {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+	if extendedId <= 0 || extendedId > len(registry.names) {
+		return "", nil
+	}
+	return registry.names[extendedId-1], registry.handlers[extendedId-1]
+}
+
+// buildHandshake returns the bencoded extended handshake sent to the peer.
+func (registry *ExtensionRegistry) buildHandshake(remoteIP string) []byte {
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+
+	extensions := &bencode.Dictionary{Values: make(map[bencode.String]bencode.Bencoder)}
+	for index, name := range registry.names {
+		extensions.Values[bencode.String{Value: name}] = &bencode.Number{Value: int64(index + 1)}
+	}
+
+	handshake := &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "m"}:    extensions,
+		bencode.String{Value: "v"}:    &bencode.String{Value: CLIENT_VERSION},
+		bencode.String{Value: "reqq"}: &bencode.Number{Value: MAX_QUEUED_REQUESTS},
+	}}
+	if registry.ListenPort > 0 {
+		handshake.Values[bencode.String{Value: "p"}] = &bencode.Number{Value: int64(registry.ListenPort)}
+	}
+	if registry.MetadataSize > 0 {
+		handshake.Values[bencode.String{Value: "metadata_size"}] = &bencode.Number{Value: int64(registry.MetadataSize)}
+	}
+	if ip := net.ParseIP(remoteIP); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		handshake.Values[bencode.String{Value: "yourip"}] = &bencode.String{Value: string(ip)}
+	}
+	return handshake.Encode()
+}
+
+// SupportsExtensions tells if the peer set the extension bit in its handshake.
+func (peer *Peer) SupportsExtensions() bool {
+	return len(peer.Reserved) == 8 && peer.Reserved[EXTENSION_BYTE]&EXTENSION_BIT != 0
+}
+
+// SupportsExtension tells if the peer announced the extension in its extended handshake.
+func (peer *Peer) SupportsExtension(name string) bool {
+	peer.eLocker.Lock()
+	defer peer.eLocker.Unlock()
+	return peer.remoteExtensions[name] != 0
+}
+
+// sendExtendedMessage sends an extended message with the given extended id.
+func (peer *Peer) sendExtendedMessage(extendedId int, payload []byte) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := convertIntsToByteArray(2 + len(payload))
+	message = append(message, EXTENDED, byte(extendedId))
+	message = append(message, payload...)
+	return peer.send(message)
+}
+
+// sendExtendedHandshake sends our extended handshake , if both of us support the extension protocol.
+func (peer *Peer) sendExtendedHandshake() error {
+	if peer.Extensions == nil || !peer.SupportsExtensions() {
+		return nil
+	}
+	return peer.sendExtendedMessage(EXTENDED_HANDSHAKE, peer.Extensions.buildHandshake(peer.IP))
+}
+
+// IsUTPSupported tells if the peer accepts uTP connections , as far as we know.
+// The extended handshake of the peer can tell it while we read its messages.
+func (peer *Peer) IsUTPSupported() bool {
+	peer.eLocker.Lock()
+	defer peer.eLocker.Unlock()
+	return peer.SupportsUTP
+}
+
+// SendExtended sends a message of the extension , with the id the peer gave it.
+func (peer *Peer) SendExtended(name string, payload []byte) error {
+	peer.eLocker.Lock()
+	extendedId := peer.remoteExtensions[name]
+	peer.eLocker.Unlock()
+	if extendedId == 0 {
+		return errors.New("Peer doesn't support " + name)
+	}
+	return peer.sendExtendedMessage(extendedId, payload)
+}
+
+// parseExtendedHandshake stores what the peer told us in its extended handshake.
+// The extensions not mentioned keep their ids , and the ones with id 0 are disabled.
+func (peer *Peer) parseExtendedHandshake(payload []byte) {
+
+	dictionary, _, err := bencode.ParseDictionary(payload)
+	if err != nil {
+		return
+	}
+
+	peer.eLocker.Lock()
+	defer peer.eLocker.Unlock()
+
+	if extensions, isDictionary := dictionary.Values[bencode.String{Value: "m"}].(*bencode.Dictionary); isDictionary {
+		if peer.remoteExtensions == nil {
+			peer.remoteExtensions = make(map[string]int)
+		}
+		for name, value := range extensions.Values {
+			if extendedId, isNumber := value.(*bencode.Number); isNumber && extendedId.Value > 0 && extendedId.Value < 256 {
+				peer.remoteExtensions[name.Value] = int(extendedId.Value)
+			} else {
+				delete(peer.remoteExtensions, name.Value)
+			}
+		}
+	}
+	if _, holepunch := peer.remoteExtensions[UT_HOLEPUNCH]; holepunch {
+		peer.SupportsUTP = true
+	}
+	if version, isString := dictionary.Values[bencode.String{Value: "v"}].(*bencode.String); isString {
+		peer.ClientVersion = version.Value
+	}
+	if port, isNumber := dictionary.Values[bencode.String{Value: "p"}].(*bencode.Number); isNumber && port.Value > 0 && port.Value < 65536 {
+		peer.ListenPort = int(port.Value)
+	}
+	if maxRequests, isNumber := dictionary.Values[bencode.String{Value: "reqq"}].(*bencode.Number); isNumber && maxRequests.Value > 0 {
+		peer.MaxRequests = int(maxRequests.Value)
+	}
+	if yourIP, isString := dictionary.Values[bencode.String{Value: "yourip"}].(*bencode.String); isString && (len(yourIP.Value) == 4 || len(yourIP.Value) == 16) {
+		peer.YourIP = net.IP(yourIP.Value)
+	}
+	if metadataSize, isNumber := dictionary.Values[bencode.String{Value: "metadata_size"}].(*bencode.Number); isNumber && metadataSize.Value > 0 {
+		peer.MetadataSize = int(metadataSize.Value)
+	}
+}
+
+// handleExtended handles an extended message : the extended handshake , or a message
+// of one of the extensions from the registry.
+func (peer *Peer) handleExtended(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	extendedId := int(data[0])
+	if extendedId == EXTENDED_HANDSHAKE {
+		peer.parseExtendedHandshake(data[1:])
+		return
+	}
+	if peer.Extensions == nil {
+		return
+	}
+	if _, handler := peer.Extensions.getHandler(extendedId); handler != nil {
+		handler(peer, data[1:])
+	}
+}
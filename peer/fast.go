@@ -0,0 +1,226 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// The fast extension is described here : http://www.bittorrent.org/beps/bep_0006.html
+const (
+	SUGGEST_PIECE  = 13
+	HAVE_ALL       = 14
+	HAVE_NONE      = 15
+	REJECT_REQUEST = 16
+	ALLOWED_FAST   = 17
+)
+
+// The bit of the reserved bytes which tells that the fast extension is supported.
+const (
+	FAST_BYTE = 7
+	FAST_BIT  = 0x04
+)
+
+// How many pieces a peer may request while we choke it , and how many suggestions we remember.
+const (
+	ALLOWED_FAST_COUNT = 10
+	MAX_SUGGESTED      = 32
+)
+
+// A peer which sends the messages of the fast extension without supporting it is disconnected.
+var errFastNotSupported = errors.New("Fast extension message from a peer which doesn't support it")
+
+// isFastMessage tells if the message belongs to the fast extension.
+func isFastMessage(id int) bool {
+	return id >= SUGGEST_PIECE && id <= ALLOWED_FAST
+}
+
+// AllowedFastSet returns the pieces a peer with the given IPv4 address may request while choked,
+// computed with the canonical algorithm of the fast extension.
+func AllowedFastSet(count int, pieceCount int, infoHash []byte, ip net.IP) []int {
+
+	ipv4 := ip.To4()
+	if ipv4 == nil || pieceCount <= 0 {
+		return nil
+	}
+	if count > pieceCount {
+		count = pieceCount
+	}
+
+	// Only the /24 network of the peer is used , so peers can't get more pieces by using more addresses.
+	hash := make([]byte, 0, 4+len(infoHash))
+	hash = append(hash, ipv4[0], ipv4[1], ipv4[2], 0)
+	hash = append(hash, infoHash...)
+
+	pieces := []int{}
+	known := make(map[int]bool)
+	for len(pieces) < count {
+		sum := sha1.Sum(hash)
+		hash = sum[:]
+		for start := 0; start < len(hash) && len(pieces) < count; start += 4 {
+			pieceIndex := int(binary.BigEndian.Uint32(hash[start:start+4]) % uint32(pieceCount))
+			if !known[pieceIndex] {
+				known[pieceIndex] = true
+				pieces = append(pieces, pieceIndex)
+			}
+		}
+	}
+	return pieces
+}
+
+// SupportsFast tells if both of us support the fast extension.
+func (peer *Peer) SupportsFast() bool {
+	return len(peer.Reserved) == 8 && peer.Reserved[FAST_BYTE]&FAST_BIT != 0
+}
+
+// sendPieceMessage sends a message whose payload is a piece index : SUGGEST_PIECE or ALLOWED_FAST.
+func (peer *Peer) sendPieceMessage(id int, pieceIndex int) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := convertIntsToByteArray(5)
+	message = append(message, byte(id))
+	message = append(message, convertIntsToByteArray(pieceIndex)...)
+	return peer.send(message)
+}
+
+// sendHaveAll tells the peer that we have all the pieces , instead of sending the bitfield.
+func (peer *Peer) sendHaveAll() error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := []byte{0, 0, 0, 1, HAVE_ALL}
+	return peer.send(message)
+}
+
+// sendHaveNone tells the peer that we have no pieces , instead of sending the bitfield.
+func (peer *Peer) sendHaveNone() error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := []byte{0, 0, 0, 1, HAVE_NONE}
+	return peer.send(message)
+}
+
+// sendReject tells the peer that we won't send the block it requested.
+func (peer *Peer) sendReject(request BlockRequest) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := convertIntsToByteArray(13)
+	message = append(message, REJECT_REQUEST)
+	message = append(message, convertIntsToByteArray(request.PieceNumber, request.Offset, request.Length)...)
+	return peer.send(message)
+}
+
+// SendSuggest suggests the peer to download the piece , for example because it is in our cache.
+func (peer *Peer) SendSuggest(pieceIndex int) error {
+	if !peer.SupportsFast() {
+		return errors.New("Peer doesn't support the fast extension")
+	}
+	return peer.sendPieceMessage(SUGGEST_PIECE, pieceIndex)
+}
+
+// sendAllowedFast computes the pieces the peer may request while we choke it , and sends them.
+// Peers with IPv6 addresses get none , since the canonical algorithm only covers IPv4.
+func (peer *Peer) sendAllowedFast() error {
+	pieces := AllowedFastSet(ALLOWED_FAST_COUNT, int(peer.TorrentInfo.FileInformations.PieceCount), peer.TorrentInfo.InfoHash, net.ParseIP(peer.IP))
+
+	peer.rLocker.Lock()
+	peer.allowedFastForPeer = make(map[int]bool)
+	for _, pieceIndex := range pieces {
+		peer.allowedFastForPeer[pieceIndex] = true
+	}
+	peer.rLocker.Unlock()
+
+	for _, pieceIndex := range pieces {
+		if err := peer.sendPieceMessage(ALLOWED_FAST, pieceIndex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isAllowedFastForPeer tells if the peer may request the piece while we choke it.
+// The caller must hold rLocker.
+func (peer *Peer) isAllowedFastForPeer(pieceIndex int) bool {
+	return peer.allowedFastForPeer[pieceIndex]
+}
+
+// setHaveAll marks that the peer has all the pieces.
+func (peer *Peer) setHaveAll() {
+	for pieceIndex := 0; pieceIndex < int(peer.TorrentInfo.FileInformations.PieceCount); pieceIndex++ {
+		peer.setHave(pieceIndex)
+	}
+}
+
+// addSuggested remembers a piece the peer suggested us , the most recent first.
+func (peer *Peer) addSuggested(pieceIndex int) {
+	if pieceIndex < 0 || pieceIndex >= int(peer.TorrentInfo.FileInformations.PieceCount) {
+		return
+	}
+	peer.fLocker.Lock()
+	defer peer.fLocker.Unlock()
+	for index, suggested := range peer.suggested {
+		if suggested == pieceIndex {
+			peer.suggested = append(peer.suggested[:index], peer.suggested[index+1:]...)
+			break
+		}
+	}
+	peer.suggested = append([]int{pieceIndex}, peer.suggested...)
+	if len(peer.suggested) > MAX_SUGGESTED {
+		peer.suggested = peer.suggested[:MAX_SUGGESTED]
+	}
+}
+
+// GetSuggestedPieces returns the pieces the peer suggested us , the most recent first.
+func (peer *Peer) GetSuggestedPieces() []int {
+	peer.fLocker.Lock()
+	defer peer.fLocker.Unlock()
+	return append([]int{}, peer.suggested...)
+}
+
+// addAllowedFast remembers a piece we may request while the peer chokes us.
+func (peer *Peer) addAllowedFast(pieceIndex int) {
+	if pieceIndex < 0 || pieceIndex >= int(peer.TorrentInfo.FileInformations.PieceCount) {
+		return
+	}
+	peer.fLocker.Lock()
+	defer peer.fLocker.Unlock()
+	if peer.allowedFast == nil {
+		peer.allowedFast = make(map[int]bool)
+	}
+	peer.allowedFast[pieceIndex] = true
+}
+
+// IsAllowedFast tells if we may request the piece while the peer chokes us.
+func (peer *Peer) IsAllowedFast(pieceIndex int) bool {
+	peer.fLocker.Lock()
+	defer peer.fLocker.Unlock()
+	return peer.allowedFast[pieceIndex]
+}
+
+// handleReject handles a request the peer rejected.
+// A piece rejected while we are choked is no longer allowed fast , so we don't ask for it again.
+func (peer *Peer) handleReject(data []byte) {
+	request, err := parseRequest(data)
+	if err != nil {
+		return
+	}
+	peer.Rejected++
+	peer.dropPending(request)
+	if peer.IsPeerChoking() {
+		peer.fLocker.Lock()
+		delete(peer.allowedFast, request.PieceNumber)
+		peer.fLocker.Unlock()
+	}
+}
+
+// rejectRequest tells the peer that we won't send the block , if the fast extension is supported.
+// Otherwise the request is silently dropped.
+func (peer *Peer) rejectRequest(request BlockRequest) {
+	if peer.SupportsFast() {
+		peer.sendReject(request)
+	}
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The examples of the specification.
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+
+	for _, count := range []int{7, 9} {
+		pieces := AllowedFastSet(count, 1313, infoHash, net.ParseIP("80.4.4.200"))
+		if len(pieces) != count {
+			t.Fatalf("Expected %d pieces , got %v", count, pieces)
+		}
+		for index, pieceIndex := range pieces {
+			if pieceIndex != expected[index] {
+				t.Errorf("Expected %v , got %v", expected[:count], pieces)
+				break
+			}
+		}
+	}
+
+	if pieces := AllowedFastSet(10, 5, infoHash, net.ParseIP("80.4.4.200")); len(pieces) != 5 {
+		t.Errorf("Expected all the 5 pieces , got %v", pieces)
+	}
+	if pieces := AllowedFastSet(10, 1313, infoHash, net.ParseIP("2001:db8::1")); pieces != nil {
+		t.Errorf("Expected no pieces for IPv6 , got %v", pieces)
+	}
+}
+
+type zeroReader struct{}
+
+func (reader zeroReader) ReadBlock(pieceIndex int, offset int, length int) ([]byte, error) {
+	return make([]byte, length), nil
+}
+
+func TestFastConnection(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x01}, 20)}
+	torrentInfo.FileInformations.PieceCount = 20
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 20 * 16384
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+
+	allPieces := bitfield.NewShared(20)
+	for pieceIndex := 0; pieceIndex < 20; pieceIndex++ {
+		allPieces.Set(pieceIndex, true)
+	}
+	noPieces := bitfield.NewShared(20)
+
+	seeder := New(torrentInfo, "-XX0000-000000000000", "127.0.0.1", 0)
+	seederComm := make(chan ConnectionCommunication, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		handshake, err := ReadHandshake(connection)
+		if err != nil {
+			seederComm <- ConnectionCommunication{nil, "ERROR:" + err.Error(), 0}
+			return
+		}
+		seeder.EstablishIncomingConnection(connection, handshake, seederComm, allPieces)
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", port)
+	leecherComm := make(chan ConnectionCommunication, 1)
+	go leecher.EstablishFullConnection(leecherComm, noPieces)
+
+	for _, comm := range []chan ConnectionCommunication{seederComm, leecherComm} {
+		if result := <-comm; result.StatusMessage != "OK" {
+			t.Fatalf("Got error: %s", result.StatusMessage)
+		}
+	}
+	defer seeder.Disconnect()
+	defer leecher.Disconnect()
+
+	if !leecher.SupportsFast() || !seeder.SupportsFast() {
+		t.Fatalf("The fast extension wasn't negotiated")
+	}
+	if leecher.CountPieces() != 20 || seeder.CountPieces() != 0 {
+		t.Errorf("HAVE_ALL / HAVE_NONE not handled : %d and %d pieces", leecher.CountPieces(), seeder.CountPieces())
+	}
+
+	allowed := AllowedFastSet(ALLOWED_FAST_COUNT, 20, torrentInfo.InfoHash, net.ParseIP("127.0.0.1"))
+	notAllowed := -1
+	for pieceIndex := 0; pieceIndex < 20; pieceIndex++ {
+		if leecher.IsAllowedFast(pieceIndex) {
+			continue
+		}
+		notAllowed = pieceIndex
+		for _, allowedPiece := range allowed {
+			if allowedPiece == pieceIndex {
+				t.Errorf("Piece %d should be allowed fast", pieceIndex)
+			}
+		}
+	}
+
+	// While choked , the allowed fast piece is served and the other one is rejected.
+	if err := leecher.WriteRequest([]int{allowed[0], 0, 16384, notAllowed, 0, 16384, 99, 0, 16384}); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	for request := 0; request < 3; request++ {
+		if err := seeder.ReadMessage(time.Second); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+	}
+	if seeder.CountQueuedRequests() != 1 {
+		t.Errorf("Expected 1 queued request , got %d", seeder.CountQueuedRequests())
+	}
+	if uploaded, err := seeder.ServeRequests(zeroReader{}); err != nil || uploaded != 16384 {
+		t.Errorf("Expected to upload the allowed fast block , got %d %v", uploaded, err)
+	}
+
+	pieces := leecher.ReadMessages(3, time.Second)
+	if len(pieces) != 1 || pieces[0].PieceNumber != allowed[0] {
+		t.Errorf("Expected the allowed fast block , got %d blocks", len(pieces))
+	}
+	if leecher.Rejected != 2 {
+		t.Errorf("Expected 2 rejected requests , got %d", leecher.Rejected)
+	}
+}
+
+func TestSendPieces(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0c}, 20)}
+	torrentInfo.FileInformations.PieceCount = 8
+
+	allPieces := bitfield.New(8)
+	for pieceIndex := 0; pieceIndex < 8; pieceIndex++ {
+		allPieces.Set(pieceIndex, true)
+	}
+	somePieces := bitfield.New(8)
+	somePieces.Set(3, true)
+	noPieces := bitfield.New(8)
+	unknownPieces := bitfield.New(0)
+
+	tests := []struct {
+		clientBitfield bitfield.Bitfield
+		expected       byte
+	}{
+		{allPieces, HAVE_ALL},
+		{somePieces, BITFIELD},
+		{noPieces, HAVE_NONE},
+		// Without the metadata we have no pieces , even if the empty bitfield has all its bits set.
+		{unknownPieces, HAVE_NONE},
+	}
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		fastPeer := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+		fastPeer.Connection = local
+		fastPeer.SetStatus(CONNECTED)
+		fastPeer.Reserved = make([]byte, 8)
+		fastPeer.Reserved[FAST_BYTE] |= FAST_BIT
+		fastPeer.startMessageLoops()
+
+		if err := fastPeer.sendPieces(&test.clientBitfield); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		message := make([]byte, 5)
+		if err := readExactly(remote, message, len(message)); err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		if message[4] != test.expected {
+			t.Errorf("Expected message %d for %d of %d pieces , got %d", test.expected, test.clientBitfield.OneBits, test.clientBitfield.Length, message[4])
+		}
+		fastPeer.stopMessageLoops()
+		remote.Close()
+	}
+}
+
+func TestFastMessagesWithoutFast(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0d}, 20)}
+	torrentInfo.FileInformations.PieceCount = 8
+	torrentInfo.FileInformations.PieceLength = 16384
+
+	messages := [][]byte{
+		{0, 0, 0, 1, HAVE_ALL},
+		{0, 0, 0, 1, HAVE_NONE},
+		{0, 0, 0, 5, SUGGEST_PIECE, 0, 0, 0, 3},
+		{0, 0, 0, 5, ALLOWED_FAST, 0, 0, 0, 3},
+		{0, 0, 0, 13, REJECT_REQUEST, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0x40, 0},
+	}
+	for _, message := range messages {
+		for _, supportsFast := range []bool{true, false} {
+			local, remote := net.Pipe()
+			remotePeer := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+			remotePeer.Connection = local
+			remotePeer.SetStatus(CONNECTED)
+			remotePeer.Reserved = make([]byte, 8)
+			if supportsFast {
+				remotePeer.Reserved[FAST_BYTE] |= FAST_BIT
+			}
+			remotePeer.startMessageLoops()
+			go remote.Write(message)
+
+			// The message is delivered , unless the peer didn't negotiate the fast extension : then the connection is closed.
+			received, open := <-remotePeer.Messages()
+			if supportsFast && (!open || received.Id != int(message[4])) {
+				t.Errorf("Expected message %d to be delivered , got %v", message[4], received)
+			}
+			if !supportsFast && open {
+				t.Errorf("Expected the connection to close after message %d , got %v", message[4], received)
+			}
+			remotePeer.stopMessageLoops()
+			remote.Close()
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package peer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bbpcr/Yomato/bitfield"
 	"github.com/bbpcr/Yomato/file_writer"
+	"github.com/bbpcr/Yomato/mse"
 	"github.com/bbpcr/Yomato/torrent_info"
+	"github.com/bbpcr/Yomato/utp"
 )
 
 type PeerStatus int
@@ -25,26 +31,97 @@ type ConnectionCommunication struct {
 	Duration      time.Duration
 }
 
+// BlockRequest is a block which the peer requested from us.
+type BlockRequest struct {
+	PieceNumber int
+	Offset      int
+	Length      int
+}
+
+// BlockReader reads back the blocks we upload to peers.
+type BlockReader interface {
+	ReadBlock(pieceIndex int, offset int, length int) ([]byte, error)
+}
+
+// AvailabilityCounter counts how many peers have each piece.
+// It is told about the pieces a peer announced , and about the pieces it lost when it disconnected.
+type AvailabilityCounter interface {
+	IncreaseAvailability(pieceIndex int)
+	DecreaseAvailability(pieceIndex int)
+}
+
 type Peer struct {
-	IP           string
-	Port         int
-	Connection   *net.TCPConn
-	Protocol     string
-	Status       PeerStatus
-	TorrentInfo  *torrent_info.TorrentInfo
-	LocalPeerId  string
-	RemotePeerId string
-	BitfieldInfo bitfield.Bitfield
-
-	ClientChoking    bool
-	ClientInterested bool
-	PeerChoking      bool
-	PeerInterested   bool
-
-	Downloading bool
-	Active      bool
+	IP             string
+	Port           int
+	Incoming       bool // The peer connected to us , so Port is the one it connected from , not the one it listens on.
+	Connection     net.Conn
+	Protocol       string
+	TorrentInfo    *torrent_info.TorrentInfo
+	LocalPeerId    string
+	RemotePeerId   string
+	ClientBitfield *bitfield.Shared
+	Availability   AvailabilityCounter
+	Reserved       []byte
+	Extensions     *ExtensionRegistry
+	Encryption     int // The encryption policy , one of the mse constants.
+
+	// When the peer supports uTP , we connect with it over UTPSocket first , then over TCP if it fails.
+	UTPSocket   *utp.Socket
+	SupportsUTP bool
+	UsesUTP     bool
+
+	// Sent by the peer in its extended handshake.
+	ClientVersion string
+	ListenPort    int
+	MaxRequests   int
+	YourIP        net.IP
+	MetadataSize  int
 
 	ConnectTime time.Duration
+	Uploaded    int64
+	Downloaded  int64
+	Rejected    int
+
+	// Rates in bytes per second , measured by the choker , guarded by sLocker.
+	downloadRate float64
+	uploadRate   float64
+
+	requests           []BlockRequest
+	allowedFastForPeer map[int]bool
+	rLocker            *sync.Mutex
+	remoteExtensions   map[string]int
+	eLocker            *sync.Mutex
+	allowedFast        map[int]bool
+	suggested          []int
+	fLocker            *sync.Mutex
+	pending            []pendingRequest
+	cancelled          []pendingRequest
+	dropped            []BlockRequest
+	pipelineRate       float64
+	rateBytes          int64
+	rateStart          time.Time
+	pLocker            *sync.Mutex
+
+	// The state of the connection , which the reader of the connection changes , guarded by sLocker.
+	clientChoking    bool
+	clientInterested bool
+	peerChoking      bool
+	peerInterested   bool
+	downloading      bool
+	queues           *messageQueues
+	status           PeerStatus
+	sLocker          *sync.Mutex
+
+	// The pieces the peer has , which the reader of the connection changes , guarded by bLocker.
+	pieces  bitfield.Bitfield
+	bLocker *sync.Mutex
+}
+
+// Handshake is the handshake received from a peer.
+type Handshake struct {
+	Reserved []byte
+	InfoHash []byte
+	PeerId   string
 }
 
 const (
@@ -61,14 +138,27 @@ const (
 	HANDSHAKE      = 10
 )
 
+// A keep alive has no id.
+const KEEP_ALIVE = -1
+
+const (
+	MAX_REQUEST_LENGTH  = 1 << 17
+	MAX_QUEUED_REQUESTS = 250
+)
+
+const PROTOCOL_STRING = "BitTorrent protocol"
+
+// A peer which doesn't answer over uTP in this time is connected over TCP.
+const UTP_CONNECT_TIMEOUT = 3 * time.Second
+
 // GetInfo return a string consisting of peer status
 func (peer *Peer) GetInfo() string {
-	infoString := fmt.Sprintf("Remote IP : %s:%d", peer.IP, peer.Port)
+	infoString := fmt.Sprintf("Remote IP : %s", net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)))
 	infoString += fmt.Sprintln()
 	infoString += fmt.Sprintln("Remote peer ID : ", peer.RemotePeerId)
 	infoString += fmt.Sprintln("Remote peer ID length : ", len(peer.RemotePeerId))
 	infoString += fmt.Sprintln("Protocol : ", peer.Protocol)
-	switch peer.Status {
+	switch peer.GetStatus() {
 	case DISCONNECTED:
 		infoString += fmt.Sprintln("Status : DISCONNECTED")
 	case CONNECTED:
@@ -79,8 +169,22 @@ func (peer *Peer) GetInfo() string {
 	infoString += fmt.Sprintln("Local peer ID : ", peer.LocalPeerId)
 	return infoString
 }
+
+// connect makes the connection to the peer , over uTP if it supports it , otherwise over TCP.
+// A peer which doesn't answer over uTP is marked as not supporting it , so we don't try again.
 func (peer *Peer) connect() error {
-	tcpAdress, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+	address := net.JoinHostPort(peer.IP, strconv.Itoa(peer.DialPort()))
+	if peer.UTPSocket != nil && peer.SupportsUTP {
+		connection, err := peer.UTPSocket.Dial(address, UTP_CONNECT_TIMEOUT)
+		if err == nil {
+			peer.Connection = connection
+			peer.UsesUTP = true
+			return nil
+		}
+		peer.SupportsUTP = false
+	}
+
+	tcpAdress, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return err
 	}
@@ -93,10 +197,11 @@ func (peer *Peer) connect() error {
 	tcpConnection.SetReadBuffer(64 * 1024)
 	tcpConnection.SetLinger(0)
 	peer.Connection = tcpConnection
+	peer.UsesUTP = false
 	return nil
 }
 
-func readExactly(connection *net.TCPConn, buffer []byte, length int) error {
+func readExactly(connection net.Conn, buffer []byte, length int) error {
 	bytesReaded := 0
 
 	if length > len(buffer) || length < 0 {
@@ -112,14 +217,14 @@ func readExactly(connection *net.TCPConn, buffer []byte, length int) error {
 	return nil
 }
 
-func writeExactly(connection *net.TCPConn, buffer []byte, length int) error {
+func writeExactly(connection net.Conn, buffer []byte, length int) error {
 
 	if length > len(buffer) || length < 0 {
 		return errors.New("Invalid parameters")
 	}
 
 	bytesWritten := 0
-	connection.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	connection.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
 	for bytesWritten < length {
 		written, err := connection.Write(buffer[bytesWritten:length])
 		if err != nil {
@@ -134,53 +239,65 @@ func writeExactly(connection *net.TCPConn, buffer []byte, length int) error {
 // tryReadMessage returns (type of messasge, message, error) received by a peer
 func (peer *Peer) tryReadMessage(timeout time.Duration, maxBufferSize int) (int, []byte, error) {
 
-	if peer.Status != CONNECTED {
+	if peer.GetStatus() != CONNECTED {
 		return -1, nil, errors.New("Peer not connected")
 	}
-	// First we read the first 5 bytes;
+	return readMessage(peer.Connection, timeout, maxBufferSize)
+}
+
+// readMessage returns (type of messasge, message, error) read from the connection.
+// The timeout is for the start of the message. Once it started , the rest of it gets MESSAGE_TIMEOUT,
+// so a slow message isn't cut in the middle , which would break the stream.
+// A keep alive returns KEEP_ALIVE and no data.
+func readMessage(connection net.Conn, timeout time.Duration, maxBufferSize int) (int, []byte, error) {
+
+	// First we read the first byte;
 	if timeout == 0 {
-		peer.Connection.SetReadDeadline(time.Time{})
+		connection.SetReadDeadline(time.Time{})
 	} else {
-		peer.Connection.SetReadDeadline(time.Now().Add(timeout))
+		connection.SetReadDeadline(time.Now().Add(timeout))
 	}
 
 	buffer := make([]byte, maxBufferSize)
-	err := readExactly(peer.Connection, buffer, 5)
-
+	err := readExactly(connection, buffer, 1)
 	if err != nil {
 		return -1, nil, err
 	}
+	connection.SetReadDeadline(time.Now().Add(MESSAGE_TIMEOUT))
 
-	// Then we convert the first 4 bytes into length , 5-th byte into id , and we read the rest of the data
-
+	// Then we convert the first 4 bytes into length , and we read the rest of the data , starting with the id
+	err = readExactly(connection, buffer[1:], 3)
+	if err != nil {
+		return -1, nil, err
+	}
 	length := int(binary.BigEndian.Uint32(buffer[0:4]))
-	id := int(buffer[4])
-
-	err = readExactly(peer.Connection, buffer, length-1)
+	if length == 0 {
+		return KEEP_ALIVE, nil, nil
+	}
 
+	err = readExactly(connection, buffer, length)
 	if err != nil {
 		return -1, nil, err
 	}
-	return id, buffer[0 : length-1], nil
+	return int(buffer[0]), buffer[1:length], nil
 }
 
 func (peer *Peer) sendBitfield(bitfieldBytes []byte) error {
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 		id := BITFIELD
 		length := 1 + len(bitfieldBytes)
 		messageBytes := convertIntsToByteArray(length)
 		messageBytes = append(messageBytes, byte(id))
 		messageBytes = append(messageBytes, bitfieldBytes...)
-		return writeExactly(peer.Connection, messageBytes, len(messageBytes))
+		return peer.send(messageBytes)
 	}
 	return errors.New("Peer not connected")
 }
 
 func (peer *Peer) sendKeepAlive() error {
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
-		buf := []byte{0, 0, 0, 0}
-		return writeExactly(peer.Connection, buf, len(buf))
+		return peer.send([]byte{0, 0, 0, 0})
 	}
 	return errors.New("Peer not connected")
 }
@@ -189,12 +306,33 @@ func (peer *Peer) sendKeepAlive() error {
 // The message is exactly : [0, 0, 0, 1, 0] (first four bytes length = 1 , last byte the id of the message = 0).
 // Peers wont respond to block requests if they are choked and uninterested.
 func (peer *Peer) sendChoke() error {
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
-		buf := []byte{0, 0, 0, 1, CHOKE}
-		err := writeExactly(peer.Connection, buf, len(buf))
+		err := peer.send([]byte{0, 0, 0, 1, CHOKE})
 		if err == nil {
-			peer.ClientChoking = true
+			peer.setState(&peer.clientChoking, true)
+
+			// After we choke a peer , it knows that all its requests were discarded.
+			// With the fast extension , they must be rejected , except the allowed fast ones.
+			rejected := []BlockRequest{}
+			peer.rLocker.Lock()
+			if peer.SupportsFast() {
+				kept := []BlockRequest{}
+				for _, request := range peer.requests {
+					if peer.isAllowedFastForPeer(request.PieceNumber) {
+						kept = append(kept, request)
+					} else {
+						rejected = append(rejected, request)
+					}
+				}
+				peer.requests = kept
+			} else {
+				peer.requests = nil
+			}
+			peer.rLocker.Unlock()
+			for _, request := range rejected {
+				peer.sendReject(request)
+			}
 		}
 		return err
 	}
@@ -206,12 +344,11 @@ func (peer *Peer) sendChoke() error {
 // Peers wont respond to block requests if they are choked and uninterested.
 func (peer *Peer) sendUnchoke() error {
 
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
-		buf := []byte{0, 0, 0, 1, UNCHOKE}
-		err := writeExactly(peer.Connection, buf, len(buf))
+		err := peer.send([]byte{0, 0, 0, 1, UNCHOKE})
 		if err == nil {
-			peer.ClientChoking = false
+			peer.setState(&peer.clientChoking, false)
 		}
 		return err
 	}
@@ -223,61 +360,328 @@ func (peer *Peer) sendUnchoke() error {
 // Peers wont respond to block requests if they are choked and uninterested.
 func (peer *Peer) sendInterested() error {
 
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
-		buf := []byte{0, 0, 0, 1, INTERESTED}
-		err := writeExactly(peer.Connection, buf, len(buf))
+		err := peer.send([]byte{0, 0, 0, 1, INTERESTED})
 		if err == nil {
-			peer.ClientInterested = true
+			peer.setState(&peer.clientInterested, true)
 		}
 		return err
 	}
 	return errors.New("Peer not connected")
 }
 
-// This function reads messages , and parses them.
+// This function reads messages , and returns the blocks among them.
+// It stops after maxMessages , when no message arrived in messageTimeoutDuration , or when the peer chokes us.
 func (peer *Peer) readMessages(maxMessages int, messageTimeoutDuration time.Duration) []file_writer.PieceData {
 
 	pieces := make([]file_writer.PieceData, 0)
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
 		for messageIndex := 0; messageIndex < maxMessages; messageIndex++ {
 
-			id, data, err := peer.tryReadMessage(messageTimeoutDuration, 17*1024)
+			message, err := peer.nextMessage(messageTimeoutDuration)
 			if err != nil {
 				break
 			}
-			if id == BITFIELD {
+			if message.Block != nil {
+				pieces = append(pieces, *message.Block)
+			}
+			if message.Id == CHOKE {
+				break
+			}
+		}
+	}
+	return pieces
+}
 
-				peer.BitfieldInfo.Put(data, len(data))
-			} else if id == HAVE {
+// handleMessage parses a message received from the peer.
+// The blocks received are appended to pieces.
+// It returns an error if the peer broke the protocol , and must be disconnected.
+func (peer *Peer) handleMessage(id int, data []byte, pieces []file_writer.PieceData) ([]file_writer.PieceData, error) {
 
-				pieceIndex := int(binary.BigEndian.Uint32(data))
-				peer.BitfieldInfo.Set(pieceIndex, true)
-			} else if id == UNCHOKE {
+	if isFastMessage(id) && !peer.SupportsFast() {
+		return pieces, errFastNotSupported
+	}
 
-				peer.PeerChoking = false
-			} else if id == CHOKE {
+	if id == BITFIELD {
 
-				peer.PeerChoking = true
-				break
-			} else if id == INTERESTED {
+		peer.putBitfield(data)
+	} else if id == HAVE {
+
+		if len(data) == 4 {
+			peer.setHave(int(binary.BigEndian.Uint32(data)))
+		}
+	} else if id == UNCHOKE {
+
+		peer.setState(&peer.peerChoking, false)
+	} else if id == CHOKE {
+
+		peer.setState(&peer.peerChoking, true)
+		peer.dropAllPending()
+	} else if id == INTERESTED {
 
-				peer.PeerInterested = true
-			} else if id == NOT_INTERESTED {
+		peer.setState(&peer.peerInterested, true)
+	} else if id == NOT_INTERESTED {
 
-				peer.PeerInterested = false
-			} else if id == PIECE {
+		peer.setState(&peer.peerInterested, false)
+	} else if id == PIECE {
 
-				var pieceData file_writer.PieceData
-				pieceData.PieceNumber = int(binary.BigEndian.Uint32(data[0:4]))
-				pieceData.Offset = int(binary.BigEndian.Uint32(data[4:8]))
-				pieceData.Piece = data[8:]
+		if len(data) >= 8 {
+			var pieceData file_writer.PieceData
+			pieceData.PieceNumber = int(binary.BigEndian.Uint32(data[0:4]))
+			pieceData.Offset = int(binary.BigEndian.Uint32(data[4:8]))
+			pieceData.Piece = data[8:]
+
+			// The blocks we didn't request are neither delivered nor counted.
+			if peer.receivePending(pieceData) {
 				pieces = append(pieces, pieceData)
+				atomic.AddInt64(&peer.Downloaded, int64(len(pieceData.Piece)))
 			}
 		}
+	} else if id == REQUEST {
+
+		peer.queueRequest(data)
+	} else if id == CANCEL {
+
+		peer.cancelRequest(data)
+	} else if id == EXTENDED {
+
+		peer.handleExtended(data)
+	} else if id == HAVE_ALL {
+
+		peer.setHaveAll()
+	} else if id == HAVE_NONE {
+
+		// The bitfield is already empty.
+	} else if id == SUGGEST_PIECE {
+
+		if len(data) == 4 {
+			peer.addSuggested(int(binary.BigEndian.Uint32(data)))
+		}
+	} else if id == ALLOWED_FAST {
+
+		if len(data) == 4 {
+			peer.addAllowedFast(int(binary.BigEndian.Uint32(data)))
+		}
+	} else if id == REJECT_REQUEST {
+
+		peer.handleReject(data)
+	}
+	return pieces, nil
+}
+
+// ReadMessage waits for one message , for connections which don't download blocks.
+// The blocks received are dropped. It returns the error of the connection , if any.
+func (peer *Peer) ReadMessage(timeout time.Duration) error {
+	_, err := peer.nextMessage(timeout)
+	return err
+}
+
+// putBitfield stores the bitfield sent by the peer , and counts the new pieces in the availability.
+func (peer *Peer) putBitfield(data []byte) {
+
+	pieceCount := int(peer.TorrentInfo.FileInformations.PieceCount)
+	if len(data) > (pieceCount+7)/8 {
+		data = data[:(pieceCount+7)/8]
+	}
+	newPieces := []int{}
+	peer.bLocker.Lock()
+	for pieceIndex := 0; pieceIndex < pieceCount && pieceIndex/8 < len(data); pieceIndex++ {
+		if data[pieceIndex/8]&(1<<(7-uint(pieceIndex%8))) != 0 && !peer.pieces.At(pieceIndex) {
+			newPieces = append(newPieces, pieceIndex)
+		}
+	}
+	peer.pieces.Put(data, len(data))
+	peer.bLocker.Unlock()
+
+	// The availability is counted outside of bLocker , because the pieces manager checks the pieces under its own lock.
+	if peer.Availability != nil {
+		for _, pieceIndex := range newPieces {
+			peer.Availability.IncreaseAvailability(pieceIndex)
+		}
 	}
-	return pieces
+}
+
+// setHave marks that the peer has the piece , and counts it in the availability.
+func (peer *Peer) setHave(pieceIndex int) {
+
+	if pieceIndex < 0 || pieceIndex >= int(peer.TorrentInfo.FileInformations.PieceCount) {
+		return
+	}
+	peer.bLocker.Lock()
+	hadPiece := peer.pieces.At(pieceIndex)
+	peer.pieces.Set(pieceIndex, true)
+	peer.bLocker.Unlock()
+	if !hadPiece && peer.Availability != nil {
+		peer.Availability.IncreaseAvailability(pieceIndex)
+	}
+}
+
+// HasPiece tells if the peer has the piece.
+func (peer *Peer) HasPiece(pieceIndex int) bool {
+	peer.bLocker.Lock()
+	defer peer.bLocker.Unlock()
+	return peer.pieces.At(pieceIndex)
+}
+
+// CountPieces returns how many pieces the peer has.
+func (peer *Peer) CountPieces() int {
+	peer.bLocker.Lock()
+	defer peer.bLocker.Unlock()
+	return int(peer.pieces.OneBits)
+}
+
+// IsSeed tells if the peer has all the pieces.
+func (peer *Peer) IsSeed() bool {
+	peer.bLocker.Lock()
+	defer peer.bLocker.Unlock()
+	return peer.pieces.Length > 0 && peer.pieces.OneBits == peer.pieces.Length
+}
+
+// parseRequest converts the payload of a REQUEST or CANCEL message into a BlockRequest.
+func parseRequest(data []byte) (BlockRequest, error) {
+	if len(data) != 12 {
+		return BlockRequest{}, errors.New("Malformed request")
+	}
+	return BlockRequest{
+		PieceNumber: int(binary.BigEndian.Uint32(data[0:4])),
+		Offset:      int(binary.BigEndian.Uint32(data[4:8])),
+		Length:      int(binary.BigEndian.Uint32(data[8:12])),
+	}, nil
+}
+
+// isValidRequest checks that we have the requested piece and that the block is inside of it.
+func (peer *Peer) isValidRequest(request BlockRequest) bool {
+
+	pieceCount := int(peer.TorrentInfo.FileInformations.PieceCount)
+	if request.PieceNumber < 0 || request.PieceNumber >= pieceCount {
+		return false
+	}
+	if peer.ClientBitfield == nil || !peer.ClientBitfield.At(request.PieceNumber) {
+		return false
+	}
+
+	pieceLength := peer.TorrentInfo.FileInformations.PieceLength
+	if request.PieceNumber == pieceCount-1 {
+		pieceLength = peer.TorrentInfo.FileInformations.TotalLength - peer.TorrentInfo.FileInformations.PieceLength*int64(pieceCount-1)
+	}
+	if request.Length <= 0 || request.Length > MAX_REQUEST_LENGTH || request.Offset < 0 {
+		return false
+	}
+	return int64(request.Offset)+int64(request.Length) <= pieceLength
+}
+
+// queueRequest adds a block requested by the peer to the upload queue.
+// Requests received while we choke the peer , invalid requests and
+// duplicated requests are dropped , or rejected if the peer supports the fast extension.
+// The allowed fast pieces can be requested while choked.
+func (peer *Peer) queueRequest(data []byte) {
+
+	request, err := parseRequest(data)
+	if err != nil {
+		return
+	}
+	if !peer.isValidRequest(request) {
+		peer.rejectRequest(request)
+		return
+	}
+
+	peer.rLocker.Lock()
+	if (peer.IsClientChoking() && !peer.isAllowedFastForPeer(request.PieceNumber)) || len(peer.requests) >= MAX_QUEUED_REQUESTS {
+		peer.rLocker.Unlock()
+		peer.rejectRequest(request)
+		return
+	}
+	defer peer.rLocker.Unlock()
+	for _, queued := range peer.requests {
+		if queued == request {
+			return
+		}
+	}
+	peer.requests = append(peer.requests, request)
+}
+
+// cancelRequest removes a block from the upload queue.
+func (peer *Peer) cancelRequest(data []byte) {
+
+	request, err := parseRequest(data)
+	if err != nil {
+		return
+	}
+
+	peer.rLocker.Lock()
+	defer peer.rLocker.Unlock()
+	for index, queued := range peer.requests {
+		if queued == request {
+			peer.requests = append(peer.requests[:index], peer.requests[index+1:]...)
+			return
+		}
+	}
+}
+
+// CountQueuedRequests returns how many blocks the peer is waiting for.
+func (peer *Peer) CountQueuedRequests() int {
+	peer.rLocker.Lock()
+	defer peer.rLocker.Unlock()
+	return len(peer.requests)
+}
+
+// sendPiece sends a PIECE message , containing a block, to the peer.
+// The message is : <length = 9 + len(block)><id = 7><index><begin><block>
+func (peer *Peer) sendPiece(request BlockRequest, block []byte) error {
+
+	if peer.GetStatus() == CONNECTED {
+		messageBytes := convertIntsToByteArray(9 + len(block))
+		messageBytes = append(messageBytes, PIECE)
+		messageBytes = append(messageBytes, convertIntsToByteArray(request.PieceNumber, request.Offset)...)
+		messageBytes = append(messageBytes, block...)
+		return peer.send(messageBytes)
+	}
+	return errors.New("Peer not connected")
+}
+
+// nextRequest removes from the upload queue the first block we can send.
+// If we are choking the peer , only the blocks of the allowed fast pieces can be sent.
+func (peer *Peer) nextRequest() (BlockRequest, bool) {
+	clientChoking := peer.IsClientChoking()
+	peer.rLocker.Lock()
+	defer peer.rLocker.Unlock()
+	for index, request := range peer.requests {
+		if !clientChoking || peer.isAllowedFastForPeer(request.PieceNumber) {
+			peer.requests = append(peer.requests[:index], peer.requests[index+1:]...)
+			return request, true
+		}
+	}
+	return BlockRequest{}, false
+}
+
+// ServeRequests sends the peer all the blocks it requested , reading them with the reader.
+// It returns the number of bytes uploaded.
+// If we are choking the peer , only the allowed fast pieces are sent.
+func (peer *Peer) ServeRequests(reader BlockReader) (int64, error) {
+
+	uploaded := int64(0)
+	for peer.GetStatus() == CONNECTED {
+
+		request, hasRequest := peer.nextRequest()
+		if !hasRequest {
+			break
+		}
+
+		block, err := reader.ReadBlock(request.PieceNumber, request.Offset, request.Length)
+		if err != nil {
+			peer.rejectRequest(request)
+			continue
+		}
+		err = peer.sendPiece(request, block)
+		if err != nil {
+			return uploaded, err
+		}
+		uploaded += int64(len(block))
+		atomic.AddInt64(&peer.Uploaded, int64(len(block)))
+	}
+	return uploaded, nil
 }
 
 func (peer *Peer) ReadMessages(maxMessages int, timeoutDuration time.Duration) []file_writer.PieceData {
@@ -289,12 +693,11 @@ func (peer *Peer) ReadMessages(maxMessages int, timeoutDuration time.Duration) [
 // Peers wont respond to block requests if they are choked and uninterested.
 func (peer *Peer) sendUninterested() error {
 
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 
-		buf := []byte{0, 0, 0, 1, NOT_INTERESTED}
-		err := writeExactly(peer.Connection, buf, len(buf))
+		err := peer.send([]byte{0, 0, 0, 1, NOT_INTERESTED})
 		if err == nil {
-			peer.ClientInterested = false
+			peer.setState(&peer.clientInterested, false)
 		}
 		return err
 	}
@@ -305,26 +708,39 @@ func (peer *Peer) sendUninterested() error {
 // Request multiple blocks on the peers
 // Parameters are like this : an array multiple of three,
 // [index1, begin1, length1, index2, begin2, length2,...] and so on..
-// This writes the byte form of the input on the connection
+// The blocks are remembered , like with SendRequests , so they are accepted when they arrive.
 func (peer *Peer) WriteRequest(params []int) error {
-	requestBytes := []byte{}
-
-	// Start creating the bytes for the request
-
-	for request := 0; request < len(params); request += 3 {
+	requests := []BlockRequest{}
+	for request := 0; request+2 < len(params); request += 3 {
+		requests = append(requests, BlockRequest{params[request], params[request+1], params[request+2]})
+	}
+	return peer.SendRequests(requests)
+}
 
-		signatureBytes := make([]byte, 5)
-		binary.BigEndian.PutUint32(signatureBytes[0:4], 13)
-		signatureBytes[4] = REQUEST
-		// The first 4 bytes are the length of one request which is 13 = sizeof(ID) + sizeof(index) + sizeof(begin) + sizeof(length)
-		requestBytes = append(requestBytes, signatureBytes...)
-		requestBytes = append(requestBytes, convertIntsToByteArray(params[request], params[request+1], params[request+2])...)
-		// We create one big byte array containing all the requests
+// SendCancel tells the peer that we don't need a block we requested anymore.
+// The request no longer takes a place in the pipeline , but the block is still accepted if it was already sent.
+// The message is : <length = 13><id = 8><index><begin><length>
+func (peer *Peer) SendCancel(pieceIndex int, offset int, length int) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
 	}
-	if peer.Status == CONNECTED {
-		return writeExactly(peer.Connection, requestBytes, len(requestBytes))
+	peer.cancelPending(BlockRequest{pieceIndex, offset, length})
+	message := convertIntsToByteArray(13)
+	message = append(message, CANCEL)
+	message = append(message, convertIntsToByteArray(pieceIndex, offset, length)...)
+	return peer.send(message)
+}
+
+// SendHave tells the peer that we have a new piece , so it can request it from us.
+// The message is : <length = 5><id = 4><index>
+func (peer *Peer) SendHave(pieceIndex int) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
 	}
-	return errors.New("Peer not connected")
+	message := convertIntsToByteArray(5)
+	message = append(message, HAVE)
+	message = append(message, convertIntsToByteArray(pieceIndex)...)
+	return peer.send(message)
 }
 
 // This converts an array of ints into a byte array
@@ -337,12 +753,78 @@ func convertIntsToByteArray(params ...int) []byte {
 	return buffer
 }
 
+// buildHandshake returns the handshake we send to a peer.
+// It is a byte array like this :
+// <protocolStringLength><protocolString><reservedBytes><infoHash><peerID>
+// with exactly (49 + protocolStringLength) bytes
+func (peer *Peer) buildHandshake() []byte {
+	handshake := make([]byte, 0, 49+len(PROTOCOL_STRING))
+	handshake = append(handshake, byte(len(PROTOCOL_STRING)))
+	handshake = append(handshake, []byte(PROTOCOL_STRING)...)
+	reserved := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	reserved[EXTENSION_BYTE] |= EXTENSION_BIT
+	reserved[FAST_BYTE] |= FAST_BIT
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, peer.TorrentInfo.InfoHash...)
+	handshake = append(handshake, []byte(peer.LocalPeerId)...)
+	return handshake
+}
+
+// ReadHandshake reads the handshake sent by a remote peer on the connection.
+// Some peers send wrong protocol , so we return an error for them.
+func ReadHandshake(connection net.Conn) (*Handshake, error) {
+
+	resp := make([]byte, 49+len(PROTOCOL_STRING))
+	err := readExactly(connection, resp, len(resp))
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := resp[1:20]
+	if resp[0] != byte(len(PROTOCOL_STRING)) || string(protocol) != PROTOCOL_STRING {
+		return nil, errors.New(fmt.Sprintf("Wrong protocol %s", string(protocol)))
+	}
+	return &Handshake{Reserved: resp[20:28], InfoHash: resp[28:48], PeerId: string(resp[48:])}, nil
+}
+
+// encryptConnection does the handshake of the message stream encryption , if the policy allows it.
+// When encryption is only preferred and the handshake fails , we reconnect without encryption.
+func (peer *Peer) encryptConnection() error {
+	if peer.Encryption == mse.ENCRYPTION_DISABLED {
+		return nil
+	}
+	connection, err := mse.Initiate(peer.Connection, peer.TorrentInfo.InfoHash, peer.Encryption)
+	if err == nil {
+		peer.Connection = connection
+		return nil
+	}
+	peer.Connection.Close()
+	if peer.Encryption == mse.ENCRYPTION_REQUIRED {
+		return err
+	}
+	return peer.connect()
+}
+
+// DialPort returns the port we connect to the peer on , or 0 if we don't know it.
+// A peer which connected to us is reachable on the port it told us in the extended handshake , if it did.
+func (peer *Peer) DialPort() int {
+	if !peer.Incoming {
+		return peer.Port
+	}
+	return peer.ListenPort
+}
+
+// IsEncrypted tells if the stream of the connection is encrypted with the message stream encryption.
+func (peer *Peer) IsEncrypted() bool {
+	return mse.IsEncrypted(peer.Connection)
+}
+
 // Sends a handshake to the peer.
 // This is mandatory to call this first , when initializing a connection with the peer,
 // because it won't response to any message until a handshake has been done.
 func (peer *Peer) sendHandshake() error {
 
-	if peer.Status == DISCONNECTED {
+	if peer.GetStatus() == DISCONNECTED {
 		//If the peer is disconnected,
 		//it connects to the ip and port that we have.
 		err := peer.connect()
@@ -350,19 +832,14 @@ func (peer *Peer) sendHandshake() error {
 			peer.Disconnect()
 			return err
 		}
+		err = peer.encryptConnection()
+		if err != nil {
+			peer.Disconnect()
+			return err
+		}
 
 		// At this point , it is connected to the peer.
-		// It will send a byte array like this :
-		// <protocolStringLength><protocolString><reservedBytes><infoHash><peerID>
-		// with exactly (48 + protocolStringLength) bytes
-
-		protocolString := "BitTorrent protocol"
-		handshake := make([]byte, 0, 48+len(protocolString))
-		handshake = append(handshake, byte(19))
-		handshake = append(handshake, []byte(protocolString)...)
-		handshake = append(handshake, []byte{0, 0, 0, 0, 0, 0, 0, 0}...)
-		handshake = append(handshake, peer.TorrentInfo.InfoHash...)
-		handshake = append(handshake, []byte(peer.LocalPeerId)...)
+		handshake := peer.buildHandshake()
 
 		peer.Connection.SetDeadline(time.Now().Add(5 * time.Second))
 		// Set a higher timeout, because some peers respond slower at handshake.
@@ -379,31 +856,49 @@ func (peer *Peer) sendHandshake() error {
 		}
 
 		// At this point , the peer should send us exactly the same size that we requested.
-		resp := make([]byte, len(handshake))
-		err = readExactly(peer.Connection, resp, len(resp))
-
+		remoteHandshake, err := ReadHandshake(peer.Connection)
 		if err != nil {
 			peer.Disconnect()
 			return err
 		}
 
-		// Some peers send wrong protocol , so we disconnect it.
-		protocol := resp[1:20]
-		peer.Protocol = string(protocol)
-		if string(protocol) != protocolString {
-
+		if !bytes.Equal(remoteHandshake.InfoHash, peer.TorrentInfo.InfoHash) {
 			peer.Disconnect()
-			return errors.New(fmt.Sprintf("Wrong protocol %s", string(protocol)))
+			return errors.New("Wrong info hash")
 		}
 
-		remotePeerId := string(resp[48:])
-		peer.RemotePeerId = remotePeerId
-		peer.Status = CONNECTED
+		peer.Protocol = PROTOCOL_STRING
+		peer.RemotePeerId = remoteHandshake.PeerId
+		peer.Reserved = remoteHandshake.Reserved
+		peer.SetStatus(CONNECTED)
 		return nil
 	}
 	return errors.New("Invalid status")
 }
 
+// answerHandshake replies to a handshake which was already read from an incoming connection.
+func (peer *Peer) answerHandshake(connection net.Conn, remoteHandshake *Handshake) error {
+
+	if peer.GetStatus() != DISCONNECTED {
+		return errors.New("Invalid status")
+	}
+
+	peer.Connection = connection
+	handshake := peer.buildHandshake()
+	peer.Connection.SetDeadline(time.Now().Add(5 * time.Second))
+	err := writeExactly(peer.Connection, handshake, len(handshake))
+	if err != nil {
+		peer.Disconnect()
+		return err
+	}
+
+	peer.Protocol = PROTOCOL_STRING
+	peer.RemotePeerId = remoteHandshake.PeerId
+	peer.Reserved = remoteHandshake.Reserved
+	peer.SetStatus(CONNECTED)
+	return nil
+}
+
 func (peer *Peer) SendKeepAlive() error {
 	return peer.sendKeepAlive()
 }
@@ -428,19 +923,54 @@ func (peer *Peer) SendUninterested() error {
 // and sets the status to DISCONNECTED.
 func (peer *Peer) Disconnect() {
 
-	peer.Status = DISCONNECTED
+	peer.SetStatus(DISCONNECTED)
+
+	// The reader has exited once the loops are stopped , so it can't change the state we reset below.
+	peer.stopMessageLoops()
 	if peer.Connection != nil {
 		peer.Connection.Close()
 	}
+	peer.rLocker.Lock()
+	peer.requests = nil
+	peer.allowedFastForPeer = nil
+	peer.rLocker.Unlock()
+
+	// The pieces of the peer are no longer available to us.
+	// The bitfield is cleared , because the peer will send it again if we reconnect.
+	peer.bLocker.Lock()
+	lostPieces := peer.pieces
+	peer.pieces = bitfield.New(int(peer.TorrentInfo.FileInformations.PieceCount))
+	peer.bLocker.Unlock()
+	if peer.Availability != nil {
+		for pieceIndex := 0; pieceIndex < int(lostPieces.Length); pieceIndex++ {
+			if lostPieces.At(pieceIndex) {
+				peer.Availability.DecreaseAvailability(pieceIndex)
+			}
+		}
+	}
+
+	// The allowed fast pieces and the suggestions are sent again if we reconnect.
+	peer.fLocker.Lock()
+	peer.allowedFast = nil
+	peer.suggested = nil
+	peer.fLocker.Unlock()
+
+	// The peer sends a new extended handshake if we reconnect.
+	peer.eLocker.Lock()
+	peer.remoteExtensions = nil
+	peer.eLocker.Unlock()
+	if peer.Extensions != nil {
+		peer.Extensions.peerDisconnected(peer)
+	}
 	return
 }
 
 // Establishes full connection with the peer.
 // Full connection means : handshake , reading the bitfield and
-// sending unchoke and interested to the peer.
-func (peer *Peer) EstablishFullConnection(comm chan ConnectionCommunication, clientBitfield *bitfield.Bitfield) {
+// sending interested to the peer.
+func (peer *Peer) EstablishFullConnection(comm chan ConnectionCommunication, clientBitfield *bitfield.Shared) {
 
-	if peer.Status == CONNECTED {
+	if peer.GetStatus() == CONNECTED {
 		return
 	}
 	startTime := time.Now()
@@ -449,51 +979,99 @@ func (peer *Peer) EstablishFullConnection(comm chan ConnectionCommunication, cli
 		comm <- ConnectionCommunication{peer, "ERROR:" + err.Error(), time.Since(startTime)}
 		return
 	}
+	peer.finishConnection(comm, clientBitfield, startTime)
+}
 
-	err = peer.sendBitfield(clientBitfield.Encode())
+// EstablishIncomingConnection does the same as EstablishFullConnection for a peer
+// which connected to us. The handshake of the remote peer was already read from the connection,
+// so we only answer it and then continue like for an outgoing connection.
+func (peer *Peer) EstablishIncomingConnection(connection net.Conn, handshake *Handshake, comm chan ConnectionCommunication, clientBitfield *bitfield.Shared) {
+
+	startTime := time.Now()
+	peer.Incoming = true
+	err := peer.answerHandshake(connection, handshake)
 	if err != nil {
-		peer.Disconnect()
 		comm <- ConnectionCommunication{peer, "ERROR:" + err.Error(), time.Since(startTime)}
 		return
 	}
+	peer.finishConnection(comm, clientBitfield, startTime)
+}
+
+// finishConnection sends our extended handshake , bitfield and interested after the handshake
+// and reads the first messages of the peer.
+// The peer stays choked , until the choker decides to unchoke it.
+func (peer *Peer) finishConnection(comm chan ConnectionCommunication, clientBitfield *bitfield.Shared, startTime time.Time) {
 
-	err = peer.sendUnchoke()
+	peer.ClientBitfield = clientBitfield
+	peer.startMessageLoops()
+	err := peer.sendExtendedHandshake()
 	if err != nil {
 		peer.Disconnect()
 		comm <- ConnectionCommunication{peer, "ERROR:" + err.Error(), time.Since(startTime)}
 		return
 	}
 
-	err = peer.sendInterested()
+	// The pieces we have may change meanwhile , so the messages below are built from a snapshot.
+	clientPieces := clientBitfield.Snapshot()
+	err = peer.sendPieces(&clientPieces)
+	if err == nil && peer.SupportsFast() {
+		err = peer.sendAllowedFast()
+	}
 	if err != nil {
 		peer.Disconnect()
 		comm <- ConnectionCommunication{peer, "ERROR:" + err.Error(), time.Since(startTime)}
 		return
 	}
 
+	// When we have all the pieces , we are not interested in anything the peer has.
+	if clientPieces.OneBits < clientPieces.Length {
+		err = peer.sendInterested()
+		if err != nil {
+			peer.Disconnect()
+			comm <- ConnectionCommunication{peer, "ERROR:" + err.Error(), time.Since(startTime)}
+			return
+		}
+	}
+
+	// We wait for the first messages of the peer , like its bitfield , until it is silent for a second.
 	peer.readMessages(int(peer.TorrentInfo.FileInformations.PieceCount+1), 1*time.Second)
 
-	peer.Status = CONNECTED
 	peer.ConnectTime = time.Since(startTime)
 	comm <- ConnectionCommunication{peer, "OK", time.Since(startTime)}
 	return
 }
 
+// sendPieces tells the peer which pieces we have.
+// With the fast extension , HAVE_ALL or HAVE_NONE replace the bitfield when they can.
+// An empty bitfield , like the one of a torrent whose metadata we don't know yet , means we have no pieces.
+// Otherwise the bitfield can be left out when we have no pieces.
+func (peer *Peer) sendPieces(clientBitfield *bitfield.Bitfield) error {
+	if peer.SupportsFast() && clientBitfield.Length > 0 && clientBitfield.OneBits == clientBitfield.Length {
+		return peer.sendHaveAll()
+	} else if peer.SupportsFast() && clientBitfield.OneBits == 0 {
+		return peer.sendHaveNone()
+	} else if clientBitfield.OneBits > 0 {
+		return peer.sendBitfield(clientBitfield.Encode())
+	}
+	return nil
+}
+
 // New returns a peer with given description
 func New(torrentInfo *torrent_info.TorrentInfo, peerId string, ip string, port int) Peer {
 	return Peer{
-		IP:               ip,
-		Port:             port,
-		Status:           DISCONNECTED,
-		TorrentInfo:      torrentInfo,
-		LocalPeerId:      peerId,
-		BitfieldInfo:     bitfield.New(int(torrentInfo.FileInformations.PieceCount)),
-		ClientChoking:    true,
-		ClientInterested: false,
-		PeerChoking:      true,
-		PeerInterested:   false,
-		Downloading:      false,
-		Active:           false,
-		ConnectTime:      time.Second * 10000,
+		IP:            ip,
+		Port:          port,
+		TorrentInfo:   torrentInfo,
+		LocalPeerId:   peerId,
+		pieces:        bitfield.New(int(torrentInfo.FileInformations.PieceCount)),
+		ConnectTime:   time.Second * 10000,
+		rLocker:       &sync.Mutex{},
+		eLocker:       &sync.Mutex{},
+		fLocker:       &sync.Mutex{},
+		pLocker:       &sync.Mutex{},
+		clientChoking: true,
+		peerChoking:   true,
+		sLocker:       &sync.Mutex{},
+		bLocker:       &sync.Mutex{},
 	}
 }
@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestHandshake(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x07}, 20)}
+	remote := New(torrentInfo, "-YM00000000000000001", "127.0.0.1", 6881)
+	handshake := remote.buildHandshake()
+	if len(handshake) != 68 {
+		t.Fatalf("Expected a handshake of 68 bytes , got %d", len(handshake))
+	}
+
+	// The remote peer sends its handshake , followed right away by a message.
+	go func() {
+		connection, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		connection.Write(append(handshake, 0, 0, 0, 1, INTERESTED))
+		connection.Read(make([]byte, 1))
+	}()
+
+	connection, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(5 * time.Second))
+
+	remoteHandshake, err := ReadHandshake(connection)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !bytes.Equal(remoteHandshake.InfoHash, torrentInfo.InfoHash) || remoteHandshake.PeerId != remote.LocalPeerId {
+		t.Errorf("Wrong handshake %x %s", remoteHandshake.InfoHash, remoteHandshake.PeerId)
+	}
+
+	// The whole handshake was read , so the message is read from its first byte.
+	message := make([]byte, 5)
+	if err := readExactly(connection, message, len(message)); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !bytes.Equal(message, []byte{0, 0, 0, 1, INTERESTED}) {
+		t.Errorf("Expected an interested message after the handshake , got %x", message)
+	}
+}
+
+func TestSendHave(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x08}, 20)}
+	torrentInfo.FileInformations.PieceCount = 300
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	seeder := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+	seeder.Connection = local
+	seeder.SetStatus(CONNECTED)
+	seeder.startMessageLoops()
+	defer seeder.stopMessageLoops()
+
+	if err := seeder.SendHave(258); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	message := make([]byte, 9)
+	if err := readExactly(remote, message, len(message)); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !bytes.Equal(message, []byte{0, 0, 0, 5, HAVE, 0, 0, 1, 2}) {
+		t.Errorf("Wrong HAVE message %x", message)
+	}
+}
+
+func TestDialPort(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x07}, 20)}
+	tests := []struct {
+		incoming  bool
+		handshake string
+		expected  int
+	}{
+		{false, "", 6881},
+		{false, "d1:pi51413ee", 6881},
+		{true, "", 0},
+		{true, "d1:pi51413ee", 51413},
+	}
+	for _, test := range tests {
+		remote := New(torrentInfo, "-YM00000000000000001", "127.0.0.1", 6881)
+		remote.Incoming = test.incoming
+		if test.handshake != "" {
+			remote.parseExtendedHandshake([]byte(test.handshake))
+		}
+		if port := remote.DialPort(); port != test.expected {
+			t.Errorf("Expected port %d for %+v , got %d", test.expected, test, port)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bbpcr/Yomato/file_writer"
+)
+
+// The requests we keep outstanding to a peer are enough for the blocks it sends in PIPELINE_DURATION,
+// at the rate it sends them. A peer which doesn't tell how many requests it queues (reqq) is
+// asked for at most DEFAULT_MAX_REQUESTS.
+const (
+	PIPELINE_DURATION    = 2 * time.Second
+	PIPELINE_BLOCK_SIZE  = 1 << 14
+	MIN_PIPELINE_DEPTH   = 4
+	DEFAULT_MAX_REQUESTS = 250
+	RATE_DURATION        = 1 * time.Second
+)
+
+// A block which didn't arrive in this time is requested again , maybe from another peer.
+const REQUEST_TIMEOUT = 20 * time.Second
+
+// pendingRequest is a block we requested from the peer , which didn't arrive yet.
+type pendingRequest struct {
+	request BlockRequest
+	sent    time.Time
+}
+
+// SendRequests requests the blocks from the peer , and remembers them until they arrive.
+// They are remembered before they are sent , so a block can't arrive before its request is known.
+func (peer *Peer) SendRequests(requests []BlockRequest) error {
+	if peer.GetStatus() != CONNECTED {
+		return errors.New("Peer not connected")
+	}
+	message := make([]byte, 0, 17*len(requests))
+	for _, request := range requests {
+		message = append(message, convertIntsToByteArray(13)...)
+		message = append(message, REQUEST)
+		message = append(message, convertIntsToByteArray(request.PieceNumber, request.Offset, request.Length)...)
+	}
+
+	now := time.Now()
+	peer.pLocker.Lock()
+	if len(peer.pending) == 0 {
+		// The rate is measured while we wait for blocks.
+		peer.rateStart = now
+		peer.rateBytes = 0
+	}
+	for _, request := range requests {
+		peer.pending = append(peer.pending, pendingRequest{request: request, sent: now})
+	}
+	peer.pLocker.Unlock()
+	return peer.send(message)
+}
+
+// receivePending removes an arrived block from the outstanding requests , and measures the rate of the peer.
+// It tells if we requested the block : the other blocks are dropped.
+func (peer *Peer) receivePending(pieceData file_writer.PieceData) bool {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	request := BlockRequest{pieceData.PieceNumber, pieceData.Offset, len(pieceData.Piece)}
+	requested := false
+	for index, pending := range peer.pending {
+		if pending.request == request {
+			peer.pending = append(peer.pending[:index], peer.pending[index+1:]...)
+			requested = true
+			break
+		}
+	}
+
+	if !requested {
+		// A block we cancelled may cross our CANCEL. It is delivered , so it is counted as wasted.
+		for index, cancelled := range peer.cancelled {
+			if cancelled.request == request {
+				peer.cancelled = append(peer.cancelled[:index], peer.cancelled[index+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	peer.rateBytes += int64(len(pieceData.Piece))
+	if elapsed := time.Since(peer.rateStart); elapsed >= RATE_DURATION {
+		rate := float64(peer.rateBytes) / elapsed.Seconds()
+		if peer.pipelineRate == 0 {
+			peer.pipelineRate = rate
+		} else {
+			peer.pipelineRate = (peer.pipelineRate + rate) / 2
+		}
+		peer.rateStart = time.Now()
+		peer.rateBytes = 0
+	}
+	return true
+}
+
+// cancelPending removes the outstanding request , because we don't need the block anymore.
+// It is remembered as cancelled until REQUEST_TIMEOUT , in case the peer already sent the block.
+func (peer *Peer) cancelPending(request BlockRequest) {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	for index, pending := range peer.pending {
+		if pending.request == request {
+			peer.pending = append(peer.pending[:index], peer.pending[index+1:]...)
+			peer.cancelled = append(peer.cancelled, pending)
+			return
+		}
+	}
+}
+
+// dropPending moves the outstanding request to the dropped ones , because the peer won't send it.
+func (peer *Peer) dropPending(request BlockRequest) {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	for index, pending := range peer.pending {
+		if pending.request == request {
+			peer.pending = append(peer.pending[:index], peer.pending[index+1:]...)
+			peer.dropped = append(peer.dropped, request)
+			return
+		}
+	}
+
+	// The peer rejects the requests we cancelled , with the fast extension.
+	for index, cancelled := range peer.cancelled {
+		if cancelled.request == request {
+			peer.cancelled = append(peer.cancelled[:index], peer.cancelled[index+1:]...)
+			return
+		}
+	}
+}
+
+// dropAllPending drops all the outstanding requests , after the peer choked us.
+// With the fast extension , the peer rejects the requests it discards , so we wait for the rejects.
+func (peer *Peer) dropAllPending() {
+	if peer.SupportsFast() {
+		return
+	}
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	for _, pending := range peer.pending {
+		peer.dropped = append(peer.dropped, pending.request)
+	}
+	peer.pending = nil
+}
+
+// DroppedRequests returns the requests the peer won't answer : the rejected ones , the ones discarded
+// when it choked us , and the ones which timed out. They are no longer outstanding.
+func (peer *Peer) DroppedRequests(timeout time.Duration) []BlockRequest {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	dropped := peer.dropped
+	peer.dropped = nil
+	kept := []pendingRequest{}
+	for _, pending := range peer.pending {
+		if time.Since(pending.sent) >= timeout {
+			dropped = append(dropped, pending.request)
+		} else {
+			kept = append(kept, pending)
+		}
+	}
+	peer.pending = kept
+
+	// The cancelled blocks which didn't arrive in time won't arrive anymore.
+	keptCancelled := []pendingRequest{}
+	for _, cancelled := range peer.cancelled {
+		if time.Since(cancelled.sent) < timeout {
+			keptCancelled = append(keptCancelled, cancelled)
+		}
+	}
+	peer.cancelled = keptCancelled
+	return dropped
+}
+
+// ClearPendingRequests forgets all the outstanding and dropped requests , and returns them.
+func (peer *Peer) ClearPendingRequests() []BlockRequest {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	requests := peer.dropped
+	for _, pending := range peer.pending {
+		requests = append(requests, pending.request)
+	}
+	peer.pending = nil
+	peer.cancelled = nil
+	peer.dropped = nil
+	return requests
+}
+
+// CountPendingRequests returns how many blocks we requested from the peer which didn't arrive yet.
+func (peer *Peer) CountPendingRequests() int {
+	peer.pLocker.Lock()
+	defer peer.pLocker.Unlock()
+	return len(peer.pending)
+}
+
+// PipelineDepth returns how many requests we should keep outstanding to the peer.
+// It grows with the rate of the peer , and it is bounded by how many requests the peer queues.
+func (peer *Peer) PipelineDepth() int {
+	peer.pLocker.Lock()
+	rate := peer.pipelineRate
+	peer.pLocker.Unlock()
+
+	maxDepth := peer.MaxRequests
+	if maxDepth <= 0 {
+		maxDepth = DEFAULT_MAX_REQUESTS
+	}
+	depth := int(rate * PIPELINE_DURATION.Seconds() / PIPELINE_BLOCK_SIZE)
+	if depth < MIN_PIPELINE_DEPTH {
+		depth = MIN_PIPELINE_DEPTH
+	}
+	if depth > maxDepth {
+		depth = maxDepth
+	}
+	return depth
+}
+
+// ReadBlockMessage waits for one message. It returns the block , if the message was a PIECE,
+// and the error of the connection , if any.
+func (peer *Peer) ReadBlockMessage(timeout time.Duration) (*file_writer.PieceData, error) {
+	message, err := peer.nextMessage(timeout)
+	return message.Block, err
+}
@@ -0,0 +1,157 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestPipeline(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x04}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+	leecher.Connection = local
+	leecher.SetStatus(CONNECTED)
+
+	// The depth grows with the rate , and it is bounded by the reqq of the peer.
+	if depth := leecher.PipelineDepth(); depth != MIN_PIPELINE_DEPTH {
+		t.Errorf("Expected a depth of %d without a rate , got %d", MIN_PIPELINE_DEPTH, depth)
+	}
+	leecher.pipelineRate = 1024 * 1024
+	if depth := leecher.PipelineDepth(); depth != 128 {
+		t.Errorf("Expected a depth of 128 at 1 MB/s , got %d", depth)
+	}
+	leecher.MaxRequests = 50
+	if depth := leecher.PipelineDepth(); depth != 50 {
+		t.Errorf("Expected the depth to be bounded by reqq , got %d", depth)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 3*17)
+		io.ReadFull(remote, data)
+		received <- data
+	}()
+	requests := []BlockRequest{{0, 0, 16384}, {1, 0, 16384}, {2, 0, 16384}}
+	if err := leecher.SendRequests(requests); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if data := <-received; data[4] != REQUEST || data[17+4] != REQUEST {
+		t.Errorf("Wrong requests %x", data)
+	}
+	if count := leecher.CountPendingRequests(); count != 3 {
+		t.Fatalf("Expected 3 pending requests , got %d", count)
+	}
+
+	// A keep alive , a block we didn't request , then a block , which is no longer pending.
+	go func() {
+		remote.Write([]byte{0, 0, 0, 0})
+		unrequested := append(convertIntsToByteArray(9+16384), PIECE)
+		unrequested = append(unrequested, convertIntsToByteArray(3, 0)...)
+		remote.Write(append(unrequested, make([]byte, 16384)...))
+		message := append(convertIntsToByteArray(9+16384), PIECE)
+		message = append(message, convertIntsToByteArray(1, 0)...)
+		remote.Write(append(message, make([]byte, 16384)...))
+		remote.Write([]byte{0, 0, 0, 1, CHOKE})
+	}()
+	if pieceData, err := leecher.ReadBlockMessage(time.Second); err != nil || pieceData != nil {
+		t.Fatalf("Expected a keep alive , got %v %v", pieceData, err)
+	}
+	if pieceData, err := leecher.ReadBlockMessage(time.Second); err != nil || pieceData != nil {
+		t.Fatalf("Expected the unrequested block to be dropped , got %v %v", pieceData, err)
+	}
+	pieceData, err := leecher.ReadBlockMessage(time.Second)
+	if err != nil || pieceData == nil || pieceData.PieceNumber != 1 || len(pieceData.Piece) != 16384 {
+		t.Fatalf("Expected the block of piece 1 , got %v %v", pieceData, err)
+	}
+	if downloaded := leecher.GetDownloaded(); downloaded != 16384 {
+		t.Errorf("Expected only the requested block to be counted , got %d bytes", downloaded)
+	}
+	if count := leecher.CountPendingRequests(); count != 2 {
+		t.Errorf("Expected 2 pending requests , got %d", count)
+	}
+
+	// Without the fast extension , a choke discards all the requests.
+	if _, err := leecher.ReadBlockMessage(time.Second); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if dropped := leecher.DroppedRequests(REQUEST_TIMEOUT); len(dropped) != 2 || dropped[0] != requests[0] || dropped[1] != requests[2] {
+		t.Errorf("Expected the requests of piece 0 and 2 to be dropped , got %v", dropped)
+	}
+
+	// The requests which aren't answered in time are dropped.
+	go io.ReadFull(remote, make([]byte, 17))
+	if err := leecher.SendRequests(requests[:1]); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if dropped := leecher.DroppedRequests(REQUEST_TIMEOUT); len(dropped) != 0 {
+		t.Errorf("Expected no dropped requests , got %v", dropped)
+	}
+	if dropped := leecher.DroppedRequests(0); len(dropped) != 1 || leecher.CountPendingRequests() != 0 {
+		t.Errorf("Expected the request to time out , got %v", dropped)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0f}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+	leecher.Connection = local
+	leecher.SetStatus(CONNECTED)
+	leecher.startMessageLoops()
+	defer leecher.stopMessageLoops()
+
+	requests := []BlockRequest{{0, 0, 16384}, {1, 0, 16384}}
+	if err := leecher.SendRequests(requests); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if err := leecher.SendCancel(1, 0, 16384); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	data := make([]byte, 3*17)
+	if _, err := io.ReadFull(remote, data); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if data[2*17+4] != CANCEL {
+		t.Errorf("Expected a CANCEL after the requests , got %x", data)
+	}
+
+	// The cancelled request no longer takes a place in the pipeline.
+	if count := leecher.CountPendingRequests(); count != 1 {
+		t.Errorf("Expected 1 pending request after the cancel , got %d", count)
+	}
+
+	// The block which crossed the CANCEL is still delivered once , so it can be counted as wasted.
+	block := append(convertIntsToByteArray(9+16384), PIECE)
+	block = append(block, convertIntsToByteArray(1, 0)...)
+	block = append(block, make([]byte, 16384)...)
+	go func() {
+		remote.Write(block)
+		remote.Write(block)
+		remote.Write([]byte{0, 0, 0, 0})
+	}()
+	if pieceData, err := leecher.ReadBlockMessage(time.Second); err != nil || pieceData == nil || pieceData.PieceNumber != 1 {
+		t.Fatalf("Expected the cancelled block , got %v %v", pieceData, err)
+	}
+	if pieceData, err := leecher.ReadBlockMessage(time.Second); err != nil || pieceData != nil {
+		t.Errorf("Expected the second copy to be dropped , got %v %v", pieceData, err)
+	}
+	if dropped := leecher.DroppedRequests(REQUEST_TIMEOUT); len(dropped) != 0 {
+		t.Errorf("Expected no dropped requests , got %v", dropped)
+	}
+}
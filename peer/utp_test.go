@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/bbpcr/Yomato/bitfield"
+	"github.com/bbpcr/Yomato/torrent_info"
+	"github.com/bbpcr/Yomato/utp"
+)
+
+// acceptPeer accepts one connection on listener , and answers its handshake.
+func acceptPeer(listener net.Listener, torrentInfo *torrent_info.TorrentInfo, comm chan ConnectionCommunication) {
+	connection, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	handshake, err := ReadHandshake(connection)
+	if err != nil {
+		comm <- ConnectionCommunication{nil, "ERROR:" + err.Error(), 0}
+		return
+	}
+	seeder := New(torrentInfo, "-XX0000-000000000000", "127.0.0.1", 0)
+	noPieces := bitfield.NewShared(int(torrentInfo.FileInformations.PieceCount))
+	seeder.EstablishIncomingConnection(connection, handshake, comm, noPieces)
+}
+
+func TestConnectOverUTP(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x02}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	remoteSocket, err := utp.Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer remoteSocket.Close()
+	localSocket, err := utp.Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer localSocket.Close()
+
+	seederComm := make(chan ConnectionCommunication, 1)
+	go acceptPeer(remoteSocket, torrentInfo, seederComm)
+
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", remoteSocket.Port())
+	leecher.UTPSocket = localSocket
+	leecher.SupportsUTP = true
+	leecherComm := make(chan ConnectionCommunication, 1)
+	noPieces := bitfield.NewShared(4)
+	go leecher.EstablishFullConnection(leecherComm, noPieces)
+
+	for _, comm := range []chan ConnectionCommunication{seederComm, leecherComm} {
+		if result := <-comm; result.StatusMessage != "OK" {
+			t.Fatalf("Got error: %s", result.StatusMessage)
+		}
+	}
+	defer leecher.Disconnect()
+	if !leecher.UsesUTP {
+		t.Errorf("Expected the connection to be over uTP")
+	}
+}
+
+func TestFallbackToTCP(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x03}, 20)}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 16384
+	torrentInfo.FileInformations.TotalLength = 4 * 16384
+
+	// Nothing answers over uTP on the port of the TCP listener.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer listener.Close()
+	localSocket, err := utp.Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer localSocket.Close()
+
+	seederComm := make(chan ConnectionCommunication, 1)
+	go acceptPeer(listener, torrentInfo, seederComm)
+
+	leecher := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	leecher.UTPSocket = localSocket
+	leecher.SupportsUTP = true
+	leecherComm := make(chan ConnectionCommunication, 1)
+	noPieces := bitfield.NewShared(4)
+	go leecher.EstablishFullConnection(leecherComm, noPieces)
+
+	for _, comm := range []chan ConnectionCommunication{seederComm, leecherComm} {
+		if result := <-comm; result.StatusMessage != "OK" {
+			t.Fatalf("Got error: %s", result.StatusMessage)
+		}
+	}
+	defer leecher.Disconnect()
+	if leecher.UsesUTP || leecher.SupportsUTP {
+		t.Errorf("Expected the connection to fall back to TCP")
+	}
+}
+
+func TestUTPFromExtendedHandshake(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0d}, 20)}
+	remotePeer := New(torrentInfo, "-YM00000000000000000", "127.0.0.1", 6881)
+
+	remotePeer.parseExtendedHandshake([]byte("d1:md6:ut_pexi1eee"))
+	if remotePeer.IsUTPSupported() {
+		t.Errorf("Expected uTP not to be supported without ut_holepunch")
+	}
+	remotePeer.parseExtendedHandshake([]byte("d1:md12:ut_holepunchi4eee"))
+	if !remotePeer.IsUTPSupported() {
+		t.Errorf("Expected uTP to be supported by a peer with ut_holepunch")
+	}
+}
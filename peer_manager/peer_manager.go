@@ -3,6 +3,7 @@ package peer_manager
 import (
 	"github.com/bbpcr/Yomato/peer"
 
+	"net"
 	"sync"
 )
 
@@ -10,46 +11,96 @@ type PeerManager struct {
 	connectedPeers    map[string]*peer.Peer
 	disconnectedPeers map[string]*peer.Peer
 	alivePeers        map[string]*peer.Peer
+	localPeers        map[string]bool
 	cdLocker          sync.Mutex
 	aLocker           sync.Mutex
 }
 
+// peerKey returns the key of a peer in the maps : its IP , in canonical form ,
+// so an IPv6 address written differently , or an IPv4 address mapped to IPv6 , is the same peer.
+func peerKey(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
 func (manager *PeerManager) SetPeerAsConnected(p *peer.Peer) {
 	manager.cdLocker.Lock()
 	defer manager.cdLocker.Unlock()
-	delete(manager.disconnectedPeers, p.IP)
-	manager.connectedPeers[p.IP] = p
+	delete(manager.disconnectedPeers, peerKey(p.IP))
+	manager.connectedPeers[peerKey(p.IP)] = p
 }
 
 func (manager *PeerManager) SetPeerAsAlive(p *peer.Peer) {
 	manager.aLocker.Lock()
 	defer manager.aLocker.Unlock()
-	manager.alivePeers[p.IP] = p
+	manager.alivePeers[peerKey(p.IP)] = p
 }
 
 func (manager *PeerManager) SetPeerAsDisconnected(p *peer.Peer) {
 	manager.cdLocker.Lock()
 	defer manager.cdLocker.Unlock()
-	delete(manager.connectedPeers, p.IP)
-	manager.disconnectedPeers[p.IP] = p
+	delete(manager.connectedPeers, peerKey(p.IP))
+	manager.disconnectedPeers[peerKey(p.IP)] = p
+}
+
+// SetPeerAsLocal marks the peer as found on the local network , so it is preferred to the others.
+func (manager *PeerManager) SetPeerAsLocal(p *peer.Peer) {
+	manager.cdLocker.Lock()
+	defer manager.cdLocker.Unlock()
+	manager.localPeers[peerKey(p.IP)] = true
+}
+
+// IsLocal tells if the peer was found on the local network.
+func (manager *PeerManager) IsLocal(p *peer.Peer) bool {
+	manager.cdLocker.Lock()
+	defer manager.cdLocker.Unlock()
+	return manager.localPeers[peerKey(p.IP)]
+}
+
+// PreferLocal reorders the peers so the ones found on the local network come first.
+func (manager *PeerManager) PreferLocal(peers []*peer.Peer) []*peer.Peer {
+	manager.cdLocker.Lock()
+	defer manager.cdLocker.Unlock()
+	ordered := make([]*peer.Peer, 0, len(peers))
+	for _, p := range peers {
+		if manager.localPeers[peerKey(p.IP)] {
+			ordered = append(ordered, p)
+		}
+	}
+	for _, p := range peers {
+		if !manager.localPeers[peerKey(p.IP)] {
+			ordered = append(ordered, p)
+		}
+	}
+	return ordered
 }
 
 func (manager *PeerManager) Exists(p *peer.Peer) bool {
 
 	manager.cdLocker.Lock()
 	defer manager.cdLocker.Unlock()
-	_, isConnected := manager.connectedPeers[p.IP]
-	_, isDisconnected := manager.disconnectedPeers[p.IP]
+	_, isConnected := manager.connectedPeers[peerKey(p.IP)]
+	_, isDisconnected := manager.disconnectedPeers[peerKey(p.IP)]
 	return isConnected || isDisconnected
 }
 
+// GetConnectedPeer returns the connected peer with the given IP , or nil if there is none.
+func (manager *PeerManager) GetConnectedPeer(ip string) *peer.Peer {
+
+	manager.cdLocker.Lock()
+	defer manager.cdLocker.Unlock()
+	return manager.connectedPeers[peerKey(ip)]
+}
+
 func (manager *PeerManager) CountDownloadingPeers() int {
 
 	manager.cdLocker.Lock()
 	defer manager.cdLocker.Unlock()
 	downloadingNum := 0
 	for _, connectedPeer := range manager.connectedPeers {
-		if connectedPeer.Downloading {
+		if connectedPeer.IsDownloading() {
 			downloadingNum++
 		}
 	}
@@ -124,6 +175,7 @@ func New() *PeerManager {
 		connectedPeers:    make(map[string]*peer.Peer),
 		disconnectedPeers: make(map[string]*peer.Peer),
 		alivePeers:        make(map[string]*peer.Peer),
+		localPeers:        make(map[string]bool),
 	}
 	return manager
 }
@@ -0,0 +1,243 @@
+// Package pex implements the peer exchange extension , described here : http://www.bittorrent.org/beps/bep_0011.html
+// Connected peers tell each other which peers they connected to , and which ones they dropped.
+package pex
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+	"github.com/bbpcr/Yomato/peer"
+)
+
+const UT_PEX = "ut_pex"
+
+// The flags of the added peers.
+const (
+	FLAG_ENCRYPTION  = 0x01
+	FLAG_SEED        = 0x02
+	FLAG_UTP         = 0x04
+	FLAG_HOLEPUNCH   = 0x08
+	FLAG_CONNECTABLE = 0x10
+)
+
+const (
+	COMPACT_IPV4_LENGTH = 6
+	COMPACT_IPV6_LENGTH = 18
+)
+
+// A peer must not send more than one message per PEX_DURATION , with at most MAX_PEERS added
+// and MAX_PEERS dropped peers.
+const (
+	PEX_DURATION = 60 * time.Second
+	MAX_PEERS    = 50
+)
+
+// Contact is a peer sent in a ut_pex message.
+type Contact struct {
+	Address string
+	Flags   byte
+}
+
+// Message is a ut_pex message : the peers connected and dropped since the previous one.
+type Message struct {
+	Added   []Contact
+	Dropped []string
+}
+
+// encodeAddress returns the compact form of address : the IP followed by the port.
+func encodeAddress(address string) ([]byte, bool) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portString)
+	if ip == nil || err != nil || port <= 0 || port >= 65536 {
+		return nil, false
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(port))
+	return compact, true
+}
+
+// decodeAddresses parses a list of compact addresses , each length bytes long.
+func decodeAddresses(compact string, length int) []string {
+	addresses := []string{}
+	for start := 0; start+length <= len(compact); start += length {
+		ip := net.IP([]byte(compact[start : start+length-2]))
+		port := binary.BigEndian.Uint16([]byte(compact[start+length-2 : start+length]))
+		addresses = append(addresses, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return addresses
+}
+
+// Encode returns the bencoded message.
+func (message *Message) Encode() []byte {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+	for _, contact := range message.Added {
+		compact, isValid := encodeAddress(contact.Address)
+		if !isValid {
+			continue
+		}
+		if len(compact) == COMPACT_IPV4_LENGTH {
+			added = append(added, compact...)
+			addedFlags = append(addedFlags, contact.Flags)
+		} else {
+			added6 = append(added6, compact...)
+			added6Flags = append(added6Flags, contact.Flags)
+		}
+	}
+	for _, address := range message.Dropped {
+		compact, isValid := encodeAddress(address)
+		if !isValid {
+			continue
+		}
+		if len(compact) == COMPACT_IPV4_LENGTH {
+			dropped = append(dropped, compact...)
+		} else {
+			dropped6 = append(dropped6, compact...)
+		}
+	}
+
+	dictionary := &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "added"}:    &bencode.String{Value: string(added)},
+		bencode.String{Value: "added.f"}:  &bencode.String{Value: string(addedFlags)},
+		bencode.String{Value: "added6"}:   &bencode.String{Value: string(added6)},
+		bencode.String{Value: "added6.f"}: &bencode.String{Value: string(added6Flags)},
+		bencode.String{Value: "dropped"}:  &bencode.String{Value: string(dropped)},
+		bencode.String{Value: "dropped6"}: &bencode.String{Value: string(dropped6)},
+	}}
+	return dictionary.Encode()
+}
+
+// getString returns the string found at key in the dictionary , or an empty one.
+func getString(dictionary *bencode.Dictionary, key string) string {
+	if value, isString := dictionary.Values[bencode.String{Value: key}].(*bencode.String); isString {
+		return value.Value
+	}
+	return ""
+}
+
+// Decode parses a ut_pex message. Peers without flags get no flags.
+func Decode(payload []byte) (*Message, error) {
+
+	dictionary, _, err := bencode.ParseDictionary(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	added := getString(dictionary, "added")
+	added6 := getString(dictionary, "added6")
+	if len(added)%COMPACT_IPV4_LENGTH != 0 || len(added6)%COMPACT_IPV6_LENGTH != 0 {
+		return nil, errors.New("Invalid compact peers")
+	}
+
+	message := &Message{}
+	for _, list := range []struct {
+		compact string
+		flags   string
+		length  int
+	}{
+		{added, getString(dictionary, "added.f"), COMPACT_IPV4_LENGTH},
+		{added6, getString(dictionary, "added6.f"), COMPACT_IPV6_LENGTH},
+	} {
+		for index, address := range decodeAddresses(list.compact, list.length) {
+			contact := Contact{Address: address}
+			if index < len(list.flags) {
+				contact.Flags = list.flags[index]
+			}
+			message.Added = append(message.Added, contact)
+		}
+	}
+	message.Dropped = append(decodeAddresses(getString(dictionary, "dropped"), COMPACT_IPV4_LENGTH),
+		decodeAddresses(getString(dictionary, "dropped6"), COMPACT_IPV6_LENGTH)...)
+	return message, nil
+}
+
+// State remembers what we told a peer , so only the changes are sent.
+type State struct {
+	sent     map[string]bool
+	lastSent time.Time
+}
+
+// NewState returns the state of a peer we didn't send anything to.
+func NewState() *State {
+	return &State{sent: make(map[string]bool)}
+}
+
+// Update returns the message telling how the connected peers changed since the previous message.
+// It returns nil if the previous message was sent less than PEX_DURATION ago , or if nothing changed.
+// The changes which didn't fit in the message are sent in the next one.
+func (state *State) Update(connected []Contact) *Message {
+
+	if time.Since(state.lastSent) < PEX_DURATION {
+		return nil
+	}
+
+	message := &Message{}
+	current := make(map[string]bool)
+	for _, contact := range connected {
+		current[contact.Address] = true
+		if !state.sent[contact.Address] && len(message.Added) < MAX_PEERS {
+			message.Added = append(message.Added, contact)
+			state.sent[contact.Address] = true
+		}
+	}
+	for address := range state.sent {
+		if !current[address] && len(message.Dropped) < MAX_PEERS {
+			message.Dropped = append(message.Dropped, address)
+			delete(state.sent, address)
+		}
+	}
+
+	if len(message.Added) == 0 && len(message.Dropped) == 0 {
+		return nil
+	}
+	state.lastSent = time.Now()
+	return message
+}
+
+// Handler returns the ut_pex handler , which gives the added peers to addPeer.
+// The messages a peer sends more often than allowed are ignored , and so are the peers over MAX_PEERS.
+// It also returns the disconnect handler , which forgets when the peers sent their last message.
+func Handler(addPeer func(contact Contact)) (peer.ExtensionHandler, peer.DisconnectHandler) {
+	lastReceived := make(map[*peer.Peer]time.Time)
+	var locker sync.Mutex
+	forget := func(remotePeer *peer.Peer) {
+		locker.Lock()
+		defer locker.Unlock()
+		delete(lastReceived, remotePeer)
+	}
+	handler := func(remotePeer *peer.Peer, payload []byte) {
+		locker.Lock()
+		last, hasSent := lastReceived[remotePeer]
+		// We leave some slack , since the messages may be delayed.
+		if hasSent && time.Since(last) < PEX_DURATION/2 {
+			locker.Unlock()
+			return
+		}
+		lastReceived[remotePeer] = time.Now()
+		locker.Unlock()
+
+		message, err := Decode(payload)
+		if err != nil {
+			return
+		}
+		for index, contact := range message.Added {
+			if index == MAX_PEERS {
+				break
+			}
+			addPeer(contact)
+		}
+	}
+	return handler, forget
+}
@@ -0,0 +1,115 @@
+package pex
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	sent := &Message{
+		Added: []Contact{
+			{"10.0.0.1:6881", FLAG_SEED},
+			{"[2001:db8::1]:51413", FLAG_ENCRYPTION | FLAG_UTP},
+			{"192.168.1.2:1", 0},
+		},
+		Dropped: []string{"10.0.0.3:6882", "[2001:db8::2]:6883"},
+	}
+
+	received, err := Decode(sent.Encode())
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+
+	expectedAdded := []Contact{sent.Added[0], sent.Added[2], sent.Added[1]}
+	if len(received.Added) != len(expectedAdded) {
+		t.Fatalf("Expected %d added peers , got %v", len(expectedAdded), received.Added)
+	}
+	for index, contact := range received.Added {
+		if contact != expectedAdded[index] {
+			t.Errorf("Expected %v , got %v", expectedAdded[index], contact)
+		}
+	}
+	if len(received.Dropped) != 2 || received.Dropped[0] != sent.Dropped[0] || received.Dropped[1] != sent.Dropped[1] {
+		t.Errorf("Wrong dropped peers %v", received.Dropped)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, invalid := range []string{"", "le", "d5:added5:12345e", "d6:added67:1234567e"} {
+		if _, err := Decode([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+
+	// The flags are optional.
+	message, err := Decode([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe1e"))
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if len(message.Added) != 1 || message.Added[0] != (Contact{"10.0.0.1:6881", 0}) {
+		t.Errorf("Wrong added peers %v", message.Added)
+	}
+}
+
+func TestStateUpdate(t *testing.T) {
+	state := NewState()
+
+	connected := []Contact{}
+	for index := 0; index < MAX_PEERS+10; index++ {
+		connected = append(connected, Contact{fmt.Sprintf("10.0.0.%d:6881", index), 0})
+	}
+
+	message := state.Update(connected)
+	if message == nil || len(message.Added) != MAX_PEERS || len(message.Dropped) != 0 {
+		t.Fatalf("Expected %d added peers , got %v", MAX_PEERS, message)
+	}
+	if state.Update(connected) != nil {
+		t.Errorf("Sent two messages in less than %s", PEX_DURATION)
+	}
+
+	// The peers which didn't fit are sent next time , with the dropped ones.
+	state.lastSent = state.lastSent.Add(-PEX_DURATION)
+	message = state.Update(connected[1:])
+	if message == nil || len(message.Added) != 10 || len(message.Dropped) != 1 || message.Dropped[0] != connected[0].Address {
+		t.Fatalf("Wrong message %v", message)
+	}
+
+	state.lastSent = state.lastSent.Add(-PEX_DURATION)
+	if message := state.Update(connected[1:]); message != nil {
+		t.Errorf("Expected no message , got %v", message)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	added := []Contact{}
+	handler, forget := Handler(func(contact Contact) {
+		added = append(added, contact)
+	})
+	registry := peer.NewExtensionRegistry(0)
+	registry.Register(UT_PEX, handler)
+	registry.OnDisconnect(forget)
+
+	remotePeer := peer.New(&torrent_info.TorrentInfo{}, "-YM00000000000000000", "10.0.0.1", 6881)
+	remotePeer.Extensions = registry
+	message := &Message{Added: []Contact{{"10.0.0.2:6881", FLAG_SEED}}}
+	handler(&remotePeer, message.Encode())
+	if len(added) != 1 || added[0] != message.Added[0] {
+		t.Errorf("Wrong added peers %v", added)
+	}
+
+	// The peer sends too often.
+	handler(&remotePeer, (&Message{Added: []Contact{{"10.0.0.3:6881", 0}}}).Encode())
+	if len(added) != 1 {
+		t.Errorf("Expected the second message to be ignored , got %v", added)
+	}
+
+	// Once the peer disconnected , it is forgotten , and its first message after it connects again is handled.
+	remotePeer.Disconnect()
+	handler(&remotePeer, (&Message{Added: []Contact{{"10.0.0.3:6881", 0}}}).Encode())
+	if len(added) != 2 {
+		t.Errorf("Expected the message after the reconnection to be handled , got %v", added)
+	}
+}
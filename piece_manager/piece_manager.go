@@ -2,8 +2,12 @@ package piece_manager
 
 import (
 	"errors"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/bbpcr/Yomato/bitfield"
 	"github.com/bbpcr/Yomato/file_writer"
 	"github.com/bbpcr/Yomato/peer"
 	"github.com/bbpcr/Yomato/torrent_info"
@@ -13,44 +17,75 @@ const (
 	BLOCK_LENGTH = 1 << 14
 )
 
+const (
+	RAREST_FIRST = iota
+	SEQUENTIAL
+)
+
+// When a piece is needed sooner than this , its blocks are requested again from faster peers.
+const URGENT_DEADLINE = 1 * time.Second
+
+// In the endgame , a block is requested from at most this many peers at once.
+const MAX_ENDGAME_REQUESTS = 3
+
 type PieceManager struct {
-	blockBytes       []int  //tells me how much i need to download from a block [block:bytes]
-	blockOffset      []int  //tells me the offset of the block in piece [block:pieceOffset]
-	blockDownloading []bool //tells me if a block is downloading [block:true/false]
-	blockPiece       []int  //tells me what piece the block belongs [block:piece]
-	pieceBytes       []int  //tells me how much i downloaded from a piece [piece:bytes]
-	pieceNumBlocks   []int  //tells me how many blocks a piece has until his position [piece:numBlocks]
-	totalBlocks      int
-	blocksLocker     sync.Mutex
+	blockBytes        []int             //tells me how much i need to download from a block [block:bytes]
+	blockOffset       []int             //tells me the offset of the block in piece [block:pieceOffset]
+	blockDownloading  []bool            //tells me if a block is downloading [block:true/false]
+	blockPiece        []int             //tells me what piece the block belongs [block:piece]
+	pieceBytes        []int             //tells me how much i downloaded from a piece [piece:bytes]
+	pieceNumBlocks    []int             //tells me how many blocks a piece has until his position [piece:numBlocks]
+	pieceAvailability []int             //tells me how many connected peers have a piece [piece:peers]
+	blockRate         []float64         //tells me the download rate of the peer a block was requested from [block:rate]
+	pieceDeadline     map[int]time.Time //tells me when a piece is needed [piece:deadline]
+	piecePriority     []int             //tells me the highest priority of the files in a piece [piece:priority]
+	blockRequesters   [][]*peer.Peer    //tells me which peers a block is requested from [block:peers]
+	pieceNeeded       []int             //tells me how many blocks of a piece are not downloaded [piece:blocks]
+	pieceFree         []int             //tells me how many blocks of a piece are not downloaded and not downloading [piece:blocks]
+	wantedNeeded      int               //tells me how many blocks of the wanted pieces are not downloaded
+	wantedFree        int               //tells me how many blocks of the wanted pieces are not downloaded and not downloading
+	wastedBytes       int64             //tells me how many bytes we received for blocks we already had
+	totalBlocks       int
+	mode              int
+	cursor            int
+	blocksLocker      sync.Mutex
 	//These should be maps because, if a value doesnt exist then we dont download it.
 }
 
+// GetBlockIndex returns the index of the block which starts at the offset of the piece,
+// or -1 if there is no such block , like for the blocks a peer made up.
 func (manager *PieceManager) GetBlockIndex(pieceIndex int, offsetIndex int) int {
 
 	//manager.blocksLocker.Lock()
 	//defer manager.blocksLocker.Unlock()
+	if pieceIndex < 0 || pieceIndex >= len(manager.pieceNumBlocks) || offsetIndex < 0 || offsetIndex%BLOCK_LENGTH != 0 {
+		return -1
+	}
 	startPosition := manager.pieceNumBlocks[pieceIndex]
 	howMany := offsetIndex / BLOCK_LENGTH
 	startPosition += howMany
+	if startPosition >= manager.totalBlocks || manager.blockPiece[startPosition] != pieceIndex {
+		return -1
+	}
 	return startPosition
 }
 
 func New(torrentInfo *torrent_info.TorrentInfo) *PieceManager {
 
 	manager := &PieceManager{
-		blockBytes:       make([]int , 0),
-		blockOffset:      make([]int , 0),
-		blockDownloading: make([]bool , 0),
-		blockPiece:       make([]int , 0),
-		pieceBytes:       make([]int , 0),
-		pieceNumBlocks:   make([]int , 0),
+		blockBytes:       make([]int, 0),
+		blockOffset:      make([]int, 0),
+		blockDownloading: make([]bool, 0),
+		blockPiece:       make([]int, 0),
+		pieceBytes:       make([]int, 0),
+		pieceNumBlocks:   make([]int, 0),
 	}
 
 	blockIndex := 0
 
 	for pieceIndex := 0; pieceIndex < int(torrentInfo.FileInformations.PieceCount); pieceIndex++ {
 
-		manager.pieceNumBlocks = append(manager.pieceNumBlocks , blockIndex)
+		manager.pieceNumBlocks = append(manager.pieceNumBlocks, blockIndex)
 		pieceLength := torrentInfo.FileInformations.PieceLength
 		if pieceIndex == int(torrentInfo.FileInformations.PieceCount)-1 {
 			pieceLength = torrentInfo.FileInformations.TotalLength - torrentInfo.FileInformations.PieceLength*(torrentInfo.FileInformations.PieceCount-1)
@@ -60,28 +95,80 @@ func New(torrentInfo *torrent_info.TorrentInfo) *PieceManager {
 		offset := 0
 
 		for blockPosition := 0; blockPosition < int(numBlocks); blockPosition++ {
-			manager.blockBytes = append(manager.blockBytes , BLOCK_LENGTH)
+			manager.blockBytes = append(manager.blockBytes, BLOCK_LENGTH)
 			manager.blockDownloading = append(manager.blockDownloading, false)
 			manager.blockPiece = append(manager.blockPiece, pieceIndex)
-			manager.blockOffset = append(manager.blockOffset , offset)
+			manager.blockOffset = append(manager.blockOffset, offset)
 			blockIndex++
 			offset += BLOCK_LENGTH
 		}
 
-		manager.pieceBytes = append(manager.pieceBytes , 0)
+		manager.pieceBytes = append(manager.pieceBytes, 0)
 
 		if lastBlockSize != 0 {
-			manager.blockBytes = append(manager.blockBytes , int(lastBlockSize))
+			manager.blockBytes = append(manager.blockBytes, int(lastBlockSize))
 			manager.blockDownloading = append(manager.blockDownloading, false)
 			manager.blockPiece = append(manager.blockPiece, pieceIndex)
-			manager.blockOffset = append(manager.blockOffset , offset)
+			manager.blockOffset = append(manager.blockOffset, offset)
 			blockIndex++
 		}
 	}
 	manager.totalBlocks = blockIndex
+	manager.pieceAvailability = make([]int, len(manager.pieceBytes))
+	manager.blockRate = make([]float64, manager.totalBlocks)
+	manager.pieceDeadline = make(map[int]time.Time)
+	manager.piecePriority = make([]int, len(manager.pieceBytes))
+	manager.blockRequesters = make([][]*peer.Peer, manager.totalBlocks)
+	for pieceIndex := range manager.piecePriority {
+		manager.piecePriority[pieceIndex] = file_writer.PRIORITY_NORMAL
+	}
+	manager.pieceNeeded = make([]int, len(manager.pieceBytes))
+	manager.pieceFree = make([]int, len(manager.pieceBytes))
+	for block := 0; block < manager.totalBlocks; block++ {
+		manager.pieceNeeded[manager.blockPiece[block]]++
+		manager.pieceFree[manager.blockPiece[block]]++
+	}
+	manager.countWantedBlocks()
 	return manager
 }
 
+// setBlock changes how many bytes of the block are left and whether it is downloading,
+// and keeps the counts of the blocks up to date. The blocks are only changed through it.
+func (manager *PieceManager) setBlock(block int, bytes int, downloading bool) {
+	pieceIndex := manager.blockPiece[block]
+	wanted := manager.piecePriority[pieceIndex] != file_writer.PRIORITY_SKIP
+	count := func(sign int) {
+		if manager.blockBytes[block] <= 0 {
+			return
+		}
+		manager.pieceNeeded[pieceIndex] += sign
+		if wanted {
+			manager.wantedNeeded += sign
+		}
+		if !manager.blockDownloading[block] {
+			manager.pieceFree[pieceIndex] += sign
+			if wanted {
+				manager.wantedFree += sign
+			}
+		}
+	}
+	count(-1)
+	manager.blockBytes[block] = bytes
+	manager.blockDownloading[block] = downloading
+	count(1)
+}
+
+// countWantedBlocks counts the blocks left of the wanted pieces , after their priorities changed.
+func (manager *PieceManager) countWantedBlocks() {
+	manager.wantedNeeded, manager.wantedFree = 0, 0
+	for pieceIndex, priority := range manager.piecePriority {
+		if priority != file_writer.PRIORITY_SKIP {
+			manager.wantedNeeded += manager.pieceNeeded[pieceIndex]
+			manager.wantedFree += manager.pieceFree[pieceIndex]
+		}
+	}
+}
+
 func (manager *PieceManager) AddPieceToDownload(pieceIndex int, torrentInfo *torrent_info.TorrentInfo) {
 	manager.blocksLocker.Lock()
 	defer manager.blocksLocker.Unlock()
@@ -95,8 +182,8 @@ func (manager *PieceManager) AddPieceToDownload(pieceIndex int, torrentInfo *tor
 	blockIndex := manager.pieceNumBlocks[pieceIndex]
 
 	for blockPosition := 0; blockPosition < int(numBlocks); blockPosition++ {
-		manager.blockBytes[blockIndex] = BLOCK_LENGTH
-		manager.blockDownloading[blockIndex] = false
+		manager.setBlock(blockIndex, BLOCK_LENGTH, false)
+		manager.blockRequesters[blockIndex] = nil
 		blockIndex++
 		offset += BLOCK_LENGTH
 	}
@@ -104,8 +191,8 @@ func (manager *PieceManager) AddPieceToDownload(pieceIndex int, torrentInfo *tor
 	manager.pieceBytes[pieceIndex] = 0
 
 	if lastBlockSize != 0 {
-		manager.blockBytes[blockIndex] = int(lastBlockSize)
-		manager.blockDownloading[blockIndex] = false
+		manager.setBlock(blockIndex, int(lastBlockSize), false)
+		manager.blockRequesters[blockIndex] = nil
 		blockIndex++
 	}
 }
@@ -123,59 +210,480 @@ func (manager *PieceManager) RemovePieceFromDownload(pieceIndex int, torrentInfo
 	blockIndex := manager.pieceNumBlocks[pieceIndex]
 
 	for blockPosition := 0; blockPosition < int(numBlocks); blockPosition++ {
-		manager.blockBytes[blockIndex] = 0
-		manager.blockDownloading[blockIndex] = false
+		manager.setBlock(blockIndex, 0, false)
+		manager.blockRequesters[blockIndex] = nil
 		blockIndex++
 		offset += BLOCK_LENGTH
 	}
 
 	if lastBlockSize != 0 {
-		manager.blockBytes[blockIndex] = 0
-		manager.blockDownloading[blockIndex] = false
+		manager.setBlock(blockIndex, 0, false)
+		manager.blockRequesters[blockIndex] = nil
 		blockIndex++
 	}
 
 	manager.pieceBytes[pieceIndex] = int(pieceLength)
 }
 
-// Returns the ID of the next piece to download.
-// This can use multiple strategies, e.g.
-// Sequentially (NOT good, easy for development)
-// or randomized (much better)
+// getPieceBlocks returns the first block of the piece and the first block after it.
+func (manager *PieceManager) getPieceBlocks(pieceIndex int) (int, int) {
+	startBlock := manager.pieceNumBlocks[pieceIndex]
+	endBlock := manager.totalBlocks
+	if pieceIndex+1 < len(manager.pieceNumBlocks) {
+		endBlock = manager.pieceNumBlocks[pieceIndex+1]
+	}
+	return startBlock, endBlock
+}
+
+// countFreeBlocks returns how many blocks of the piece are not downloaded and not downloading,
+// and how many blocks of the piece are not downloaded.
+func (manager *PieceManager) countFreeBlocks(pieceIndex int) (int, int) {
+	return manager.pieceFree[pieceIndex], manager.pieceNeeded[pieceIndex]
+}
+
+// canDownload tells if we want the piece and the peer has it.
+// While the peer chokes us , only its allowed fast pieces can be requested.
+func (manager *PieceManager) canDownload(pieceIndex int, for_peer *peer.Peer) bool {
+	if for_peer.IsPeerChoking() && !for_peer.IsAllowedFast(pieceIndex) {
+		return false
+	}
+	return manager.piecePriority[pieceIndex] != file_writer.PRIORITY_SKIP && for_peer.HasPiece(pieceIndex)
+}
+
+// HasBlocksFor tells if there are blocks left which can be requested from the peer.
+// The counts of the pieces are checked before the peer , which has its own locks.
+func (manager *PieceManager) HasBlocksFor(for_peer *peer.Peer) bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	for pieceIndex := range manager.pieceNeeded {
+		if manager.pieceNeeded[pieceIndex] > 0 && manager.canDownload(pieceIndex, for_peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsInterestedIn tells if the peer has pieces we still need , whether it chokes us or not.
+func (manager *PieceManager) IsInterestedIn(for_peer *peer.Peer) bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	for pieceIndex := range manager.pieceBytes {
+		if manager.pieceNeeded[pieceIndex] > 0 && manager.piecePriority[pieceIndex] != file_writer.PRIORITY_SKIP && for_peer.HasPiece(pieceIndex) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBetterPiece tells if the piece should be started before the other piece:
+// it has a higher priority , or the same priority and it is rarer.
+func (manager *PieceManager) isBetterPiece(pieceIndex int, otherPiece int) bool {
+	if manager.piecePriority[pieceIndex] != manager.piecePriority[otherPiece] {
+		return manager.piecePriority[pieceIndex] > manager.piecePriority[otherPiece]
+	}
+	return manager.pieceAvailability[pieceIndex] < manager.pieceAvailability[otherPiece]
+}
+
+func containsBlock(blocks []int, block int) bool {
+	for _, otherBlock := range blocks {
+		if otherBlock == block {
+			return true
+		}
+	}
+	return false
+}
+
+// appendFreeBlocks appends the free blocks of the piece to blocks , until there are maxBlocks.
+func (manager *PieceManager) appendFreeBlocks(blocks []int, pieceIndex int, maxBlocks int) []int {
+	startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+	for block := startBlock; block < endBlock && len(blocks) < maxBlocks; block++ {
+		if !manager.blockDownloading[block] && manager.blockBytes[block] > 0 && !containsBlock(blocks, block) {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// SetFilePriorities maps the priorities of the files onto the pieces.
+// A piece gets the highest priority of the files it contains , so the pieces at the boundary of
+// a skipped file are still downloaded if the other file is wanted.
+func (manager *PieceManager) SetFilePriorities(priorities []int, torrentInfo *torrent_info.TorrentInfo) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+
+	for pieceIndex := range manager.piecePriority {
+		manager.piecePriority[pieceIndex] = file_writer.PRIORITY_SKIP
+	}
+
+	fileStart := int64(0)
+	for fileIndex, fileData := range torrentInfo.FileInformations.Files {
+		fileEnd := fileStart + fileData.Length
+		if fileData.Length > 0 {
+			firstPiece := int(fileStart / torrentInfo.FileInformations.PieceLength)
+			lastPiece := int((fileEnd - 1) / torrentInfo.FileInformations.PieceLength)
+			for pieceIndex := firstPiece; pieceIndex <= lastPiece && pieceIndex < len(manager.piecePriority); pieceIndex++ {
+				if priorities[fileIndex] > manager.piecePriority[pieceIndex] {
+					manager.piecePriority[pieceIndex] = priorities[fileIndex]
+				}
+			}
+		}
+		fileStart = fileEnd
+	}
+	manager.countWantedBlocks()
+}
+
+// IsPieceWanted tells if the piece is part of a file which is not skipped.
+func (manager *PieceManager) IsPieceWanted(pieceIndex int) bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	return manager.piecePriority[pieceIndex] != file_writer.PRIORITY_SKIP
+}
+
+// AllWantedCompleted tells if we have all the pieces which we want.
+func (manager *PieceManager) AllWantedCompleted(clientBitfield *bitfield.Shared) bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	for pieceIndex, priority := range manager.piecePriority {
+		if priority != file_writer.PRIORITY_SKIP && !clientBitfield.At(pieceIndex) {
+			return false
+		}
+	}
+	return true
+}
+
+// CountWantedPieces returns how many pieces we want , and how many of them we have.
+func (manager *PieceManager) CountWantedPieces(clientBitfield *bitfield.Shared) (int, int) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	wanted, completed := 0, 0
+	for pieceIndex, priority := range manager.piecePriority {
+		if priority != file_writer.PRIORITY_SKIP {
+			wanted++
+			if clientBitfield.At(pieceIndex) {
+				completed++
+			}
+		}
+	}
+	return wanted, completed
+}
+
+// SetMode chooses how new pieces are picked : RAREST_FIRST or SEQUENTIAL.
+func (manager *PieceManager) SetMode(mode int) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	manager.mode = mode
+}
+
+// SetCursor moves the playback cursor to the piece.
+// In SEQUENTIAL mode , pieces are downloaded in order starting from the cursor.
+func (manager *PieceManager) SetCursor(pieceIndex int) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(manager.pieceBytes) {
+		manager.cursor = pieceIndex
+	}
+}
+
+// SetPieceDeadline tells that the piece is needed within the given duration.
+// Pieces with deadlines are downloaded before anything else , earliest deadline first.
+func (manager *PieceManager) SetPieceDeadline(pieceIndex int, within time.Duration) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(manager.pieceBytes) {
+		manager.pieceDeadline[pieceIndex] = time.Now().Add(within)
+	}
+}
+
+// ClearDeadlines removes the deadlines of all the pieces.
+func (manager *PieceManager) ClearDeadlines() {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	manager.pieceDeadline = make(map[int]time.Time)
+}
+
+// getDeadlinePieces returns the pieces with deadlines which still need blocks , earliest deadline first.
+// The deadlines of finished pieces are removed.
+func (manager *PieceManager) getDeadlinePieces() []int {
+	pieces := []int{}
+	for pieceIndex := range manager.pieceDeadline {
+		if _, needed := manager.countFreeBlocks(pieceIndex); needed == 0 {
+			delete(manager.pieceDeadline, pieceIndex)
+		} else {
+			pieces = append(pieces, pieceIndex)
+		}
+	}
+	sort.Slice(pieces, func(i, j int) bool {
+		return manager.pieceDeadline[pieces[i]].Before(manager.pieceDeadline[pieces[j]])
+	})
+	return pieces
+}
+
+// appendUrgentBlocks appends the blocks of a piece whose deadline is close , which are already downloading
+// from a slower peer. The same blocks are requested again from the faster peer.
+func (manager *PieceManager) appendUrgentBlocks(blocks []int, pieceIndex int, maxBlocks int, for_peer *peer.Peer) []int {
+	startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+	downloadRate := for_peer.GetDownloadRate()
+	for block := startBlock; block < endBlock && len(blocks) < maxBlocks; block++ {
+		if manager.blockDownloading[block] && manager.blockBytes[block] > 0 && manager.blockRate[block] < downloadRate && !manager.isRequestedFrom(block, for_peer) && !containsBlock(blocks, block) {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// isRequestedFrom tells if the block is already requested from the peer.
+func (manager *PieceManager) isRequestedFrom(block int, for_peer *peer.Peer) bool {
+	for _, requester := range manager.blockRequesters[block] {
+		if requester == for_peer {
+			return true
+		}
+	}
+	return false
+}
+
+// inEndgame tells if every block we still want is already downloading.
+func (manager *PieceManager) inEndgame() bool {
+	return manager.wantedFree == 0 && manager.wantedNeeded > 0
+}
+
+// IsEndgame tells if the download reached the endgame , where every block left is already downloading.
+func (manager *PieceManager) IsEndgame() bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	return manager.inEndgame()
+}
+
+// appendEndgameBlocks appends the blocks which are downloading from other peers , until there are maxBlocks.
+// The blocks requested from the fewest peers come first , and none is requested from more than MAX_ENDGAME_REQUESTS peers.
+func (manager *PieceManager) appendEndgameBlocks(blocks []int, maxBlocks int, for_peer *peer.Peer) []int {
+	candidates := []int{}
+	for pieceIndex := range manager.pieceNeeded {
+		if manager.pieceNeeded[pieceIndex] == 0 || !manager.canDownload(pieceIndex, for_peer) {
+			continue
+		}
+		startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+		for block := startBlock; block < endBlock; block++ {
+			if manager.blockDownloading[block] && manager.blockBytes[block] > 0 && len(manager.blockRequesters[block]) < MAX_ENDGAME_REQUESTS &&
+				!manager.isRequestedFrom(block, for_peer) && !containsBlock(blocks, block) {
+				candidates = append(candidates, block)
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(manager.blockRequesters[candidates[i]]) < len(manager.blockRequesters[candidates[j]])
+	})
+	for _, block := range candidates {
+		if len(blocks) >= maxBlocks {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// Returns the blocks to download next from the peer.
+// Pieces with deadlines come first. Then, in RAREST_FIRST mode, pieces which are partially downloaded
+// are finished , so they can be verified and shared , and new pieces are picked rarest-first
+// with random tie-breaking, so that all the pieces stay available in the swarm.
+// In SEQUENTIAL mode new pieces are picked in order , starting from the cursor.
+// In the endgame , blocks which are already downloading from other peers are returned.
 func (manager *PieceManager) GetNextBlocksToDownload(for_peer *peer.Peer, maxBlocks int) []int {
 
-	//manager.blocksLocker.Lock()
-	//defer manager.blocksLocker.Unlock()
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
 	blocks := []int{}
-	for block, count := 0, 0; block < manager.totalBlocks && count < maxBlocks; block++ {
-		if !manager.blockDownloading[block] && for_peer.BitfieldInfo.At(manager.blockPiece[block]) && manager.blockBytes[block] > 0 {
-			blocks = append(blocks, block)
-			count++
+	pieceCount := len(manager.pieceBytes)
+
+	// The pieces needed soon are the most important.
+	for _, pieceIndex := range manager.getDeadlinePieces() {
+		if len(blocks) >= maxBlocks {
+			break
+		}
+		if !manager.canDownload(pieceIndex, for_peer) {
+			continue
+		}
+		blocks = manager.appendFreeBlocks(blocks, pieceIndex, maxBlocks)
+		if time.Until(manager.pieceDeadline[pieceIndex]) < URGENT_DEADLINE {
+			blocks = manager.appendUrgentBlocks(blocks, pieceIndex, maxBlocks, for_peer)
+		}
+	}
+
+	// Then the pieces the peer suggested , which it can send quickly.
+	for _, pieceIndex := range for_peer.GetSuggestedPieces() {
+		if len(blocks) >= maxBlocks {
+			break
+		}
+		if manager.canDownload(pieceIndex, for_peer) {
+			blocks = manager.appendFreeBlocks(blocks, pieceIndex, maxBlocks)
+		}
+	}
+
+	if manager.mode == SEQUENTIAL {
+		for position := 0; position < pieceCount && len(blocks) < maxBlocks; position++ {
+			pieceIndex := (manager.cursor + position) % pieceCount
+			if manager.canDownload(pieceIndex, for_peer) {
+				blocks = manager.appendFreeBlocks(blocks, pieceIndex, maxBlocks)
+			}
 		}
 	}
 
-	if len(blocks) < maxBlocks {
-		for block, count := 0, len(blocks); block < manager.totalBlocks && count < maxBlocks; block++ {
-			if for_peer.BitfieldInfo.At(manager.blockPiece[block]) && manager.blockBytes[block] > 0 {
-				blocks = append(blocks, block)
-				count++
+	// First we continue the pieces which were started.
+	newPieces := []int{}
+	for pieceIndex := 0; pieceIndex < pieceCount && len(blocks) < maxBlocks; pieceIndex++ {
+		free, needed := manager.countFreeBlocks(pieceIndex)
+		if free == 0 || !manager.canDownload(pieceIndex, for_peer) {
+			continue
+		}
+		startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+		if needed < endBlock-startBlock || free < needed {
+			blocks = manager.appendFreeBlocks(blocks, pieceIndex, maxBlocks)
+		} else {
+			newPieces = append(newPieces, pieceIndex)
+		}
+	}
+
+	// Then we start the rarest pieces , from the files with the highest priority.
+	for len(blocks) < maxBlocks && len(newPieces) > 0 {
+		rarest := []int{}
+		for _, pieceIndex := range newPieces {
+			if len(rarest) == 0 || manager.isBetterPiece(pieceIndex, rarest[0]) {
+				rarest = []int{pieceIndex}
+			} else if !manager.isBetterPiece(rarest[0], pieceIndex) {
+				rarest = append(rarest, pieceIndex)
 			}
 		}
+		chosen := rarest[rand.Intn(len(rarest))]
+		blocks = manager.appendFreeBlocks(blocks, chosen, maxBlocks)
+		for index, pieceIndex := range newPieces {
+			if pieceIndex == chosen {
+				newPieces = append(newPieces[:index], newPieces[index+1:]...)
+				break
+			}
+		}
+	}
+
+	// At the end of the download , every block left is already downloading.
+	// They are requested from several peers , so a slow peer doesn't delay the end.
+	if len(blocks) < maxBlocks && manager.inEndgame() {
+		blocks = manager.appendEndgameBlocks(blocks, maxBlocks, for_peer)
+	}
+
+	// We remember how fast the peer was , so the blocks can be requested from a faster peer if they are late.
+	downloadRate := for_peer.GetDownloadRate()
+	for _, block := range blocks {
+		if !manager.blockDownloading[block] || manager.blockRate[block] < downloadRate {
+			manager.blockRate[block] = downloadRate
+		}
 	}
 
 	return blocks
 }
 
+// IncreaseAvailability is called when a peer announced that it has the piece.
+func (manager *PieceManager) IncreaseAvailability(pieceIndex int) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(manager.pieceAvailability) {
+		manager.pieceAvailability[pieceIndex]++
+	}
+}
+
+// DecreaseAvailability is called when a peer which had the piece disconnected.
+func (manager *PieceManager) DecreaseAvailability(pieceIndex int) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(manager.pieceAvailability) && manager.pieceAvailability[pieceIndex] > 0 {
+		manager.pieceAvailability[pieceIndex]--
+	}
+}
+
+// GetAvailability returns how many connected peers have each piece.
+func (manager *PieceManager) GetAvailability() []int {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	availability := make([]int, len(manager.pieceAvailability))
+	copy(availability, manager.pieceAvailability)
+	return availability
+}
+
+// DistributedCopies returns how many full copies of the torrent are in the swarm of connected peers.
+// The integer part is the availability of the rarest piece , and the fraction is the
+// part of the pieces which are more available than that.
+func (manager *PieceManager) DistributedCopies() float64 {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if len(manager.pieceAvailability) == 0 {
+		return 0
+	}
+	minimum := manager.pieceAvailability[0]
+	for _, count := range manager.pieceAvailability {
+		if count < minimum {
+			minimum = count
+		}
+	}
+	moreAvailable := 0
+	for _, count := range manager.pieceAvailability {
+		if count > minimum {
+			moreAvailable++
+		}
+	}
+	return float64(minimum) + float64(moreAvailable)/float64(len(manager.pieceAvailability))
+}
+
+// GetPartialPieces returns the pieces which are partially downloaded , and for each of them
+// which of its blocks are downloaded.
+func (manager *PieceManager) GetPartialPieces() map[int][]bool {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	partialPieces := make(map[int][]bool)
+	for pieceIndex := range manager.pieceBytes {
+		_, needed := manager.countFreeBlocks(pieceIndex)
+		startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+		if needed == 0 || needed == endBlock-startBlock {
+			continue
+		}
+		downloaded := make([]bool, endBlock-startBlock)
+		for block := startBlock; block < endBlock; block++ {
+			downloaded[block-startBlock] = manager.blockBytes[block] == 0
+		}
+		partialPieces[pieceIndex] = downloaded
+	}
+	return partialPieces
+}
+
+// SetDownloadedBlocks marks the blocks of the piece as downloaded , as returned by GetPartialPieces.
+func (manager *PieceManager) SetDownloadedBlocks(pieceIndex int, downloaded []bool) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if pieceIndex < 0 || pieceIndex >= len(manager.pieceBytes) {
+		return
+	}
+	startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+	for block := startBlock; block < endBlock && block-startBlock < len(downloaded); block++ {
+		if downloaded[block-startBlock] && manager.blockBytes[block] > 0 {
+			manager.pieceBytes[pieceIndex] += manager.blockBytes[block]
+			manager.setBlock(block, 0, false)
+		}
+	}
+}
+
 func (manager *PieceManager) UpdatePiece(pieceData file_writer.PieceData) error {
 
 	manager.blocksLocker.Lock()
 	defer manager.blocksLocker.Unlock()
 	blockIndex := manager.GetBlockIndex(pieceData.PieceNumber, pieceData.Offset)
+	if blockIndex < 0 {
+		return errors.New("Piece wasn't updated due to invalid params or piece already updated")
+	}
 	pieceLength := len(pieceData.Piece)
 	if manager.blockBytes[blockIndex] > 0 && pieceLength > 0 {
-		manager.blockBytes[blockIndex] -= pieceLength
+		manager.setBlock(blockIndex, manager.blockBytes[blockIndex]-pieceLength, manager.blockDownloading[blockIndex])
 		manager.pieceBytes[pieceData.PieceNumber] += pieceLength
 	} else {
+		if pieceLength > 0 {
+			// The block was received from another peer first.
+			manager.wastedBytes += int64(pieceLength)
+		}
 		return errors.New("Piece wasn't updated due to invalid params or piece already updated")
 	}
 	return nil
@@ -185,13 +693,71 @@ func (manager *PieceManager) SetPieceDownloading(pieceData file_writer.PieceData
 	manager.blocksLocker.Lock()
 	defer manager.blocksLocker.Unlock()
 	blockIndex := manager.GetBlockIndex(pieceData.PieceNumber, pieceData.Offset)
-	manager.blockDownloading[blockIndex] = value
+	if blockIndex < 0 {
+		return
+	}
+	manager.setBlock(blockIndex, manager.blockBytes[blockIndex], value)
+}
+
+// RequestBlock marks the block as downloading from the peer.
+func (manager *PieceManager) RequestBlock(blockIndex int, for_peer *peer.Peer) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if !manager.isRequestedFrom(blockIndex, for_peer) {
+		manager.blockRequesters[blockIndex] = append(manager.blockRequesters[blockIndex], for_peer)
+	}
+	manager.setBlock(blockIndex, manager.blockBytes[blockIndex], true)
+}
+
+// ReleaseBlock tells that the block is no longer downloading from the peer.
+// The block stays downloading while other peers were asked for it.
+func (manager *PieceManager) ReleaseBlock(blockIndex int, for_peer *peer.Peer) {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	if blockIndex < 0 || blockIndex >= manager.totalBlocks {
+		return
+	}
+	requesters := manager.blockRequesters[blockIndex]
+	for index, requester := range requesters {
+		if requester == for_peer {
+			manager.blockRequesters[blockIndex] = append(requesters[:index:index], requesters[index+1:]...)
+			break
+		}
+	}
+	manager.setBlock(blockIndex, manager.blockBytes[blockIndex], len(manager.blockRequesters[blockIndex]) > 0)
+}
+
+// FinishBlock is called when the block was received from the peer.
+// It returns the other peers the block was requested from , which should be sent a CANCEL.
+func (manager *PieceManager) FinishBlock(pieceData file_writer.PieceData, from_peer *peer.Peer) []*peer.Peer {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	blockIndex := manager.GetBlockIndex(pieceData.PieceNumber, pieceData.Offset)
+	others := []*peer.Peer{}
+	if blockIndex < 0 {
+		return others
+	}
+	for _, requester := range manager.blockRequesters[blockIndex] {
+		if requester != from_peer {
+			others = append(others, requester)
+		}
+	}
+	manager.blockRequesters[blockIndex] = nil
+	manager.setBlock(blockIndex, manager.blockBytes[blockIndex], false)
+	return others
+}
+
+// WastedBytes returns how many bytes were received for blocks we already had , because of the duplicated requests.
+func (manager *PieceManager) WastedBytes() int64 {
+	manager.blocksLocker.Lock()
+	defer manager.blocksLocker.Unlock()
+	return manager.wastedBytes
 }
 
 func (manager *PieceManager) SetBlockDownloading(blockIndex int, value bool) {
 	manager.blocksLocker.Lock()
 	defer manager.blocksLocker.Unlock()
-	manager.blockDownloading[blockIndex] = value
+	manager.setBlock(blockIndex, manager.blockBytes[blockIndex], value)
 }
 
 func (manager *PieceManager) MakeRequest(blockIndex int) (int, int, int) {
@@ -204,7 +770,9 @@ func (manager *PieceManager) MakeRequest(blockIndex int) (int, int, int) {
 
 func (manager *PieceManager) IsPieceCompleted(pieceIndex int, torrentInfo *torrent_info.TorrentInfo) bool {
 
-	
+	if pieceIndex < 0 || pieceIndex >= len(manager.pieceBytes) {
+		return false
+	}
 	if pieceIndex == int(torrentInfo.FileInformations.PieceCount-1) {
 		if torrentInfo.FileInformations.PieceCount >= 2 {
 			lastPieceLength := torrentInfo.FileInformations.TotalLength - torrentInfo.FileInformations.PieceLength*(torrentInfo.FileInformations.PieceCount-1)
@@ -0,0 +1,309 @@
+package piece_manager
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/file_writer"
+	"github.com/bbpcr/Yomato/peer"
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+// newSeeder returns an unchoking peer which has all the pieces.
+func newSeeder(t *testing.T, torrentInfo *torrent_info.TorrentInfo) *peer.Peer {
+	seeder := peer.New(torrentInfo, "-XX0000-000000000000", "127.0.0.1", 6881)
+
+	// The peer supports the fast extension , unchokes us and tells it has all the pieces over a fake connection.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	seeder.Connection = local
+	seeder.SetStatus(peer.CONNECTED)
+	seeder.Reserved = make([]byte, 8)
+	seeder.Reserved[peer.FAST_BYTE] |= peer.FAST_BIT
+	go remote.Write([]byte{0, 0, 0, 1, peer.UNCHOKE, 0, 0, 0, 1, peer.HAVE_ALL})
+	if err := seeder.ReadMessage(time.Second); err != nil || seeder.IsPeerChoking() {
+		t.Fatalf("The peer didn't unchoke us : %v", err)
+	}
+	if err := seeder.ReadMessage(time.Second); err != nil || !seeder.IsSeed() {
+		t.Fatalf("The peer didn't send HAVE_ALL : %v", err)
+	}
+	return &seeder
+}
+
+func TestEndgame(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{}
+	torrentInfo.FileInformations.PieceCount = 2
+	torrentInfo.FileInformations.PieceLength = 2 * BLOCK_LENGTH
+	torrentInfo.FileInformations.TotalLength = 4 * BLOCK_LENGTH
+	manager := New(torrentInfo)
+
+	seeders := []*peer.Peer{}
+	for index := 0; index < MAX_ENDGAME_REQUESTS+1; index++ {
+		seeders = append(seeders, newSeeder(t, torrentInfo))
+	}
+
+	blocks := manager.GetNextBlocksToDownload(seeders[0], 10)
+	if len(blocks) != 4 {
+		t.Fatalf("Expected 4 blocks , got %v", blocks)
+	}
+	if manager.IsEndgame() {
+		t.Errorf("The endgame started before the blocks were requested")
+	}
+	for _, block := range blocks {
+		manager.RequestBlock(block, seeders[0])
+	}
+	if !manager.IsEndgame() {
+		t.Fatalf("Expected the endgame once every block is downloading")
+	}
+
+	// The blocks are requested again , from at most MAX_ENDGAME_REQUESTS peers.
+	for _, seeder := range seeders[1:MAX_ENDGAME_REQUESTS] {
+		blocks := manager.GetNextBlocksToDownload(seeder, 10)
+		if len(blocks) != 4 {
+			t.Fatalf("Expected 4 blocks in the endgame , got %v", blocks)
+		}
+		for _, block := range blocks {
+			manager.RequestBlock(block, seeder)
+		}
+	}
+	if blocks := manager.GetNextBlocksToDownload(seeders[0], 10); len(blocks) != 0 {
+		t.Errorf("The same blocks were requested twice from a peer : %v", blocks)
+	}
+	if blocks := manager.GetNextBlocksToDownload(seeders[MAX_ENDGAME_REQUESTS], 10); len(blocks) != 0 {
+		t.Errorf("Expected no more duplicates than %d , got %v", MAX_ENDGAME_REQUESTS, blocks)
+	}
+
+	// When the block arrives , the other peers are cancelled.
+	pieceData := file_writer.PieceData{PieceNumber: 1, Offset: BLOCK_LENGTH, Piece: make([]byte, BLOCK_LENGTH)}
+	if err := manager.UpdatePiece(pieceData); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	others := manager.FinishBlock(pieceData, seeders[1])
+	if len(others) != MAX_ENDGAME_REQUESTS-1 {
+		t.Fatalf("Expected %d peers to cancel , got %d", MAX_ENDGAME_REQUESTS-1, len(others))
+	}
+	for _, other := range others {
+		if other == seeders[1] {
+			t.Errorf("The peer which sent the block was cancelled")
+		}
+	}
+
+	// A copy which still arrives is wasted.
+	if err := manager.UpdatePiece(pieceData); err == nil {
+		t.Errorf("Expected an error for a duplicated block")
+	}
+	if manager.WastedBytes() != BLOCK_LENGTH {
+		t.Errorf("Expected %d wasted bytes , got %d", BLOCK_LENGTH, manager.WastedBytes())
+	}
+
+	// A released block stays downloading while other peers were asked for it.
+	manager.ReleaseBlock(0, seeders[0])
+	manager.ReleaseBlock(0, seeders[1])
+	if blocks := manager.GetNextBlocksToDownload(seeders[MAX_ENDGAME_REQUESTS], 1); len(blocks) != 1 || blocks[0] != 0 {
+		t.Errorf("Expected block 0 , got %v", blocks)
+	}
+	manager.ReleaseBlock(0, seeders[2])
+	if manager.IsEndgame() {
+		t.Errorf("Expected the endgame to stop when a block is no longer downloading")
+	}
+}
+
+func TestInvalidBlocks(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{}
+	torrentInfo.FileInformations.PieceCount = 2
+	torrentInfo.FileInformations.PieceLength = 2 * BLOCK_LENGTH
+	torrentInfo.FileInformations.TotalLength = 3 * BLOCK_LENGTH
+	manager := New(torrentInfo)
+
+	if blockIndex := manager.GetBlockIndex(1, 0); blockIndex != 2 {
+		t.Errorf("Expected block 2 , got %d", blockIndex)
+	}
+
+	// The pieces and offsets outside of the torrent , or between the blocks , have no block.
+	invalid := [][2]int{{-1, 0}, {2, 0}, {1 << 30, 0}, {0, -BLOCK_LENGTH}, {0, 2 * BLOCK_LENGTH}, {1, BLOCK_LENGTH}, {0, 100}}
+	for _, position := range invalid {
+		if blockIndex := manager.GetBlockIndex(position[0], position[1]); blockIndex != -1 {
+			t.Errorf("Expected no block for piece %d at %d , got %d", position[0], position[1], blockIndex)
+		}
+		pieceData := file_writer.PieceData{PieceNumber: position[0], Offset: position[1], Piece: make([]byte, BLOCK_LENGTH)}
+		if err := manager.UpdatePiece(pieceData); err == nil {
+			t.Errorf("Expected an error for piece %d at %d", position[0], position[1])
+		}
+		if others := manager.FinishBlock(pieceData, nil); len(others) != 0 {
+			t.Errorf("Expected no peers to cancel , got %d", len(others))
+		}
+		if manager.IsPieceCompleted(position[0], torrentInfo) {
+			t.Errorf("Expected piece %d not to be completed", position[0])
+		}
+	}
+}
+
+// checkBlockCounts compares the counts of the blocks with the blocks themselves.
+func checkBlockCounts(t *testing.T, manager *PieceManager) {
+	wantedNeeded, wantedFree := 0, 0
+	for pieceIndex := range manager.pieceBytes {
+		free, needed := 0, 0
+		startBlock, endBlock := manager.getPieceBlocks(pieceIndex)
+		for block := startBlock; block < endBlock; block++ {
+			if manager.blockBytes[block] > 0 {
+				needed++
+				if !manager.blockDownloading[block] {
+					free++
+				}
+			}
+		}
+		if free != manager.pieceFree[pieceIndex] || needed != manager.pieceNeeded[pieceIndex] {
+			t.Fatalf("Piece %d : expected %d free and %d needed blocks , counted %d and %d", pieceIndex, free, needed, manager.pieceFree[pieceIndex], manager.pieceNeeded[pieceIndex])
+		}
+		if manager.piecePriority[pieceIndex] != file_writer.PRIORITY_SKIP {
+			wantedNeeded += needed
+			wantedFree += free
+		}
+	}
+	if wantedNeeded != manager.wantedNeeded || wantedFree != manager.wantedFree {
+		t.Fatalf("Expected %d free and %d needed wanted blocks , counted %d and %d", wantedFree, wantedNeeded, manager.wantedFree, manager.wantedNeeded)
+	}
+}
+
+func TestBlockCounts(t *testing.T) {
+	torrentInfo := &torrent_info.TorrentInfo{}
+	torrentInfo.FileInformations.PieceCount = 4
+	torrentInfo.FileInformations.PieceLength = 2 * BLOCK_LENGTH
+	torrentInfo.FileInformations.TotalLength = 7*BLOCK_LENGTH + 100
+	torrentInfo.FileInformations.Files = []torrent_info.SingleFileInfo{{Length: 3 * BLOCK_LENGTH}, {Length: 4*BLOCK_LENGTH + 100}}
+	manager := New(torrentInfo)
+	seeder := newSeeder(t, torrentInfo)
+	checkBlockCounts(t, manager)
+
+	random := rand.New(rand.NewSource(1))
+	for step := 0; step < 2000; step++ {
+		block := random.Intn(manager.totalBlocks)
+		pieceData := file_writer.PieceData{PieceNumber: manager.blockPiece[block], Offset: manager.blockOffset[block], Piece: make([]byte, BLOCK_LENGTH)}
+		switch random.Intn(7) {
+		case 0:
+			manager.RequestBlock(block, seeder)
+		case 1:
+			manager.ReleaseBlock(block, seeder)
+		case 2:
+			manager.UpdatePiece(pieceData)
+		case 3:
+			manager.FinishBlock(pieceData, seeder)
+		case 4:
+			manager.AddPieceToDownload(manager.blockPiece[block], torrentInfo)
+		case 5:
+			manager.RemovePieceFromDownload(manager.blockPiece[block], torrentInfo)
+		case 6:
+			manager.SetFilePriorities([]int{random.Intn(2), file_writer.PRIORITY_NORMAL}, torrentInfo)
+		}
+		checkBlockCounts(t, manager)
+	}
+}
+
+// newSelectionManager returns a manager for 3 files of 2 pieces , whose pieces have 2 blocks,
+// so the blocks of the piece p are 2p and 2p+1. The availability of the pieces is given.
+func newSelectionManager(availability []int) (*PieceManager, *torrent_info.TorrentInfo) {
+	torrentInfo := &torrent_info.TorrentInfo{}
+	torrentInfo.FileInformations.PieceCount = 6
+	torrentInfo.FileInformations.PieceLength = 2 * BLOCK_LENGTH
+	torrentInfo.FileInformations.TotalLength = 12 * BLOCK_LENGTH
+	torrentInfo.FileInformations.Files = []torrent_info.SingleFileInfo{{Length: 4 * BLOCK_LENGTH}, {Length: 4 * BLOCK_LENGTH}, {Length: 4 * BLOCK_LENGTH}}
+	manager := New(torrentInfo)
+	for pieceIndex, count := range availability {
+		for peers := 0; peers < count; peers++ {
+			manager.IncreaseAvailability(pieceIndex)
+		}
+	}
+	return manager, torrentInfo
+}
+
+func TestPieceSelection(t *testing.T) {
+	tests := []struct {
+		name         string
+		availability []int
+		prepare      func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer)
+		maxBlocks    int
+		expected     []int
+	}{
+		{"rarest first", []int{2, 1, 3, 2, 2, 2}, nil, 2, []int{2, 3}},
+		{"rarest first , then the next rarest", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.RemovePieceFromDownload(0, torrentInfo)
+			manager.RemovePieceFromDownload(3, torrentInfo)
+			manager.RemovePieceFromDownload(4, torrentInfo)
+			manager.RemovePieceFromDownload(5, torrentInfo)
+		}, 4, []int{2, 3, 4, 5}},
+		{"partial pieces first", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetDownloadedBlocks(4, []bool{true, false})
+		}, 1, []int{9}},
+		{"downloading pieces first", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.RequestBlock(6, seeder)
+		}, 3, []int{7, 2, 3}},
+		{"higher priority before rarer", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetFilePriorities([]int{file_writer.PRIORITY_NORMAL, file_writer.PRIORITY_LOW, file_writer.PRIORITY_HIGH}, torrentInfo)
+		}, 4, []int{8, 9, 10, 11}},
+		{"skipped pieces never", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetFilePriorities([]int{file_writer.PRIORITY_SKIP, file_writer.PRIORITY_NORMAL, file_writer.PRIORITY_SKIP}, torrentInfo)
+		}, 12, []int{6, 7, 4, 5}},
+		{"sequential from the cursor", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetMode(SEQUENTIAL)
+			manager.SetCursor(4)
+		}, 4, []int{8, 9, 10, 11}},
+		{"sequential wraps around", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetMode(SEQUENTIAL)
+			manager.SetCursor(5)
+		}, 4, []int{10, 11, 0, 1}},
+		{"sequential skips the pieces we have", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetMode(SEQUENTIAL)
+			manager.SetCursor(1)
+			manager.RemovePieceFromDownload(2, torrentInfo)
+		}, 4, []int{2, 3, 6, 7}},
+		{"deadlines first , earliest first", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetMode(SEQUENTIAL)
+			manager.SetPieceDeadline(5, 20*time.Second)
+			manager.SetPieceDeadline(3, 10*time.Second)
+		}, 6, []int{6, 7, 10, 11, 0, 1}},
+		{"deadlines before the rarest pieces", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetPieceDeadline(2, 10*time.Second)
+		}, 4, []int{4, 5, 2, 3}},
+		{"deadlines of the pieces we have are dropped", []int{2, 1, 3, 2, 2, 2}, func(manager *PieceManager, torrentInfo *torrent_info.TorrentInfo, seeder *peer.Peer) {
+			manager.SetMode(SEQUENTIAL)
+			manager.SetPieceDeadline(5, 10*time.Second)
+			manager.RemovePieceFromDownload(5, torrentInfo)
+		}, 2, []int{0, 1}},
+	}
+	for _, test := range tests {
+		manager, torrentInfo := newSelectionManager(test.availability)
+		seeder := newSeeder(t, torrentInfo)
+		if test.prepare != nil {
+			test.prepare(manager, torrentInfo, seeder)
+		}
+		blocks := manager.GetNextBlocksToDownload(seeder, test.maxBlocks)
+		if len(blocks) != len(test.expected) {
+			t.Errorf("%s : expected the blocks %v , got %v", test.name, test.expected, blocks)
+			continue
+		}
+		for index := range blocks {
+			if blocks[index] != test.expected[index] {
+				t.Errorf("%s : expected the blocks %v , got %v", test.name, test.expected, blocks)
+				break
+			}
+		}
+	}
+}
+
+func TestRarestFirstTieBreak(t *testing.T) {
+	// The pieces 1 , 2 and 4 are the rarest , and each of them should be picked sometimes.
+	picked := make(map[int]int)
+	for run := 0; run < 100; run++ {
+		manager, torrentInfo := newSelectionManager([]int{3, 1, 1, 2, 1, 3})
+		blocks := manager.GetNextBlocksToDownload(newSeeder(t, torrentInfo), 2)
+		if len(blocks) != 2 || blocks[1] != blocks[0]+1 || blocks[0]%2 != 0 {
+			t.Fatalf("Expected the blocks of one piece , got %v", blocks)
+		}
+		picked[blocks[0]/2]++
+	}
+	if len(picked) != 3 || picked[1] == 0 || picked[2] == 0 || picked[4] == 0 {
+		t.Errorf("Expected the rarest pieces 1 , 2 and 4 to be picked at random , got %v", picked)
+	}
+}
@@ -0,0 +1,178 @@
+// Package resume_data saves the state of a download in a bencoded file,
+// so that a restarted download doesn't need to check every piece again.
+package resume_data
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// FileState is what we remember about a file , to know if it was changed since the resume data was saved.
+type FileState struct {
+	Length  int64
+	ModTime int64
+}
+
+// PartialPiece holds the blocks downloaded from a piece which isn't completed.
+type PartialPiece struct {
+	PieceIndex int
+	Blocks     []byte // bitfield of the downloaded blocks
+}
+
+type ResumeData struct {
+	InfoHash      []byte
+	Bitfield      []byte
+	Files         []FileState
+	PartialPieces []PartialPiece
+	Uploaded      int64
+	Downloaded    int64
+	Peers         []string // ip:port of the peers we were connected to
+}
+
+func newString(value string) *bencode.String {
+	return &bencode.String{Value: value}
+}
+
+func newNumber(value int64) *bencode.Number {
+	return &bencode.Number{Value: value}
+}
+
+// Encode returns the bencoded form of the resume data.
+func (data *ResumeData) Encode() []byte {
+
+	files := &bencode.List{}
+	for _, file := range data.Files {
+		files.Values = append(files.Values, &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+			bencode.String{Value: "length"}: newNumber(file.Length),
+			bencode.String{Value: "mtime"}:  newNumber(file.ModTime),
+		}})
+	}
+
+	partialPieces := &bencode.List{}
+	for _, partialPiece := range data.PartialPieces {
+		partialPieces.Values = append(partialPieces.Values, &bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+			bencode.String{Value: "piece"}:  newNumber(int64(partialPiece.PieceIndex)),
+			bencode.String{Value: "blocks"}: newString(string(partialPiece.Blocks)),
+		}})
+	}
+
+	peers := &bencode.List{}
+	for _, peerAddress := range data.Peers {
+		peers.Values = append(peers.Values, newString(peerAddress))
+	}
+
+	dictionary := bencode.Dictionary{Values: map[bencode.String]bencode.Bencoder{
+		bencode.String{Value: "info hash"}:  newString(string(data.InfoHash)),
+		bencode.String{Value: "bitfield"}:   newString(string(data.Bitfield)),
+		bencode.String{Value: "files"}:      files,
+		bencode.String{Value: "partial"}:    partialPieces,
+		bencode.String{Value: "uploaded"}:   newNumber(data.Uploaded),
+		bencode.String{Value: "downloaded"}: newNumber(data.Downloaded),
+		bencode.String{Value: "peers"}:      peers,
+	}}
+	return dictionary.Encode()
+}
+
+// Decode parses resume data encoded with Encode.
+func Decode(source []byte) (*ResumeData, error) {
+
+	decoded, _, err := bencode.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, isDictionary := decoded.(*bencode.Dictionary)
+	if !isDictionary {
+		return nil, errors.New("Malformed resume data")
+	}
+
+	data := &ResumeData{}
+	infoHash, infoHashIsString := dictionary.Values[bencode.String{Value: "info hash"}].(*bencode.String)
+	bitfieldBytes, bitfieldIsString := dictionary.Values[bencode.String{Value: "bitfield"}].(*bencode.String)
+	if !infoHashIsString || !bitfieldIsString {
+		return nil, errors.New("Malformed resume data")
+	}
+	data.InfoHash = []byte(infoHash.Value)
+	data.Bitfield = []byte(bitfieldBytes.Value)
+
+	if files, isList := dictionary.Values[bencode.String{Value: "files"}].(*bencode.List); isList {
+		for _, fileEntry := range files.Values {
+			fileDictionary, isDictionary := fileEntry.(*bencode.Dictionary)
+			if !isDictionary {
+				return nil, errors.New("Malformed resume data")
+			}
+			length, lengthIsNumber := fileDictionary.Values[bencode.String{Value: "length"}].(*bencode.Number)
+			modTime, modTimeIsNumber := fileDictionary.Values[bencode.String{Value: "mtime"}].(*bencode.Number)
+			if !lengthIsNumber || !modTimeIsNumber {
+				return nil, errors.New("Malformed resume data")
+			}
+			data.Files = append(data.Files, FileState{Length: length.Value, ModTime: modTime.Value})
+		}
+	}
+
+	if partialPieces, isList := dictionary.Values[bencode.String{Value: "partial"}].(*bencode.List); isList {
+		for _, partialEntry := range partialPieces.Values {
+			partialDictionary, isDictionary := partialEntry.(*bencode.Dictionary)
+			if !isDictionary {
+				continue
+			}
+			pieceIndex, pieceIsNumber := partialDictionary.Values[bencode.String{Value: "piece"}].(*bencode.Number)
+			blocks, blocksIsString := partialDictionary.Values[bencode.String{Value: "blocks"}].(*bencode.String)
+			if pieceIsNumber && blocksIsString {
+				data.PartialPieces = append(data.PartialPieces, PartialPiece{PieceIndex: int(pieceIndex.Value), Blocks: []byte(blocks.Value)})
+			}
+		}
+	}
+
+	if uploaded, isNumber := dictionary.Values[bencode.String{Value: "uploaded"}].(*bencode.Number); isNumber {
+		data.Uploaded = uploaded.Value
+	}
+	if downloaded, isNumber := dictionary.Values[bencode.String{Value: "downloaded"}].(*bencode.Number); isNumber {
+		data.Downloaded = downloaded.Value
+	}
+
+	if peers, isList := dictionary.Values[bencode.String{Value: "peers"}].(*bencode.List); isList {
+		for _, peerEntry := range peers.Values {
+			if peerAddress, isString := peerEntry.(*bencode.String); isString {
+				data.Peers = append(data.Peers, peerAddress.Value)
+			}
+		}
+	}
+	return data, nil
+}
+
+// GetFileState returns the length and modification time of the file at path.
+func GetFileState(path string) (FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Length: info.Size(), ModTime: info.ModTime().UnixNano()}, nil
+}
+
+// Load reads the resume data from path.
+func Load(path string) (*ResumeData, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(source)
+}
+
+// Save writes the resume data to path.
+// It writes a temporary file first , so a crash never leaves a half written resume file.
+func (data *ResumeData) Save(path string) error {
+	temporaryPath := path + ".tmp"
+	if err := ioutil.WriteFile(temporaryPath, data.Encode(), 0666); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+// Matches tells if the resume data was saved for the torrent with the given info hash.
+func (data *ResumeData) Matches(infoHash []byte) bool {
+	return bytes.Equal(data.InfoHash, infoHash)
+}
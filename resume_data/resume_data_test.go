@@ -0,0 +1,35 @@
+package resume_data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := &ResumeData{
+		InfoHash:      []byte("01234567890123456789"),
+		Bitfield:      []byte{0xff, 0x80},
+		Files:         []FileState{{Length: 100, ModTime: 1234567890}, {Length: 0, ModTime: 0}},
+		PartialPieces: []PartialPiece{{PieceIndex: 3, Blocks: []byte{0xa0}}},
+		Uploaded:      4096,
+		Downloaded:    8192,
+		Peers:         []string{"1.2.3.4:6881", "[::1]:6882"},
+	}
+
+	decoded, err := Decode(data.Encode())
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if !reflect.DeepEqual(data, decoded) {
+		t.Errorf("Resume data not decoded correctly: %v vs %v", data, decoded)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	if _, err := Decode([]byte("i3e")); err == nil {
+		t.Errorf("Expected an error for resume data which is not a dictionary")
+	}
+	if _, err := Decode([]byte("d5:filesleee")); err == nil {
+		t.Errorf("Expected an error for resume data without info hash")
+	}
+}
@@ -30,12 +30,13 @@ type InfoDictionary struct {
 type TorrentInfo struct {
 	FileInformations InfoDictionary
 	AnnounceUrl      string
-	AnnounceList     []string
+	AnnounceList     [][]string // the tiers of trackers , as described here : http://www.bittorrent.org/beps/bep_0012.html
 	CreationDate     int64
 	Comment          string
 	CreatedBy        string
 	Encoding         string
 	InfoHash         []byte
+	InfoBytes        []byte // the bencoded info dictionary , from which InfoHash is computed
 }
 
 // Description prints out fields of a TorrentInfo object.
@@ -120,8 +121,9 @@ func getInfoDictionaryFromBencoder(decoded bencode.Bencoder, output *TorrentInfo
 	dictionary := decoded.(*bencode.Dictionary)
 
 	// create the info hash from tracker communication
+	output.InfoBytes = dictionary.Encode()
 	hash := sha1.New()
-	hash.Write(dictionary.Encode())
+	hash.Write(output.InfoBytes)
 	output.InfoHash = hash.Sum(nil)
 
 	for key, value := range dictionary.Values {
@@ -252,14 +254,19 @@ func GetInfoFromBencoder(decoded bencode.Bencoder) (*TorrentInfo, error) {
 		case "announce-list":
 
 			// It should be a list of list of strings but we check each time we convert the interface
+			// Each list is a tier , and the empty tiers are dropped.
 			if announceList, isList := value.(*bencode.List); isList {
 				for _, listBencoder := range announceList.Values {
 					if announce, isList := listBencoder.(*bencode.List); isList {
+						tier := []string{}
 						for _, str := range announce.Values {
 							if realString, isString := str.(*bencode.String); isString {
-								info.AnnounceList = append(info.AnnounceList, realString.Value)
+								tier = append(tier, realString.Value)
 							}
 						}
+						if len(tier) > 0 {
+							info.AnnounceList = append(info.AnnounceList, tier)
+						}
 					}
 				}
 			}
@@ -0,0 +1,37 @@
+package tracker
+
+import (
+	"fmt"
+)
+
+// NetworkError is returned when the tracker couldn't be reached , or didn't answer in time.
+type NetworkError struct {
+	Err error
+}
+
+func (err NetworkError) Error() string { return "Network error: " + err.Err.Error() }
+func (err NetworkError) Unwrap() error { return err.Err }
+
+// HTTPStatusError is returned when an HTTP tracker answered with another status than 200 OK.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err HTTPStatusError) Error() string {
+	return fmt.Sprintf("Expected 200 OK from tracker; got %s", err.Status)
+}
+
+// ProtocolError is returned when the answer of the tracker can't be understood.
+type ProtocolError struct {
+	Reason string
+}
+
+func (err ProtocolError) Error() string { return "Protocol error: " + err.Reason }
+
+// FailureError is returned when the tracker refused the request , with the reason it gave.
+type FailureError struct {
+	Reason string
+}
+
+func (err FailureError) Error() string { return "Tracker failure: " + err.Reason }
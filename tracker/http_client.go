@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+const (
+	DEFAULT_USER_AGENT      = "Yomato"
+	DEFAULT_DIAL_TIMEOUT    = 10 * time.Second
+	DEFAULT_REQUEST_TIMEOUT = 30 * time.Second
+	DEFAULT_MAX_REDIRECTS   = 5
+)
+
+// HTTPSettings configure the client which talks to the HTTP and HTTPS trackers.
+// The zero values are replaced by the defaults.
+type HTTPSettings struct {
+	UserAgent      string
+	DialTimeout    time.Duration
+	RequestTimeout time.Duration // The whole request , with the redirects and the answer.
+	MaxRedirects   int           // A negative value forbids the redirects.
+	Proxy          string        // An http:// , https:// or socks5:// URL. Without one , the proxy of the environment is used.
+	CARoots        string        // A PEM file with the certificates the HTTPS trackers are checked against , instead of the system ones.
+}
+
+// userAgentTransport sets our user agent on the requests.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (transport userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("User-Agent", transport.userAgent)
+	return transport.base.RoundTrip(request)
+}
+
+// NewHTTPClient returns a client for the trackers. Its connections are kept alive and reused between the announces.
+func NewHTTPClient(settings HTTPSettings) (*http.Client, error) {
+
+	if settings.UserAgent == "" {
+		settings.UserAgent = DEFAULT_USER_AGENT
+	}
+	if settings.DialTimeout <= 0 {
+		settings.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	if settings.RequestTimeout <= 0 {
+		settings.RequestTimeout = DEFAULT_REQUEST_TIMEOUT
+	}
+	if settings.MaxRedirects == 0 {
+		settings.MaxRedirects = DEFAULT_MAX_REDIRECTS
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: settings.DialTimeout}).DialContext,
+		TLSHandshakeTimeout: settings.DialTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}
+	if settings.Proxy != "" {
+		proxyUrl, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		if proxyUrl.Scheme != "http" && proxyUrl.Scheme != "https" && proxyUrl.Scheme != "socks5" {
+			return nil, errors.New(fmt.Sprintf("Unknown proxy scheme %s", proxyUrl.Scheme))
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if settings.CARoots != "" {
+		pem, err := ioutil.ReadFile(settings.CARoots)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in " + settings.CARoots)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	maxRedirects := settings.MaxRedirects
+	client := &http.Client{
+		Transport: userAgentTransport{settings.UserAgent, transport},
+		Timeout:   settings.RequestTimeout,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errors.New(fmt.Sprintf("Stopped after %d redirects", len(via)-1))
+			}
+			return nil
+		},
+	}
+	return client, nil
+}
+
+var (
+	defaultHTTPClient *http.Client
+	httpClientLocker  sync.Mutex
+)
+
+// SetHTTPClient sets the client used by the trackers which don't have their own.
+func SetHTTPClient(client *http.Client) {
+	httpClientLocker.Lock()
+	defer httpClientLocker.Unlock()
+	defaultHTTPClient = client
+}
+
+// getHTTPClient returns the client used by the trackers which don't have their own , made with the default settings if none was set.
+func getHTTPClient() *http.Client {
+	httpClientLocker.Lock()
+	defer httpClientLocker.Unlock()
+	if defaultHTTPClient == nil {
+		defaultHTTPClient, _ = NewHTTPClient(HTTPSettings{})
+	}
+	return defaultHTTPClient
+}
+
+// httpClient returns the client of the tracker.
+func (tracker Tracker) httpClient() *http.Client {
+	if tracker.HTTPClient != nil {
+		return tracker.HTTPClient
+	}
+	return getHTTPClient()
+}
+
+// httpGet sends a request to an HTTP tracker , and returns its bencoded answer.
+// The answers compressed with gzip are decompressed , even when we didn't ask for it.
+func httpGet(client *http.Client, requestUrl string) (bencode.Bencoder, error) {
+
+	response, err := client.Get(requestUrl)
+
+	if err != nil {
+		return bencode.Dictionary{}, NetworkError{err}
+	}
+	defer response.Body.Close()
+
+	var body io.Reader = response.Body
+	if response.Header.Get("Content-Encoding") == "gzip" && !response.Uncompressed {
+		gzipReader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return bencode.Dictionary{}, ProtocolError{err.Error()}
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return bencode.Dictionary{}, NetworkError{err}
+	}
+
+	if response.StatusCode != 200 {
+		return bencode.Dictionary{}, HTTPStatusError{response.StatusCode, response.Status}
+	}
+	decoded, _, err := bencode.Parse(data)
+	if err != nil {
+		return bencode.Dictionary{}, ProtocolError{err.Error()}
+	}
+	return decoded, nil
+}
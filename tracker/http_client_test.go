@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+const ANNOUNCE_RESPONSE = "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"
+
+func TestHTTPSAnnounce(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(ANNOUNCE_RESPONSE))
+	}))
+	defer server.Close()
+
+	// The certificate of the server is only trusted when it is given as a CA root.
+	caRoots := filepath.Join(t.TempDir(), "roots.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caRoots, certificate, 0600); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x09}, 20)}
+	httpsTracker := New(server.URL+"/announce", info, 6881, "-YM00000000000000000")
+	httpsTracker.HTTPClient, _ = NewHTTPClient(HTTPSettings{})
+	if _, err := httpsTracker.RequestPeers(0, 0, 100, NONE); err == nil {
+		t.Errorf("Expected the certificate of the tracker to be refused")
+	}
+	client, err := NewHTTPClient(HTTPSettings{CARoots: caRoots})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	httpsTracker.HTTPClient = client
+	if response, err := httpsTracker.RequestPeers(0, 0, 100, NONE); err != nil || len(response.Peers) != 1 {
+		t.Errorf("Expected one peer over HTTPS , got %v %v", response.Peers, err)
+	}
+
+	if _, err := NewHTTPClient(HTTPSettings{CARoots: os.DevNull}); err == nil {
+		t.Errorf("Expected an error for a file without certificates")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	var userAgents []string
+	var locker sync.Mutex
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		locker.Lock()
+		userAgents = append(userAgents, request.Header.Get("User-Agent"))
+		locker.Unlock()
+		switch request.URL.Path {
+		case "/moved/announce":
+			http.Redirect(writer, request, "/announce", http.StatusFound)
+		case "/gzip/announce":
+			// Some trackers compress their answers even when they weren't asked to.
+			writer.Header().Set("Content-Encoding", "gzip")
+			compressor := gzip.NewWriter(writer)
+			compressor.Write([]byte(ANNOUNCE_RESPONSE))
+			compressor.Close()
+		default:
+			writer.Write([]byte(ANNOUNCE_RESPONSE))
+		}
+	}))
+	connections := 0
+	server.Config.ConnState = func(connection net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			locker.Lock()
+			connections++
+			locker.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client, err := NewHTTPClient(HTTPSettings{UserAgent: "Yomato/test"})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0a}, 20)}
+	for _, path := range []string{"/announce", "/moved/announce", "/gzip/announce"} {
+		httpTracker := New(server.URL+path, info, 6881, "-YM00000000000000000")
+		httpTracker.HTTPClient = client
+		if response, err := httpTracker.RequestPeers(0, 0, 100, NONE); err != nil || len(response.Peers) != 1 {
+			t.Errorf("Expected one peer from %s , got %v %v", path, response.Peers, err)
+		}
+	}
+
+	locker.Lock()
+	if connections != 1 {
+		t.Errorf("Expected the connection to be reused , got %d connections", connections)
+	}
+	for _, userAgent := range userAgents {
+		if userAgent != "Yomato/test" {
+			t.Errorf("Expected our user agent , got %s", userAgent)
+		}
+	}
+	locker.Unlock()
+
+	// The redirects can be forbidden.
+	client, _ = NewHTTPClient(HTTPSettings{MaxRedirects: -1})
+	movedTracker := New(server.URL+"/moved/announce", info, 6881, "-YM00000000000000000")
+	movedTracker.HTTPClient = client
+	if _, err := movedTracker.RequestPeers(0, 0, 100, NONE); err == nil {
+		t.Errorf("Expected the redirect to be refused")
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(ANNOUNCE_RESPONSE))
+	}))
+	defer server.Close()
+
+	// The proxy gets the whole URL of the tracker , and forwards the request.
+	proxied := []string{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		proxied = append(proxied, request.URL.Host)
+		response, err := http.Get(request.URL.String())
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		writer.Write(body)
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPSettings{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0b}, 20)}
+	httpTracker := New(server.URL+"/announce", info, 6881, "-YM00000000000000000")
+	httpTracker.HTTPClient = client
+	if response, err := httpTracker.RequestPeers(0, 0, 100, NONE); err != nil || len(response.Peers) != 1 {
+		t.Fatalf("Expected one peer through the proxy , got %v %v", response.Peers, err)
+	}
+	if len(proxied) != 1 || proxied[0] != server.Listener.Addr().String() {
+		t.Errorf("Expected the announce to go through the proxy , got %v", proxied)
+	}
+
+	if _, err := NewHTTPClient(HTTPSettings{Proxy: "socks5://127.0.0.1:1080"}); err != nil {
+		t.Errorf("Got error: %s", err)
+	}
+	if _, err := NewHTTPClient(HTTPSettings{Proxy: "ftp://127.0.0.1:21"}); err == nil {
+		t.Errorf("Expected an error for an unknown proxy")
+	}
+}
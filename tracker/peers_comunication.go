@@ -2,13 +2,48 @@ package tracker
 
 import (
 	"errors"
-	"fmt"
+	"net"
+
 	"github.com/bbpcr/Yomato/bencode"
 )
 
+// The lengths of a peer in compact form : the IP address followed by the port.
+const (
+	COMPACT_IPV4_LENGTH = 6
+	COMPACT_IPV6_LENGTH = 18
+)
+
+// decodeCompactPeers returns the peers given in compact form as dictionaries , like the ones of the list form.
+// An incomplete peer at the end is ignored.
+func decodeCompactPeers(byteArray []byte, length int) []bencode.Bencoder {
+
+	peers := []bencode.Bencoder{}
+	for i := 0; i+length <= len(byteArray); i += length {
+
+		smallDictionary := new(bencode.Dictionary)
+		smallDictionary.Values = make(map[bencode.String]bencode.Bencoder)
+
+		numberPort := new(bencode.Number)
+		numberPort.Value = int64(byteArray[i+length-2])<<8 + int64(byteArray[i+length-1])
+
+		ip := new(bencode.String)
+		ip.Value = net.IP(byteArray[i : i+length-2]).String()
+
+		peerId := new(bencode.String)
+		peerId.Value = ""
+
+		smallDictionary.Values[bencode.String{Value: "port"}] = numberPort
+		smallDictionary.Values[bencode.String{Value: "ip"}] = ip
+		smallDictionary.Values[bencode.String{Value: "peer id"}] = peerId
+		peers = append(peers, smallDictionary)
+	}
+	return peers
+}
+
 // GetPeers parses peers information from a given Bencoder and returns the same Bencoder dictionary
 // but with a key ('peers') which holds a bencoded list, each element of list having a dictionary with
-// keys 'port', 'ip', 'peer_id' for each peer
+// keys 'port', 'ip', 'peer id' for each peer.
+// The IPv6 peers , given in compact form in 'peers6' , are added to the list.
 func GetPeers(bdecoded bencode.Bencoder) (bencode.Bencoder, error) {
 
 	// Try to cast to dictionary
@@ -19,46 +54,34 @@ func GetPeers(bdecoded bencode.Bencoder) (bencode.Bencoder, error) {
 	}
 
 	// Get the peer value
-	peersBencoded := responseDictionary.Values[bencode.String{Value: "peers"}]
+	peersBencoded, hasPeers := responseDictionary.Values[bencode.String{Value: "peers"}]
+	peers6Bencoded, hasPeers6 := responseDictionary.Values[bencode.String{Value: "peers6"}]
 
 	// We have two posibilities , peersBencoded is a list of dictionaries or is a string
 	// If it's a list , it's already decoded , if it's a string we need to decode it.
-	stringPeers, isString := peersBencoded.(*bencode.String)
-	_, isList := peersBencoded.(*bencode.List)
-
-	if isString {
+	bigList := new(bencode.List)
+	if stringPeers, isString := peersBencoded.(*bencode.String); isString {
 
 		// We have a binary form like this : multiple of 6 bytes , where the first 4 bytes are IP and the last 2 are the port number
-		// We now create the list of dictionaries.
-		bigList := new(bencode.List)
-
-		byteArray := []byte(stringPeers.Value)
-		for i := 0; i < len(byteArray); i += 6 {
-
-			smallDictionary := new(bencode.Dictionary)
-			smallDictionary.Values = make(map[bencode.String]bencode.Bencoder)
-
-			numberPort := new(bencode.Number)
-			numberPort.Value = int64(byteArray[i+4])<<8 + int64(byteArray[i+5])
-
-			ip := new(bencode.String)
-			ip.Value = fmt.Sprintf("%d.%d.%d.%d", byteArray[i], byteArray[i+1], byteArray[i+2], byteArray[i+3])
-
-			peerId := new(bencode.String)
-			peerId.Value = ""
+		bigList.Values = decodeCompactPeers([]byte(stringPeers.Value), COMPACT_IPV4_LENGTH)
+	} else if listPeers, isList := peersBencoded.(*bencode.List); isList {
+		bigList.Values = listPeers.Values
+	} else if hasPeers || !hasPeers6 {
 
-			smallDictionary.Values[bencode.String{Value: "port"}] = numberPort
-			smallDictionary.Values[bencode.String{Value: "ip"}] = ip
-			smallDictionary.Values[bencode.String{Value: "peer id"}] = peerId
-			bigList.Values = append(bigList.Values, smallDictionary)
+		// If it isn't a list or a string , it's something else , and we return an error.
+		return bdecoded, errors.New("Malformed response!")
+	}
 
+	if hasPeers6 {
+		stringPeers6, isString := peers6Bencoded.(*bencode.String)
+		if !isString {
+			return bdecoded, errors.New("Malformed response!")
 		}
-		responseDictionary.Values[bencode.String{Value: "peers"}] = bigList
-	} else if !isList {
 
-		// If it isn't a list or a string , it's something else , and we return an error.
-		return bdecoded, errors.New("Malformed response!")
+		// The same binary form , with 16 bytes for the IP.
+		bigList.Values = append(bigList.Values, decodeCompactPeers([]byte(stringPeers6.Value), COMPACT_IPV6_LENGTH)...)
 	}
+	responseDictionary.Values[bencode.String{Value: "peers"}] = bigList
 
 	// We return the modified responseDictionary
 	return responseDictionary, nil
@@ -0,0 +1,65 @@
+package tracker
+
+import (
+	"testing"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// peerAddresses returns the ip and port of the peers in the list made by GetPeers.
+func peerAddresses(t *testing.T, data bencode.Bencoder) []string {
+	peers, isList := data.(*bencode.Dictionary).Values[bencode.String{Value: "peers"}].(*bencode.List)
+	if !isList {
+		t.Fatalf("Expected a list of peers")
+	}
+	addresses := []string{}
+	for _, entry := range peers.Values {
+		dictionary := entry.(*bencode.Dictionary)
+		ip := dictionary.Values[bencode.String{Value: "ip"}].(*bencode.String).Value
+		port := dictionary.Values[bencode.String{Value: "port"}].(*bencode.Number).Value
+		addresses = append(addresses, ip+" "+string(bencode.Number{Value: port}.Encode()))
+	}
+	return addresses
+}
+
+func TestGetPeers(t *testing.T) {
+	tests := []struct {
+		response string
+		expected []string
+	}{
+		// Compact IPv4 peers , with an incomplete one at the end.
+		{"d5:peers14:\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x1a\xe2\x01\x02e", []string{"10.0.0.1 i6881e", "192.168.1.2 i6882e"}},
+		// Compact IPv6 peers only.
+		{"d6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", []string{"2001:db8::1 i6881e"}},
+		// Both.
+		{"d5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x1a\xe2e", []string{"10.0.0.1 i6881e", "2001:db8::2 i6882e"}},
+		// The dictionary model , with an IPv6 address.
+		{"d5:peersld2:ip11:2001:db8::37:peer id20:-XX0000-0000000000004:porti6883eeee", []string{"2001:db8::3 i6883e"}},
+	}
+	for _, test := range tests {
+		data, _, err := bencode.Parse([]byte(test.response))
+		if err != nil {
+			t.Fatalf("Got error: %s", err)
+		}
+		result, err := GetPeers(data)
+		if err != nil {
+			t.Fatalf("Got error for %q: %s", test.response, err)
+		}
+		addresses := peerAddresses(t, result)
+		if len(addresses) != len(test.expected) {
+			t.Fatalf("Expected %v , got %v", test.expected, addresses)
+		}
+		for index := range addresses {
+			if addresses[index] != test.expected[index] {
+				t.Errorf("Expected %v , got %v", test.expected, addresses)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"le", "d8:intervali1800ee", "d5:peersi1ee", "d6:peers6le"} {
+		data, _, _ := bencode.Parse([]byte(invalid))
+		if _, err := GetPeers(data); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
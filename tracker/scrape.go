@@ -0,0 +1,179 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// A UDP scrape asks for at most this many torrents , so the request fits in one packet.
+const UDP_MAX_SCRAPE_HASHES = 74
+
+// ScrapeResult is what a tracker knows about the swarm of a torrent.
+type ScrapeResult struct {
+	InfoHash   []byte
+	Complete   int64  // The seeders.
+	Incomplete int64  // The leechers.
+	Downloaded int64  // How many times the download was completed.
+	Name       string // Given by some HTTP trackers.
+}
+
+// ScrapeUrl returns the scrape URL of an HTTP tracker , as described here : https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention
+// The last part of the announce URL must start with "announce" , which is replaced by "scrape".
+func ScrapeUrl(announceUrl string) (string, error) {
+	slash := strings.LastIndex(announceUrl, "/")
+	if slash < 0 || !strings.HasPrefix(announceUrl[slash+1:], "announce") {
+		return "", errors.New("Tracker doesn't support scrape")
+	}
+	return announceUrl[:slash+1] + "scrape" + announceUrl[slash+1+len("announce"):], nil
+}
+
+// httpScrape asks the HTTP tracker about the torrents , in one request.
+func httpScrape(client *http.Client, announceUrl string, infoHashes [][]byte) ([]ScrapeResult, error) {
+
+	scrapeUrl, err := ScrapeUrl(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	qs := url.Values{}
+	for _, infoHash := range infoHashes {
+		qs.Add("info_hash", string(infoHash))
+	}
+	separator := "?"
+	if strings.Contains(scrapeUrl, "?") {
+		separator = "&"
+	}
+
+	data, err := httpGet(client, scrapeUrl+separator+qs.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return parseScrape(data)
+}
+
+// parseScrape returns the results of an HTTP scrape , which has a dictionary for each torrent under "files".
+func parseScrape(data bencode.Bencoder) ([]ScrapeResult, error) {
+
+	responseDictionary, isDictionary := data.(*bencode.Dictionary)
+	if !isDictionary {
+		return nil, ProtocolError{"Malformed response!"}
+	}
+	if failureReason, isString := responseDictionary.Values[bencode.String{Value: "failure reason"}].(*bencode.String); isString {
+		return nil, FailureError{failureReason.Value}
+	}
+	files, filesIsDictionary := responseDictionary.Values[bencode.String{Value: "files"}].(*bencode.Dictionary)
+	if !filesIsDictionary {
+		return nil, ProtocolError{"Malformed response!"}
+	}
+
+	results := []ScrapeResult{}
+	for infoHash, value := range files.Values {
+		file, isDictionary := value.(*bencode.Dictionary)
+		if !isDictionary {
+			continue
+		}
+		result := ScrapeResult{InfoHash: []byte(infoHash.Value)}
+		if complete, isNumber := file.Values[bencode.String{Value: "complete"}].(*bencode.Number); isNumber {
+			result.Complete = complete.Value
+		}
+		if incomplete, isNumber := file.Values[bencode.String{Value: "incomplete"}].(*bencode.Number); isNumber {
+			result.Incomplete = incomplete.Value
+		}
+		if downloaded, isNumber := file.Values[bencode.String{Value: "downloaded"}].(*bencode.Number); isNumber {
+			result.Downloaded = downloaded.Value
+		}
+		if name, isString := file.Values[bencode.String{Value: "name"}].(*bencode.String); isString {
+			result.Name = name.Value
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// scrape asks the UDP tracker at host about the torrents , UDP_MAX_SCRAPE_HASHES at a time.
+func (client *udpClient) scrape(host string, infoHashes [][]byte) ([]ScrapeResult, error) {
+
+	address, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, NetworkError{err}
+	}
+
+	results := []ScrapeResult{}
+	for start := 0; start < len(infoHashes); start += UDP_MAX_SCRAPE_HASHES {
+		end := start + UDP_MAX_SCRAPE_HASHES
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		/*
+			Offset	Size	Name	Value
+			0	8	connection id
+			8	4	action	2 for scrape
+			12	4	transaction id
+			16 + 20 * n	20	info hash
+		*/
+		request := make([]byte, 16+20*(end-start))
+		binary.BigEndian.PutUint32(request[8:12], UDP_ACTION_SCRAPE)
+		for index, infoHash := range infoHashes[start:end] {
+			copy(request[16+20*index:36+20*index], infoHash)
+		}
+
+		/*
+			Offset	Size	Name	Value
+			0	4	action	2
+			4	4	transaction id
+			8 + 12 * n	4	seeders
+			12 + 12 * n	4	completed
+			16 + 12 * n	4	leechers
+		*/
+		answer, err := client.request(address, request, 8+12*(end-start), client.maxRetransmits)
+		if err != nil {
+			return nil, err
+		}
+		for index, infoHash := range infoHashes[start:end] {
+			offset := 8 + 12*index
+			results = append(results, ScrapeResult{
+				InfoHash:   infoHash,
+				Complete:   int64(binary.BigEndian.Uint32(answer[offset : offset+4])),
+				Downloaded: int64(binary.BigEndian.Uint32(answer[offset+4 : offset+8])),
+				Incomplete: int64(binary.BigEndian.Uint32(answer[offset+8 : offset+12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// Scrape asks the tracker about the swarms of the torrents , without announcing us.
+// Without info hashes , it asks about the torrent of the tracker. There is a result for each torrent the tracker knows.
+func (tracker Tracker) Scrape(infoHashes ...[]byte) ([]ScrapeResult, error) {
+
+	if len(infoHashes) == 0 {
+		infoHashes = [][]byte{tracker.TorrentInfo.InfoHash}
+	}
+	requestUrl, err := url.Parse(tracker.AnnounceUrl)
+	if err != nil {
+		return nil, errors.New("Malformed URL")
+	}
+
+	switch requestUrl.Scheme {
+	case "http", "https":
+		return httpScrape(tracker.httpClient(), tracker.AnnounceUrl, infoHashes)
+	case "udp":
+		client, err := getUDPClient()
+		if err != nil {
+			return nil, NetworkError{err}
+		}
+		return client.scrape(requestUrl.Host, infoHashes)
+	}
+	return nil, errors.New("No known protocol")
+}
+
+func (result ScrapeResult) GetInfo() string {
+	return fmt.Sprintf("Seeders : %d Leechers : %d Completed : %d", result.Complete, result.Incomplete, result.Downloaded)
+}
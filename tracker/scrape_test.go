@@ -0,0 +1,101 @@
+package tracker
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	tests := []struct {
+		announceUrl string
+		scrapeUrl   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", ""},
+		{"http://example.com/x%064announce", ""},
+	}
+	for _, test := range tests {
+		scrapeUrl, err := ScrapeUrl(test.announceUrl)
+		if test.scrapeUrl == "" && err == nil {
+			t.Errorf("Expected %s to have no scrape URL , got %s", test.announceUrl, scrapeUrl)
+		}
+		if test.scrapeUrl != "" && scrapeUrl != test.scrapeUrl {
+			t.Errorf("Expected the scrape URL of %s to be %s , got %s %v", test.announceUrl, test.scrapeUrl, scrapeUrl, err)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	first := bytes.Repeat([]byte{0x01}, 20)
+	second := bytes.Repeat([]byte{0x02}, 20)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/scrape" || request.URL.Query().Get("passkey") != "secret" || len(request.URL.Query()["info_hash"]) != 2 {
+			writer.Write([]byte("d14:failure reason11:Bad requeste"))
+			return
+		}
+		writer.Write([]byte("d5:filesd20:" + string(first) + "d8:completei5e10:downloadedi50e10:incompletei10e4:name5:Firste" +
+			"20:" + string(second) + "d8:completei1e10:downloadedi2e10:incompletei3eeee"))
+	}))
+	defer server.Close()
+
+	scraper := New(server.URL+"/announce?passkey=secret", &torrent_info.TorrentInfo{InfoHash: first}, 6881, "-YM00000000000000000")
+	results, err := scraper.Scrape(first, second)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results , got %v", results)
+	}
+	for _, result := range results {
+		if bytes.Equal(result.InfoHash, first) && (result.Complete != 5 || result.Incomplete != 10 || result.Downloaded != 50 || result.Name != "First") {
+			t.Errorf("Wrong result for the first torrent %v", result)
+		}
+		if bytes.Equal(result.InfoHash, second) && (result.Complete != 1 || result.Incomplete != 3 || result.Downloaded != 2) {
+			t.Errorf("Wrong result for the second torrent %v", result)
+		}
+	}
+
+	// The failure reason of the tracker is returned as an error.
+	scraper.AnnounceUrl = server.URL + "/announce"
+	if _, err := scraper.Scrape(); err != (FailureError{"Bad request"}) {
+		t.Errorf("Expected the failure reason of the tracker , got %v", err)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	fake := newFakeUDPTracker(t, 0)
+	defer fake.connection.Close()
+	client, err := newUDPClient(50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer client.close()
+
+	// More torrents than fit in one request.
+	infoHashes := [][]byte{}
+	for index := 1; index <= UDP_MAX_SCRAPE_HASHES+6; index++ {
+		infoHashes = append(infoHashes, bytes.Repeat([]byte{byte(index)}, 20))
+	}
+	results, err := client.scrape(fake.host(), infoHashes)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if len(results) != len(infoHashes) {
+		t.Fatalf("Expected %d results , got %d", len(infoHashes), len(results))
+	}
+	for index, result := range results {
+		value := int64(index + 1)
+		if !bytes.Equal(result.InfoHash, infoHashes[index]) || result.Complete != value || result.Downloaded != 10*value || result.Incomplete != 100*value {
+			t.Errorf("Wrong result %d : %v", index, result)
+		}
+	}
+}
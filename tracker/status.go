@@ -0,0 +1,75 @@
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// TrackerStatus is what happened when we announced to a tracker , and when we will announce to it again.
+type TrackerStatus struct {
+	AnnounceUrl  string
+	Tier         int
+	Working      bool
+	Failures     int // The announces which failed in a row.
+	LastSuccess  time.Time
+	LastError    error
+	LastErrorAt  time.Time
+	NextAnnounce time.Time
+	Peers        int // The peers given by the last announce which succeeded.
+}
+
+// Status returns the status of all the trackers , tier after tier.
+func (tiers *Tiers) Status() []TrackerStatus {
+	tiers.locker.Lock()
+	defer tiers.locker.Unlock()
+	statuses := []TrackerStatus{}
+	for tierIndex, tier := range tiers.tiers {
+		for _, state := range tier {
+			statuses = append(statuses, TrackerStatus{
+				AnnounceUrl:  state.tracker.AnnounceUrl,
+				Tier:         tierIndex,
+				Working:      state.working,
+				Failures:     state.failures,
+				LastSuccess:  state.lastSuccess,
+				LastError:    state.lastError,
+				LastErrorAt:  state.lastErrorAt,
+				NextAnnounce: state.nextAnnounce,
+				Peers:        state.peers,
+			})
+		}
+	}
+	return statuses
+}
+
+// formatTime returns the time of day , or "-" for the zero time.
+func formatTime(moment time.Time) string {
+	if moment.IsZero() {
+		return "-"
+	}
+	return moment.Format("15:04:05")
+}
+
+// StatusTable returns the status of the trackers as a table , with a line for each tracker.
+func StatusTable(statuses []TrackerStatus) string {
+	var table bytes.Buffer
+	writer := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "Tier\tTracker\tStatus\tPeers\tLast success\tNext announce\tLast error")
+	for _, status := range statuses {
+		state := "not tried"
+		if status.Working {
+			state = "working"
+		} else if status.Failures > 0 {
+			state = fmt.Sprintf("failed %dx", status.Failures)
+		}
+		lastError := "-"
+		if status.LastError != nil {
+			lastError = fmt.Sprintf("[%s] %s", formatTime(status.LastErrorAt), status.LastError)
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", status.Tier, status.AnnounceUrl, state, status.Peers,
+			formatTime(status.LastSuccess), formatTime(status.NextAnnounce), lastError)
+	}
+	writer.Flush()
+	return table.String()
+}
@@ -0,0 +1,242 @@
+package tracker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+// A tracker which didn't give an interval is announced to again after DEFAULT_ANNOUNCE_INTERVAL.
+const DEFAULT_ANNOUNCE_INTERVAL = 30 * time.Minute
+
+// A tracker which failed is tried again after RETRY_DURATION , which doubles after each failure , up to MAX_RETRY_DURATION.
+const (
+	RETRY_DURATION     = 1 * time.Minute
+	MAX_RETRY_DURATION = 1 * time.Hour
+)
+
+// trackerState is a tracker , what happened when we announced to it , and when we should announce to it again.
+type trackerState struct {
+	tracker      Tracker
+	working      bool      // The last announce succeeded.
+	failures     int       // The announces which failed in a row.
+	nextAnnounce time.Time // The interval or the backoff of the tracker ends.
+	minAnnounce  time.Time // The min interval of the tracker ends.
+	lastSuccess  time.Time
+	lastError    error
+	lastErrorAt  time.Time
+	peers        int // The peers given by the last announce which succeeded.
+}
+
+// schedule remembers the answer of the tracker , and when we should announce to it again.
+func (state *trackerState) schedule(response TrackerResponse, err error, now time.Time) {
+	if err == nil {
+		interval := time.Duration(response.Interval) * time.Second
+		if interval <= 0 {
+			interval = DEFAULT_ANNOUNCE_INTERVAL
+		}
+		state.working = true
+		state.failures = 0
+		state.nextAnnounce = now.Add(interval)
+		state.minAnnounce = now.Add(time.Duration(response.MinInterval) * time.Second)
+		state.lastSuccess = now
+		state.peers = len(response.Peers)
+		return
+	}
+
+	retry := RETRY_DURATION << uint(state.failures)
+	if retry > MAX_RETRY_DURATION || retry <= 0 {
+		retry = MAX_RETRY_DURATION
+	}
+	state.working = false
+	state.failures++
+	state.nextAnnounce = now.Add(retry)
+	state.minAnnounce = state.nextAnnounce
+	state.lastError = err
+	state.lastErrorAt = now
+}
+
+// tierAnnounce is an announce to a tier , whose answer is sent on responses , if the tier worked.
+type tierAnnounce struct {
+	event           int
+	bytesUploaded   int64
+	bytesDownloaded int64
+	bytesLeft       int64
+	force           bool
+	responses       chan TrackerResponse
+	group           *sync.WaitGroup
+}
+
+// Tiers are the trackers of a torrent , grouped in tiers as described here : http://www.bittorrent.org/beps/bep_0012.html
+// We announce to one tracker of each tier , the first one which works , which is then moved first in its tier.
+// The tiers are announced to concurrently , each when its tracker wants it.
+// A tier announces once at a time : the events which come while it announces are queued , and sent in order after it.
+type Tiers struct {
+	tiers      [][]*trackerState
+	announcing []bool
+	queued     [][]tierAnnounce
+	locker     sync.Mutex
+}
+
+// NewTiers returns the tiers of the torrent , with the trackers of each tier shuffled.
+// Without an announce list , the announce URL is the only tier.
+func NewTiers(info *torrent_info.TorrentInfo, port int, peerId string) *Tiers {
+
+	announceList := info.AnnounceList
+	if len(announceList) == 0 && info.AnnounceUrl != "" {
+		announceList = [][]string{{info.AnnounceUrl}}
+	}
+
+	tiers := &Tiers{}
+	known := make(map[string]bool)
+	for _, announceUrls := range announceList {
+		tier := []*trackerState{}
+		for _, announceUrl := range announceUrls {
+			if !known[announceUrl] {
+				known[announceUrl] = true
+				tier = append(tier, &trackerState{tracker: New(announceUrl, info, port, peerId)})
+			}
+		}
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		if len(tier) > 0 {
+			tiers.tiers = append(tiers.tiers, tier)
+		}
+	}
+	tiers.announcing = make([]bool, len(tiers.tiers))
+	tiers.queued = make([][]tierAnnounce, len(tiers.tiers))
+	return tiers
+}
+
+// Trackers returns all the trackers , tier after tier.
+func (tiers *Tiers) Trackers() []Tracker {
+	tiers.locker.Lock()
+	defer tiers.locker.Unlock()
+	trackers := []Tracker{}
+	for _, tier := range tiers.tiers {
+		for _, state := range tier {
+			trackers = append(trackers, state.tracker)
+		}
+	}
+	return trackers
+}
+
+// isDue tells if the tracker should be announced to now.
+// A forced announce skips the interval , but not the min interval of a working tracker.
+func (state *trackerState) isDue(now time.Time, force bool) bool {
+	if force {
+		return !state.working || !now.Before(state.minAnnounce)
+	}
+	return !now.Before(state.nextAnnounce)
+}
+
+// isTierDue tells if a tracker of the tier should be announced to now.
+// While the first tracker works , the tier follows it. Otherwise , any tracker of the tier can be tried.
+func isTierDue(tier []*trackerState, now time.Time, force bool) bool {
+	if tier[0].working {
+		return tier[0].isDue(now, force)
+	}
+	for _, state := range tier {
+		if state.isDue(now, force) {
+			return true
+		}
+	}
+	return false
+}
+
+// Announce announces to the tiers which are due , concurrently , and returns the answers of the trackers which worked.
+// The events are announced to all the tiers. The stopped event is only announced to the trackers which work.
+// A forced regular announce is sent even before the interval of the tracker ends , but not before its min interval.
+// A regular announce is skipped by the tiers which are already announcing , while an event waits for them.
+// The channel is closed once all the announces are done.
+func (tiers *Tiers) Announce(event int, bytesUploaded int64, bytesDownloaded int64, bytesLeft int64, force bool) <-chan TrackerResponse {
+
+	tiers.locker.Lock()
+	defer tiers.locker.Unlock()
+
+	responses := make(chan TrackerResponse, len(tiers.tiers))
+	var group sync.WaitGroup
+	now := time.Now()
+	for tierIndex, tier := range tiers.tiers {
+		announce := tierAnnounce{event, bytesUploaded, bytesDownloaded, bytesLeft, force, responses, &group}
+		if tiers.announcing[tierIndex] {
+			// The trackers which don't work are skipped by announceTier , once we know what the announce in flight did.
+			if event != NONE {
+				group.Add(1)
+				tiers.queued[tierIndex] = append(tiers.queued[tierIndex], announce)
+			}
+			continue
+		}
+		if event == DOWNLOAD_STOPPED && !tier[0].working {
+			continue
+		}
+		if event == NONE && !isTierDue(tier, now, force) {
+			continue
+		}
+		tiers.announcing[tierIndex] = true
+		group.Add(1)
+		go tiers.runTier(tierIndex, announce)
+	}
+	go func() {
+		group.Wait()
+		close(responses)
+	}()
+	return responses
+}
+
+// runTier makes the announce to the tier , then the announces queued meanwhile , until none is left.
+func (tiers *Tiers) runTier(tierIndex int, announce tierAnnounce) {
+	for {
+		response, worked := tiers.announceTier(tierIndex, announce.event, announce.bytesUploaded, announce.bytesDownloaded, announce.bytesLeft, announce.force)
+		if worked {
+			announce.responses <- response
+		}
+		announce.group.Done()
+
+		tiers.locker.Lock()
+		if len(tiers.queued[tierIndex]) == 0 {
+			tiers.announcing[tierIndex] = false
+			tiers.locker.Unlock()
+			return
+		}
+		announce = tiers.queued[tierIndex][0]
+		tiers.queued[tierIndex] = tiers.queued[tierIndex][1:]
+		tiers.locker.Unlock()
+	}
+}
+
+// announceTier announces to the trackers of the tier , in order , until one works. That one is moved first in the tier.
+// The regular announces skip the trackers which aren't due.
+func (tiers *Tiers) announceTier(tierIndex int, event int, bytesUploaded int64, bytesDownloaded int64, bytesLeft int64, force bool) (TrackerResponse, bool) {
+
+	tiers.locker.Lock()
+	tier := append([]*trackerState{}, tiers.tiers[tierIndex]...)
+	tiers.locker.Unlock()
+
+	for stateIndex, state := range tier {
+		tiers.locker.Lock()
+		skip := (event == NONE && !state.isDue(time.Now(), force)) || (event == DOWNLOAD_STOPPED && !state.working)
+		tiers.locker.Unlock()
+		if skip {
+			continue
+		}
+
+		response, err := state.tracker.RequestPeers(bytesUploaded, bytesDownloaded, bytesLeft, event)
+
+		tiers.locker.Lock()
+		state.schedule(response, err, time.Now())
+		if state.working {
+			tier := tiers.tiers[tierIndex]
+			copy(tier[1:stateIndex+1], tier[:stateIndex])
+			tier[0] = state
+		}
+		tiers.locker.Unlock()
+		if state.working {
+			return response, true
+		}
+	}
+	return TrackerResponse{}, false
+}
@@ -0,0 +1,157 @@
+package tracker
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+// fakeHTTPTracker is an HTTP tracker which counts the announces it gets.
+type fakeHTTPTracker struct {
+	server    *httptest.Server
+	announces int
+	locker    sync.Mutex
+}
+
+func newFakeHTTPTracker(response string) *fakeHTTPTracker {
+	fake := &fakeHTTPTracker{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fake.locker.Lock()
+		fake.announces++
+		fake.locker.Unlock()
+		writer.Write([]byte(response))
+	}))
+	return fake
+}
+
+func (fake *fakeHTTPTracker) count() int {
+	fake.locker.Lock()
+	defer fake.locker.Unlock()
+	return fake.announces
+}
+
+func collect(responses <-chan TrackerResponse) []TrackerResponse {
+	collected := []TrackerResponse{}
+	for response := range responses {
+		collected = append(collected, response)
+	}
+	return collected
+}
+
+func TestTiers(t *testing.T) {
+	working := newFakeHTTPTracker("d8:intervali1800e12:min intervali0e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	defer working.server.Close()
+	failing := newFakeHTTPTracker("d14:failure reason7:Go awaye")
+	defer failing.server.Close()
+	other := newFakeHTTPTracker("d8:intervali60e12:min intervali3600e5:peers0:e")
+	defer other.server.Close()
+
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x07}, 20)}
+	info.AnnounceList = [][]string{
+		{failing.server.URL + "/announce", working.server.URL + "/announce"},
+		{other.server.URL + "/announce", other.server.URL + "/announce"},
+	}
+	tiers := NewTiers(info, 6881, "-YM00000000000000000")
+	if trackers := tiers.Trackers(); len(trackers) != 3 {
+		t.Fatalf("Expected the duplicate tracker to be dropped , got %d trackers", len(trackers))
+	}
+
+	// One tracker of each tier answers , and the working one is moved first.
+	responses := collect(tiers.Announce(DOWNLOAD_STARTED, 0, 0, 100, false))
+	if len(responses) != 2 {
+		t.Fatalf("Expected an answer from each tier , got %v", responses)
+	}
+	if tiers.tiers[0][0].tracker.AnnounceUrl != working.server.URL+"/announce" {
+		t.Errorf("Expected the working tracker to be first in its tier")
+	}
+	if working.count() != 1 || failing.count() > 1 || other.count() != 1 {
+		t.Errorf("Wrong announces : %d %d %d", working.count(), failing.count(), other.count())
+	}
+
+	// Nothing is due before the intervals end , and a forced announce waits for the min interval.
+	if responses := collect(tiers.Announce(NONE, 0, 0, 100, false)); len(responses) != 0 {
+		t.Errorf("Expected no announce before the interval , got %v", responses)
+	}
+	if responses := collect(tiers.Announce(NONE, 0, 0, 100, true)); len(responses) != 1 || responses[0].AnnounceUrl != working.server.URL+"/announce" {
+		t.Errorf("Expected only the tracker without a min interval to be announced to , got %v", responses)
+	}
+
+	// When the interval of a tracker ends , only its tier is announced to.
+	tiers.tiers[1][0].nextAnnounce = time.Now()
+	if responses := collect(tiers.Announce(NONE, 0, 0, 100, false)); len(responses) != 1 || responses[0].AnnounceUrl != other.server.URL+"/announce" {
+		t.Errorf("Expected the second tier to be announced to , got %v", responses)
+	}
+
+	// The failing tracker backs off.
+	state := &trackerState{}
+	now := time.Now()
+	for failures := 0; failures < 8; failures++ {
+		state.schedule(TrackerResponse{}, NetworkError{udpTimeout{}}, now)
+	}
+	if state.nextAnnounce != now.Add(MAX_RETRY_DURATION) {
+		t.Errorf("Expected the backoff to stop at %s , got %s", MAX_RETRY_DURATION, state.nextAnnounce.Sub(now))
+	}
+	state.failures = 2
+	state.schedule(TrackerResponse{}, NetworkError{udpTimeout{}}, now)
+	if state.nextAnnounce != now.Add(4*RETRY_DURATION) {
+		t.Errorf("Expected a backoff of %s , got %s", 4*RETRY_DURATION, state.nextAnnounce.Sub(now))
+	}
+
+	// The stopped event only goes to the working trackers.
+	working.server.Close()
+	collect(tiers.Announce(DOWNLOAD_STOPPED, 0, 0, 100, false))
+	if failing.count() > 1 || other.count() != 3 {
+		t.Errorf("Expected the stopped event to go to the working trackers only : %d %d", failing.count(), other.count())
+	}
+}
+
+func TestEventsDuringAnnounce(t *testing.T) {
+	// The first announce hangs until it is released , the next ones answer right away.
+	events := []string{}
+	entered := make(chan bool, 1)
+	release := make(chan bool)
+	var locker sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		locker.Lock()
+		events = append(events, request.URL.Query().Get("event"))
+		first := len(events) == 1
+		locker.Unlock()
+		if first {
+			entered <- true
+			<-release
+		}
+		writer.Write([]byte("d8:intervali1800e12:min intervali0e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x0c}, 20)}
+	info.AnnounceList = [][]string{{server.URL + "/announce"}}
+	tiers := NewTiers(info, 6881, "-YM00000000000000000")
+
+	started := tiers.Announce(DOWNLOAD_STARTED, 0, 0, 100, false)
+	<-entered
+
+	// While the tier announces , the events are queued , and a regular announce is skipped.
+	completed := tiers.Announce(DOWNLOAD_COMPLETED, 0, 100, 0, false)
+	stopped := tiers.Announce(DOWNLOAD_STOPPED, 0, 100, 0, false)
+	if responses := collect(tiers.Announce(NONE, 0, 100, 0, true)); len(responses) != 0 {
+		t.Errorf("Expected the regular announce to be skipped , got %v", responses)
+	}
+	close(release)
+
+	for _, responses := range []<-chan TrackerResponse{started, completed, stopped} {
+		if collected := collect(responses); len(collected) != 1 {
+			t.Errorf("Expected an answer for each event , got %v", collected)
+		}
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	if len(events) != 3 || events[0] != "started" || events[1] != "completed" || events[2] != "stopped" {
+		t.Errorf("Expected the events to be announced in order , got %v", events)
+	}
+}
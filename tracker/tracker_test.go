@@ -0,0 +1,66 @@
+package tracker
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bbpcr/Yomato/torrent_info"
+)
+
+func TestRequestPeersErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/missing":
+			http.NotFound(writer, request)
+		case "/garbage":
+			writer.Write([]byte("<html>"))
+		case "/failure":
+			writer.Write([]byte("d14:failure reason17:Torrent not founde"))
+		default:
+			writer.Write([]byte("d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"))
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	info := &torrent_info.TorrentInfo{InfoHash: bytes.Repeat([]byte{0x08}, 20)}
+	response, err := New(server.URL+"/announce", info, 6881, "-YM00000000000000000").RequestPeers(0, 0, 100, DOWNLOAD_STARTED)
+	if err != nil || len(response.Peers) != 1 || response.Interval != 900 {
+		t.Fatalf("Expected an answer with one peer , got %v %v", response, err)
+	}
+
+	response, err = New(server.URL+"/missing", info, 6881, "-YM00000000000000000").RequestPeers(0, 0, 100, NONE)
+	if statusError, isStatus := err.(HTTPStatusError); !isStatus || statusError.StatusCode != 404 {
+		t.Errorf("Expected an HTTP status error , got %v", err)
+	}
+	response, err = New(server.URL+"/garbage", info, 6881, "-YM00000000000000000").RequestPeers(0, 0, 100, NONE)
+	if _, isProtocol := err.(ProtocolError); !isProtocol {
+		t.Errorf("Expected a protocol error , got %v", err)
+	}
+	response, err = New(server.URL+"/failure", info, 6881, "-YM00000000000000000").RequestPeers(0, 0, 100, NONE)
+	if err != (FailureError{"Torrent not found"}) || response.FailureReason != "Torrent not found" {
+		t.Errorf("Expected the failure reason of the tracker , got %v %v", response.FailureReason, err)
+	}
+	response, err = New(closed.URL+"/announce", info, 6881, "-YM00000000000000000").RequestPeers(0, 0, 100, NONE)
+	if _, isNetwork := err.(NetworkError); !isNetwork {
+		t.Errorf("Expected a network error , got %v", err)
+	}
+
+	// The status of the trackers shows the last error of each one.
+	info.AnnounceList = [][]string{{server.URL + "/announce"}, {server.URL + "/failure"}}
+	tiers := NewTiers(info, 6881, "-YM00000000000000000")
+	for _ = range tiers.Announce(DOWNLOAD_STARTED, 0, 0, 100, false) {
+	}
+	statuses := tiers.Status()
+	if len(statuses) != 2 || !statuses[0].Working || statuses[0].Peers != 1 || statuses[1].Working || statuses[1].LastError == nil {
+		t.Fatalf("Wrong status %v", statuses)
+	}
+	table := strings.Split(StatusTable(statuses), "\n")
+	if len(table) != 4 || !strings.Contains(table[1], "working") || !strings.Contains(table[2], "Tracker failure: Torrent not found") {
+		t.Errorf("Wrong status table %q", table)
+	}
+}
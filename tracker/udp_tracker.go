@@ -0,0 +1,324 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+// The UDP tracker protocol , as described here : http://www.bittorrent.org/beps/bep_0015.html
+const (
+	UDP_PROTOCOL_ID     = 0x41727101980
+	UDP_ACTION_CONNECT  = 0
+	UDP_ACTION_ANNOUNCE = 1
+	UDP_ACTION_SCRAPE   = 2
+	UDP_ACTION_ERROR    = 3
+)
+
+// A request which isn't answered in UDP_RETRANSMIT_TIMEOUT * 2^n is sent again , up to UDP_MAX_RETRANSMITS times.
+// BEP 15 allows 8 retransmits , but then a dead tracker would keep us waiting for hours.
+const (
+	UDP_RETRANSMIT_TIMEOUT = 15 * time.Second
+	UDP_MAX_RETRANSMITS    = 2
+)
+
+// A connection id given by a tracker can be used for this long.
+const UDP_CONNECTION_ID_DURATION = 60 * time.Second
+
+// The biggest UDP packet , so the answers are never truncated.
+const UDP_MAX_PACKET_SIZE = 65536
+
+// udpConnectionId is a connection id given by a tracker , and when it expires.
+type udpConnectionId struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpClient talks to all the UDP trackers over one socket.
+// The answers are matched to the requests by their transaction id.
+type udpClient struct {
+	connection        *net.UDPConn
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+
+	transactions  map[uint32]chan []byte
+	connectionIds map[string]udpConnectionId
+	locker        sync.Mutex
+}
+
+var (
+	sharedUDPClient      *udpClient
+	sharedUDPClientError error
+	sharedUDPClientOnce  sync.Once
+)
+
+// getUDPClient returns the client shared by all the UDP trackers , which is created on the first use.
+func getUDPClient() (*udpClient, error) {
+	sharedUDPClientOnce.Do(func() {
+		sharedUDPClient, sharedUDPClientError = newUDPClient(UDP_RETRANSMIT_TIMEOUT, UDP_MAX_RETRANSMITS)
+	})
+	return sharedUDPClient, sharedUDPClientError
+}
+
+// newUDPClient opens a socket for the UDP trackers , over IPv4 and IPv6 , and starts reading the answers.
+func newUDPClient(retransmitTimeout time.Duration, maxRetransmits int) (*udpClient, error) {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	client := &udpClient{
+		connection:        connection,
+		retransmitTimeout: retransmitTimeout,
+		maxRetransmits:    maxRetransmits,
+		transactions:      make(map[uint32]chan []byte),
+		connectionIds:     make(map[string]udpConnectionId),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+// readLoop gives each answer to the request with the same transaction id. The unknown answers are ignored.
+func (client *udpClient) readLoop() {
+	buffer := make([]byte, UDP_MAX_PACKET_SIZE)
+	for {
+		bytesRead, _, err := client.connection.ReadFromUDP(buffer)
+		if err != nil {
+			if netError, isNetError := err.(net.Error); isNetError && netError.Timeout() {
+				continue
+			}
+			return
+		}
+		if bytesRead < 8 {
+			continue
+		}
+		transactionId := binary.BigEndian.Uint32(buffer[4:8])
+		client.locker.Lock()
+		answers, exists := client.transactions[transactionId]
+		client.locker.Unlock()
+		if exists {
+			select {
+			case answers <- append([]byte{}, buffer[:bytesRead]...):
+			default:
+			}
+		}
+	}
+}
+
+// close closes the socket of the client.
+func (client *udpClient) close() {
+	client.connection.Close()
+}
+
+// startTransaction returns a random transaction id which isn't used , and the channel of its answer.
+func (client *udpClient) startTransaction() (uint32, chan []byte) {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+	for {
+		transactionId := rand.Uint32()
+		if _, exists := client.transactions[transactionId]; !exists {
+			answers := make(chan []byte, 1)
+			client.transactions[transactionId] = answers
+			return transactionId, answers
+		}
+	}
+}
+
+// endTransaction forgets the transaction , so its late answers are ignored.
+func (client *udpClient) endTransaction(transactionId uint32) {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+	delete(client.transactions, transactionId)
+}
+
+// roundTrip sends the request with a new transaction id , and waits at most timeout for the answer.
+// The answer must have the action of the request , and at least minLength bytes.
+// If the tracker answers with an error , it is returned as a FailureError.
+func (client *udpClient) roundTrip(address *net.UDPAddr, request []byte, minLength int, timeout time.Duration) ([]byte, error) {
+	transactionId, answers := client.startTransaction()
+	defer client.endTransaction(transactionId)
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+
+	if _, err := client.connection.WriteToUDP(request, address); err != nil {
+		return nil, NetworkError{err}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case answer := <-answers:
+		action := binary.BigEndian.Uint32(answer[0:4])
+		if action == UDP_ACTION_ERROR {
+			return nil, FailureError{string(answer[8:])}
+		}
+		if action != binary.BigEndian.Uint32(request[8:12]) || len(answer) < minLength {
+			return nil, ProtocolError{"Invalid answer from the udp tracker"}
+		}
+		return answer, nil
+	case <-timer.C:
+		return nil, udpTimeout{}
+	}
+}
+
+// connectionId returns a connection id for the tracker , from the cache if it didn't expire.
+func (client *udpClient) connectionId(address *net.UDPAddr, timeout time.Duration) (uint64, error) {
+	key := address.String()
+	client.locker.Lock()
+	cached, exists := client.connectionIds[key]
+	client.locker.Unlock()
+	if exists && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	/*
+		Offset	Size	Name	Value
+		0	8	protocol id	0x41727101980
+		8	4	action	0 for connect
+		12	4	transaction id	random
+	*/
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(request[8:12], UDP_ACTION_CONNECT)
+	sent := time.Now()
+	answer, err := client.roundTrip(address, request, 16, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	// The answer has the action , the transaction id , and the connection id.
+	connectionId := binary.BigEndian.Uint64(answer[8:16])
+	client.locker.Lock()
+	client.connectionIds[key] = udpConnectionId{id: connectionId, expires: sent.Add(UDP_CONNECTION_ID_DURATION)}
+	client.locker.Unlock()
+	return connectionId, nil
+}
+
+// forgetConnectionId removes the connection id of the tracker from the cache.
+func (client *udpClient) forgetConnectionId(address *net.UDPAddr) {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+	delete(client.connectionIds, address.String())
+}
+
+// request sends the request to the tracker , after it got a connection id , which is put in its first 8 bytes.
+// The request is sent again after 15 * 2^n seconds without an answer , up to retransmits times.
+func (client *udpClient) request(address *net.UDPAddr, request []byte, minLength int, retransmits int) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= retransmits; attempt++ {
+		timeout := client.retransmitTimeout << uint(attempt)
+		var connectionId uint64
+		connectionId, err = client.connectionId(address, timeout)
+		if err != nil {
+			if _, isTimeout := err.(udpTimeout); isTimeout {
+				continue
+			}
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(request[0:8], connectionId)
+
+		var answer []byte
+		answer, err = client.roundTrip(address, request, minLength, timeout)
+		if err == nil {
+			return answer, nil
+		}
+		if _, isTimeout := err.(udpTimeout); !isTimeout {
+			// The connection id may be the problem , so a new one is asked next time.
+			client.forgetConnectionId(address)
+			return nil, err
+		}
+	}
+	return nil, NetworkError{err}
+}
+
+// announce announces us to the tracker at host , and returns its answer in the form of an HTTP tracker answer.
+func (client *udpClient) announce(host string, peerID string, infoHash string, port int, uploaded int64, downloaded int64, left int64, event int, key uint32) (bencode.Bencoder, error) {
+
+	address, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return bencode.Dictionary{}, NetworkError{err}
+	}
+
+	/*
+		Offset      Size				Name				Value
+			0	 8 (64 bit integer)	 connection  id	 connection id from server
+			8	 4 (32-bit integer)	 action	 1;  for announce request
+			12	 4 (32-bit integer)	 transaction id	 random , set for each retransmit
+			16	 20	                 info_hash	 the info_hash of the torrent that is being announced
+			36	 20	                 peer id	 the peer ID of the client announcing itself
+			56	 8 (64 bit integer)	 downloaded	 bytes downloaded by client this session
+			64	 8 (64 bit integer)	 left	     bytes left to complete the download
+			72	 8 (64 bit integer)	 uploaded	 bytes uploaded this session
+			80	 4 (32 bit integer)	 event	     0=None; 1=Download completed; 2=Download started; 3=Download stopped.
+			84	 4 (32 bit integer)	 IPv4	     IP address, default set to 0 (use source address)
+			88	 4 (32 bit integer)	 key	     the same for all our announces , so the tracker knows us when our IP changes
+			92	 4 (32 bit integer)	 num want	 -1 by default. number of clients to return
+			96	 2 (16 bit integer)	 port	     the client's TCP port
+	*/
+
+	request := make([]byte, 98)
+	binary.BigEndian.PutUint32(request[8:12], UDP_ACTION_ANNOUNCE)
+	copy(request[16:36], []byte(infoHash))
+	copy(request[36:56], []byte(peerID))
+	binary.BigEndian.PutUint64(request[56:64], uint64(downloaded))
+	binary.BigEndian.PutUint64(request[64:72], uint64(left))
+	binary.BigEndian.PutUint64(request[72:80], uint64(uploaded))
+	binary.BigEndian.PutUint32(request[80:84], uint32(event))
+	binary.BigEndian.PutUint32(request[84:88], 0)
+	binary.BigEndian.PutUint32(request[88:92], key)
+	binary.BigEndian.PutUint32(request[92:96], 10000)
+	binary.BigEndian.PutUint16(request[96:98], uint16(port))
+
+	// Nobody waits for the answer to the stopped event , so it isn't sent again.
+	retransmits := client.maxRetransmits
+	if event == DOWNLOAD_STOPPED {
+		retransmits = 0
+	}
+
+	answer, err := client.request(address, request, 20, retransmits)
+	if err != nil {
+		return bencode.Dictionary{}, err
+	}
+
+	/*
+		Offset	   Size	        Name	         Value
+
+		0	         4	        action	         1
+		4	         4	        transaction id	 same like the transaction id sent be the announce request
+		8	         4	        interval	     seconds to wait till next announce
+		12	         4	        leechers	     amount of leechers in swarm
+		16	         4	        seeders	         amount of seeders in swarm
+		20 + 6 * n	 4	        IPv4	         IP of peer
+		24 + 6 * n	 2	        port	         TCP port of client
+
+		When the tracker is reached over IPv6 , the peers are IPv6 : 16 bytes for the IP and 2 for the port.
+	*/
+
+	peersKey := "peers"
+	if address.IP.To4() == nil {
+		peersKey = "peers6"
+	}
+
+	// At this point we have all we need so we create the dictionary from scratch.
+	bigDictionary := new(bencode.Dictionary)
+	bigDictionary.Values = make(map[bencode.String]bencode.Bencoder)
+	interval := int64(binary.BigEndian.Uint32(answer[8:12]))
+	bigDictionary.Values[bencode.String{Value: "interval"}] = &bencode.Number{Value: interval}
+	bigDictionary.Values[bencode.String{Value: "min interval"}] = &bencode.Number{Value: interval / 2}
+	bigDictionary.Values[bencode.String{Value: "incomplete"}] = &bencode.Number{Value: int64(binary.BigEndian.Uint32(answer[12:16]))}
+	bigDictionary.Values[bencode.String{Value: "complete"}] = &bencode.Number{Value: int64(binary.BigEndian.Uint32(answer[16:20]))}
+	bigDictionary.Values[bencode.String{Value: peersKey}] = &bencode.String{Value: string(answer[20:])}
+
+	perfectDictionary, err := GetPeers(bigDictionary)
+	if err != nil {
+		return bencode.Dictionary{}, ProtocolError{err.Error()}
+	}
+	return perfectDictionary, nil
+}
+
+// udpTimeout is returned when the tracker didn't answer in time.
+type udpTimeout struct{}
+
+func (err udpTimeout) Error() string { return "Timeout while waiting for the udp tracker" }
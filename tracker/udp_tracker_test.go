@@ -0,0 +1,202 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbpcr/Yomato/bencode"
+)
+
+const FAKE_CONNECTION_ID = 0x1122334455667788
+
+// fakeUDPTracker is an in-process UDP tracker. It drops the first packets it receives , if asked to.
+type fakeUDPTracker struct {
+	connection *net.UDPConn
+	drop       int
+	connects   int
+	announces  [][]byte
+	locker     sync.Mutex
+}
+
+func newFakeUDPTracker(t *testing.T, drop int) *fakeUDPTracker {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	fake := &fakeUDPTracker{connection: connection, drop: drop}
+	go fake.serve()
+	return fake
+}
+
+func (fake *fakeUDPTracker) host() string {
+	return fake.connection.LocalAddr().String()
+}
+
+func (fake *fakeUDPTracker) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		bytesRead, address, err := fake.connection.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		request := append([]byte{}, buffer[:bytesRead]...)
+		fake.locker.Lock()
+		if fake.drop > 0 {
+			fake.drop--
+			fake.locker.Unlock()
+			continue
+		}
+		answer := make([]byte, 8)
+		copy(answer[4:8], request[12:16])
+		switch binary.BigEndian.Uint32(request[8:12]) {
+		case UDP_ACTION_CONNECT:
+			fake.connects++
+			answer = append(answer, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(answer[8:16], FAKE_CONNECTION_ID)
+		case UDP_ACTION_ANNOUNCE:
+			fake.announces = append(fake.announces, request)
+			if binary.BigEndian.Uint64(request[0:8]) != FAKE_CONNECTION_ID || request[16] == 0xff {
+				binary.BigEndian.PutUint32(answer[0:4], UDP_ACTION_ERROR)
+				answer = append(answer, "Torrent not registered"...)
+				break
+			}
+			binary.BigEndian.PutUint32(answer[0:4], UDP_ACTION_ANNOUNCE)
+			answer = append(answer, convertUint32s(1800, 2, 3)...)
+			answer = append(answer, 10, 0, 0, 1, 0x1a, 0xe1)
+			answer = append(answer, request[16], 0, 0, 2, 0x1a, 0xe2)
+		case UDP_ACTION_SCRAPE:
+			// The seeders , completed and leechers are made of the first byte of the info hash.
+			binary.BigEndian.PutUint32(answer[0:4], UDP_ACTION_SCRAPE)
+			for offset := 16; offset+20 <= len(request); offset += 20 {
+				value := uint32(request[offset])
+				answer = append(answer, convertUint32s(value, 10*value, 100*value)...)
+			}
+		}
+		fake.locker.Unlock()
+		fake.connection.WriteToUDP(answer, address)
+	}
+}
+
+func convertUint32s(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for index, value := range values {
+		binary.BigEndian.PutUint32(data[4*index:], value)
+	}
+	return data
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	fake := newFakeUDPTracker(t, 1)
+	defer fake.connection.Close()
+	client, err := newUDPClient(50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer client.close()
+
+	// The connect is dropped once , and sent again.
+	infoHash := string(bytes.Repeat([]byte{0x01}, 20))
+	data, err := client.announce(fake.host(), "-YM00000000000000000", infoHash, 6881, 100, 200, 300, DOWNLOAD_STARTED, 0xdeadbeef)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	dictionary := data.(*bencode.Dictionary)
+	if interval := dictionary.Values[bencode.String{Value: "interval"}].(*bencode.Number).Value; interval != 1800 {
+		t.Errorf("Expected an interval of 1800 , got %d", interval)
+	}
+	if complete := dictionary.Values[bencode.String{Value: "complete"}].(*bencode.Number).Value; complete != 3 {
+		t.Errorf("Expected 3 seeders , got %d", complete)
+	}
+	if incomplete := dictionary.Values[bencode.String{Value: "incomplete"}].(*bencode.Number).Value; incomplete != 2 {
+		t.Errorf("Expected 2 leechers , got %d", incomplete)
+	}
+	addresses := peerAddresses(t, data)
+	if len(addresses) != 2 || addresses[0] != "10.0.0.1 i6881e" || addresses[1] != "1.0.0.2 i6882e" {
+		t.Errorf("Wrong peers %v", addresses)
+	}
+
+	fake.locker.Lock()
+	request := fake.announces[0]
+	fake.locker.Unlock()
+	if binary.BigEndian.Uint16(request[96:98]) != 6881 || binary.BigEndian.Uint32(request[88:92]) != 0xdeadbeef {
+		t.Errorf("Expected our port and key in the announce , got %x", request)
+	}
+	if binary.BigEndian.Uint32(request[80:84]) != DOWNLOAD_STARTED || binary.BigEndian.Uint64(request[56:64]) != 200 {
+		t.Errorf("Wrong announce %x", request)
+	}
+
+	// The announces share the socket , and the connection id.
+	var group sync.WaitGroup
+	for index := 2; index <= 5; index++ {
+		group.Add(1)
+		go func(index byte) {
+			defer group.Done()
+			data, err := client.announce(fake.host(), "-YM00000000000000000", string(bytes.Repeat([]byte{index}, 20)), 6881, 0, 0, 0, NONE, 0xdeadbeef)
+			if err != nil {
+				t.Errorf("Got error: %s", err)
+				return
+			}
+			if addresses := peerAddresses(t, data); len(addresses) != 2 || addresses[1] != net.IPv4(index, 0, 0, 2).String()+" i6882e" {
+				t.Errorf("Got the peers of another announce : %v", addresses)
+			}
+		}(byte(index))
+	}
+	group.Wait()
+
+	fake.locker.Lock()
+	defer fake.locker.Unlock()
+	if fake.connects != 1 {
+		t.Errorf("Expected the connection id to be cached , got %d connects", fake.connects)
+	}
+	transactionIds := make(map[string]bool)
+	for _, request := range fake.announces {
+		transactionIds[string(request[12:16])] = true
+	}
+	if len(transactionIds) != len(fake.announces) {
+		t.Errorf("Expected a new transaction id for each announce")
+	}
+}
+
+func TestUDPAnnounceError(t *testing.T) {
+	fake := newFakeUDPTracker(t, 0)
+	defer fake.connection.Close()
+	client, err := newUDPClient(50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer client.close()
+
+	// The error sent by the tracker is its failure reason.
+	infoHash := string(bytes.Repeat([]byte{0xff}, 20))
+	if _, err := client.announce(fake.host(), "-YM00000000000000000", infoHash, 6881, 0, 0, 0, NONE, 1); err != (FailureError{"Torrent not registered"}) {
+		t.Errorf("Expected the failure reason of the tracker , got %v", err)
+	}
+}
+
+func TestUDPAnnounceTimeout(t *testing.T) {
+	fake := newFakeUDPTracker(t, 100)
+	defer fake.connection.Close()
+	client, err := newUDPClient(20*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer client.close()
+
+	// The connect waits 20 , 40 and 80 ms for an answer , then we give up.
+	startTime := time.Now()
+	if _, err := client.announce(fake.host(), "-YM00000000000000000", string(make([]byte, 20)), 6881, 0, 0, 0, NONE, 1); err != (NetworkError{udpTimeout{}}) {
+		t.Fatalf("Expected a timeout , got %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed < 140*time.Millisecond {
+		t.Errorf("Expected the timeouts to back off , gave up after %s", elapsed)
+	}
+	fake.locker.Lock()
+	defer fake.locker.Unlock()
+	if dropped := 100 - fake.drop; dropped != 3 {
+		t.Errorf("Expected 3 connects , got %d", dropped)
+	}
+}
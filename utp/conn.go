@@ -0,0 +1,670 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The states of a connection.
+const (
+	STATE_SYN_SENT = iota
+	STATE_CONNECTED
+	STATE_CLOSED
+)
+
+const (
+	PACKET_SIZE      = 1400
+	MAX_PAYLOAD      = PACKET_SIZE - HEADER_LENGTH
+	READ_BUFFER_SIZE = 1024 * 1024
+	MAX_OUT_OF_ORDER = 1024
+)
+
+// The LEDBAT congestion control keeps the delay added by our packets near TARGET_DELAY ,
+// so the other traffic of the link isn't slowed down.
+const (
+	TARGET_DELAY                    = 100 * time.Millisecond
+	MAX_CWND_INCREASE_BYTES_PER_RTT = 3000
+	MIN_WINDOW                      = PACKET_SIZE
+	MAX_WINDOW                      = READ_BUFFER_SIZE
+	BASE_DELAY_SLOT                 = time.Minute
+	BASE_DELAY_SLOTS                = 2
+)
+
+// After MAX_TIMEOUTS retransmissions of the same packet , the connection is dropped.
+const (
+	INITIAL_TIMEOUT = time.Second
+	MIN_TIMEOUT     = 500 * time.Millisecond
+	MAX_TIMEOUT     = 16 * time.Second
+	MAX_TIMEOUTS    = 5
+)
+
+// How many packets are acked after a missing one before it is sent again.
+const DUPLICATE_ACKS = 3
+
+var (
+	errClosed = errors.New("Connection closed")
+	errReset  = errors.New("Connection reset by the peer")
+)
+
+// timeoutError is returned when a deadline or the connection timeout is reached.
+type timeoutError struct{}
+
+func (err timeoutError) Error() string   { return "i/o timeout" }
+func (err timeoutError) Timeout() bool   { return true }
+func (err timeoutError) Temporary() bool { return true }
+
+// microseconds returns the timestamp of the packets.
+func microseconds(now time.Time) uint32 {
+	return uint32(now.UnixNano() / int64(time.Microsecond))
+}
+
+// delayHistory keeps the minimum delay of each of the last BASE_DELAY_SLOTS minutes.
+// The lowest of them is the base delay , the delay of the link when its queues are empty.
+type delayHistory struct {
+	minima      []uint32
+	slotStarted time.Time
+}
+
+func (history *delayHistory) add(delay uint32, now time.Time) {
+	if len(history.minima) == 0 || now.Sub(history.slotStarted) > BASE_DELAY_SLOT {
+		history.minima = append(history.minima, delay)
+		if len(history.minima) > BASE_DELAY_SLOTS {
+			history.minima = history.minima[1:]
+		}
+		history.slotStarted = now
+		return
+	}
+	if last := len(history.minima) - 1; delay < history.minima[last] {
+		history.minima[last] = delay
+	}
+}
+
+func (history *delayHistory) base() uint32 {
+	base := history.minima[0]
+	for _, delay := range history.minima[1:] {
+		if delay < base {
+			base = delay
+		}
+	}
+	return base
+}
+
+// outgoingPacket is a packet we sent , kept until it is acked.
+type outgoingPacket struct {
+	header        header
+	payload       []byte
+	sentTime      time.Time
+	transmissions int
+	acked         bool
+	resent        bool
+	lost          bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	socket *Socket
+	remote *net.UDPAddr
+	recvId uint16
+	sendId uint16
+	state  int
+
+	seqNr        uint16
+	ackNr        uint16
+	lastAck      uint16
+	outgoing     []*outgoingPacket
+	inFlight     int
+	maxWindow    int
+	slowStart    bool
+	remoteWindow int
+	replyMicro   uint32
+	delays       delayHistory
+
+	rtt           time.Duration
+	rttVariance   time.Duration
+	timeout       time.Duration
+	timeoutAt     time.Time
+	timeouts      int
+	duplicateAcks int
+
+	readBuffer  []byte
+	outOfOrder  map[uint16][]byte
+	finReceived bool
+	finSeq      uint16
+	eof         bool
+	closed      bool
+	err         error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+
+	locker sync.Mutex
+	cond   *sync.Cond
+}
+
+func newConn(socket *Socket, remote *net.UDPAddr) *Conn {
+	conn := &Conn{
+		socket:       socket,
+		remote:       remote,
+		maxWindow:    MIN_WINDOW,
+		slowStart:    true,
+		remoteWindow: MAX_WINDOW,
+		timeout:      INITIAL_TIMEOUT,
+		outOfOrder:   make(map[uint16][]byte),
+	}
+	conn.cond = sync.NewCond(&conn.locker)
+	return conn
+}
+
+// receiveWindow returns how many bytes we may still receive.
+// The caller must hold the locker , like for all the unexported methods.
+func (conn *Conn) receiveWindow() uint32 {
+	buffered := len(conn.readBuffer)
+	for _, payload := range conn.outOfOrder {
+		buffered += len(payload)
+	}
+	if buffered >= READ_BUFFER_SIZE {
+		return 0
+	}
+	return uint32(READ_BUFFER_SIZE - buffered)
+}
+
+// selectiveAck returns the bitmask of the packets received after a missing one , or nil if none was.
+func (conn *Conn) selectiveAck() []byte {
+	if len(conn.outOfOrder) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range conn.outOfOrder {
+		if offset := int(seq - conn.ackNr - 2); offset > last {
+			last = offset
+		}
+	}
+	mask := make([]byte, (last/32+1)*4)
+	for seq := range conn.outOfOrder {
+		offset := int(seq - conn.ackNr - 2)
+		mask[offset/8] |= 1 << uint(offset%8)
+	}
+	return mask
+}
+
+// transmit sends a packet we keep until it is acked , with up to date acks and timestamps.
+func (conn *Conn) transmit(packet *outgoingPacket, now time.Time) {
+	packet.header.Timestamp = microseconds(now)
+	packet.header.TimestampDifference = conn.replyMicro
+	packet.header.WindowSize = conn.receiveWindow()
+	packet.header.AckNumber = conn.ackNr
+	packet.sentTime = now
+	packet.transmissions++
+	conn.socket.write(packet.header.encode(packet.payload), conn.remote)
+}
+
+// sendPacket sends a packet which takes a sequence number : a SYN , some data or a FIN.
+func (conn *Conn) sendPacket(packetType int, payload []byte) {
+	packet := &outgoingPacket{
+		header:  header{Type: packetType, ConnectionId: conn.sendId, SequenceNumber: conn.seqNr},
+		payload: payload,
+	}
+	if packetType == ST_SYN {
+		packet.header.ConnectionId = conn.recvId
+	}
+	conn.seqNr++
+	now := time.Now()
+	if len(conn.outgoing) == 0 {
+		conn.timeoutAt = now.Add(conn.timeout)
+	}
+	conn.outgoing = append(conn.outgoing, packet)
+	conn.inFlight += len(payload)
+	conn.transmit(packet, now)
+}
+
+// sendState acks the packets we received.
+func (conn *Conn) sendState() {
+	state := &header{
+		Type:                ST_STATE,
+		ConnectionId:        conn.sendId,
+		Timestamp:           microseconds(time.Now()),
+		TimestampDifference: conn.replyMicro,
+		WindowSize:          conn.receiveWindow(),
+		SequenceNumber:      conn.seqNr,
+		AckNumber:           conn.ackNr,
+		SelectiveAck:        conn.selectiveAck(),
+	}
+	conn.socket.write(state.encode(nil), conn.remote)
+}
+
+// canSend tells if a packet of size bytes fits in the congestion window and the window of the peer.
+// A packet is always allowed when nothing is in flight , so a closed window is probed.
+func (conn *Conn) canSend(size int) bool {
+	window := conn.maxWindow
+	if conn.remoteWindow < window {
+		window = conn.remoteWindow
+	}
+	return conn.inFlight == 0 || conn.inFlight+size <= window
+}
+
+// lossEvent halves the congestion window , after a packet was lost.
+func (conn *Conn) lossEvent() {
+	conn.slowStart = false
+	conn.maxWindow /= 2
+	if conn.maxWindow < MIN_WINDOW {
+		conn.maxWindow = MIN_WINDOW
+	}
+}
+
+// updateRTT updates the round trip time , and the timeout computed from it.
+func (conn *Conn) updateRTT(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVariance = sample / 2
+	} else {
+		difference := conn.rtt - sample
+		if difference < 0 {
+			difference = -difference
+		}
+		conn.rttVariance += (difference - conn.rttVariance) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+	conn.updateTimeout()
+}
+
+// updateTimeout computes the timeout from the round trip time , once it was measured.
+func (conn *Conn) updateTimeout() {
+	if conn.rtt == 0 {
+		return
+	}
+	conn.timeout = conn.rtt + 4*conn.rttVariance
+	if conn.timeout < MIN_TIMEOUT {
+		conn.timeout = MIN_TIMEOUT
+	}
+}
+
+// updateWindow grows or shrinks the congestion window with LEDBAT , after ackedBytes were acked.
+// The timestamp difference sent by the peer is the delay of our packets , plus the difference of the clocks ,
+// which the base delay removes.
+func (conn *Conn) updateWindow(timestampDifference uint32, ackedBytes int, now time.Time) {
+	var ourDelay time.Duration
+	if timestampDifference != 0 {
+		conn.delays.add(timestampDifference, now)
+		ourDelay = time.Duration(timestampDifference-conn.delays.base()) * time.Microsecond
+	}
+	if ourDelay > TARGET_DELAY {
+		conn.slowStart = false
+	}
+
+	if conn.slowStart {
+		conn.maxWindow += ackedBytes
+	} else {
+		offTarget := float64(TARGET_DELAY-ourDelay) / float64(TARGET_DELAY)
+		if offTarget < -1 {
+			offTarget = -1
+		}
+		conn.maxWindow += int(MAX_CWND_INCREASE_BYTES_PER_RTT * offTarget * float64(ackedBytes) / float64(conn.maxWindow))
+	}
+	if conn.maxWindow < MIN_WINDOW {
+		conn.maxWindow = MIN_WINDOW
+	}
+	if conn.maxWindow > MAX_WINDOW {
+		conn.maxWindow = MAX_WINDOW
+	}
+}
+
+// ackPacket marks a packet we sent as received by the peer , and returns its size.
+func (conn *Conn) ackPacket(packet *outgoingPacket, now time.Time) int {
+	if packet.acked {
+		return 0
+	}
+	packet.acked = true
+	if !packet.lost {
+		conn.inFlight -= len(packet.payload)
+	}
+	packet.lost = false
+	if packet.transmissions == 1 {
+		conn.updateRTT(now.Sub(packet.sentTime))
+	}
+	return len(packet.payload)
+}
+
+// resendLost sends again the packets followed by at least DUPLICATE_ACKS acked packets , once.
+func (conn *Conn) resendLost(now time.Time) {
+	ackedAfter := 0
+	lost := false
+	for index := len(conn.outgoing) - 1; index >= 0; index-- {
+		packet := conn.outgoing[index]
+		if packet.acked {
+			ackedAfter++
+			continue
+		}
+		if ackedAfter >= DUPLICATE_ACKS && !packet.resent && !packet.lost {
+			packet.resent = true
+			conn.transmit(packet, now)
+			lost = true
+		}
+	}
+	if lost {
+		conn.lossEvent()
+	}
+}
+
+// flush sends again the packets considered lost after a timeout , as long as the windows allow it.
+func (conn *Conn) flush(now time.Time) {
+	for _, packet := range conn.outgoing {
+		if !packet.lost {
+			continue
+		}
+		if !conn.canSend(len(packet.payload)) {
+			return
+		}
+		packet.lost = false
+		packet.resent = true
+		conn.inFlight += len(packet.payload)
+		conn.transmit(packet, now)
+	}
+}
+
+// handleAck removes the packets the peer received , and detects the lost ones.
+func (conn *Conn) handleAck(packetHeader *header, now time.Time) {
+	ackedBytes := 0
+	progress := false
+	for len(conn.outgoing) > 0 && !seqLess(packetHeader.AckNumber, conn.outgoing[0].header.SequenceNumber) {
+		ackedBytes += conn.ackPacket(conn.outgoing[0], now)
+		conn.outgoing = conn.outgoing[1:]
+		progress = true
+	}
+
+	// The selective acks tell which packets after the missing ones were received.
+	// A missing packet is considered lost and sent again once enough packets after it were received.
+	for offset := 0; offset < len(packetHeader.SelectiveAck)*8 && len(conn.outgoing) > 0; offset++ {
+		if packetHeader.SelectiveAck[offset/8]&(1<<uint(offset%8)) == 0 {
+			continue
+		}
+		index := int(packetHeader.AckNumber + 2 + uint16(offset) - conn.outgoing[0].header.SequenceNumber)
+		if index >= 0 && index < len(conn.outgoing) {
+			ackedBytes += conn.ackPacket(conn.outgoing[index], now)
+		}
+	}
+	if len(packetHeader.SelectiveAck) > 0 {
+		conn.resendLost(now)
+	}
+
+	// Without selective acks , the same ack received again and again also means a packet was lost.
+	if !progress && packetHeader.Type == ST_STATE && packetHeader.AckNumber == conn.lastAck && len(conn.outgoing) > 0 {
+		conn.duplicateAcks++
+		if first := conn.outgoing[0]; conn.duplicateAcks == DUPLICATE_ACKS && !first.acked && !first.lost {
+			conn.lossEvent()
+			first.resent = true
+			conn.transmit(first, now)
+		}
+	} else if progress {
+		conn.duplicateAcks = 0
+	}
+	conn.lastAck = packetHeader.AckNumber
+
+	if ackedBytes > 0 || progress {
+		conn.timeouts = 0
+		conn.updateTimeout()
+		conn.timeoutAt = now.Add(conn.timeout)
+	}
+	if ackedBytes > 0 {
+		conn.updateWindow(packetHeader.TimestampDifference, ackedBytes, now)
+	}
+	conn.flush(now)
+}
+
+// handleData keeps the payload of a DATA or FIN packet , in order.
+func (conn *Conn) handleData(packetHeader *header, payload []byte) {
+	seq := packetHeader.SequenceNumber
+	if packetHeader.Type == ST_FIN && !conn.finReceived {
+		conn.finReceived = true
+		conn.finSeq = seq
+	}
+	if !seqLess(conn.ackNr, seq) || int(seq-conn.ackNr) > MAX_OUT_OF_ORDER {
+		return
+	}
+	if seq != conn.ackNr+1 {
+		if _, known := conn.outOfOrder[seq]; !known {
+			conn.outOfOrder[seq] = payload
+		}
+		return
+	}
+
+	conn.readBuffer = append(conn.readBuffer, payload...)
+	conn.ackNr = seq
+	for {
+		next, found := conn.outOfOrder[conn.ackNr+1]
+		if !found {
+			break
+		}
+		delete(conn.outOfOrder, conn.ackNr+1)
+		conn.readBuffer = append(conn.readBuffer, next...)
+		conn.ackNr++
+	}
+	if conn.finReceived && conn.ackNr == conn.finSeq {
+		conn.eof = true
+	}
+}
+
+// handlePacket handles a packet the socket received for this connection.
+func (conn *Conn) handlePacket(packetHeader *header, payload []byte) {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	defer conn.cond.Broadcast()
+
+	if conn.state == STATE_CLOSED {
+		return
+	}
+	if packetHeader.Type == ST_RESET {
+		conn.fail(errReset)
+		return
+	}
+
+	now := time.Now()
+	conn.replyMicro = microseconds(now) - packetHeader.Timestamp
+	conn.remoteWindow = int(packetHeader.WindowSize)
+	if conn.state == STATE_SYN_SENT {
+		if packetHeader.Type != ST_STATE {
+			return
+		}
+		conn.state = STATE_CONNECTED
+		conn.ackNr = packetHeader.SequenceNumber - 1
+	}
+
+	conn.handleAck(packetHeader, now)
+	if packetHeader.Type == ST_DATA || packetHeader.Type == ST_FIN {
+		conn.handleData(packetHeader, payload)
+		conn.sendState()
+	}
+	if conn.closed && len(conn.outgoing) == 0 {
+		conn.destroy()
+	}
+}
+
+// tick sends again the packets which weren't acked in time.
+// It is called periodically by the socket.
+func (conn *Conn) tick(now time.Time) {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+
+	if conn.state == STATE_CLOSED || len(conn.outgoing) == 0 || now.Before(conn.timeoutAt) {
+		return
+	}
+	conn.timeouts++
+	if conn.timeouts > MAX_TIMEOUTS {
+		conn.fail(timeoutError{})
+		return
+	}
+	// All the packets in flight are considered lost , and sent again as the window grows.
+	conn.maxWindow = MIN_WINDOW
+	conn.slowStart = true
+	for _, packet := range conn.outgoing {
+		if !packet.acked && !packet.lost {
+			packet.lost = true
+			conn.inFlight -= len(packet.payload)
+		}
+	}
+	conn.flush(now)
+	conn.timeout *= 2
+	if conn.timeout > MAX_TIMEOUT {
+		conn.timeout = MAX_TIMEOUT
+	}
+	conn.timeoutAt = now.Add(conn.timeout)
+}
+
+// destroy closes the connection , and removes it from the socket.
+func (conn *Conn) destroy() {
+	conn.state = STATE_CLOSED
+	conn.socket.remove(conn)
+	conn.cond.Broadcast()
+}
+
+// fail closes the connection because of err , which is returned by the next reads and writes.
+func (conn *Conn) fail(err error) {
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.destroy()
+}
+
+// waitConnected waits until the peer answers our SYN , or until the deadline.
+func (conn *Conn) waitConnected(deadline time.Time) error {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		conn.locker.Lock()
+		conn.cond.Broadcast()
+		conn.locker.Unlock()
+	})
+	defer timer.Stop()
+
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	for conn.state == STATE_SYN_SENT {
+		if time.Now().After(deadline) {
+			conn.fail(timeoutError{})
+			break
+		}
+		conn.cond.Wait()
+	}
+	return conn.err
+}
+
+// Read reads the data received in order.
+// It returns io.EOF once the peer closed the connection and all its data was read.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	for {
+		if len(conn.readBuffer) > 0 {
+			length := copy(buffer, conn.readBuffer)
+			conn.readBuffer = conn.readBuffer[length:]
+			return length, nil
+		}
+		if conn.eof {
+			return 0, io.EOF
+		}
+		if conn.closed {
+			return 0, errClosed
+		}
+		if conn.err != nil {
+			return 0, conn.err
+		}
+		if !conn.readDeadline.IsZero() && time.Now().After(conn.readDeadline) {
+			return 0, timeoutError{}
+		}
+		conn.cond.Wait()
+	}
+}
+
+// Write sends the data , waiting while the windows are full.
+func (conn *Conn) Write(data []byte) (int, error) {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	written := 0
+	for written < len(data) {
+		size := len(data) - written
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+		for !conn.canSend(size) || conn.state != STATE_CONNECTED {
+			if conn.err != nil {
+				return written, conn.err
+			}
+			if conn.closed || conn.state == STATE_CLOSED {
+				return written, errClosed
+			}
+			if !conn.writeDeadline.IsZero() && time.Now().After(conn.writeDeadline) {
+				return written, timeoutError{}
+			}
+			conn.cond.Wait()
+		}
+		if conn.closed {
+			return written, errClosed
+		}
+		payload := make([]byte, size)
+		copy(payload, data[written:])
+		conn.sendPacket(ST_DATA, payload)
+		written += size
+	}
+	return written, nil
+}
+
+// Close sends a FIN to the peer. The connection is kept until the FIN and the data before it are acked.
+func (conn *Conn) Close() error {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	switch {
+	case conn.state == STATE_CONNECTED:
+		conn.sendPacket(ST_FIN, nil)
+	case conn.state == STATE_SYN_SENT:
+		conn.destroy()
+	}
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// setDeadline sets a deadline , and wakes up the waiting reads or writes when it is reached.
+func (conn *Conn) setDeadline(deadline *time.Time, timer **time.Timer, value time.Time) {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+	*deadline = value
+	if *timer != nil {
+		(*timer).Stop()
+	}
+	if !value.IsZero() {
+		*timer = time.AfterFunc(time.Until(value), func() {
+			conn.locker.Lock()
+			conn.cond.Broadcast()
+			conn.locker.Unlock()
+		})
+	}
+	conn.cond.Broadcast()
+}
+
+func (conn *Conn) SetDeadline(deadline time.Time) error {
+	conn.SetReadDeadline(deadline)
+	return conn.SetWriteDeadline(deadline)
+}
+
+func (conn *Conn) SetReadDeadline(deadline time.Time) error {
+	conn.setDeadline(&conn.readDeadline, &conn.readTimer, deadline)
+	return nil
+}
+
+func (conn *Conn) SetWriteDeadline(deadline time.Time) error {
+	conn.setDeadline(&conn.writeDeadline, &conn.writeTimer, deadline)
+	return nil
+}
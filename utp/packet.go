@@ -0,0 +1,101 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The packet types.
+const (
+	ST_DATA = iota
+	ST_FIN
+	ST_STATE
+	ST_RESET
+	ST_SYN
+)
+
+const (
+	VERSION                 = 1
+	HEADER_LENGTH           = 20
+	EXTENSION_SELECTIVE_ACK = 1
+)
+
+// header is the header of a packet , followed by the extensions we know : only the selective acks.
+type header struct {
+	Type                int
+	ConnectionId        uint16
+	Timestamp           uint32
+	TimestampDifference uint32
+	WindowSize          uint32
+	SequenceNumber      uint16
+	AckNumber           uint16
+
+	// Bit i tells if the packet AckNumber + 2 + i was received.
+	SelectiveAck []byte
+}
+
+// encode returns the packet with the header and the payload.
+func (packetHeader *header) encode(payload []byte) []byte {
+	length := HEADER_LENGTH + len(payload)
+	if len(packetHeader.SelectiveAck) > 0 {
+		length += 2 + len(packetHeader.SelectiveAck)
+	}
+	data := make([]byte, HEADER_LENGTH, length)
+	data[0] = byte(packetHeader.Type<<4 | VERSION)
+	if len(packetHeader.SelectiveAck) > 0 {
+		data[1] = EXTENSION_SELECTIVE_ACK
+	}
+	binary.BigEndian.PutUint16(data[2:4], packetHeader.ConnectionId)
+	binary.BigEndian.PutUint32(data[4:8], packetHeader.Timestamp)
+	binary.BigEndian.PutUint32(data[8:12], packetHeader.TimestampDifference)
+	binary.BigEndian.PutUint32(data[12:16], packetHeader.WindowSize)
+	binary.BigEndian.PutUint16(data[16:18], packetHeader.SequenceNumber)
+	binary.BigEndian.PutUint16(data[18:20], packetHeader.AckNumber)
+	if len(packetHeader.SelectiveAck) > 0 {
+		data = append(data, 0, byte(len(packetHeader.SelectiveAck)))
+		data = append(data, packetHeader.SelectiveAck...)
+	}
+	return append(data, payload...)
+}
+
+// isPacket tells if the data looks like a uTP packet.
+// The other packets received on the same port , for example the bencoded DHT messages , never do.
+func isPacket(data []byte) bool {
+	return len(data) >= HEADER_LENGTH && data[0]&0x0f == VERSION && int(data[0]>>4) <= ST_SYN
+}
+
+// parsePacket returns the header and the payload of a packet. The unknown extensions are skipped.
+func parsePacket(data []byte) (*header, []byte, error) {
+	if !isPacket(data) {
+		return nil, nil, errors.New("Not a uTP packet")
+	}
+	packetHeader := &header{
+		Type:                int(data[0] >> 4),
+		ConnectionId:        binary.BigEndian.Uint16(data[2:4]),
+		Timestamp:           binary.BigEndian.Uint32(data[4:8]),
+		TimestampDifference: binary.BigEndian.Uint32(data[8:12]),
+		WindowSize:          binary.BigEndian.Uint32(data[12:16]),
+		SequenceNumber:      binary.BigEndian.Uint16(data[16:18]),
+		AckNumber:           binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	extension := data[1]
+	rest := data[HEADER_LENGTH:]
+	for extension != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, errors.New("Invalid extension")
+		}
+		extensionData := rest[2 : 2+int(rest[1])]
+		if extension == EXTENSION_SELECTIVE_ACK {
+			packetHeader.SelectiveAck = extensionData
+		}
+		extension = rest[0]
+		rest = rest[2+len(extensionData):]
+	}
+	return packetHeader, rest, nil
+}
+
+// seqLess tells if the sequence number first comes before second , taking care of the wrap around.
+func seqLess(first, second uint16) bool {
+	return int16(first-second) < 0
+}
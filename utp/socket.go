@@ -0,0 +1,326 @@
+// Package utp implements the micro transport protocol , described here : http://www.bittorrent.org/beps/bep_0029.html
+// It is a reliable stream over UDP , whose LEDBAT congestion control gives way to the other traffic.
+// The connections of a socket share its UDP port , which is also used by the DHT.
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_PACKET_SIZE = 65536
+	ACCEPT_BACKLOG  = 32
+	TICK_DURATION   = 100 * time.Millisecond
+
+	// The buffers of the UDP connection , big enough for the bursts of packets.
+	SOCKET_BUFFER_SIZE = 4 * 1024 * 1024
+)
+
+// PacketHandler handles the packets received on the socket which aren't uTP packets.
+type PacketHandler func(data []byte, address *net.UDPAddr)
+
+// Socket multiplexes the uTP connections , made or accepted , on a UDP connection.
+// It implements net.Listener.
+type Socket struct {
+	connection *net.UDPConn
+	conns      map[string]*Conn
+	accepted   chan *Conn
+	fallback   PacketHandler
+	closed     bool
+	done       chan struct{}
+	locker     sync.Mutex
+
+	// drop tells if an outgoing packet is lost , to test the retransmissions.
+	drop func() bool
+}
+
+// connectionKey returns the key of a connection , which receives the packets with the id recvId from address.
+func connectionKey(address *net.UDPAddr, recvId uint16) string {
+	return fmt.Sprintf("%s/%d", address.String(), recvId)
+}
+
+func randomId() uint16 {
+	data := make([]byte, 2)
+	rand.Read(data)
+	return binary.BigEndian.Uint16(data)
+}
+
+// NewSocket returns a socket which uses the UDP connection , and starts reading from it.
+func NewSocket(connection *net.UDPConn) *Socket {
+	connection.SetReadBuffer(SOCKET_BUFFER_SIZE)
+	connection.SetWriteBuffer(SOCKET_BUFFER_SIZE)
+	socket := &Socket{
+		connection: connection,
+		conns:      make(map[string]*Conn),
+		accepted:   make(chan *Conn, ACCEPT_BACKLOG),
+		done:       make(chan struct{}),
+	}
+	go socket.serve()
+	go socket.tick()
+	return socket
+}
+
+// Listen returns a socket listening on the UDP port. If port is 0 , a random one is chosen.
+func Listen(port int) (*Socket, error) {
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(connection), nil
+}
+
+// Connection returns the UDP connection , so other protocols can send packets from the same port.
+func (socket *Socket) Connection() *net.UDPConn {
+	return socket.connection
+}
+
+// Port returns the UDP port of the socket.
+func (socket *Socket) Port() int {
+	return socket.connection.LocalAddr().(*net.UDPAddr).Port
+}
+
+// SetFallback sets the handler of the packets which aren't uTP packets.
+// There is only one , so it fails if another one is already set. A nil handler removes it.
+func (socket *Socket) SetFallback(handler PacketHandler) error {
+	socket.locker.Lock()
+	defer socket.locker.Unlock()
+	if handler != nil && socket.fallback != nil {
+		return errors.New("Fallback handler already set")
+	}
+	socket.fallback = handler
+	return nil
+}
+
+// serve reads the packets from the UDP connection , until it is closed.
+func (socket *Socket) serve() {
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		length, address, err := socket.connection.ReadFromUDP(buffer)
+		if err != nil {
+			if netError, isNetError := err.(net.Error); isNetError && netError.Temporary() {
+				continue
+			}
+			socket.Close()
+			return
+		}
+		data := make([]byte, length)
+		copy(data, buffer[:length])
+		socket.handlePacket(data, address)
+	}
+}
+
+// tick sends again the packets which weren't acked in time , until the socket is closed.
+func (socket *Socket) tick() {
+	ticker := time.NewTicker(TICK_DURATION)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, conn := range socket.getConns() {
+				conn.tick(now)
+			}
+		case <-socket.done:
+			return
+		}
+	}
+}
+
+func (socket *Socket) getConns() []*Conn {
+	socket.locker.Lock()
+	defer socket.locker.Unlock()
+	conns := make([]*Conn, 0, len(socket.conns))
+	for _, conn := range socket.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// findConn returns the connection a packet from address is for , or nil.
+// A RESET carries the id the peer receives with , which is our send id.
+func (socket *Socket) findConn(packetHeader *header, address *net.UDPAddr) *Conn {
+	socket.locker.Lock()
+	defer socket.locker.Unlock()
+	if conn := socket.conns[connectionKey(address, packetHeader.ConnectionId)]; conn != nil || packetHeader.Type != ST_RESET {
+		return conn
+	}
+	for _, recvId := range []uint16{packetHeader.ConnectionId - 1, packetHeader.ConnectionId + 1} {
+		if conn := socket.conns[connectionKey(address, recvId)]; conn != nil && conn.sendId == packetHeader.ConnectionId {
+			return conn
+		}
+	}
+	return nil
+}
+
+// handlePacket gives a packet to its connection. The packets which aren't uTP packets go to the fallback handler.
+func (socket *Socket) handlePacket(data []byte, address *net.UDPAddr) {
+	if !isPacket(data) {
+		socket.locker.Lock()
+		fallback := socket.fallback
+		socket.locker.Unlock()
+		if fallback != nil {
+			fallback(data, address)
+		}
+		return
+	}
+	packetHeader, payload, err := parsePacket(data)
+	if err != nil {
+		return
+	}
+	if packetHeader.Type == ST_SYN {
+		socket.handleSyn(packetHeader, address)
+		return
+	}
+	conn := socket.findConn(packetHeader, address)
+	if conn == nil {
+		if packetHeader.Type != ST_RESET {
+			socket.sendReset(packetHeader, address)
+		}
+		return
+	}
+	conn.handlePacket(packetHeader, payload)
+}
+
+// handleSyn accepts a new connection. If the SYN was sent again , because our answer was lost , we answer again.
+func (socket *Socket) handleSyn(packetHeader *header, address *net.UDPAddr) {
+	key := connectionKey(address, packetHeader.ConnectionId+1)
+
+	socket.locker.Lock()
+	conn, known := socket.conns[key]
+	if !known && !socket.closed {
+		conn = newConn(socket, address)
+		conn.recvId = packetHeader.ConnectionId + 1
+		conn.sendId = packetHeader.ConnectionId
+		conn.seqNr = randomId()
+		conn.ackNr = packetHeader.SequenceNumber
+		conn.state = STATE_CONNECTED
+		socket.conns[key] = conn
+	}
+	socket.locker.Unlock()
+	if conn == nil {
+		return
+	}
+
+	conn.locker.Lock()
+	conn.replyMicro = microseconds(time.Now()) - packetHeader.Timestamp
+	conn.sendState()
+	conn.locker.Unlock()
+	if known {
+		return
+	}
+
+	select {
+	case socket.accepted <- conn:
+	default:
+		// Too many connections are waiting to be accepted.
+		conn.locker.Lock()
+		conn.fail(errReset)
+		conn.locker.Unlock()
+		socket.sendReset(packetHeader, address)
+	}
+}
+
+// sendReset tells the peer that we don't know the connection of its packet.
+func (socket *Socket) sendReset(packetHeader *header, address *net.UDPAddr) {
+	reset := &header{
+		Type:           ST_RESET,
+		ConnectionId:   packetHeader.ConnectionId,
+		Timestamp:      microseconds(time.Now()),
+		SequenceNumber: randomId(),
+		AckNumber:      packetHeader.SequenceNumber,
+	}
+	socket.write(reset.encode(nil), address)
+}
+
+// write sends a packet.
+func (socket *Socket) write(data []byte, address *net.UDPAddr) {
+	if socket.drop != nil && socket.drop() {
+		return
+	}
+	socket.connection.WriteToUDP(data, address)
+}
+
+// remove forgets a closed connection.
+func (socket *Socket) remove(conn *Conn) {
+	socket.locker.Lock()
+	defer socket.locker.Unlock()
+	key := connectionKey(conn.remote, conn.recvId)
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+}
+
+// Dial makes a connection to address , given as host:port.
+// It fails if the peer doesn't answer in timeout.
+func (socket *Socket) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConn(socket, remote)
+
+	socket.locker.Lock()
+	if socket.closed {
+		socket.locker.Unlock()
+		return nil, errClosed
+	}
+	for {
+		conn.recvId = randomId()
+		if _, exists := socket.conns[connectionKey(remote, conn.recvId)]; !exists {
+			break
+		}
+	}
+	conn.sendId = conn.recvId + 1
+	socket.conns[connectionKey(remote, conn.recvId)] = conn
+	socket.locker.Unlock()
+
+	conn.locker.Lock()
+	conn.state = STATE_SYN_SENT
+	conn.seqNr = 1
+	conn.sendPacket(ST_SYN, nil)
+	conn.locker.Unlock()
+
+	if err := conn.waitConnected(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Accept waits for a peer to connect to us.
+func (socket *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.accepted:
+		return conn, nil
+	case <-socket.done:
+		return nil, errClosed
+	}
+}
+
+// Addr returns the address of the UDP connection.
+func (socket *Socket) Addr() net.Addr {
+	return socket.connection.LocalAddr()
+}
+
+// Close closes the UDP connection , and all the connections of the socket.
+func (socket *Socket) Close() error {
+	socket.locker.Lock()
+	if socket.closed {
+		socket.locker.Unlock()
+		return nil
+	}
+	socket.closed = true
+	close(socket.done)
+	socket.locker.Unlock()
+
+	for _, conn := range socket.getConns() {
+		conn.locker.Lock()
+		conn.fail(errClosed)
+		conn.locker.Unlock()
+	}
+	return socket.connection.Close()
+}
@@ -0,0 +1,202 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacket(t *testing.T) {
+	sent := &header{
+		Type:                ST_DATA,
+		ConnectionId:        1234,
+		Timestamp:           5678,
+		TimestampDifference: 90,
+		WindowSize:          65536,
+		SequenceNumber:      65535,
+		AckNumber:           7,
+		SelectiveAck:        []byte{0x05, 0, 0, 0x80},
+	}
+	data := sent.encode([]byte("payload"))
+	if data[0] != 0x01 || data[1] != EXTENSION_SELECTIVE_ACK {
+		t.Errorf("Wrong type , version or extension %x", data[:2])
+	}
+
+	received, payload, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("Wrong payload %q", payload)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("Expected %v , got %v", sent, received)
+	}
+
+	if isPacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")) {
+		t.Errorf("A DHT message was taken for a uTP packet")
+	}
+	if !seqLess(65535, 2) || seqLess(2, 65535) {
+		t.Errorf("Wrong comparison of wrapped sequence numbers")
+	}
+}
+
+// connectPair returns two connected sockets , and a connection between them.
+func connectPair(t *testing.T) (*Socket, *Socket, net.Conn, net.Conn) {
+	first, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	second, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := second.Accept()
+		accepted <- conn
+	}()
+	dialed, err := first.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(second.Port())), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	select {
+	case conn := <-accepted:
+		return first, second, dialed, conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The connection wasn't accepted")
+	}
+	return nil, nil, nil, nil
+}
+
+// transfer sends data from one end to the other , and checks it arrived unchanged.
+func transfer(t *testing.T, from net.Conn, to net.Conn, length int) {
+	data := make([]byte, length)
+	rand.Read(data)
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		if _, err := from.Write(data); err != nil {
+			t.Errorf("Got error: %s", err)
+		}
+	}()
+
+	to.SetReadDeadline(time.Now().Add(20 * time.Second))
+	received := make([]byte, length)
+	if _, err := io.ReadFull(to, received); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	wait.Wait()
+	if !bytes.Equal(received, data) {
+		t.Fatalf("The data changed during the transfer")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	first, second, dialed, accepted := connectPair(t)
+	defer first.Close()
+	defer second.Close()
+
+	transfer(t, dialed, accepted, 1024*1024)
+	transfer(t, accepted, dialed, 100*1024)
+
+	// The peer reads the end of the stream once we close the connection.
+	dialed.Close()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := accepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF , got %v", err)
+	}
+}
+
+func TestPacketLoss(t *testing.T) {
+	first, second, dialed, accepted := connectPair(t)
+	defer first.Close()
+	defer second.Close()
+
+	// One packet out of ten is lost , both ways.
+	random := rand.New(rand.NewSource(1))
+	var randomLocker sync.Mutex
+	drop := func() bool {
+		randomLocker.Lock()
+		defer randomLocker.Unlock()
+		return random.Intn(10) == 0
+	}
+	first.drop = drop
+	second.drop = drop
+
+	transfer(t, dialed, accepted, 256*1024)
+	transfer(t, accepted, dialed, 64*1024)
+}
+
+func TestReadDeadline(t *testing.T) {
+	first, second, dialed, _ := connectPair(t)
+	defer first.Close()
+	defer second.Close()
+
+	dialed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	if netError, isNetError := err.(net.Error); !isNetError || !netError.Timeout() {
+		t.Errorf("Expected a timeout , got %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	socket, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer socket.Close()
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer silent.Close()
+
+	if _, err := socket.Dial(silent.LocalAddr().String(), 300*time.Millisecond); err == nil {
+		t.Errorf("Expected a timeout")
+	}
+	if len(socket.getConns()) != 0 {
+		t.Errorf("The connection which timed out wasn't removed")
+	}
+}
+
+func TestFallback(t *testing.T) {
+	socket, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer socket.Close()
+
+	received := make(chan []byte, 1)
+	if err := socket.SetFallback(func(data []byte, address *net.UDPAddr) { received <- data }); err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	if err := socket.SetFallback(func(data []byte, address *net.UDPAddr) {}); err == nil {
+		t.Errorf("Expected an error for a second fallback")
+	}
+
+	sender, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: socket.Port()})
+	if err != nil {
+		t.Fatalf("Got error: %s", err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("d1:y1:qe"))
+	select {
+	case data := <-received:
+		if string(data) != "d1:y1:qe" {
+			t.Errorf("Wrong packet %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("The packet didn't reach the fallback handler")
+	}
+}
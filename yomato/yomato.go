@@ -3,20 +3,116 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/bbpcr/Yomato/choker"
 	"github.com/bbpcr/Yomato/cli"
 	"github.com/bbpcr/Yomato/downloader"
+	"github.com/bbpcr/Yomato/file_writer"
+	"github.com/bbpcr/Yomato/mse"
+	"github.com/bbpcr/Yomato/piece_manager"
+	"github.com/bbpcr/Yomato/tracker"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: yomato [file.torrent]")
+		fmt.Println("Usage: yomato [options] [file.torrent | magnet-link]")
+		fmt.Println("       yomato scrape [options] [file.torrent | magnet-link]")
+		fmt.Println("Run yomato -h to see the options")
 		return
 	}
 
-	path, _ := cli.Parse()
+	options := cli.Parse()
 
-	download := downloader.New(path)
+	httpClient, err := tracker.NewHTTPClient(tracker.HTTPSettings{
+		UserAgent:      options.UserAgent,
+		RequestTimeout: options.TrackerTimeout,
+		Proxy:          options.TrackerProxy,
+		CARoots:        options.TrackerCARoots,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	tracker.SetHTTPClient(httpClient)
+
+	// The scrape command only asks the trackers about the swarm.
+	if options.Command == "scrape" {
+		if err := downloader.Scrape(options.Path); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	dhtSettings := downloader.DHTSettings{
+		Enabled:        !options.NoDHT,
+		BootstrapNodes: options.DHTBootstrap,
+	}
+	encryption, err := mse.PolicyByName(options.Encryption)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var download *downloader.Downloader
+	if strings.HasPrefix(options.Path, "magnet:") {
+		if download, err = downloader.NewFromMagnet(options.Path, options.SaveTorrent, dhtSettings, encryption); err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else {
+		download = downloader.New(options.Path, encryption)
+	}
+	download.Seeding = downloader.SeedSettings{
+		Enabled:  options.SeedingEnabled(),
+		Ratio:    options.SeedRatio,
+		Duration: options.SeedTime,
+		IdleTime: options.SeedIdle,
+	}
+	download.DHT = dhtSettings
+	download.LocalDiscovery = !options.NoLSD
+	policy, err := choker.PolicyByName(options.ChokingPolicy)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	download.Choker = choker.New(policy, options.UploadSlots)
+	if options.Sequential {
+		download.PiecesManager.SetMode(piece_manager.SEQUENTIAL)
+	}
+	if options.StreamFile >= 0 {
+		if err := download.SetStreamingCursor(options.StreamFile, 0); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	for _, priority := range options.Priorities {
+		separator := strings.LastIndex(priority, "=")
+		if separator < 0 {
+			fmt.Println("Invalid priority", priority)
+			return
+		}
+		level, err := file_writer.PriorityByName(priority[separator+1:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if _, err := download.SetFilePriority(priority[:separator], level); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	for _, exclude := range options.Excludes {
+		matched, err := download.SetFilePriority(exclude, file_writer.PRIORITY_SKIP)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Excluded", matched, "files matching", exclude)
+	}
 	fmt.Println(download.TorrentInfo.Description())
-	download.StartDownloading()
+	if options.SeedOnly {
+		download.StartSeeding()
+	} else {
+		download.StartDownloading()
+	}
 }